@@ -206,3 +206,10 @@ func TestExecuteServerWithBadYAML(t *testing.T) {
 
 	assert.Equal(1, osExit)
 }
+
+func TestLoadEventStreamActionPluginMissing(t *testing.T) {
+	assert := assert.New(t)
+
+	err := loadEventStreamActionPlugin("mytype", "/does/not/exist.so")
+	assert.Regexp("FFEC100275.*Failed to load EventStreamActionPlugin '/does/not/exist.so'", err)
+}
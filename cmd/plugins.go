@@ -19,19 +19,26 @@ import (
 
 	"github.com/hyperledger/firefly-ethconnect/internal/auth"
 	"github.com/hyperledger/firefly-ethconnect/internal/errors"
+	"github.com/hyperledger/firefly-ethconnect/internal/events"
 	"github.com/hyperledger/firefly-ethconnect/pkg/plugins"
 	log "github.com/sirupsen/logrus"
 )
 
 // PluginConfig is the JSON configuration for loading plugins
 type PluginConfig struct {
-	SecurityModulePlugin string `json:"securityModule"`
+	SecurityModulePlugin     string            `json:"securityModule"`
+	EventStreamActionPlugins map[string]string `json:"eventStreamActions"` // stream type to module path
 }
 
 func loadPlugins(conf *PluginConfig) error {
 	if err := loadSecurityModulePlugin(conf); err != nil {
 		return err
 	}
+	for streamType, modulePath := range conf.EventStreamActionPlugins {
+		if err := loadEventStreamActionPlugin(streamType, modulePath); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -56,3 +63,19 @@ func loadSecurityModulePlugin(conf *PluginConfig) error {
 	auth.RegisterSecurityModule(*smSymbol.(*plugins.SecurityModule))
 	return nil
 }
+
+func loadEventStreamActionPlugin(streamType, modulePath string) error {
+
+	log.Debugf("Loading EventStreamActionPlugin '%s' for stream type '%s'", modulePath, streamType)
+	esPlugin, err := plugin.Open(modulePath)
+	if err != nil {
+		return errors.Errorf(errors.EventStreamActionPluginLoad, modulePath, err)
+	}
+
+	esSymbol, err := esPlugin.Lookup("EventStreamActionPlugin")
+	if err != nil || esSymbol == nil {
+		return errors.Errorf(errors.EventStreamActionPluginSymbol, modulePath, err)
+	}
+
+	return events.RegisterEventStreamActionPlugin(streamType, *esSymbol.(*plugins.EventStreamActionPlugin))
+}
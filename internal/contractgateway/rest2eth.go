@@ -70,6 +70,7 @@ type rest2eth struct {
 	asyncDispatcher REST2EthAsyncDispatcher
 	syncDispatcher  rest2EthSyncDispatcher
 	subMgr          events.SubscriptionManager
+	decimalTxIndex  bool // the DecimalTransactionIndex setting of the subscription manager, for event queries
 }
 
 type restAsyncMsg struct {
@@ -153,30 +154,36 @@ func (r *rest2eth) addRoutes(router *httprouter.Router) {
 	router.POST("/contracts/:address/:method", r.restHandler)
 	router.GET("/contracts/:address/:method", r.restHandler)
 	router.POST("/contracts/:address/:method/:subcommand", r.restHandler)
+	router.GET("/contracts/:address/:method/:subcommand", r.logsHandler)
 
 	router.POST("/abis/:abi", r.restHandler)
 	router.POST("/abis/:abi/:address/:method", r.restHandler)
 	router.GET("/abis/:abi/:address/:method", r.restHandler)
 	router.POST("/abis/:abi/:address/:method/:subcommand", r.restHandler)
+	router.GET("/abis/:abi/:address/:method/:subcommand", r.logsHandler)
 
 	// Remote registry managed address routes, with long and short names
 	router.POST("/instances/:instance_lookup/:method", r.restHandler)
 	router.GET("/instances/:instance_lookup/:method", r.restHandler)
 	router.POST("/instances/:instance_lookup/:method/:subcommand", r.restHandler)
+	router.GET("/instances/:instance_lookup/:method/:subcommand", r.logsHandler)
 
 	router.POST("/i/:instance_lookup/:method", r.restHandler)
 	router.GET("/i/:instance_lookup/:method", r.restHandler)
 	router.POST("/i/:instance_lookup/:method/:subcommand", r.restHandler)
+	router.GET("/i/:instance_lookup/:method/:subcommand", r.logsHandler)
 
 	router.POST("/gateways/:gateway_lookup", r.restHandler)
 	router.POST("/gateways/:gateway_lookup/:address/:method", r.restHandler)
 	router.GET("/gateways/:gateway_lookup/:address/:method", r.restHandler)
 	router.POST("/gateways/:gateway_lookup/:address/:method/:subcommand", r.restHandler)
+	router.GET("/gateways/:gateway_lookup/:address/:method/:subcommand", r.logsHandler)
 
 	router.POST("/g/:gateway_lookup", r.restHandler)
 	router.POST("/g/:gateway_lookup/:address/:method", r.restHandler)
 	router.GET("/g/:gateway_lookup/:address/:method", r.restHandler)
 	router.POST("/g/:gateway_lookup/:address/:method/:subcommand", r.restHandler)
+	router.GET("/g/:gateway_lookup/:address/:method/:subcommand", r.logsHandler)
 }
 
 type restCmd struct {
@@ -237,6 +244,19 @@ func (r *rest2eth) resolveABI(res http.ResponseWriter, req *http.Request, params
 				return
 			}
 			location.Name = info.ABI
+			// If the contract is an upgradeable proxy, use the ABI of its implementation at the block of the call.
+			// An invalid block number is reported when the call is made.
+			blockNumber, bnErr := eth.RPCBlockNumber(getFlyParam("blocknumber", req))
+			if bnErr != nil {
+				blockNumber = "latest"
+			}
+			if info, err = r.cr.GetImplementationContract(req.Context(), r.rpc, addrParam, blockNumber); err != nil {
+				// The registered ABI is used if we cannot tell, as it was before proxies were supported
+				log.Warnf("Failed to check whether %s is a proxy at block %s. Using its registered ABI: %s", addrParam, blockNumber, err)
+				err = nil
+			} else if info != nil {
+				location.Name = info.ABI
+			}
 		}
 	}
 
@@ -468,6 +488,25 @@ func (r *rest2eth) restHandler(res http.ResponseWriter, req *http.Request, param
 	}
 }
 
+// logsHandler serves the historical logs of an event, without a subscription
+func (r *rest2eth) logsHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if strings.ToLower(params.ByName("subcommand")) != "logs" {
+		r.restErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayUnknownOperation, params.ByName("subcommand")), 404)
+		return
+	}
+	c, err := r.resolveParams(res, req, params)
+	if err != nil {
+		return
+	}
+	if c.abiEvent == nil {
+		r.restErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayEventNotDeclared, params.ByName("method")), 404)
+		return
+	}
+	r.queryEventLogs(res, req, &c)
+}
+
 func (r *rest2eth) fromBodyOrForm(req *http.Request, body map[string]interface{}, param string) string {
 	val := body[param]
 	valType := reflect.TypeOf(val)
@@ -518,6 +557,49 @@ func (r *rest2eth) subscribeEvent(res http.ResponseWriter, req *http.Request, ad
 	res.Write(resBytes)
 }
 
+func (r *rest2eth) queryEventLogs(res http.ResponseWriter, req *http.Request, c *restCmd) {
+	q := &events.LogQuery{
+		Event:                   c.abiEvent,
+		FromBlock:               r.fromBodyOrForm(req, c.body, "fromBlock"),
+		ToBlock:                 r.fromBodyOrForm(req, c.body, "toBlock"),
+		Timestamps:              strings.ToLower(req.FormValue("timestamps")) == "true",
+		Inputs:                  strings.ToLower(req.FormValue("inputs")) == "true",
+		DecimalTransactionIndex: r.decimalTxIndex,
+	}
+	if c.addr != "" {
+		address := ethbind.API.HexToAddress(c.addr)
+		q.Address = &address
+	}
+	if limitStr := req.FormValue("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			r.restErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.EventQueryBadLimit, limitStr), 400)
+			return
+		}
+		q.Limit = limit
+	}
+	if q.Inputs {
+		abi, err := ethbind.API.ABIMarshalingToABIRuntime(c.deployMsg.ABI)
+		if err != nil {
+			r.restErrReply(res, req, err, 400)
+			return
+		}
+		q.ABI = abi
+	}
+	result, err := events.QueryLogs(req.Context(), r.rpc, q)
+	if err != nil {
+		r.restErrReply(res, req, err, 400)
+		return
+	}
+	status := 200
+	resBytes, _ := json.Marshal(result)
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	log.Debugf("<-- %s", resBytes)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(resBytes)
+}
+
 func (r *rest2eth) doubleURLDecode(s string) string {
 	// Due to an annoying bug in the rapidoc Swagger UI, it is double URL encoding parameters.
 	// As most constellation b64 encoded values end in "=" that's breaking the ability to use
@@ -19,6 +19,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"math/big"
 	"net/http"
 	"net/http/httptest"
@@ -33,6 +34,7 @@ import (
 	"github.com/hyperledger/firefly-ethconnect/internal/ethbind"
 	"github.com/hyperledger/firefly-ethconnect/internal/events"
 	"github.com/hyperledger/firefly-ethconnect/internal/messages"
+	"github.com/hyperledger/firefly-ethconnect/internal/receipts"
 	"github.com/hyperledger/firefly-ethconnect/mocks/contractregistrymocks"
 	"github.com/hyperledger/firefly-ethconnect/mocks/ethmocks"
 	"github.com/julienschmidt/httprouter"
@@ -90,12 +92,14 @@ func (m *mockGateway) PreDeploy(msg *messages.DeployContract) error { return nil
 func (m *mockGateway) PostDeploy(msg *messages.TransactionReceipt) error {
 	return m.postDeployError
 }
-func (m *mockGateway) AddRoutes(router *httprouter.Router) { return }
-func (m *mockGateway) Shutdown()                           { return }
+func (m *mockGateway) AddRoutes(router *httprouter.Router)                          { return }
+func (m *mockGateway) SetReceiptStore(persistence receipts.ReceiptStorePersistence) {}
+func (m *mockGateway) Shutdown()                                                    { return }
 
 type mockSubMgr struct {
 	err             error
 	updateStreamErr error
+	deadLetterErr   error
 	captureSub      *events.SubscriptionCreateDTO
 	sub             *events.SubscriptionInfo
 	stream          *events.StreamInfo
@@ -104,6 +108,20 @@ type mockSubMgr struct {
 	suspended       bool
 	resumed         bool
 	capturedAddr    *ethbinding.Address
+	deadLetter      *events.DeadLetter
+	deadLetters     []*events.DeadLetter
+	export          *events.EventsExport
+	importOpts      *events.ImportOptions
+	exportOpts      *events.ExportOptions
+	importResult    *events.ImportResult
+	redelivered     bool
+	purged          bool
+	streamStatus    *events.StreamStatus
+	sseAcked        string
+	receipt         map[string]interface{}
+	receiptStore    receipts.ReceiptStorePersistence
+	replay          *events.ReplayInfo
+	replayRequest   *events.ReplayRequest
 }
 
 func (m *mockSubMgr) Init() error { return m.err }
@@ -117,6 +135,20 @@ func (m *mockSubMgr) Streams(ctx context.Context) []*events.StreamInfo { return
 func (m *mockSubMgr) StreamByID(ctx context.Context, id string) (*events.StreamInfo, error) {
 	return m.stream, m.err
 }
+func (m *mockSubMgr) StreamStatus(ctx context.Context, id string) (*events.StreamStatus, error) {
+	return m.streamStatus, m.err
+}
+func (m *mockSubMgr) StreamSSE(res http.ResponseWriter, req *http.Request, id string) error {
+	if m.err == nil {
+		res.Header().Set("Content-Type", "text/event-stream")
+		res.WriteHeader(200)
+	}
+	return m.err
+}
+func (m *mockSubMgr) AckSSE(ctx context.Context, id, batchID string) error {
+	m.sseAcked = batchID
+	return m.err
+}
 func (m *mockSubMgr) SuspendStream(ctx context.Context, id string) error {
 	m.suspended = true
 	return m.err
@@ -143,6 +175,47 @@ func (m *mockSubMgr) DeleteSubscription(ctx context.Context, id string) error {
 func (m *mockSubMgr) ResetSubscription(ctx context.Context, id, initialBlock string) error {
 	return m.err
 }
+func (m *mockSubMgr) ReplaySubscription(ctx context.Context, id string, req *events.ReplayRequest) (*events.ReplayInfo, error) {
+	m.replayRequest = req
+	return m.replay, m.err
+}
+func (m *mockSubMgr) ReplayByID(ctx context.Context, id string) (*events.ReplayInfo, error) {
+	return m.replay, m.err
+}
+func (m *mockSubMgr) CancelReplay(ctx context.Context, id string) error { return m.err }
+func (m *mockSubMgr) DeadLetters(ctx context.Context, streamID string) ([]*events.DeadLetter, error) {
+	return m.deadLetters, m.err
+}
+func (m *mockSubMgr) DeadLetterByID(ctx context.Context, streamID, id string) (*events.DeadLetter, error) {
+	return m.deadLetter, m.err
+}
+func (m *mockSubMgr) RedeliverDeadLetter(ctx context.Context, streamID, id string) error {
+	m.redelivered = true
+	return m.deadLetterErr
+}
+func (m *mockSubMgr) DeleteDeadLetter(ctx context.Context, streamID, id string) error {
+	return m.deadLetterErr
+}
+func (m *mockSubMgr) PurgeDeadLetters(ctx context.Context, streamID string) error {
+	m.purged = true
+	return m.deadLetterErr
+}
+
+func (m *mockSubMgr) DispatchReceipt(receipt map[string]interface{}) {
+	m.receipt = receipt
+}
+func (m *mockSubMgr) SetReceiptStore(persistence receipts.ReceiptStorePersistence) {
+	m.receiptStore = persistence
+}
+func (m *mockSubMgr) Export(ctx context.Context, opts *events.ExportOptions) (*events.EventsExport, error) {
+	m.exportOpts = opts
+	return m.export, m.err
+}
+func (m *mockSubMgr) Import(ctx context.Context, export *events.EventsExport, opts *events.ImportOptions) (*events.ImportResult, error) {
+	m.export = export
+	m.importOpts = opts
+	return m.importResult, m.err
+}
 func (m *mockSubMgr) Close(wait bool) {}
 
 func newTestDeployMsg(t *testing.T, addr string) *contractregistry.DeployContractWithAddress {
@@ -179,6 +252,8 @@ func newTestREST2EthAndMsg(dispatcher *mockREST2EthDispatcher, from, to string,
 func expectContractSuccess(t *testing.T, mcr *contractregistrymocks.ContractStore, address string) {
 	mcr.On("GetContractByAddress", strings.TrimPrefix(strings.ToLower(address), "0x")).
 		Return(&contractregistry.ContractInfo{ABI: "abi1"}, nil)
+	mcr.On("GetImplementationContract", mock.Anything, mock.Anything, strings.TrimPrefix(strings.ToLower(address), "0x"), mock.Anything).
+		Return(nil, nil)
 	expectABISuccess(t, mcr, "abi1")
 }
 
@@ -985,6 +1060,8 @@ func TestSendTransactionBadMethodABI(t *testing.T) {
 	mcr := r.cr.(*contractregistrymocks.ContractStore)
 	mcr.On("GetContractByAddress", "66c5fe653e7a9ebb628a6d40f0452d1e358baee8").
 		Return(&contractregistry.ContractInfo{ABI: "abi-id"}, nil)
+	mcr.On("GetImplementationContract", mock.Anything, mock.Anything, "66c5fe653e7a9ebb628a6d40f0452d1e358baee8", "latest").
+		Return(nil, nil)
 	mcr.On("GetABI", contractregistry.ABILocation{
 		ABIType: contractregistry.LocalABI,
 		Name:    "abi-id",
@@ -1029,6 +1106,8 @@ func TestSendTransactionBadEventABI(t *testing.T) {
 	mcr := r.cr.(*contractregistrymocks.ContractStore)
 	mcr.On("GetContractByAddress", "66c5fe653e7a9ebb628a6d40f0452d1e358baee8").
 		Return(&contractregistry.ContractInfo{ABI: "abi-id"}, nil)
+	mcr.On("GetImplementationContract", mock.Anything, mock.Anything, "66c5fe653e7a9ebb628a6d40f0452d1e358baee8", "latest").
+		Return(nil, nil)
 	mcr.On("GetABI", contractregistry.ABILocation{
 		ABIType: contractregistry.LocalABI,
 		Name:    "abi-id",
@@ -1426,6 +1505,81 @@ func TestSendTransactionBadBody(t *testing.T) {
 	mcr.AssertExpectations(t)
 }
 
+func TestCallMethodViaProxy(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
+	dispatcher := &mockREST2EthDispatcher{}
+
+	r, router, res, _ := newTestREST2EthAndMsg(dispatcher, "", to, map[string]interface{}{})
+	mcr := r.cr.(*contractregistrymocks.ContractStore)
+	mcr.On("GetContractByAddress", strings.TrimPrefix(to, "0x")).
+		Return(&contractregistry.ContractInfo{ABI: "proxy-abi"}, nil)
+	mcr.On("GetImplementationContract", mock.Anything, r.rpc, strings.TrimPrefix(to, "0x"), "0x3039").
+		Return(&contractregistry.ContractInfo{ABI: "abi1"}, nil)
+	expectABISuccess(t, mcr, "abi1")
+
+	mockRPC := r.rpc.(*ethmocks.RPCClient)
+	mockRPC.On("CallContext", mock.Anything, mock.Anything, "eth_call", mock.Anything, "0x3039").
+		Run(func(args mock.Arguments) {
+			result := args[1].(*string)
+			*result = "0x000000000000000000000000000000000000000000000000000000000001e2400000000000000000000000000000000000000000000000000000000000000040000000000000000000000000000000000000000000000000000000000000000774657374696e6700000000000000000000000000000000000000000000000000"
+		}).
+		Return(nil)
+
+	req := httptest.NewRequest("GET", "/contracts/"+to+"/get?fly-blocknumber=12345", bytes.NewReader([]byte{}))
+	router.ServeHTTP(res, req)
+
+	assert.Equal(200, res.Result().StatusCode)
+	var reply map[string]interface{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Equal("123456", reply["i"])
+
+	mcr.AssertExpectations(t)
+	mockRPC.AssertExpectations(t)
+}
+
+func TestCallMethodViaProxyFail(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
+	dispatcher := &mockREST2EthDispatcher{}
+
+	r, router, res, _ := newTestREST2EthAndMsg(dispatcher, "", to, map[string]interface{}{})
+	mcr := r.cr.(*contractregistrymocks.ContractStore)
+	mcr.On("GetContractByAddress", strings.TrimPrefix(to, "0x")).
+		Return(&contractregistry.ContractInfo{ABI: "proxy-abi"}, nil)
+	mcr.On("GetImplementationContract", mock.Anything, r.rpc, strings.TrimPrefix(to, "0x"), "latest").
+		Return(nil, fmt.Errorf("eth_getStorageAt returned: pop"))
+	// The call is made with the registered ABI of the proxy
+	expectABISuccess(t, mcr, "proxy-abi")
+
+	mockRPC := r.rpc.(*ethmocks.RPCClient)
+	mockRPC.On("CallContext", mock.Anything, mock.Anything, "eth_call", mock.Anything, "latest").
+		Run(func(args mock.Arguments) {
+			result := args[1].(*string)
+			*result = "0x000000000000000000000000000000000000000000000000000000000001e2400000000000000000000000000000000000000000000000000000000000000040000000000000000000000000000000000000000000000000000000000000000774657374696e6700000000000000000000000000000000000000000000000000"
+		}).
+		Return(nil)
+
+	req := httptest.NewRequest("GET", "/contracts/"+to+"/get", bytes.NewReader([]byte{}))
+	router.ServeHTTP(res, req)
+
+	assert.Equal(200, res.Result().StatusCode)
+	var reply map[string]interface{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Equal("123456", reply["i"])
+
+	mcr.AssertExpectations(t)
+	mockRPC.AssertExpectations(t)
+}
+
 func TestCallMethodSuccess(t *testing.T) {
 	log.SetLevel(log.DebugLevel)
 	assert := assert.New(t)
@@ -2034,3 +2188,155 @@ func TestGetTransactionInfoDecodeFail(t *testing.T) {
 
 	assert.Equal(500, res.Result().StatusCode)
 }
+
+func expectLogsQuery(t *testing.T, mockRPC *ethmocks.RPCClient) {
+	logsBytes, err := ioutil.ReadFile("../../test/simplevents_logs.json")
+	assert.NoError(t, err)
+	mockRPC.On("CallContext", mock.Anything, mock.Anything, "eth_blockNumber").
+		Run(func(args mock.Arguments) {
+			args[1].(*ethbinding.HexBigInt).ToInt().SetInt64(1000)
+		}).
+		Return(nil)
+	mockRPC.On("CallContext", mock.Anything, mock.Anything, "eth_getLogs", mock.Anything).
+		Run(func(args mock.Arguments) {
+			json.Unmarshal(logsBytes, args[1])
+		}).
+		Return(nil)
+}
+
+func TestQueryEventLogsSuccess(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	dispatcher := &mockREST2EthDispatcher{}
+	r, router := newTestREST2Eth(dispatcher)
+	mcr := r.cr.(*contractregistrymocks.ContractStore)
+	expectContractSuccess(t, mcr, "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
+	mockRPC := r.rpc.(*ethmocks.RPCClient)
+	expectLogsQuery(t, mockRPC)
+
+	req := httptest.NewRequest("GET", "/contracts/0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8/Changed/logs?fromBlock=900", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	assert.Equal(200, res.Result().StatusCode)
+	var reply map[string]interface{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Equal("900", reply["fromBlock"])
+	assert.Equal("1000", reply["toBlock"])
+	assert.Nil(reply["nextBlock"])
+	results := reply["events"].([]interface{})
+	assert.Len(results, 3)
+	event := results[0].(map[string]interface{})
+	assert.Equal("Changed(address,int64,string,bytes32,string)", event["signature"])
+	assert.Equal("42", event["data"].(map[string]interface{})["i"])
+	assert.Equal("0x0", event["transactionIndex"])
+
+	mockRPC.AssertNumberOfCalls(t, "CallContext", 2)
+	mcr.AssertExpectations(t)
+}
+
+func TestQueryEventLogsLimit(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	dispatcher := &mockREST2EthDispatcher{}
+	r, router := newTestREST2Eth(dispatcher)
+	r.decimalTxIndex = true
+	mcr := r.cr.(*contractregistrymocks.ContractStore)
+	expectContractSuccess(t, mcr, "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
+	mockRPC := r.rpc.(*ethmocks.RPCClient)
+	expectLogsQuery(t, mockRPC)
+
+	req := httptest.NewRequest("GET", "/contracts/0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8/Changed/logs?fromBlock=0&toBlock=999&limit=1", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	assert.Equal(200, res.Result().StatusCode)
+	var reply map[string]interface{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Equal("250", reply["nextBlock"])
+	assert.Len(reply["events"], 3)
+	event := reply["events"].([]interface{})[0].(map[string]interface{})
+	assert.Equal("0", event["transactionIndex"])
+}
+
+func TestQueryEventLogsBadLimit(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	dispatcher := &mockREST2EthDispatcher{}
+	r, router := newTestREST2Eth(dispatcher)
+	mcr := r.cr.(*contractregistrymocks.ContractStore)
+	expectContractSuccess(t, mcr, "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
+
+	req := httptest.NewRequest("GET", "/contracts/0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8/Changed/logs?fromBlock=0&limit=-1", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	assert.Equal(400, res.Result().StatusCode)
+	reply := errors.RESTError{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Regexp("Invalid limit '-1' for event query", reply.Message)
+}
+
+func TestQueryEventLogsBadBlock(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	dispatcher := &mockREST2EthDispatcher{}
+	r, router := newTestREST2Eth(dispatcher)
+	mcr := r.cr.(*contractregistrymocks.ContractStore)
+	expectContractSuccess(t, mcr, "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
+
+	req := httptest.NewRequest("GET", "/contracts/0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8/Changed/logs?fromBlock=abc", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	assert.Equal(400, res.Result().StatusCode)
+	reply := errors.RESTError{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Regexp("Invalid fromBlock 'abc' for event query", reply.Message)
+}
+
+func TestQueryEventLogsNotEvent(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	dispatcher := &mockREST2EthDispatcher{}
+	r, router := newTestREST2Eth(dispatcher)
+	mcr := r.cr.(*contractregistrymocks.ContractStore)
+	expectContractSuccess(t, mcr, "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
+
+	req := httptest.NewRequest("GET", "/contracts/0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8/get/logs", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	assert.Equal(404, res.Result().StatusCode)
+	reply := errors.RESTError{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Regexp("Event 'get' is not declared in the ABI", reply.Message)
+}
+
+func TestQueryEventLogsUnknownOperation(t *testing.T) {
+	assert := assert.New(t)
+
+	dispatcher := &mockREST2EthDispatcher{}
+	_, router := newTestREST2Eth(dispatcher)
+
+	req := httptest.NewRequest("GET", "/contracts/0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8/Changed/other", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	assert.Equal(404, res.Result().StatusCode)
+}
@@ -46,6 +46,7 @@ import (
 	"github.com/hyperledger/firefly-ethconnect/internal/events"
 	"github.com/hyperledger/firefly-ethconnect/internal/messages"
 	"github.com/hyperledger/firefly-ethconnect/internal/openapi"
+	"github.com/hyperledger/firefly-ethconnect/internal/receipts"
 	"github.com/hyperledger/firefly-ethconnect/internal/tx"
 	"github.com/hyperledger/firefly-ethconnect/internal/utils"
 	"github.com/hyperledger/firefly-ethconnect/internal/ws"
@@ -70,6 +71,7 @@ type SmartContractGateway interface {
 	PostDeploy(msg *messages.TransactionReceipt) error
 	AddRoutes(router *httprouter.Router)
 	SendReply(message interface{})
+	SetReceiptStore(persistence receipts.ReceiptStorePersistence)
 	Shutdown()
 }
 
@@ -122,12 +124,35 @@ func (g *smartContractGW) AddRoutes(router *httprouter.Router) {
 	router.DELETE(events.StreamPathPrefix+"/:id", g.withEventsAuth(g.deleteStreamOrSub))
 	router.DELETE(events.SubPathPrefix+"/:id", g.withEventsAuth(g.deleteStreamOrSub))
 	router.POST(events.SubPathPrefix+"/:id/reset", g.withEventsAuth(g.resetSub))
+	router.POST(events.SubPathPrefix+"/:id/replay", g.withEventsAuth(g.replaySub))
+	router.GET(events.ReplayPathPrefix+"/:id", g.withEventsAuth(g.getReplay))
+	router.DELETE(events.ReplayPathPrefix+"/:id", g.withEventsAuth(g.cancelReplay))
 	router.POST(events.StreamPathPrefix+"/:id/suspend", g.withEventsAuth(g.suspendOrResumeStream))
 	router.POST(events.StreamPathPrefix+"/:id/resume", g.withEventsAuth(g.suspendOrResumeStream))
+	router.GET(events.StreamPathPrefix+"/:id/status", g.withEventsAuth(g.getStreamStatus))
+	router.GET(events.StreamPathPrefix+"/:id/sse", g.withEventsAuth(g.streamSSE))
+	router.POST(events.StreamPathPrefix+"/:id/sse/ack", g.withEventsAuth(g.ackSSE))
+	router.GET(events.StreamPathPrefix+"/:id/deadletters", g.withEventsAuth(g.listDeadLetters))
+	router.DELETE(events.StreamPathPrefix+"/:id/deadletters", g.withEventsAuth(g.deleteDeadLetters))
+	router.GET(events.StreamPathPrefix+"/:id/deadletters/:dlid", g.withEventsAuth(g.getDeadLetter))
+	router.DELETE(events.StreamPathPrefix+"/:id/deadletters/:dlid", g.withEventsAuth(g.deleteDeadLetters))
+	router.POST(events.StreamPathPrefix+"/:id/deadletters/:dlid/redeliver", g.withEventsAuth(g.redeliverDeadLetter))
+	router.GET(events.AdminPathPrefix+"/export", g.withEventsAuth(g.exportEvents))
+	router.POST(events.AdminPathPrefix+"/import", g.withEventsAuth(g.importEvents))
 }
 
 func (g *smartContractGW) SendReply(message interface{}) {
 	g.ws.SendReply(message)
+	if receipt, ok := message.(map[string]interface{}); ok && g.sm != nil {
+		g.sm.DispatchReceipt(receipt)
+	}
+}
+
+// SetReceiptStore provides the receipt store to the event streams, for subscriptions to receipts
+func (g *smartContractGW) SetReceiptStore(persistence receipts.ReceiptStorePersistence) {
+	if g.sm != nil {
+		g.sm.SetReceiptStore(persistence)
+	}
 }
 
 // NewSmartContractGateway constructor
@@ -171,6 +196,7 @@ func NewSmartContractGateway(conf *SmartContractGatewayConf, txnConf *tx.TxnProc
 		}
 	}
 	gw.r2e = newREST2eth(gw, gw.cs, rpc, gw.sm, processor, asyncDispatcher, syncDispatcher)
+	gw.r2e.decimalTxIndex = conf.DecimalTransactionIndex
 	return gw, nil
 }
 
@@ -571,6 +597,79 @@ func (g *smartContractGW) resetSub(res http.ResponseWriter, req *http.Request, p
 	res.WriteHeader(status)
 }
 
+// replaySub replays the events of a subscription between two blocks to a temporary stream
+func (g *smartContractGW) replaySub(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errEventSupportMissing, 405)
+		return
+	}
+
+	var body events.ReplayRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		g.gatewayErrReply(res, req, errors.Errorf(errors.RESTGatewayReplayInvalid, err), 400)
+		return
+	}
+	retval, err := g.sm.ReplaySubscription(req.Context(), params.ByName("id"), &body)
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 500)
+		return
+	}
+
+	status := 201
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(retval)
+}
+
+// getReplay returns the progress of a replay
+func (g *smartContractGW) getReplay(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errEventSupportMissing, 405)
+		return
+	}
+
+	retval, err := g.sm.ReplayByID(req.Context(), params.ByName("id"))
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 404)
+		return
+	}
+
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(retval)
+}
+
+// cancelReplay stops a replay and removes it
+func (g *smartContractGW) cancelReplay(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errEventSupportMissing, 405)
+		return
+	}
+
+	if err := g.sm.CancelReplay(req.Context(), params.ByName("id")); err != nil {
+		g.gatewayErrReply(res, req, err, 404)
+		return
+	}
+
+	status := 204
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+}
+
 // suspendOrResumeStream suspends or resumes a stream
 func (g *smartContractGW) suspendOrResumeStream(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
 	log.Infof("--> %s %s", req.Method, req.URL)
@@ -597,6 +696,245 @@ func (g *smartContractGW) suspendOrResumeStream(res http.ResponseWriter, req *ht
 	res.WriteHeader(status)
 }
 
+// getStreamStatus returns the runtime status of a stream and its subscriptions
+func (g *smartContractGW) getStreamStatus(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errEventSupportMissing, 405)
+		return
+	}
+
+	streamStatus, err := g.sm.StreamStatus(req.Context(), params.ByName("id"))
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 404)
+		return
+	}
+
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(streamStatus)
+}
+
+// streamSSE delivers the events of an SSE stream to the client, until it disconnects
+func (g *smartContractGW) streamSSE(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errEventSupportMissing, 405)
+		return
+	}
+
+	if err := g.sm.StreamSSE(res, req, params.ByName("id")); err != nil {
+		g.gatewayErrReply(res, req, err, 404)
+		return
+	}
+
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, 200)
+}
+
+type sseAck struct {
+	BatchID string `json:"batchId"`
+}
+
+// ackSSE acknowledges the batch currently being delivered on an SSE stream
+func (g *smartContractGW) ackSSE(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errEventSupportMissing, 405)
+		return
+	}
+
+	var ack sseAck
+	if err := json.NewDecoder(req.Body).Decode(&ack); err != nil {
+		g.gatewayErrReply(res, req, errors.Errorf(errors.RESTGatewaySSEAckInvalid, err), 400)
+		return
+	}
+
+	if err := g.sm.AckSSE(req.Context(), params.ByName("id"), ack.BatchID); err != nil {
+		g.gatewayErrReply(res, req, err, 404)
+		return
+	}
+
+	status := 204
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+}
+
+// listDeadLetters lists the skipped batches for a stream
+func (g *smartContractGW) listDeadLetters(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errEventSupportMissing, 405)
+		return
+	}
+
+	dls, err := g.sm.DeadLetters(req.Context(), params.ByName("id"))
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 404)
+		return
+	}
+
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(&dls)
+}
+
+// getDeadLetter returns a single skipped batch for a stream, including the events
+func (g *smartContractGW) getDeadLetter(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errEventSupportMissing, 405)
+		return
+	}
+
+	dl, err := g.sm.DeadLetterByID(req.Context(), params.ByName("id"), params.ByName("dlid"))
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 404)
+		return
+	}
+
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(dl)
+}
+
+// deleteDeadLetters deletes a single skipped batch, or purges all skipped batches for a stream
+func (g *smartContractGW) deleteDeadLetters(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errEventSupportMissing, 405)
+		return
+	}
+
+	var err error
+	if dlID := params.ByName("dlid"); dlID != "" {
+		if _, err = g.sm.DeadLetterByID(req.Context(), params.ByName("id"), dlID); err != nil {
+			g.gatewayErrReply(res, req, err, 404)
+			return
+		}
+		err = g.sm.DeleteDeadLetter(req.Context(), params.ByName("id"), dlID)
+	} else {
+		if _, err = g.sm.StreamByID(req.Context(), params.ByName("id")); err != nil {
+			g.gatewayErrReply(res, req, err, 404)
+			return
+		}
+		err = g.sm.PurgeDeadLetters(req.Context(), params.ByName("id"))
+	}
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 500)
+		return
+	}
+
+	status := 204
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+}
+
+// redeliverDeadLetter queues a skipped batch for delivery on the stream again
+func (g *smartContractGW) redeliverDeadLetter(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errEventSupportMissing, 405)
+		return
+	}
+
+	if _, err := g.sm.DeadLetterByID(req.Context(), params.ByName("id"), params.ByName("dlid")); err != nil {
+		g.gatewayErrReply(res, req, err, 404)
+		return
+	}
+
+	err := g.sm.RedeliverDeadLetter(req.Context(), params.ByName("id"), params.ByName("dlid"))
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 500)
+		return
+	}
+
+	status := 204
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+}
+
+// exportEvents returns all streams, subscriptions and checkpoints, for import into another server.
+// The secrets of webhooks are only included with secrets=true
+func (g *smartContractGW) exportEvents(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errEventSupportMissing, 405)
+		return
+	}
+
+	export, err := g.sm.Export(req.Context(), &events.ExportOptions{
+		IncludeSecrets: strings.ToLower(req.FormValue("secrets")) == "true",
+	})
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 500)
+		return
+	}
+
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(export)
+}
+
+// importEvents creates the streams, subscriptions and checkpoints of an export, or validates them with dryrun=true
+func (g *smartContractGW) importEvents(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errEventSupportMissing, 405)
+		return
+	}
+
+	var export events.EventsExport
+	if err := json.NewDecoder(req.Body).Decode(&export); err != nil {
+		g.gatewayErrReply(res, req, errors.Errorf(errors.RESTGatewayImportInvalid, err), 400)
+		return
+	}
+
+	result, err := g.sm.Import(req.Context(), &export, &events.ImportOptions{
+		DryRun:   strings.ToLower(req.FormValue("dryrun")) == "true",
+		Conflict: strings.ToLower(req.FormValue("conflict")),
+	})
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 400)
+		return
+	}
+
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(result)
+}
+
 func (g *smartContractGW) isSwaggerRequest(req *http.Request) (swaggerGen *openapi.ABI2Swagger, uiRequest, factoryOnly, abiRequest, refreshABI bool, from string) {
 	_ = req.ParseForm()
 	var swaggerRequest bool
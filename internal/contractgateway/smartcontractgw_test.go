@@ -17,6 +17,7 @@ package contractgateway
 import (
 	"archive/zip"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -37,8 +38,10 @@ import (
 	"github.com/hyperledger/firefly-ethconnect/internal/ethbind"
 	"github.com/hyperledger/firefly-ethconnect/internal/events"
 	"github.com/hyperledger/firefly-ethconnect/internal/messages"
+	"github.com/hyperledger/firefly-ethconnect/internal/receipts"
 	"github.com/hyperledger/firefly-ethconnect/internal/tx"
 	"github.com/hyperledger/firefly-ethconnect/mocks/contractregistrymocks"
+	"github.com/hyperledger/firefly-ethconnect/mocks/receiptsmocks"
 	"github.com/julienschmidt/httprouter"
 	ethbinding "github.com/kaleido-io/ethbinding/pkg"
 	log "github.com/sirupsen/logrus"
@@ -58,6 +61,10 @@ func (m *mockWebSocketServer) SendReply(message interface{}) {
 	m.testChan <- message
 }
 
+func (m *mockWebSocketServer) SendToGroup(topic, group, stream string, batchNumber uint64, message interface{}, interrupt <-chan struct{}) error {
+	return nil
+}
+
 type SolcJson struct {
 	ABI string `json:"abi"`
 	Bin string `json:"bin"`
@@ -1757,6 +1764,62 @@ func TestResetSubNoManager(t *testing.T) {
 	assert.Equal(405, res.Result().StatusCode)
 }
 
+func TestReplaySub(t *testing.T) {
+	assert := assert.New(t)
+
+	reqData := map[string]interface{}{
+		"fromBlock": "100",
+		"toBlock":   "200",
+		"stream":    map[string]interface{}{"type": "websocket"},
+	}
+	b, _ := json.Marshal(&reqData)
+	mockSubMgr := &mockSubMgr{replay: &events.ReplayInfo{ID: "rp-1"}}
+	var result events.ReplayInfo
+	res := testGWPathBody("POST", events.SubPathPrefix+"/123/replay", &result, mockSubMgr, bytes.NewReader(b))
+	assert.Equal(201, res.Result().StatusCode)
+	assert.Equal("rp-1", result.ID)
+	assert.Equal("200", mockSubMgr.replayRequest.ToBlock)
+	assert.Equal("websocket", mockSubMgr.replayRequest.Stream.Type)
+}
+
+func TestReplaySubFail(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSubMgr := &mockSubMgr{err: fmt.Errorf("pop")}
+	res := testGWPathBody("POST", events.SubPathPrefix+"/123/replay", nil, mockSubMgr, bytes.NewReader([]byte(`{}`)))
+	assert.Equal(500, res.Result().StatusCode)
+
+	res = testGWPathBody("POST", events.SubPathPrefix+"/123/replay", nil, mockSubMgr, bytes.NewReader([]byte(`!json`)))
+	assert.Equal(400, res.Result().StatusCode)
+
+	res = testGWPath("POST", events.SubPathPrefix+"/123/replay", nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+}
+
+func TestGetAndCancelReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSubMgr := &mockSubMgr{replay: &events.ReplayInfo{ID: "rp-1", Status: events.ReplayStatusCompleted}}
+	var result events.ReplayInfo
+	res := testGWPath("GET", events.ReplayPathPrefix+"/rp-1", &result, mockSubMgr)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal(events.ReplayStatusCompleted, result.Status)
+
+	res = testGWPath("DELETE", events.ReplayPathPrefix+"/rp-1", nil, mockSubMgr)
+	assert.Equal(204, res.Result().StatusCode)
+
+	mockSubMgr.err = fmt.Errorf("pop")
+	res = testGWPath("GET", events.ReplayPathPrefix+"/rp-1", nil, mockSubMgr)
+	assert.Equal(404, res.Result().StatusCode)
+	res = testGWPath("DELETE", events.ReplayPathPrefix+"/rp-1", nil, mockSubMgr)
+	assert.Equal(404, res.Result().StatusCode)
+
+	res = testGWPath("GET", events.ReplayPathPrefix+"/rp-1", nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+	res = testGWPath("DELETE", events.ReplayPathPrefix+"/rp-1", nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+}
+
 func TestDeleteStream(t *testing.T) {
 	assert := assert.New(t)
 
@@ -1877,6 +1940,73 @@ func TestSendReplyBroadcast(t *testing.T) {
 	assert.Equal(testMessage, receivedReply)
 }
 
+func TestSendReplyDispatchesReceipt(t *testing.T) {
+	assert := assert.New(t)
+	ws := &mockWebSocketServer{
+		testChan: make(chan interface{}, 1),
+	}
+	sm := &mockSubMgr{}
+	scgw := &smartContractGW{ws: ws, sm: sm}
+
+	receipt := map[string]interface{}{"_id": "req1"}
+	scgw.SendReply(receipt)
+	assert.Equal(receipt, <-ws.testChan)
+	assert.Equal(receipt, sm.receipt)
+}
+
+func TestSendReplyNotBlockedBySuspendedStream(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	sm, err := events.NewSubscriptionManager(&events.SubscriptionManagerConf{
+		EventLevelDBPath:        path.Join(dir, "events"),
+		WebhooksAllowPrivateIPs: true,
+	}, nil, &contractregistrymocks.ContractStore{}, &mockWebSocketServer{})
+	assert.NoError(err)
+	err = sm.Init()
+	assert.NoError(err)
+	defer sm.Close(true)
+	store := receipts.NewMemoryReceipts(&receipts.ReceiptStoreConf{MaxDocs: 10})
+	sm.SetReceiptStore(store)
+
+	ctx := context.Background()
+	var spec events.StreamInfo
+	err = json.Unmarshal([]byte(`{"type":"webhook","webhook":{"url":"http://localhost:1"}}`), &spec)
+	assert.NoError(err)
+	stream, err := sm.AddStream(ctx, &spec)
+	assert.NoError(err)
+	err = sm.SuspendStream(ctx, stream.ID)
+	assert.NoError(err)
+	_, err = sm.AddSubscriptionDirect(ctx, &events.SubscriptionCreateDTO{Stream: stream.ID, Kind: events.SubscriptionKindReceipts})
+	assert.NoError(err)
+
+	// Replies are processed while the subscription to receipts cannot take any more of them
+	ws := &mockWebSocketServer{testChan: make(chan interface{}, 1)}
+	scgw := &smartContractGW{ws: ws, sm: sm}
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2000; i++ {
+			scgw.SendReply(map[string]interface{}{"_id": fmt.Sprintf("req%d", i), "receivedAt": int64(i)})
+			<-ws.testChan
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		assert.Fail("SendReply blocked by a suspended stream")
+	}
+}
+
+func TestSetReceiptStore(t *testing.T) {
+	sm := &mockSubMgr{}
+	store := &receiptsmocks.ReceiptStorePersistence{}
+	(&smartContractGW{sm: sm}).SetReceiptStore(store)
+	assert.Equal(t, store, sm.receiptStore)
+	(&smartContractGW{}).SetReceiptStore(store)
+}
+
 func TestPublishBadABI(t *testing.T) {
 	// writes real files and tests end to end
 	assert := assert.New(t)
@@ -2045,3 +2175,194 @@ func TestResolveAddressGetContractFail(t *testing.T) {
 	assert.Nil(info)
 	assert.Equal("", name)
 }
+
+func TestGetStreamStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := &mockSubMgr{
+		streamStatus: &events.StreamStatus{
+			ID:       "123",
+			InFlight: 5,
+			Blocked:  true,
+			Subscriptions: []*events.SubscriptionStatus{
+				{ID: "sub1", BlockHWM: "100", InCatchupMode: true},
+			},
+		},
+	}
+	var result events.StreamStatus
+	res := testGWPath("GET", events.StreamPathPrefix+"/123/status", &result, sm)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal(uint64(5), result.InFlight)
+	assert.True(result.Blocked)
+	assert.Equal("100", result.Subscriptions[0].BlockHWM)
+	assert.True(result.Subscriptions[0].InCatchupMode)
+
+	res = testGWPath("GET", events.StreamPathPrefix+"/123/status", nil, &mockSubMgr{err: fmt.Errorf("not found")})
+	assert.Equal(404, res.Result().StatusCode)
+
+	res = testGWPath("GET", events.StreamPathPrefix+"/123/status", nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+}
+
+func TestListDeadLetters(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := &mockSubMgr{
+		deadLetters: []*events.DeadLetter{{ID: "dl1"}},
+	}
+	var results []*events.DeadLetter
+	res := testGWPath("GET", events.StreamPathPrefix+"/123/deadletters", &results, sm)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal("dl1", results[0].ID)
+
+	res = testGWPath("GET", events.StreamPathPrefix+"/123/deadletters", nil, &mockSubMgr{err: fmt.Errorf("not found")})
+	assert.Equal(404, res.Result().StatusCode)
+
+	res = testGWPath("GET", events.StreamPathPrefix+"/123/deadletters", nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+}
+
+func TestGetDeadLetter(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := &mockSubMgr{
+		deadLetter: &events.DeadLetter{ID: "dl1"},
+	}
+	var result events.DeadLetter
+	res := testGWPath("GET", events.StreamPathPrefix+"/123/deadletters/dl1", &result, sm)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal("dl1", result.ID)
+
+	res = testGWPath("GET", events.StreamPathPrefix+"/123/deadletters/dl1", nil, &mockSubMgr{err: fmt.Errorf("not found")})
+	assert.Equal(404, res.Result().StatusCode)
+
+	res = testGWPath("GET", events.StreamPathPrefix+"/123/deadletters/dl1", nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+}
+
+func TestDeleteAndPurgeDeadLetters(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := &mockSubMgr{}
+	res := testGWPath("DELETE", events.StreamPathPrefix+"/123/deadletters/dl1", nil, sm)
+	assert.Equal(204, res.Result().StatusCode)
+	assert.False(sm.purged)
+
+	res = testGWPath("DELETE", events.StreamPathPrefix+"/123/deadletters", nil, sm)
+	assert.Equal(204, res.Result().StatusCode)
+	assert.True(sm.purged)
+
+	var errInfo = errors.RESTError{}
+	res = testGWPath("DELETE", events.StreamPathPrefix+"/123/deadletters", &errInfo, &mockSubMgr{deadLetterErr: fmt.Errorf("pop")})
+	assert.Equal(500, res.Result().StatusCode)
+	assert.Equal("pop", errInfo.Message)
+
+	res = testGWPath("DELETE", events.StreamPathPrefix+"/123/deadletters/dl1", nil, &mockSubMgr{deadLetterErr: fmt.Errorf("pop")})
+	assert.Equal(500, res.Result().StatusCode)
+
+	res = testGWPath("DELETE", events.StreamPathPrefix+"/123/deadletters", nil, &mockSubMgr{err: fmt.Errorf("not found")})
+	assert.Equal(404, res.Result().StatusCode)
+
+	res = testGWPath("DELETE", events.StreamPathPrefix+"/123/deadletters/dl1", nil, &mockSubMgr{err: fmt.Errorf("not found")})
+	assert.Equal(404, res.Result().StatusCode)
+
+	res = testGWPath("DELETE", events.StreamPathPrefix+"/123/deadletters", nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+}
+
+func TestRedeliverDeadLetter(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := &mockSubMgr{}
+	res := testGWPath("POST", events.StreamPathPrefix+"/123/deadletters/dl1/redeliver", nil, sm)
+	assert.Equal(204, res.Result().StatusCode)
+	assert.True(sm.redelivered)
+
+	res = testGWPath("POST", events.StreamPathPrefix+"/123/deadletters/dl1/redeliver", nil, &mockSubMgr{deadLetterErr: fmt.Errorf("pop")})
+	assert.Equal(500, res.Result().StatusCode)
+
+	res = testGWPath("POST", events.StreamPathPrefix+"/123/deadletters/dl1/redeliver", nil, &mockSubMgr{err: fmt.Errorf("not found")})
+	assert.Equal(404, res.Result().StatusCode)
+
+	res = testGWPath("POST", events.StreamPathPrefix+"/123/deadletters/dl1/redeliver", nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+}
+
+func TestStreamSSE(t *testing.T) {
+	assert := assert.New(t)
+
+	res := testGWPath("GET", events.StreamPathPrefix+"/123/sse", nil, &mockSubMgr{})
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal("text/event-stream", res.Result().Header.Get("Content-Type"))
+
+	res = testGWPath("GET", events.StreamPathPrefix+"/123/sse", nil, &mockSubMgr{err: fmt.Errorf("not found")})
+	assert.Equal(404, res.Result().StatusCode)
+
+	res = testGWPath("GET", events.StreamPathPrefix+"/123/sse", nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+}
+
+func TestAckSSE(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := &mockSubMgr{}
+	res := testGWPathBody("POST", events.StreamPathPrefix+"/123/sse/ack", nil, sm, bytes.NewReader([]byte(`{"batchId":"batch1"}`)))
+	assert.Equal(204, res.Result().StatusCode)
+	assert.Equal("batch1", sm.sseAcked)
+
+	var errInfo = errors.RESTError{}
+	res = testGWPathBody("POST", events.StreamPathPrefix+"/123/sse/ack", &errInfo, &mockSubMgr{}, bytes.NewReader([]byte(`!json`)))
+	assert.Equal(400, res.Result().StatusCode)
+	assert.Regexp("Invalid SSE acknowledgement", errInfo.Message)
+
+	res = testGWPathBody("POST", events.StreamPathPrefix+"/123/sse/ack", nil, &mockSubMgr{err: fmt.Errorf("not in flight")}, bytes.NewReader([]byte(`{"batchId":"batch1"}`)))
+	assert.Equal(404, res.Result().StatusCode)
+
+	res = testGWPath("POST", events.StreamPathPrefix+"/123/sse/ack", nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+}
+
+func TestExportEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := &mockSubMgr{export: &events.EventsExport{Version: 1, Streams: []*events.StreamInfo{{ID: "es-1"}}}}
+	var export events.EventsExport
+	res := testGWPath("GET", events.AdminPathPrefix+"/export", &export, sm)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal("es-1", export.Streams[0].ID)
+	assert.False(sm.exportOpts.IncludeSecrets)
+
+	res = testGWPath("GET", events.AdminPathPrefix+"/export?secrets=true", &export, sm)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.True(sm.exportOpts.IncludeSecrets)
+
+	res = testGWPath("GET", events.AdminPathPrefix+"/export", nil, &mockSubMgr{err: fmt.Errorf("pop")})
+	assert.Equal(500, res.Result().StatusCode)
+
+	res = testGWPath("GET", events.AdminPathPrefix+"/export", nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+}
+
+func TestImportEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := &mockSubMgr{importResult: &events.ImportResult{DryRun: true}}
+	var result events.ImportResult
+	res := testGWPathBody("POST", events.AdminPathPrefix+"/import?dryrun=true&conflict=Skip", &result, sm, bytes.NewReader([]byte(`{"version":1,"streams":[{"id":"es-1"}]}`)))
+	assert.Equal(200, res.Result().StatusCode)
+	assert.True(result.DryRun)
+	assert.Equal("es-1", sm.export.Streams[0].ID)
+	assert.True(sm.importOpts.DryRun)
+	assert.Equal(events.ImportConflictSkip, sm.importOpts.Conflict)
+
+	var errInfo = errors.RESTError{}
+	res = testGWPathBody("POST", events.AdminPathPrefix+"/import", &errInfo, &mockSubMgr{}, bytes.NewReader([]byte(`!json`)))
+	assert.Equal(400, res.Result().StatusCode)
+	assert.Regexp("Invalid import document", errInfo.Message)
+
+	res = testGWPathBody("POST", events.AdminPathPrefix+"/import", nil, &mockSubMgr{err: fmt.Errorf("pop")}, bytes.NewReader([]byte(`{}`)))
+	assert.Equal(400, res.Result().StatusCode)
+
+	res = testGWPath("POST", events.AdminPathPrefix+"/import", nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+}
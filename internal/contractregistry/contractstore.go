@@ -16,6 +16,7 @@ package contractregistry
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -32,8 +33,10 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	ethconnecterrors "github.com/hyperledger/firefly-ethconnect/internal/errors"
+	"github.com/hyperledger/firefly-ethconnect/internal/eth"
 	"github.com/hyperledger/firefly-ethconnect/internal/kvstore"
 	"github.com/hyperledger/firefly-ethconnect/internal/messages"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
 )
 
 const (
@@ -52,6 +55,8 @@ type ContractResolver interface {
 	ResolveContractAddress(registeredName string) (string, error)
 	GetContractByAddress(addrHex string) (*ContractInfo, error)
 	GetABI(location ABILocation, refresh bool) (deployMsg *DeployContractWithAddress, err error)
+	GetEventBySignature(topic string) (*ethbinding.ABIElementMarshaling, error)
+	GetImplementationContract(ctx context.Context, rpc eth.RPCClient, addrHex, blockNumber string) (*ContractInfo, error)
 	CheckNameAvailable(name string, isRemote bool) error
 }
 
@@ -75,10 +80,12 @@ type ContractStoreConf struct {
 }
 
 type contractStore struct {
-	conf     *ContractStoreConf
-	rr       RemoteRegistry
-	db       kvstore.KVStore
-	abiCache *lru.Cache
+	conf       *ContractStoreConf
+	rr         RemoteRegistry
+	db         kvstore.KVStore
+	abiCache   *lru.Cache
+	proxyCache *lru.Cache // proxy address and historical block (or latest) -> implementation address
+	nonProxies *lru.Cache // addresses of contracts that were not proxies at the head of the chain -> expiry time
 }
 
 const (
@@ -222,6 +229,7 @@ func (cs *contractStore) AddABI(abiID string, deployMsg *messages.DeployContract
 	if err != nil {
 		return nil, err
 	}
+	cs.indexEventSignatures(abiID, deployMsg.ABI, false)
 	return &storedABI.ABIInfo, nil
 }
 
@@ -324,6 +332,12 @@ func (cs *contractStore) Init() (err error) {
 	if cs.abiCache, err = lru.New(cacheSize); err != nil {
 		return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayResourceErr, err)
 	}
+	if cs.proxyCache, err = lru.New(DefaultProxyCacheSize); err != nil {
+		return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayResourceErr, err)
+	}
+	if cs.nonProxies, err = lru.New(DefaultProxyCacheSize); err != nil {
+		return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayResourceErr, err)
+	}
 	ldbName := cs.conf.LevelDBName
 	if ldbName != "" {
 		ldbName = DefaultLevelDBName
@@ -333,6 +347,7 @@ func (cs *contractStore) Init() (err error) {
 		return err
 	}
 	cs.migrateFilesToLevelDB()
+	cs.indexStoredEventSignatures()
 	return cs.rr.Init()
 }
 
@@ -0,0 +1,94 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contractregistry
+
+import (
+	"fmt"
+	"strings"
+
+	ethconnecterrors "github.com/hyperledger/firefly-ethconnect/internal/errors"
+	"github.com/hyperledger/firefly-ethconnect/internal/ethbind"
+	"github.com/hyperledger/firefly-ethconnect/internal/kvstore"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	log "github.com/sirupsen/logrus"
+)
+
+const ldbEventSignaturePrefix = "event_signature"
+
+// storedEventSignature indexes an event in a local ABI by its signature hash, which is the
+// first topic of the logs it emits
+type storedEventSignature struct {
+	ABIID string                           `json:"abiId"`
+	Event *ethbinding.ABIElementMarshaling `json:"event"`
+}
+
+func eventSignatureKey(topic string) string {
+	return fmt.Sprintf("%s/%s", ldbEventSignaturePrefix, strings.TrimPrefix(strings.ToLower(topic), "0x"))
+}
+
+// indexEventSignatures records the events of a local ABI by signature. When two ABIs contain an
+// event with the same signature, the most recently added one is used, unless onlyNew is set.
+func (cs *contractStore) indexEventSignatures(abiID string, abi ethbinding.ABIMarshaling, onlyNew bool) {
+	for i := range abi {
+		element := abi[i]
+		if element.Type != "event" || element.Anonymous {
+			continue
+		}
+		event, err := ethbind.API.ABIElementMarshalingToABIEvent(&element)
+		if err != nil {
+			log.Warnf("%s: Unable to index event '%s': %s", abiID, element.Name, err)
+			continue
+		}
+		key := eventSignatureKey(event.ID.Hex())
+		if onlyNew {
+			if _, err := cs.db.Get(key); err == nil {
+				continue
+			}
+		}
+		if err := cs.db.PutJSON(key, &storedEventSignature{ABIID: abiID, Event: &element}); err != nil {
+			log.Errorf("%s: Failed to index event '%s': %s", abiID, element.Name, err)
+		}
+	}
+}
+
+// indexStoredEventSignatures indexes the events of ABIs that were stored before the index existed
+func (cs *contractStore) indexStoredEventSignatures() {
+	it := cs.db.NewIteratorWithRange(&kvstore.Range{
+		Start: []byte(ldbABIIDPrefix + "/"),
+		Limit: []byte(ldbABIIDPrefix + "0"),
+	})
+	defer it.Release()
+	for it.Next() {
+		var storedABI StoredABI
+		if err := it.ValueJSON(&storedABI); err != nil || storedABI.DeployMsg == nil {
+			continue
+		}
+		cs.indexEventSignatures(storedABI.ID, storedABI.DeployMsg.ABI, true)
+	}
+}
+
+// GetEventBySignature returns the definition of an event in a local ABI, from the signature hash that
+// is the first topic of the logs it emits
+func (cs *contractStore) GetEventBySignature(topic string) (*ethbinding.ABIElementMarshaling, error) {
+	var stored storedEventSignature
+	err := cs.db.GetJSON(eventSignatureKey(topic), &stored)
+	if err == kvstore.ErrorNotFound {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayEventSignatureNotFound, topic)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stored.Event, nil
+}
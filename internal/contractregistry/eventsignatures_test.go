@@ -0,0 +1,77 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contractregistry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/ethbind"
+	"github.com/hyperledger/firefly-ethconnect/internal/messages"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func testEventABI(name string) ethbinding.ABIMarshaling {
+	return ethbinding.ABIMarshaling{
+		{Type: "function", Name: "set", Inputs: []ethbinding.ABIArgumentMarshaling{{Name: "x", Type: "uint256"}}},
+		{Type: "event", Name: "Changed", Inputs: []ethbinding.ABIArgumentMarshaling{{Name: name, Type: "uint256"}}},
+		{Type: "event", Name: "Hidden", Anonymous: true},
+	}
+}
+
+func TestGetEventBySignature(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	cs := NewContractStore(&ContractStoreConf{StoragePath: dir}, &mockRR{})
+	err := cs.Init()
+	assert.NoError(err)
+	defer cs.Close()
+
+	abi := testEventABI("first")
+	event, err := ethbind.API.ABIElementMarshalingToABIEvent(&abi[1])
+	assert.NoError(err)
+	topic := event.ID.Hex()
+
+	_, err = cs.GetEventBySignature(topic)
+	assert.Regexp("FFEC100269", err)
+
+	_, err = cs.(*contractStore).AddABI("abi1", &messages.DeployContract{ABI: abi}, time.Now())
+	assert.NoError(err)
+	element, err := cs.GetEventBySignature(topic)
+	assert.NoError(err)
+	assert.Equal("first", element.Inputs[0].Name)
+
+	// The most recently added ABI is used
+	_, err = cs.(*contractStore).AddABI("abi2", &messages.DeployContract{ABI: testEventABI("second")}, time.Now())
+	assert.NoError(err)
+	element, err = cs.GetEventBySignature(topic)
+	assert.NoError(err)
+	assert.Equal("second", element.Inputs[0].Name)
+
+	// Indexing the stored ABIs does not replace an indexed event, but adds a missing one
+	cs.(*contractStore).indexStoredEventSignatures()
+	element, err = cs.GetEventBySignature(topic)
+	assert.NoError(err)
+	assert.Equal("second", element.Inputs[0].Name)
+
+	cs.(*contractStore).db.Delete(eventSignatureKey(topic))
+	cs.(*contractStore).indexStoredEventSignatures()
+	element, err = cs.GetEventBySignature(topic)
+	assert.NoError(err)
+	assert.Equal("first", element.Inputs[0].Name)
+}
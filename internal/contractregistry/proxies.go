@@ -0,0 +1,104 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contractregistry
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/eth"
+	"github.com/hyperledger/firefly-ethconnect/internal/ethbind"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultProxyCacheSize is the number of proxy implementations at historical blocks we hold in a LRU cache
+const DefaultProxyCacheSize = 1000
+
+// LatestProxyCacheTTL is how long the result of checking a contract for a proxy at the head of the chain
+// is assumed to hold, before it is checked again
+const LatestProxyCacheTTL = 1 * time.Minute
+
+var hexBlockNumber = regexp.MustCompile(`^0x[0-9a-fA-F]+$`)
+
+// latestImplementation is the implementation of a proxy at the head of the chain, which can change
+type latestImplementation struct {
+	implHexNo0x string
+	expiry      time.Time
+}
+
+// GetImplementationContract returns the contract registered at the implementation address of an
+// EIP-1967 or EIP-1822 proxy at a block, so the ABI of the implementation is used even after the
+// proxy is upgraded. Returns nil if the contract is not a proxy, or its implementation at that block
+// is not registered. The block number must be in JSON/RPC form, such as "latest" or "0x1b".
+func (cs *contractStore) GetImplementationContract(ctx context.Context, rpc eth.RPCClient, addrHex, blockNumber string) (*ContractInfo, error) {
+	addrHexNo0x := strings.TrimPrefix(strings.ToLower(addrHex), "0x")
+	implHexNo0x, err := cs.getProxyImplementation(ctx, rpc, addrHexNo0x, blockNumber)
+	if err != nil || implHexNo0x == "" {
+		return nil, err
+	}
+	info, err := cs.GetContractByAddress(implHexNo0x)
+	if err != nil {
+		log.Infof("Implementation 0x%s of proxy 0x%s at block %s is not registered: %s", implHexNo0x, addrHexNo0x, blockNumber, err)
+		return nil, nil
+	}
+	return info, nil
+}
+
+// getProxyImplementation returns the implementation address of a proxy at a block, or an empty string
+// if the contract is not a proxy. The implementation at a historical block cannot change, so it is
+// cached. The implementation at the head of the chain is cached for a short time, so repeated lookups
+// do not each make calls, as is a contract that is not a proxy at the head of the chain - which is then
+// assumed not to be one at any block. Those expire, as the proxy might be upgraded, or the contract
+// redeployed as a proxy, in a later block.
+func (cs *contractStore) getProxyImplementation(ctx context.Context, rpc eth.RPCClient, addrHexNo0x, blockNumber string) (string, error) {
+	if expiry, notProxy := cs.nonProxies.Get(addrHexNo0x); notProxy {
+		if time.Now().Before(expiry.(time.Time)) {
+			return "", nil
+		}
+		cs.nonProxies.Remove(addrHexNo0x)
+	}
+	historical := hexBlockNumber.MatchString(blockNumber)
+	key := addrHexNo0x + "/" + strings.ToLower(blockNumber)
+	if cached, ok := cs.proxyCache.Get(key); ok {
+		if latest, isLatest := cached.(*latestImplementation); !isLatest {
+			return cached.(string), nil
+		} else if time.Now().Before(latest.expiry) {
+			return latest.implHexNo0x, nil
+		}
+		cs.proxyCache.Remove(key)
+	}
+
+	addr := ethbind.API.HexToAddress("0x" + addrHexNo0x)
+	impl, err := eth.GetProxyImplementation(ctx, rpc, &addr, blockNumber)
+	if err != nil {
+		return "", err
+	}
+	implHexNo0x := ""
+	if impl != nil {
+		implHexNo0x = strings.TrimPrefix(strings.ToLower(impl.String()), "0x")
+	}
+	switch {
+	case historical:
+		cs.proxyCache.Add(key, implHexNo0x)
+	case blockNumber != "latest":
+	case implHexNo0x == "":
+		cs.nonProxies.Add(addrHexNo0x, time.Now().Add(LatestProxyCacheTTL))
+	default:
+		cs.proxyCache.Add(key, &latestImplementation{implHexNo0x: implHexNo0x, expiry: time.Now().Add(LatestProxyCacheTTL)})
+	}
+	return implHexNo0x, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contractregistry
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/eth"
+	"github.com/hyperledger/firefly-ethconnect/mocks/ethmocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const (
+	testProxyAddr = "0123456789abcdef0123456789abcdef01234567"
+	testImplV1    = "d50ce736021d9f7b0b2566a3d2fa7fa3136c003c"
+	testImplV2    = "1111111111111111111111111111111111111111"
+)
+
+func mockStorageAt(rpc *ethmocks.RPCClient, slot, blockNumber, value string) *mock.Call {
+	return rpc.On("CallContext", mock.Anything, mock.Anything, "eth_getStorageAt", mock.Anything, slot, blockNumber).
+		Run(func(args mock.Arguments) {
+			*(args[1].(*string)) = value
+		}).Return(nil)
+}
+
+func slotValue(addrHexNo0x string) string {
+	return "0x000000000000000000000000" + addrHexNo0x
+}
+
+func TestGetImplementationContract(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	cs := NewContractStore(&ContractStoreConf{StoragePath: dir}, &mockRR{})
+	err := cs.Init()
+	assert.NoError(err)
+	defer cs.Close()
+	_, err = cs.AddContract(testImplV1, "abi1", "impl1", "")
+	assert.NoError(err)
+
+	// The implementation at a historical block is cached
+	rpc := &ethmocks.RPCClient{}
+	mockStorageAt(rpc, eth.EIP1967ImplementationSlot, "0x10", slotValue(testImplV1)).Once()
+	for i := 0; i < 2; i++ {
+		info, err := cs.GetImplementationContract(context.Background(), rpc, "0x"+testProxyAddr, "0x10")
+		assert.NoError(err)
+		assert.Equal("abi1", info.ABI)
+	}
+
+	// The implementation at the head of the chain is not registered, and is cached for a short time
+	mockStorageAt(rpc, eth.EIP1967ImplementationSlot, "latest", slotValue(testImplV2)).Once()
+	for i := 0; i < 2; i++ {
+		info, err := cs.GetImplementationContract(context.Background(), rpc, testProxyAddr, "latest")
+		assert.NoError(err)
+		assert.Nil(info)
+	}
+	rpc.AssertExpectations(t)
+
+	// Once that expires, the proxy is checked again, as it might have been upgraded
+	cs.(*contractStore).proxyCache.Add(testProxyAddr+"/latest", &latestImplementation{implHexNo0x: testImplV2, expiry: time.Now().Add(-1 * time.Second)})
+	mockStorageAt(rpc, eth.EIP1967ImplementationSlot, "latest", slotValue(testImplV1)).Once()
+	info, err := cs.GetImplementationContract(context.Background(), rpc, testProxyAddr, "latest")
+	assert.NoError(err)
+	assert.Equal("abi1", info.ABI)
+	rpc.AssertExpectations(t)
+}
+
+func TestGetImplementationContractNotProxy(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	cs := NewContractStore(&ContractStoreConf{StoragePath: dir}, &mockRR{})
+	err := cs.Init()
+	assert.NoError(err)
+	defer cs.Close()
+
+	// Once a contract is found not to be a proxy at the head of the chain, it is not checked again
+	rpc := &ethmocks.RPCClient{}
+	mockStorageAt(rpc, mock.Anything, "latest", "0x0000000000000000000000000000000000000000000000000000000000000000").Twice()
+	for i := 0; i < 2; i++ {
+		info, err := cs.GetImplementationContract(context.Background(), rpc, testProxyAddr, "latest")
+		assert.NoError(err)
+		assert.Nil(info)
+	}
+	info, err := cs.GetImplementationContract(context.Background(), rpc, testProxyAddr, "0x10")
+	assert.NoError(err)
+	assert.Nil(info)
+	rpc.AssertExpectations(t)
+
+	// Once that expires, the contract is checked again, as it might have become a proxy
+	cs.(*contractStore).nonProxies.Add(testProxyAddr, time.Now().Add(-1*time.Second))
+	mockStorageAt(rpc, eth.EIP1967ImplementationSlot, "0x20", slotValue(testImplV1)).Once()
+	_, err = cs.GetImplementationContract(context.Background(), rpc, testProxyAddr, "0x20")
+	assert.NoError(err)
+	rpc.AssertExpectations(t)
+}
+
+func TestGetImplementationContractFail(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	cs := NewContractStore(&ContractStoreConf{StoragePath: dir}, &mockRR{})
+	err := cs.Init()
+	assert.NoError(err)
+	defer cs.Close()
+
+	rpc := &ethmocks.RPCClient{}
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_getStorageAt", mock.Anything, mock.Anything, "0x10").Return(fmt.Errorf("pop"))
+	_, err = cs.GetImplementationContract(context.Background(), rpc, testProxyAddr, "0x10")
+	assert.Regexp("eth_getStorageAt returned: pop", err)
+}
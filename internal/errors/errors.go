@@ -154,7 +154,7 @@ var (
 	// EventStreamsCannotUpdateType cannot change tyep
 	EventStreamsCannotUpdateType = e(100050, "The type of an event stream cannot be changed")
 	// EventStreamsInvalidDistributionMode unknown distribution mode
-	EventStreamsInvalidDistributionMode = e(100051, "Invalid distribution mode '%s'. Valid distribution modes are: 'workloadDistribution' and 'broadcast'.")
+	EventStreamsInvalidDistributionMode = e(100051, "Invalid distribution mode '%s'. Valid distribution modes are: 'workloadDistribution', 'broadcast' and 'consumerGroup'.")
 	// EventStreamsUpdateAlreadyInProgress update already in progress
 	EventStreamsUpdateAlreadyInProgress = e(100052, "Update to event stream already in progress")
 
@@ -530,6 +530,111 @@ var (
 	CompilerFailedVersion = e(100225, "Failed to invoke solc binary '%s' to check version: %s")
 	// CompilerFailedVersionRegex failed to extract version from output
 	CompilerFailedVersionRegex = e(100226, "Failed to extract version from solc '%s' output: %s")
+
+	// EventStreamsDeadLetterNotFound dead letter not found
+	EventStreamsDeadLetterNotFound = e(100227, "Dead letter with ID '%s' not found")
+	// EventStreamsDeadLetterStoreFailed problem saving a dead letter to our DB
+	EventStreamsDeadLetterStoreFailed = e(100228, "Failed to store dead letter: %s")
+	// EventQueryBadBlock the fromBlock or toBlock of a historical event query is invalid
+	EventQueryBadBlock = e(100229, "Invalid %s '%s' for event query")
+	// EventQueryBadBlockRange the fromBlock of a historical event query is after the toBlock
+	EventQueryBadBlockRange = e(100230, "Invalid block range for event query: fromBlock=%s toBlock=%s")
+	// EventQueryBadLimit the limit of a historical event query is not a positive number
+	EventQueryBadLimit = e(100231, "Invalid limit '%s' for event query")
+	// RESTGatewayUnknownOperation the operation on the method or event in the path is not supported
+	RESTGatewayUnknownOperation = e(100232, "Unknown operation '%s'")
+	// EventStreamsSSENotSSEStream attempt to connect to a stream that does not have the SSE action
+	EventStreamsSSENotSSEStream = e(100233, "Event stream '%s' is not of type 'sse'")
+	// EventStreamsSSEStreamingUnsupported the HTTP response cannot be flushed for each event
+	EventStreamsSSEStreamingUnsupported = e(100234, "Streaming is not supported for this connection")
+	// EventStreamsSSEAckNotInFlight the batch acknowledged by the client is not the one awaiting acknowledgement
+	EventStreamsSSEAckNotInFlight = e(100235, "Batch '%s' is not awaiting acknowledgement on event stream '%s'")
+	// EventStreamsSSEInterruptedSend When we are interrupted waiting for a client to connect
+	EventStreamsSSEInterruptedSend = e(100236, "Interrupted waiting for SSE connection to send event")
+	// EventStreamsSSEInterruptedReceive When we are interrupted waiting for an acknowledgment
+	EventStreamsSSEInterruptedReceive = e(100237, "Interrupted waiting for SSE acknowledgment")
+	// RESTGatewaySSEAckInvalid the body of an SSE acknowledgement could not be parsed
+	RESTGatewaySSEAckInvalid = e(100238, "Invalid SSE acknowledgement: %s")
+	// EventStreamsPushSubscriptionClosed the node closed an eth_subscribe subscription without an error
+	EventStreamsPushSubscriptionClosed = e(100239, "eth_subscribe subscription closed")
+	// EventStreamsConfirmationsInvalid a negative confirmation count was supplied for a stream or subscription
+	EventStreamsConfirmationsInvalid = e(100240, "Invalid confirmations count %d - must be zero or more")
+	// EventStreamsConfirmationsDisabled confirmations were requested, but the block confirmation manager is not enabled
+	EventStreamsConfirmationsDisabled = e(100241, "Confirmations cannot be required for a stream or subscription, as block confirmations are not enabled")
+	// EventStreamsSubscribeBadKind an unknown kind of subscription was requested
+	EventStreamsSubscribeBadKind = e(100242, "Unknown subscription kind '%s' - must be 'events', 'blocks', 'transactions' or 'receipts'")
+	// EventStreamsSubscribeKindNoEvent an event was supplied for a subscription to blocks or transactions
+	EventStreamsSubscribeKindNoEvent = e(100243, "An event cannot be specified for a subscription of kind '%s'")
+	// EventStreamsExportFailed failed to read an entry from the events DB during export
+	EventStreamsExportFailed = e(100244, "Failed to export '%s': %s")
+	// EventStreamsImportInvalid the import document failed validation, so nothing was imported
+	EventStreamsImportInvalid = e(100245, "Import failed validation: %s")
+	// EventStreamsImportBadConflictMode an unknown conflict handling mode was requested for an import
+	EventStreamsImportBadConflictMode = e(100246, "Unknown conflict handling '%s' - must be 'fail', 'skip' or 'replace'")
+	// EventStreamsImportBadID an entry in an import has an ID without the expected prefix
+	EventStreamsImportBadID = e(100247, "Invalid ID '%s' - must start with '%s'")
+	// EventStreamsImportConflict an entry in an import already exists, and the conflict handling is 'fail'
+	EventStreamsImportConflict = e(100248, "'%s' already exists")
+	// EventStreamsImportCheckpointNoStream a checkpoint in an import is for a stream that is not in the import
+	EventStreamsImportCheckpointNoStream = e(100249, "Checkpoint for stream '%s' does not have a matching stream in the import")
+	// RESTGatewayImportInvalid the body of an import could not be parsed
+	RESTGatewayImportInvalid = e(100250, "Invalid import document: %s")
+	// EventStreamsWebhookTLSConfig the TLS configuration of a webhook could not be loaded
+	EventStreamsWebhookTLSConfig = e(100251, "Invalid TLS configuration for webhook: %s")
+	// EventStreamsWebhookOAuth2Config the OAuth2 configuration of a webhook is incomplete
+	EventStreamsWebhookOAuth2Config = e(100252, "Must specify webhook.oauth2.tokenUrl and webhook.oauth2.clientId for OAuth2")
+	// EventStreamsWebhookOAuth2TokenFailed the token endpoint did not return an access token
+	EventStreamsWebhookOAuth2TokenFailed = e(100253, "Failed to obtain OAuth2 token from %s: %s")
+	// EventStreamsWebhookBadFormat an unknown payload format was requested for a webhook
+	EventStreamsWebhookBadFormat = e(100254, "Unknown webhook format '%s' - must be 'array', 'event', 'cloudevents' or 'template'")
+	// EventStreamsWebhookBadTemplate the payload template of a webhook could not be parsed
+	EventStreamsWebhookBadTemplate = e(100255, "Invalid webhook template: %s")
+	// EventStreamsWebhookTemplateFailed the payload template of a webhook could not be applied to an event
+	EventStreamsWebhookTemplateFailed = e(100256, "Failed to apply webhook template to event %s: %s")
+	// EventStreamsActionPluginType a plugin was registered for a stream type that is built-in
+	EventStreamsActionPluginType = e(100257, "Stream type '%s' cannot be provided by a plugin")
+	// EventStreamsActionPluginConfig the plugin of a stream type rejected the configuration of a stream
+	EventStreamsActionPluginConfig = e(100258, "Invalid configuration for stream type '%s': %s")
+	// EventStreamsActionPluginFailed the plugin of a stream type failed to create the action for a stream
+	EventStreamsActionPluginFailed = e(100259, "Failed to create action for stream type '%s': %s")
+	// EventStreamActionPluginLoad failed to load the .so of an event stream action plugin
+	EventStreamActionPluginLoad = e(100275, "Failed to load EventStreamActionPlugin '%s': %s")
+	// EventStreamActionPluginSymbol missing symbol in plugin
+	EventStreamActionPluginSymbol = e(100260, "Failed to load 'EventStreamActionPlugin' symbol from '%s': %s")
+	// EventStreamsReplayBadKind a replay was requested for a subscription that is not to events
+	EventStreamsReplayBadKind = e(100261, "Replay is only supported for subscriptions to events, not '%s'")
+	// EventStreamsReplayNoStream a replay was requested without a stream to deliver the events to
+	EventStreamsReplayNoStream = e(100262, "A stream must be provided to receive the replayed events")
+	// EventStreamsReplayBadStreamType a replay was requested to a type of stream that cannot be temporary
+	EventStreamsReplayBadStreamType = e(100263, "Stream type '%s' is not supported for replays")
+	// EventStreamsReplayNotFound the replay ID does not exist
+	EventStreamsReplayNotFound = e(100264, "Replay with ID '%s' not found")
+	// EventStreamsReplayCancelled the replay was cancelled before it completed
+	EventStreamsReplayCancelled = e(100265, "Replay cancelled")
+	// EventStreamsWebSocketNoConsumerGroup the consumer group distribution mode was used without a group
+	EventStreamsWebSocketNoConsumerGroup = e(100266, "A consumer group must be provided for the 'consumerGroup' distribution mode")
+	// EventStreamsInvalidBatchOrdering unknown batch ordering
+	EventStreamsInvalidBatchOrdering = e(100267, "Invalid batch ordering '%s'. Valid batch orderings are: 'subscription' and 'address'")
+	// EventStreamsPipelinedPersistBatches persisted batches are replayed one at a time, so cannot be pipelined
+	EventStreamsPipelinedPersistBatches = e(100268, "Multiple in-flight batches cannot be combined with persisted batches")
+	// RESTGatewayEventSignatureNotFound no local ABI contains an event with the signature
+	RESTGatewayEventSignatureNotFound = e(100269, "No ABI found with an event with signature %s")
+	// EventStreamsSubscribeRawNoFilter a subscription without an event ABI would match every log on the chain
+	EventStreamsSubscribeRawNoFilter = e(100270, "A subscription without an event requires an address or topics to filter on")
+	// EventStreamsSubscribeEventAndTopics topics were provided for a subscription with an event ABI
+	EventStreamsSubscribeEventAndTopics = e(100271, "Topics can only be provided for a subscription without an event")
+	// EventStreamsReceiptStoreUnavailable a subscription to receipts was started before the receipt store was available
+	EventStreamsReceiptStoreUnavailable = e(100272, "The receipt store is not available to restore the subscription to receipts")
+	// EventStreamsReceiptStoreQueryFailed the receipts received since the checkpoint of a subscription could not be read
+	EventStreamsReceiptStoreQueryFailed = e(100273, "Failed to read the receipts received since %d from the receipt store: %s")
+	// EventStreamsWebhookRedactedSecret a stream was created with the placeholder the API returns for a secret
+	EventStreamsWebhookRedactedSecret = e(100274, "The placeholder '%s' returned by the API for a secret cannot be used as a secret")
+	// EventStreamsPipelinedUncorrelatedAcks the stream type cannot tell apart the acknowledgements of concurrent batches
+	EventStreamsPipelinedUncorrelatedAcks = e(100276, "Multiple in-flight batches are not supported for stream type '%s'. Use a webhook, or a websocket with the 'consumerGroup' distribution mode")
+	// EventStreamsSharedLogsProvisional a stream requested provisional notifications, which cannot be retracted when logs are read with eth_getLogs
+	EventStreamsSharedLogsProvisional = e(100277, "Provisional notifications are not supported when shared log fetching is enabled")
+	// RESTGatewayReplayInvalid the body of a replay request could not be parsed
+	RESTGatewayReplayInvalid = e(100278, "Invalid replay request: %s")
 )
 
 type EthconnectError interface {
@@ -0,0 +1,54 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+	"time"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/errors"
+	"github.com/hyperledger/firefly-ethconnect/internal/ethbind"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// EIP1967ImplementationSlot is the storage slot of the implementation address of an EIP-1967 proxy,
+	// bytes32(uint256(keccak256('eip1967.proxy.implementation')) - 1)
+	EIP1967ImplementationSlot = "0x360894a13ba1a3210667c828492db98dca3e2076cc3735a920a3ca505d382bbc"
+	// EIP1822ImplementationSlot is the storage slot of the implementation address of an EIP-1822 (UUPS) proxy,
+	// keccak256("PROXIABLE")
+	EIP1822ImplementationSlot = "0xc5f16f0fcc639fa48a6947836d9850f504798523bf8c9a3a87d5876cf622bcf7"
+)
+
+// GetProxyImplementation reads the implementation slots of a contract at a block, and returns the
+// address of the implementation if the contract is an EIP-1967 or EIP-1822 proxy, or nil if it is not
+func GetProxyImplementation(ctx context.Context, rpc RPCClient, addr *ethbinding.Address, blockNumber string) (*ethbinding.Address, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	for _, slot := range []string{EIP1967ImplementationSlot, EIP1822ImplementationSlot} {
+		var value string
+		if err := rpc.CallContext(ctx, &value, "eth_getStorageAt", addr, slot, blockNumber); err != nil {
+			return nil, errors.Errorf(errors.RPCCallReturnedError, "eth_getStorageAt", err)
+		}
+		impl := ethbind.API.BytesToAddress(ethbind.API.FromHex(value))
+		if impl != (ethbinding.Address{}) {
+			log.Debugf("Proxy %s implementation at block %s: %s", addr.String(), blockNumber, impl.String())
+			return &impl, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/ethbind"
+	"github.com/stretchr/testify/assert"
+)
+
+const zeroSlot = "0x0000000000000000000000000000000000000000000000000000000000000000"
+
+func TestGetProxyImplementationEIP1967(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &testRPCClient{
+		resultWrangler: func(result interface{}) {
+			*(result.(*string)) = "0x000000000000000000000000d50ce736021d9f7b0b2566a3d2fa7fa3136c003c"
+		},
+	}
+	addr := ethbind.API.HexToAddress("0x0123456789abcDEF0123456789abCDef01234567")
+	impl, err := GetProxyImplementation(context.Background(), r, &addr, "0x1b")
+	assert.NoError(err)
+	assert.Equal("0xD50ce736021D9F7B0B2566a3D2FA7FA3136C003C", impl.String())
+	assert.Equal("eth_getStorageAt", r.capturedMethod)
+	assert.Equal([]interface{}{&addr, EIP1967ImplementationSlot, "0x1b"}, r.capturedArgs)
+	assert.Empty(r.capturedMethod2)
+}
+
+func TestGetProxyImplementationEIP1822(t *testing.T) {
+	assert := assert.New(t)
+
+	var r *testRPCClient
+	r = &testRPCClient{
+		resultWrangler: func(result interface{}) {
+			if r.capturedMethod2 == "" {
+				*(result.(*string)) = zeroSlot
+			} else {
+				*(result.(*string)) = "0x000000000000000000000000d50ce736021d9f7b0b2566a3d2fa7fa3136c003c"
+			}
+		},
+	}
+	addr := ethbind.API.HexToAddress("0x0123456789abcDEF0123456789abCDef01234567")
+	impl, err := GetProxyImplementation(context.Background(), r, &addr, "latest")
+	assert.NoError(err)
+	assert.Equal("0xD50ce736021D9F7B0B2566a3D2FA7FA3136C003C", impl.String())
+	assert.Equal([]interface{}{&addr, EIP1822ImplementationSlot, "latest"}, r.capturedArgs2)
+}
+
+func TestGetProxyImplementationNotProxy(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &testRPCClient{
+		resultWrangler: func(result interface{}) {
+			*(result.(*string)) = zeroSlot
+		},
+	}
+	addr := ethbind.API.HexToAddress("0x0123456789abcDEF0123456789abCDef01234567")
+	impl, err := GetProxyImplementation(context.Background(), r, &addr, "latest")
+	assert.NoError(err)
+	assert.Nil(impl)
+}
+
+func TestGetProxyImplementationFail(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &testRPCClient{
+		mockError: fmt.Errorf("pop"),
+	}
+	addr := ethbind.API.HexToAddress("0x0123456789abcDEF0123456789abCDef01234567")
+	_, err := GetProxyImplementation(context.Background(), r, &addr, "latest")
+	assert.Regexp("eth_getStorageAt returned: pop", err)
+}
+
+func TestRPCBlockNumber(t *testing.T) {
+	assert := assert.New(t)
+
+	for in, out := range map[string]string{"": "latest", "latest": "latest", "pending": "pending", "0xab23": "0xab23", "12345": "0x3039"} {
+		blockNumber, err := RPCBlockNumber(in)
+		assert.NoError(err)
+		assert.Equal(out, blockNumber)
+	}
+	_, err := RPCBlockNumber("banana")
+	assert.Regexp("FFEC100", err)
+}
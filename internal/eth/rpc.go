@@ -18,6 +18,7 @@ import (
 	"context"
 	"net/url"
 	"os"
+	"reflect"
 
 	"github.com/hyperledger/firefly-ethconnect/internal/auth"
 	"github.com/hyperledger/firefly-ethconnect/internal/errors"
@@ -53,7 +54,20 @@ func RPCConnect(conf *RPCConnOpts) (RPCClientAll, error) {
 	}
 	log.Infof("New JSON/RPC connection established")
 	log.Debugf("JSON/RPC connected to %s", u)
-	return &rpcWrapper{rpc: rpcClient}, nil
+	return &rpcWrapper{
+		rpc:           rpcClient,
+		subscriptions: u != nil && (u.Scheme == "ws" || u.Scheme == "wss"),
+	}, nil
+}
+
+// SubscriptionClient returns the async interface of the client, if it is connected over
+// a websocket transport that supports push notifications via eth_subscribe, or nil if
+// the caller must poll
+func SubscriptionClient(rpc RPCClient) RPCClientAsync {
+	if w, ok := rpc.(*rpcWrapper); ok && w.subscriptions {
+		return w
+	}
+	return nil
 }
 
 // CobraInitRPC sets the standard command-line parameters for RPC
@@ -70,7 +84,8 @@ type rcpClient interface {
 }
 
 type rpcWrapper struct {
-	rpc rcpClient
+	rpc           rcpClient
+	subscriptions bool
 }
 
 // RPCClientSubscription local alias type for ClientSubscription
@@ -102,6 +117,45 @@ func (w *rpcWrapper) CallContext(ctx context.Context, result interface{}, method
 	return err
 }
 
+// BatchCallContext sends the requests as a single JSON/RPC batch. The batch type of the underlying
+// client is built by reflection, so that this package does not need to link the go-ethereum types
+func (w *rpcWrapper) BatchCallContext(ctx context.Context, b []BatchElem) error {
+	for _, elem := range b {
+		if err := auth.AuthRPC(ctx, elem.Method, elem.Args...); err != nil {
+			log.Errorf("JSON/RPC %s - not authorized: %s", elem.Method, err)
+			return errors.Errorf(errors.Unauthorized)
+		}
+	}
+	batchCall := reflect.ValueOf(w.rpc).MethodByName("BatchCallContext")
+	if !batchCall.IsValid() || batchCall.Type().NumIn() != 2 || batchCall.Type().In(1).Kind() != reflect.Slice {
+		for i := range b {
+			b[i].Error = w.rpc.CallContext(ctx, b[i].Result, b[i].Method, b[i].Args...)
+		}
+		return nil
+	}
+	batch := reflect.MakeSlice(batchCall.Type().In(1), len(b), len(b))
+	for i, elem := range b {
+		be := batch.Index(i)
+		be.FieldByName("Method").SetString(elem.Method)
+		be.FieldByName("Args").Set(reflect.ValueOf(elem.Args))
+		if elem.Result != nil {
+			be.FieldByName("Result").Set(reflect.ValueOf(elem.Result))
+		}
+	}
+	log.Tracef("RPC batch --> %d requests", len(b))
+	ret := batchCall.Call([]reflect.Value{reflect.ValueOf(ctx), batch})
+	for i := range b {
+		if errVal := batch.Index(i).FieldByName("Error"); !errVal.IsNil() {
+			b[i].Error = errVal.Interface().(error)
+		}
+	}
+	log.Tracef("RPC batch <-- %d results", len(b))
+	if !ret[0].IsNil() {
+		return ret[0].Interface().(error)
+	}
+	return nil
+}
+
 func (w *rpcWrapper) Subscribe(ctx context.Context, namespace string, channel interface{}, args ...interface{}) (RPCClientSubscription, error) {
 	if err := auth.AuthRPCSubscribe(ctx, namespace, channel, args...); err != nil {
 		log.Errorf("JSON/RPC Subscribe - not authorized: %s", err)
@@ -132,6 +186,31 @@ type RPCClient interface {
 	CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error
 }
 
+// BatchElem is one request in a JSON/RPC batch. Error is set if that request failed
+type BatchElem struct {
+	Method string
+	Args   []interface{}
+	Result interface{}
+	Error  error
+}
+
+// RPCClientBatch is implemented by clients that can send multiple requests in a single JSON/RPC batch
+type RPCClientBatch interface {
+	BatchCallContext(ctx context.Context, b []BatchElem) error
+}
+
+// BatchCall sends the requests in a single JSON/RPC batch if the client supports it, or one at a time
+// if it does not. The error returned is for the batch as a whole, and each request has its own error
+func BatchCall(ctx context.Context, rpc RPCClient, b []BatchElem) error {
+	if bc, ok := rpc.(RPCClientBatch); ok && len(b) > 0 {
+		return bc.BatchCallContext(ctx, b)
+	}
+	for i := range b {
+		b[i].Error = rpc.CallContext(ctx, b[i].Result, b[i].Method, b[i].Args...)
+	}
+	return nil
+}
+
 // RPCClientAsync refers to the async functions from the ethereum RPC client that we use
 type RPCClientAsync interface {
 	Subscribe(ctx context.Context, namespace string, channel interface{}, args ...interface{}) (RPCClientSubscription, error)
@@ -16,6 +16,9 @@ package eth
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
@@ -113,6 +116,20 @@ func TestRPCConnectFail(t *testing.T) {
 	assert.Error(err)
 }
 
+func TestSubscriptionClient(t *testing.T) {
+	assert := assert.New(t)
+	router := &httprouter.Router{}
+	testSvr := httptest.NewServer(router)
+	defer testSvr.Close()
+
+	rpc, err := RPCConnect(&RPCConnOpts{URL: testSvr.URL})
+	assert.NoError(err)
+	assert.Nil(SubscriptionClient(rpc))
+
+	w := &rpcWrapper{rpc: &mockEthClient{}, subscriptions: true}
+	assert.Equal(w, SubscriptionClient(w))
+}
+
 func TestSubscribeWrapper(t *testing.T) {
 	assert := assert.New(t)
 	ms := &mockRPCSubscription{
@@ -138,3 +155,65 @@ func TestCallContextWrapperAuth(t *testing.T) {
 
 	auth.RegisterSecurityModule(nil)
 }
+
+func TestBatchCallContext(t *testing.T) {
+	assert := assert.New(t)
+	testSvr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		var batch []map[string]interface{}
+		err := json.NewDecoder(req.Body).Decode(&batch)
+		assert.NoError(err)
+		results := make([]map[string]interface{}, len(batch))
+		for i, r := range batch {
+			results[i] = map[string]interface{}{"jsonrpc": "2.0", "id": r["id"]}
+			if r["method"] == "eth_fail" {
+				results[i]["error"] = map[string]interface{}{"code": -32000, "message": "pop"}
+			} else {
+				results[i]["result"] = r["params"].([]interface{})[0]
+			}
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(results)
+	}))
+	defer testSvr.Close()
+
+	rpc, err := RPCConnect(&RPCConnOpts{URL: testSvr.URL})
+	assert.NoError(err)
+	var r1, r2 string
+	b := []BatchElem{
+		{Method: "eth_echo", Args: []interface{}{"one"}, Result: &r1},
+		{Method: "eth_fail", Args: []interface{}{"two"}, Result: &r2},
+	}
+	err = BatchCall(context.Background(), rpc, b)
+	assert.NoError(err)
+	assert.Equal("one", r1)
+	assert.NoError(b[0].Error)
+	assert.Regexp("pop", b[1].Error)
+	assert.Empty(r2)
+}
+
+func TestBatchCallContextFallback(t *testing.T) {
+	assert := assert.New(t)
+
+	w := &rpcWrapper{rpc: &mockEthClient{}}
+	b := []BatchElem{{Method: "eth_echo"}, {Method: "eth_echo"}}
+	err := BatchCall(context.Background(), w, b)
+	assert.NoError(err)
+
+	rpc := &testRPCClient{mockError: fmt.Errorf("pop"), mockError2: fmt.Errorf("pop")}
+	err = BatchCall(context.Background(), rpc, b)
+	assert.NoError(err)
+	assert.Regexp("pop", b[0].Error)
+	assert.Regexp("pop", b[1].Error)
+}
+
+func TestBatchCallContextAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	auth.RegisterSecurityModule(&authtest.TestSecurityModule{})
+
+	w := &rpcWrapper{rpc: &mockEthClient{}}
+	err := w.BatchCallContext(context.Background(), []BatchElem{{Method: "eth_echo"}})
+	assert.Regexp("Unauthorized", err)
+
+	auth.RegisterSecurityModule(nil)
+}
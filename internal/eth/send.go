@@ -125,7 +125,8 @@ func (tx *Txn) Call(ctx context.Context, rpc RPCClient, blocknumber string) (res
 	return
 }
 
-func (tx *Txn) CallAndProcessReply(ctx context.Context, rpc RPCClient, blocknumber string) (map[string]interface{}, error) {
+// RPCBlockNumber converts a block number supplied by a user into the form used in JSON/RPC calls
+func RPCBlockNumber(blocknumber string) (string, error) {
 	callOption := "latest"
 	// only allowed values are "earliest/latest/pending", "", a number string "12345" or a hex number "0xab23"
 	// "latest" and "" (no fly-blocknumber given) are equivalent
@@ -137,11 +138,19 @@ func (tx *Txn) CallAndProcessReply(ctx context.Context, rpc RPCClient, blocknumb
 			n := new(big.Int)
 			n, ok := n.SetString(blocknumber, 10)
 			if !ok {
-				return nil, errors.Errorf(errors.TransactionCallInvalidBlockNumber)
+				return "", errors.Errorf(errors.TransactionCallInvalidBlockNumber)
 			}
 			callOption = ethbind.API.EncodeBig(n)
 		}
 	}
+	return callOption, nil
+}
+
+func (tx *Txn) CallAndProcessReply(ctx context.Context, rpc RPCClient, blocknumber string) (map[string]interface{}, error) {
+	callOption, err := RPCBlockNumber(blocknumber)
+	if err != nil {
+		return nil, err
+	}
 
 	retBytes, _, err := tx.Call(ctx, rpc, callOption)
 	if err != nil || retBytes == nil {
@@ -21,6 +21,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	lru "github.com/hashicorp/golang-lru"
@@ -40,13 +41,19 @@ type blockConfirmationManager struct {
 	filterID              string
 	filterStale           bool
 	rpc                   eth.RPCClient
+	pushRPC               eth.RPCClientAsync
+	headSub               eth.RPCClientSubscription // set while we receive newHeads via eth_subscribe, instead of polling a filter
+	heads                 chan *blockInfo
 	requiredConfirmations int
 	pollingInterval       time.Duration
 	blockCache            *lru.Cache
+	dispatched            *lru.Cache // recently confirmed events, so we can notify the stream if they are later removed
 	bcmNotifications      chan *bcmNotification
 	highestBlockSeen      uint64
 	includeInPayload      bool
 	pending               map[string]*pendingEvent
+	watchersMux           sync.Mutex
+	watchers              map[*subscription]chan struct{} // subscriptions to blocks and transactions, woken on each new block
 	done                  chan struct{}
 }
 
@@ -77,11 +84,12 @@ type bcmConfInternal struct {
 }
 
 type pendingEvent struct {
-	key           string
-	added         time.Time
-	confirmations []*blockInfo
-	event         *eventData
-	eventStream   *eventStream
+	key                   string
+	added                 time.Time
+	requiredConfirmations int
+	confirmations         []*blockInfo
+	event                 *eventData
+	eventStream           *eventStream
 }
 
 type pendingEvents []*pendingEvent
@@ -100,13 +108,16 @@ const (
 	bcmNewLog bcmEventType = iota
 	bcmRemovedLog
 	bcmStopStream
+	bcmStreamStatus
 )
 
 type bcmNotification struct {
-	nType       bcmEventType
-	event       *eventData
-	eventStream *eventStream
-	complete    chan struct{} // for bcmStopStream only
+	nType                 bcmEventType
+	event                 *eventData
+	eventStream           *eventStream
+	requiredConfirmations int            // for bcmNewLog only - overrides the default if non-zero
+	complete              chan struct{}  // for bcmStopStream and bcmStreamStatus only
+	pending               map[string]int // for bcmStreamStatus only - count of pending events per subscription
 }
 
 // blockInfo is the information we cache for a block
@@ -127,6 +138,37 @@ func (bi *blockInfo) MarshalJSON() ([]byte, error) {
 	})
 }
 
+// UnmarshalJSON accepts both the hex encoding returned by the node, and the decimal encoding
+// from MarshalJSON (used when an event with confirmations is persisted in an in-flight batch)
+func (bi *blockInfo) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Number     string          `json:"number"`
+		Hash       ethbinding.Hash `json:"hash"`
+		ParentHash ethbinding.Hash `json:"parentHash"`
+		Timestamp  string          `json:"timestamp"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	var number, timestamp uint64
+	var err error
+	if raw.Number != "" {
+		if number, err = strconv.ParseUint(raw.Number, 0, 64); err != nil {
+			return err
+		}
+	}
+	if raw.Timestamp != "" {
+		if timestamp, err = strconv.ParseUint(raw.Timestamp, 0, 64); err != nil {
+			return err
+		}
+	}
+	bi.Number = ethbinding.HexUint(number)
+	bi.Hash = raw.Hash
+	bi.ParentHash = raw.ParentHash
+	bi.Timestamp = ethbinding.HexUint(timestamp)
+	return nil
+}
+
 func parseBCMConfig(conf *bcmConfExternal) *bcmConfInternal {
 	intConf := &bcmConfInternal{
 		requiredConfirmations: defaultConfirmations,
@@ -156,6 +198,7 @@ func newBlockConfirmationManager(ctx context.Context, rpc eth.RPCClient, conf *b
 		ctx:                   bcmCtx,
 		cancelFunc:            cancelFunc,
 		rpc:                   rpc,
+		pushRPC:               eth.SubscriptionClient(rpc),
 		log:                   log.WithField("job", "blockConfirmationManager"),
 		requiredConfirmations: conf.requiredConfirmations,
 		pollingInterval:       conf.pollingInterval,
@@ -167,6 +210,9 @@ func newBlockConfirmationManager(ctx context.Context, rpc eth.RPCClient, conf *b
 	if bcm.blockCache, err = lru.New(conf.blockCacheSize); err != nil {
 		return nil, errors.Errorf(errors.EventStreamsCreateStreamResourceErr, err)
 	}
+	if bcm.dispatched, err = lru.New(conf.blockCacheSize); err != nil {
+		return nil, errors.Errorf(errors.EventStreamsCreateStreamResourceErr, err)
+	}
 	return bcm, nil
 }
 
@@ -188,6 +234,18 @@ func (bcm *blockConfirmationManager) notify(ev *bcmNotification) {
 func (bcm *blockConfirmationManager) createBlockFilter() error {
 	ctx, cancel := context.WithTimeout(bcm.ctx, 30*time.Second)
 	defer cancel()
+	if bcm.pushRPC != nil {
+		heads := make(chan *blockInfo, pushBufferSize)
+		sub, err := bcm.pushRPC.Subscribe(ctx, "eth", heads, "newHeads")
+		if err == nil {
+			bcm.headSub = sub
+			bcm.heads = heads
+			bcm.filterStale = false
+			bcm.log.Infof("Subscribed to newHeads with eth_subscribe")
+			return nil
+		}
+		bcm.log.Warnf("eth_subscribe for newHeads failed, falling back to polling: %s", err)
+	}
 	err := bcm.rpc.CallContext(ctx, &bcm.filterID, "eth_newBlockFilter")
 	if err != nil {
 		return errors.Errorf(errors.RPCCallReturnedError, "eth_newBlockFilter", err)
@@ -210,6 +268,41 @@ func (bcm *blockConfirmationManager) pollBlockFilter() ([]*ethbinding.Hash, erro
 	return blockHashes, nil
 }
 
+// pushedBlockHashes returns the hashes of the new heads pushed by the node since the last
+// call. If the subscription has failed, we mark the filter stale so it is re-established,
+// and the chain walked to pick up any blocks we missed.
+func (bcm *blockConfirmationManager) pushedBlockHashes(heads []*blockInfo) ([]*ethbinding.Hash, error) {
+	for drained := false; !drained; {
+		select {
+		case head := <-bcm.heads:
+			heads = append(heads, head)
+		case err := <-bcm.headSub.Err():
+			if err == nil {
+				err = errors.Errorf(errors.EventStreamsPushSubscriptionClosed)
+			}
+			bcm.unsubscribeHeads()
+			bcm.filterStale = true
+			return nil, err
+		default:
+			drained = true
+		}
+	}
+	blockHashes := make([]*ethbinding.Hash, len(heads))
+	for i, head := range heads {
+		bcm.addToCache(head)
+		blockHashes[i] = &head.Hash
+	}
+	return blockHashes, nil
+}
+
+func (bcm *blockConfirmationManager) unsubscribeHeads() {
+	if bcm.headSub != nil {
+		bcm.headSub.Unsubscribe()
+		bcm.headSub = nil
+		bcm.heads = nil
+	}
+}
+
 func (bcm *blockConfirmationManager) addToCache(blockInfo *blockInfo) {
 	bcm.blockCache.Add(blockInfo.Hash.String(), blockInfo)
 	bcm.blockCache.Add(strconv.FormatUint(uint64(blockInfo.Number), 10), blockInfo)
@@ -269,22 +362,31 @@ func (bcm *blockConfirmationManager) getBlockByNumber(blockNumber uint64, expect
 
 func (bcm *blockConfirmationManager) confirmationsListener() {
 	defer close(bcm.done)
+	defer bcm.unsubscribeHeads()
 	pollTimer := time.NewTimer(0)
 	notifications := make([]*bcmNotification, 0)
+	heads := make([]*blockInfo, 0)
 	for {
 		popped := false
 		for !popped {
 			select {
 			case <-pollTimer.C:
 				popped = true
+			case head := <-bcm.heads:
+				// A new head was pushed, so we process it without waiting for the poll timer
+				heads = append(heads, head)
+				popped = true
 			case <-bcm.ctx.Done():
 				bcm.log.Debugf("Block confirmation listener stopping")
 				return
 			case notification := <-bcm.bcmNotifications:
-				if notification.nType == bcmStopStream {
+				switch notification.nType {
+				case bcmStopStream:
 					// Handle stream notifications immediately
 					bcm.streamStopped(notification)
-				} else {
+				case bcmStreamStatus:
+					bcm.streamStatus(notification)
+				default:
 					// Defer until after we've got new logs
 					notifications = append(notifications, notification)
 				}
@@ -305,8 +407,15 @@ func (bcm *blockConfirmationManager) confirmationsListener() {
 			}
 		}
 
-		// Do the poll
-		blockHashes, err := bcm.pollBlockFilter()
+		// Do the poll, or collect the pushed heads
+		var blockHashes []*ethbinding.Hash
+		var err error
+		if bcm.headSub != nil {
+			blockHashes, err = bcm.pushedBlockHashes(heads)
+			heads = heads[:0]
+		} else {
+			blockHashes, err = bcm.pollBlockFilter()
+		}
 		if err != nil {
 			bcm.log.Errorf("Failed to retrieve blocks from filter: %s", err)
 			continue
@@ -329,8 +438,30 @@ func (bcm *blockConfirmationManager) confirmationsListener() {
 
 }
 
-func (bcm *blockConfirmationManager) keyForEvent(event *eventData) string {
-	return fmt.Sprintf("TX:%s|BLOCK:%s/%s|INDEX:%s|LOG:%s", event.TransactionHash, event.BlockNumber, event.BlockHash, event.TransactionIndex, event.LogIndex)
+// validateConfirmations checks a confirmations override on a stream or subscription
+func validateConfirmations(sm subscriptionManager, confirmations *int) error {
+	if confirmations == nil {
+		return nil
+	}
+	if *confirmations < 0 {
+		return errors.Errorf(errors.EventStreamsConfirmationsInvalid, *confirmations)
+	}
+	if *confirmations > 0 && sm.confirmationManager() == nil {
+		return errors.Errorf(errors.EventStreamsConfirmationsDisabled)
+	}
+	return nil
+}
+
+// keyForEvent identifies an event for one subscription on one stream. Every stream and subscription that
+// matches a log has its own entry, as each can require different confirmations, and each must be told
+// if the log is removed. The index of the log in the block is used, as the LogIndex of the event is its
+// position in the logs returned by a single poll.
+func (bcm *blockConfirmationManager) keyForEvent(event *eventData, eventStream *eventStream) string {
+	streamID := ""
+	if eventStream != nil && eventStream.spec != nil {
+		streamID = eventStream.spec.ID
+	}
+	return fmt.Sprintf("STREAM:%s|SUB:%s|TX:%s|BLOCK:%s/%s|INDEX:%s|LOG:%d", streamID, event.SubID, event.TransactionHash, event.BlockNumber, event.BlockHash, event.TransactionIndex, event.blockLogIndex)
 }
 
 func (bcm *blockConfirmationManager) processNotifications(notifications []*bcmNotification) error {
@@ -338,12 +469,12 @@ func (bcm *blockConfirmationManager) processNotifications(notifications []*bcmNo
 	for _, n := range notifications {
 		switch n.nType {
 		case bcmNewLog:
-			pending := bcm.addEvent(n.event, n.eventStream)
+			pending := bcm.addEvent(n.event, n.eventStream, n.requiredConfirmations)
 			if err := bcm.walkChainForEvent(pending); err != nil {
 				return err
 			}
 		case bcmRemovedLog:
-			bcm.removeEvent(n.event)
+			bcm.removeEvent(n.event, n.eventStream)
 		default:
 			// Note that streamStopped is handled in the polling loop directly
 			bcm.log.Warnf("Unexpected notification type: %d", n.nType)
@@ -360,20 +491,40 @@ func (bcm *blockConfirmationManager) streamStopped(notification *bcmNotification
 			delete(bcm.pending, eventKey)
 		}
 	}
+	for _, eventKey := range bcm.dispatched.Keys() {
+		if dispatched, ok := bcm.dispatched.Peek(eventKey); ok && dispatched.(*pendingEvent).eventStream == notification.eventStream {
+			bcm.dispatched.Remove(eventKey)
+		}
+	}
+	close(notification.complete)
+}
+
+// streamStatus counts the pending events for each subscription on a given stream, and notifies once done
+func (bcm *blockConfirmationManager) streamStatus(notification *bcmNotification) {
+	for _, pending := range bcm.pending {
+		if pending.eventStream == notification.eventStream {
+			notification.pending[pending.event.SubID]++
+		}
+	}
 	close(notification.complete)
 }
 
 // addEvent is called by the goroutine on receipt of a new event notification
-func (bcm *blockConfirmationManager) addEvent(event *eventData, eventStream *eventStream) *pendingEvent {
+func (bcm *blockConfirmationManager) addEvent(event *eventData, eventStream *eventStream, requiredConfirmations int) *pendingEvent {
+
+	if requiredConfirmations <= 0 {
+		requiredConfirmations = bcm.requiredConfirmations
+	}
 
 	// Add the event
-	eventKey := bcm.keyForEvent(event)
+	eventKey := bcm.keyForEvent(event, eventStream)
 	pending := &pendingEvent{
-		key:           bcm.keyForEvent(event),
-		added:         time.Now(),
-		confirmations: make([]*blockInfo, 0, bcm.requiredConfirmations),
-		event:         event,
-		eventStream:   eventStream,
+		key:                   eventKey,
+		added:                 time.Now(),
+		requiredConfirmations: requiredConfirmations,
+		confirmations:         make([]*blockInfo, 0, requiredConfirmations),
+		event:                 event,
+		eventStream:           eventStream,
 	}
 	bcm.pending[eventKey] = pending
 	bcm.log.Infof("Added pending event %s", eventKey)
@@ -381,9 +532,31 @@ func (bcm *blockConfirmationManager) addEvent(event *eventData, eventStream *eve
 }
 
 // removeEvent is called by the goroutine on receipt of a remove event notification
-func (bcm *blockConfirmationManager) removeEvent(event *eventData) {
-	bcm.log.Infof("Removing stale event %s", bcm.keyForEvent(event))
-	delete(bcm.pending, bcm.keyForEvent(event))
+func (bcm *blockConfirmationManager) removeEvent(event *eventData, eventStream *eventStream) {
+	eventKey := bcm.keyForEvent(event, eventStream)
+	bcm.log.Infof("Removing stale event %s", eventKey)
+	if pending, ok := bcm.pending[eventKey]; ok {
+		bcm.removePending(pending)
+	} else if cached, ok := bcm.dispatched.Get(eventKey); ok {
+		// The reorg was deeper than the confirmations we required, so the consumer must roll back
+		bcm.dispatched.Remove(eventKey)
+		bcm.dispatchRemoved(cached.(*pendingEvent))
+	}
+}
+
+// removePending drops a pending event that is no longer on the chain
+func (bcm *blockConfirmationManager) removePending(pending *pendingEvent) {
+	delete(bcm.pending, pending.key)
+	if pending.eventStream.provisionalNotifications() {
+		// The consumer was told about the event, so must be told it is not going to be confirmed
+		bcm.dispatchRemoved(pending)
+	}
+}
+
+// dispatchRemoved notifies the stream that an event it has been sent is no longer on the chain
+func (bcm *blockConfirmationManager) dispatchRemoved(removed *pendingEvent) {
+	bcm.log.Infof("Dispatching removed event=%s", removed.key)
+	removed.eventStream.handleEvent(removed.event.provisionalCopy(EventStatusRemoved))
 }
 
 func (bcm *blockConfirmationManager) processBlockHashes(blockHashes []*ethbinding.Hash) {
@@ -407,6 +580,35 @@ func (bcm *blockConfirmationManager) processBlockHashes(blockHashes []*ethbindin
 			bcm.highestBlockSeen = uint64(block.Number)
 		}
 	}
+
+	if len(blockHashes) > 0 {
+		bcm.notifyBlockWatchers()
+	}
+}
+
+// addBlockWatcher registers a subscription to blocks or transactions, to wake its event stream when
+// we detect a new block - so it reads the block without waiting for its polling interval
+func (bcm *blockConfirmationManager) addBlockWatcher(s *subscription) {
+	bcm.watchersMux.Lock()
+	defer bcm.watchersMux.Unlock()
+	if bcm.watchers == nil {
+		bcm.watchers = make(map[*subscription]chan struct{})
+	}
+	bcm.watchers[s] = s.lp.stream.pushNotify
+}
+
+func (bcm *blockConfirmationManager) removeBlockWatcher(s *subscription) {
+	bcm.watchersMux.Lock()
+	defer bcm.watchersMux.Unlock()
+	delete(bcm.watchers, s)
+}
+
+func (bcm *blockConfirmationManager) notifyBlockWatchers() {
+	bcm.watchersMux.Lock()
+	defer bcm.watchersMux.Unlock()
+	for _, notify := range bcm.watchers {
+		signal(notify)
+	}
 }
 
 func (bcm *blockConfirmationManager) processBlock(block *blockInfo) {
@@ -424,7 +626,7 @@ func (bcm *blockConfirmationManager) processBlock(block *blockInfo) {
 			if parentStr == expectedParentHash && blockNumber == expectedBlockNumber {
 				pending.confirmations = append(pending.confirmations[0:i], block)
 				bcm.log.Infof("Confirmation %d at block %d / %s event=%s",
-					len(pending.confirmations), block.Number, block.Hash.String(), bcm.keyForEvent(pending.event))
+					len(pending.confirmations), block.Number, block.Hash.String(), pending.key)
 				break
 			}
 			if i < len(pending.confirmations) {
@@ -432,7 +634,7 @@ func (bcm *blockConfirmationManager) processBlock(block *blockInfo) {
 			}
 			expectedBlockNumber++
 		}
-		if len(pending.confirmations) >= bcm.requiredConfirmations {
+		if len(pending.confirmations) >= pending.requiredConfirmations {
 			delete(bcm.pending, eventKey)
 			confirmed = append(confirmed, pending)
 		}
@@ -448,12 +650,16 @@ func (bcm *blockConfirmationManager) processBlock(block *blockInfo) {
 
 // dispatchConfirmed drive the event stream for any events that are confirmed, and prunes the state
 func (bcm *blockConfirmationManager) dispatchConfirmed(confirmed *pendingEvent) {
-	eventKey := bcm.keyForEvent(confirmed.event)
+	eventKey := confirmed.key
 	bcm.log.Infof("Confirmed with %d confirmations event=%s", len(confirmed.confirmations), eventKey)
 
 	if bcm.includeInPayload {
 		confirmed.event.Confirmations = confirmed.confirmations
 	}
+	if confirmed.eventStream.provisionalNotifications() {
+		confirmed.event.Status = EventStatusConfirmed
+	}
+	bcm.dispatched.Add(eventKey, confirmed)
 	confirmed.eventStream.handleEvent(confirmed.event)
 }
 
@@ -482,7 +688,7 @@ func (bcm *blockConfirmationManager) walkChain() error {
 
 func (bcm *blockConfirmationManager) walkChainForEvent(pending *pendingEvent) (err error) {
 
-	eventKey := bcm.keyForEvent(pending.event)
+	eventKey := pending.key
 
 	blockNumber := pending.event.blockNumber + 1
 	expectedParentHash := pending.event.BlockHash
@@ -504,10 +710,16 @@ func (bcm *blockConfirmationManager) walkChainForEvent(pending *pendingEvent) (e
 		candidateParentHash := block.ParentHash.String()
 		if candidateParentHash != expectedParentHash {
 			bcm.log.Infof("Block mismatch in confirmations: block=%d expected=%s actual=%s confirmations=%d event=%s", blockNumber, expectedParentHash, candidateParentHash, len(pending.confirmations), eventKey)
+			if len(pending.confirmations) == 0 {
+				// The block containing the event is not the parent of the next block on the chain, so has
+				// been orphaned. If the log is in the new canonical chain, it will be detected again.
+				bcm.log.Infof("Event is on orphaned block %d / %s event=%s", pending.event.blockNumber, pending.event.BlockHash, eventKey)
+				bcm.removePending(pending)
+			}
 			return nil
 		}
 		pending.confirmations = append(pending.confirmations, block)
-		if len(pending.confirmations) >= bcm.requiredConfirmations {
+		if len(pending.confirmations) >= pending.requiredConfirmations {
 			// Ready for dispatch
 			bcm.dispatchConfirmed(pending)
 			return nil
@@ -439,7 +439,7 @@ func TestConfirmationsListenerFailWalkingChain(t *testing.T) {
 		transactionIndex: 5,
 		logIndex:         10,
 	}
-	bcm.addEvent(eventToConfirm, testStream)
+	bcm.addEvent(eventToConfirm, testStream, 0)
 
 	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_newBlockFilter").Run(func(args mock.Arguments) {
 		*args[1].(*string) = "filter_id1"
@@ -548,7 +548,7 @@ func TestConfirmationsListenerStopStream(t *testing.T) {
 		logIndex:         10,
 	}
 	completed := make(chan struct{})
-	bcm.addEvent(eventToConfirm, testStream)
+	bcm.addEvent(eventToConfirm, testStream, 0)
 	bcm.notify(&bcmNotification{
 		nType:       bcmStopStream,
 		eventStream: testStream,
@@ -593,10 +593,11 @@ func TestConfirmationsRemoveEvent(t *testing.T) {
 		transactionIndex: 5,
 		logIndex:         10,
 	}
-	bcm.addEvent(event, testStream)
+	bcm.addEvent(event, testStream, 0)
 	bcm.notify(&bcmNotification{
-		nType: bcmRemovedLog,
-		event: event,
+		nType:       bcmRemovedLog,
+		event:       event,
+		eventStream: testStream,
 	})
 
 	changeCount := 0
@@ -636,7 +637,7 @@ func TestWalkChainForEventBlockNotAvailable(t *testing.T) {
 		blockNumber:      1001,
 		transactionIndex: 5,
 		logIndex:         10,
-	}, testStream)
+	}, testStream, 0)
 
 	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_getBlockByNumber", mock.MatchedBy(func(i ethbinding.HexUint64) bool {
 		return uint64(i) == 1002
@@ -661,7 +662,7 @@ func TestWalkChainForEventBlockNotInConfirmationChain(t *testing.T) {
 		blockNumber:      1001,
 		transactionIndex: 5,
 		logIndex:         10,
-	}, testStream)
+	}, testStream, 0)
 
 	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_getBlockByNumber", mock.MatchedBy(func(i ethbinding.HexUint64) bool {
 		return uint64(i) == 1002
@@ -675,6 +676,7 @@ func TestWalkChainForEventBlockNotInConfirmationChain(t *testing.T) {
 
 	err := bcm.walkChainForEvent(pendingEvent)
 	assert.NoError(t, err)
+	assert.Empty(t, bcm.pending)
 
 	rpc.AssertExpectations(t)
 }
@@ -690,7 +692,7 @@ func TestWalkChainForEventBlockLookupFail(t *testing.T) {
 		blockNumber:      1001,
 		transactionIndex: 5,
 		logIndex:         10,
-	}, testStream)
+	}, testStream, 0)
 
 	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_getBlockByNumber", mock.MatchedBy(func(i ethbinding.HexUint64) bool {
 		return uint64(i) == 1002
@@ -808,3 +810,235 @@ func TestGetBlockNotFound(t *testing.T) {
 	assert.Nil(t, blockInfo)
 
 }
+
+func TestBlockConfirmationManagerNewHeadsPush(t *testing.T) {
+	bcm, rpc := newTestBlockConfirmationManagerConf(t, &bcmConfInternal{
+		requiredConfirmations: 1,
+		blockCacheSize:        defaultBlockCacheSize,
+		pollingInterval:       1 * time.Millisecond,
+		eventQueueLength:      1,
+	})
+	pushRPC := &testPushRPC{}
+	bcm.pushRPC = pushRPC
+
+	testStream := &eventStream{
+		eventStream: make(chan *eventData, 1),
+	}
+	eventToConfirm := &eventData{
+		TransactionHash: "0x531e219d98d81dc9f9a14811ac537479f5d77a74bdba47629bfbebe2d7663ce7",
+		BlockHash:       "0x0e32d749a86cfaf551d528b5b121cea456f980a39e5b8136eb8e85dbc744a542",
+		blockNumber:     1001,
+	}
+	// The block is not available when we first walk the chain for the event
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_getBlockByNumber", mock.Anything, false).Return(nil).Maybe()
+
+	bcm.start()
+	bcm.notify(&bcmNotification{
+		nType:       bcmNewLog,
+		event:       eventToConfirm,
+		eventStream: testStream,
+	})
+
+	var sub *testPushSubscription
+	assert.Eventually(t, func() bool {
+		sub = pushRPC.lastSub()
+		return sub != nil
+	}, 5*time.Second, 1*time.Millisecond)
+	assert.Equal(t, []interface{}{"newHeads"}, sub.args)
+	sub.channel.(chan *blockInfo) <- &blockInfo{
+		Number:     1002,
+		Hash:       ethbind.API.HexToHash("0x46210d224888265c269359529618bf2f6adb2697ff52c63c10f16a2391bdd295"),
+		ParentHash: ethbind.API.HexToHash("0x0e32d749a86cfaf551d528b5b121cea456f980a39e5b8136eb8e85dbc744a542"),
+	}
+
+	dispatched := <-testStream.eventStream
+	assert.Equal(t, eventToConfirm, dispatched)
+
+	bcm.stop()
+	assert.True(t, sub.unsubscribed)
+	rpc.AssertNotCalled(t, "CallContext", mock.Anything, mock.Anything, "eth_newBlockFilter")
+}
+
+func TestBlockConfirmationManagerNewHeadsFailure(t *testing.T) {
+	assert := assert.New(t)
+	bcm, _ := newTestBlockConfirmationManager(t, false)
+	pushRPC := &testPushRPC{}
+	bcm.pushRPC = pushRPC
+
+	err := bcm.createBlockFilter()
+	assert.NoError(err)
+	assert.False(bcm.filterStale)
+	sub := pushRPC.lastSub()
+
+	head := &blockInfo{Number: 1002, Hash: ethbind.API.HexToHash("0x46210d224888265c269359529618bf2f6adb2697ff52c63c10f16a2391bdd295")}
+	sub.channel.(chan *blockInfo) <- head
+	blockHashes, err := bcm.pushedBlockHashes([]*blockInfo{})
+	assert.NoError(err)
+	assert.Equal([]*ethbinding.Hash{&head.Hash}, blockHashes)
+	cached, ok := bcm.blockCache.Get(head.Hash.String())
+	assert.True(ok)
+	assert.Equal(head, cached)
+
+	sub.errChan <- fmt.Errorf("pop")
+	_, err = bcm.pushedBlockHashes([]*blockInfo{})
+	assert.Regexp("pop", err)
+	assert.True(bcm.filterStale)
+	assert.Nil(bcm.headSub)
+	assert.True(sub.unsubscribed)
+}
+
+func TestBlockConfirmationManagerNewHeadsFallbackToPolling(t *testing.T) {
+	assert := assert.New(t)
+	bcm, rpc := newTestBlockConfirmationManager(t, false)
+	bcm.pushRPC = &testPushRPC{err: fmt.Errorf("notifications not supported")}
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_newBlockFilter").Run(func(args mock.Arguments) {
+		*args[1].(*string) = "filter_id1"
+	}).Return(nil)
+
+	err := bcm.createBlockFilter()
+	assert.NoError(err)
+	assert.Nil(bcm.headSub)
+	assert.Equal("filter_id1", bcm.filterID)
+}
+
+func TestBlockConfirmationManagerProvisionalConfirmedAndRemoved(t *testing.T) {
+	assert := assert.New(t)
+	bcm, _ := newTestBlockConfirmationManager(t, false)
+
+	testStream := &eventStream{
+		spec:        &StreamInfo{ProvisionalNotifications: true},
+		eventStream: make(chan *eventData, 1),
+	}
+	confirmed := &eventData{
+		ID:          "es1/1001/0/0",
+		BlockHash:   "0x0e32d749a86cfaf551d528b5b121cea456f980a39e5b8136eb8e85dbc744a542",
+		blockNumber: 1001,
+	}
+	bcm.addEvent(confirmed, testStream, 1)
+	bcm.processBlock(&blockInfo{
+		Number:     1002,
+		ParentHash: ethbind.API.HexToHash("0x0e32d749a86cfaf551d528b5b121cea456f980a39e5b8136eb8e85dbc744a542"),
+	})
+	ev := <-testStream.eventStream
+	assert.Equal("es1/1001/0/0", ev.ID)
+	assert.Equal(EventStatusConfirmed, ev.Status)
+
+	removed := &eventData{ID: "es1/1001/1/0", LogIndex: "1", blockNumber: 1001}
+	bcm.addEvent(removed, testStream, 0)
+	bcm.removeEvent(&eventData{LogIndex: "1"}, testStream)
+	ev = <-testStream.eventStream
+	assert.Equal("es1/1001/1/0/removed", ev.ID)
+	assert.Equal(EventStatusRemoved, ev.Status)
+	assert.Empty(bcm.pending)
+
+	// Removing an event that is not pending does not dispatch anything
+	bcm.removeEvent(&eventData{LogIndex: "1"}, testStream)
+	assert.Empty(testStream.eventStream)
+
+	// Removing an event that was confirmed and dispatched notifies the consumer to roll back
+	bcm.removeEvent(&eventData{BlockHash: confirmed.BlockHash}, testStream)
+	ev = <-testStream.eventStream
+	assert.Equal("es1/1001/0/0/removed", ev.ID)
+	assert.Equal(EventStatusRemoved, ev.Status)
+	bcm.removeEvent(&eventData{BlockHash: confirmed.BlockHash}, testStream)
+	assert.Empty(testStream.eventStream)
+}
+
+func TestBlockConfirmationManagerStopStreamForgetsDispatched(t *testing.T) {
+	assert := assert.New(t)
+	bcm, _ := newTestBlockConfirmationManager(t, false)
+
+	testStream := &eventStream{eventStream: make(chan *eventData, 1)}
+	otherStream := &eventStream{eventStream: make(chan *eventData, 1)}
+	bcm.dispatchConfirmed(bcm.addEvent(&eventData{ID: "e1", LogIndex: "1"}, testStream, 0))
+	bcm.dispatchConfirmed(bcm.addEvent(&eventData{ID: "e2", LogIndex: "2"}, otherStream, 0))
+	<-testStream.eventStream
+	<-otherStream.eventStream
+
+	complete := make(chan struct{})
+	bcm.streamStopped(&bcmNotification{eventStream: testStream, complete: complete})
+	<-complete
+	assert.Equal(1, bcm.dispatched.Len())
+	_, ok := bcm.dispatched.Get(bcm.keyForEvent(&eventData{LogIndex: "2"}, otherStream))
+	assert.True(ok)
+}
+
+func TestConfirmationsPendingPerSubscription(t *testing.T) {
+	assert := assert.New(t)
+	bcm, _ := newTestBlockConfirmationManager(t, false)
+	stream := &eventStream{}
+
+	// Two subscriptions with different thresholds matching the same log are tracked separately
+	bcm.addEvent(&eventData{SubID: "sub1", TransactionHash: "0x12345", LogIndex: "1"}, stream, 3)
+	bcm.addEvent(&eventData{SubID: "sub2", TransactionHash: "0x12345", LogIndex: "1"}, stream, 5)
+	assert.Len(bcm.pending, 2)
+	assert.Equal(3, bcm.pending[bcm.keyForEvent(&eventData{SubID: "sub1", TransactionHash: "0x12345", LogIndex: "1"}, stream)].requiredConfirmations)
+	assert.Equal(5, bcm.pending[bcm.keyForEvent(&eventData{SubID: "sub2", TransactionHash: "0x12345", LogIndex: "1"}, stream)].requiredConfirmations)
+}
+
+func TestWalkChainForEventOrphanedBlock(t *testing.T) {
+	assert := assert.New(t)
+	bcm, rpc := newTestBlockConfirmationManager(t, false)
+
+	testStream := &eventStream{
+		spec:        &StreamInfo{ProvisionalNotifications: true},
+		eventStream: make(chan *eventData, 1),
+	}
+	pendingEvent := bcm.addEvent(&eventData{
+		ID:          "es1/1001/0/0",
+		BlockHash:   "0x0e32d749a86cfaf551d528b5b121cea456f980a39e5b8136eb8e85dbc744a542",
+		blockNumber: 1001,
+	}, testStream, 0)
+
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_getBlockByNumber", mock.MatchedBy(func(i ethbinding.HexUint64) bool {
+		return uint64(i) == 1002
+	}), false).Run(func(args mock.Arguments) {
+		*(args[1].(**blockInfo)) = &blockInfo{
+			Number:     1002,
+			Hash:       ethbind.API.HexToHash("0xed21f4f73d150f16f922ae82b7485cd936ae1eca4c027516311b928360a347e8"),
+			ParentHash: ethbind.API.HexToHash("0x64fd8179b80dd255d52ce60d7f265c0506be810e2f3df52463fadeb44bb4d2df"),
+		}
+	}).Return(nil).Once()
+
+	err := bcm.walkChainForEvent(pendingEvent)
+	assert.NoError(err)
+	ev := <-testStream.eventStream
+	assert.Equal("es1/1001/0/0/removed", ev.ID)
+	assert.Equal(EventStatusRemoved, ev.Status)
+	assert.Empty(bcm.pending)
+
+	rpc.AssertExpectations(t)
+}
+
+func TestConfirmationsRemovedNotifiesEachStreamAndSubscription(t *testing.T) {
+	assert := assert.New(t)
+	bcm, _ := newTestBlockConfirmationManager(t, false)
+
+	stream1 := &eventStream{spec: &StreamInfo{ID: "es1"}, eventStream: make(chan *eventData, 2)}
+	stream2 := &eventStream{spec: &StreamInfo{ID: "es2"}, eventStream: make(chan *eventData, 2)}
+	newEvent := func(subID string) *eventData {
+		return &eventData{ID: subID, SubID: subID, TransactionHash: "0x12345", LogIndex: "0", blockLogIndex: 7}
+	}
+	for _, d := range []struct {
+		subID  string
+		stream *eventStream
+	}{{"sub1", stream1}, {"sub2", stream1}, {"sub3", stream2}} {
+		pending := bcm.addEvent(newEvent(d.subID), d.stream, 0)
+		delete(bcm.pending, pending.key)
+		bcm.dispatchConfirmed(pending)
+		<-d.stream.eventStream
+	}
+
+	// The removed log is at a different position in the poll that reports it
+	for _, d := range []struct {
+		subID  string
+		stream *eventStream
+	}{{"sub1", stream1}, {"sub2", stream1}, {"sub3", stream2}} {
+		removed := newEvent(d.subID)
+		removed.LogIndex = "3"
+		bcm.removeEvent(removed, d.stream)
+		ev := <-d.stream.eventStream
+		assert.Equal(d.subID+"/removed", ev.ID)
+		assert.Equal(EventStatusRemoved, ev.Status)
+	}
+}
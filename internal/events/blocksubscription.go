@@ -0,0 +1,265 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/contractregistry"
+	"github.com/hyperledger/firefly-ethconnect/internal/errors"
+	"github.com/hyperledger/firefly-ethconnect/internal/eth"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	log "github.com/sirupsen/logrus"
+)
+
+// chainBlock is a block returned by eth_getBlockByNumber
+type chainBlock struct {
+	Number       ethbinding.HexUint  `json:"number"`
+	Hash         ethbinding.Hash     `json:"hash"`
+	ParentHash   ethbinding.Hash     `json:"parentHash"`
+	Timestamp    ethbinding.HexUint  `json:"timestamp"`
+	Transactions []*chainTransaction `json:"transactions"`
+}
+
+// chainTransaction is a transaction in a block, which is only the hash unless full transactions were requested
+type chainTransaction struct {
+	eth.TxnInfo
+}
+
+func (t *chainTransaction) UnmarshalJSON(b []byte) error {
+	if strings.HasPrefix(string(b), `"`) {
+		t.Hash = &ethbinding.Hash{}
+		return json.Unmarshal(b, t.Hash)
+	}
+	return json.Unmarshal(b, &t.TxnInfo)
+}
+
+// watchesBlocks returns true for subscriptions to blocks or transactions, rather than to contract events
+func (info *SubscriptionInfo) watchesBlocks() bool {
+	return info.Kind == SubscriptionKindBlocks || info.Kind == SubscriptionKindTransactions
+}
+
+func newBlockSubscription(sm subscriptionManager, rpc eth.RPCClient, cr contractregistry.ContractResolver, stream *eventStream, addr *ethbinding.Address, i *SubscriptionInfo) (*subscription, error) {
+	if i.Event != nil {
+		return nil, errors.Errorf(errors.EventStreamsSubscribeKindNoEvent, i.Kind)
+	}
+	s := restoreBlockSubscription(sm, rpc, cr, stream, i)
+	f := &i.Filter
+	if addr != nil {
+		f.Addresses = append(f.Addresses, *addr)
+	}
+	addrStr := "*"
+	if i.Kind == SubscriptionKindTransactions && len(f.Addresses) > 0 {
+		addrs := make([]string, len(f.Addresses))
+		for idx, a := range f.Addresses {
+			addrs[idx] = a.String()
+		}
+		addrStr = strings.Join(addrs, ",")
+	}
+	i.Summary = addrStr + ":" + i.Kind
+	if i.Name == "" {
+		log.Debugf("No name provided for subscription, using auto-generated summary:%s", i.Summary)
+		i.Name = i.Summary
+	}
+	log.Infof("Created subscription ID:%s name:%s kind:%s", i.ID, i.Name, i.Kind)
+	return s, nil
+}
+
+func restoreBlockSubscription(sm subscriptionManager, rpc eth.RPCClient, cr contractregistry.ContractResolver, stream *eventStream, i *SubscriptionInfo) *subscription {
+	s := &subscription{
+		info:                i,
+		rpc:                 rpc,
+		cr:                  cr,
+		lp:                  newLogProcessor(i.ID, nil, stream, sm.confirmationManager()),
+		logName:             i.ID + ":" + i.Kind,
+		filterStale:         true,
+		catchupModeBlockGap: sm.config().CatchupModeBlockGap,
+		catchupModePageSize: sm.config().CatchupModePageSize,
+		bcm:                 sm.confirmationManager(),
+	}
+	s.lp.confirmations = i.Confirmations
+	return s
+}
+
+// startBlockWatch starts reading blocks from the checkpoint. If the block confirmation manager
+// is running, its block listener wakes the event stream as soon as a new block is detected.
+func (s *subscription) startBlockWatch(ctx context.Context, since *big.Int) {
+	s.nextBlock = new(big.Int).Set(since)
+	s.catchupBlock = nil
+	s.markFilterStale(ctx, false)
+	if s.bcm != nil {
+		s.bcm.addBlockWatcher(s)
+	}
+	log.Infof("%s: reading %s from block %s", s.logName, s.info.Kind, since.String())
+}
+
+func (s *subscription) stopBlockWatch() {
+	if s.bcm != nil {
+		s.bcm.removeBlockWatcher(s)
+	}
+	s.nextBlock = nil
+}
+
+// processNewBlocks reads the blocks from the next block up to the head of the chain, a page at a time
+func (s *subscription) processNewBlocks(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	head := ethbinding.HexBigInt{}
+	if err := s.rpc.CallContext(ctx, &head, "eth_blockNumber"); err != nil {
+		return errors.Errorf(errors.RPCCallReturnedError, "eth_blockNumber", err)
+	}
+	headBlock := head.ToInt()
+	endBlock := new(big.Int).Add(s.nextBlock, big.NewInt(s.catchupModePageSize-1))
+	if endBlock.Cmp(headBlock) > 0 {
+		endBlock.Set(headBlock)
+	}
+
+	var abi *ethbinding.RuntimeABI
+	if s.info.Kind == SubscriptionKindTransactions {
+		abi, _ = loadABI(s.cr, s.info.ABI)
+	}
+	for s.nextBlock.Cmp(endBlock) <= 0 {
+		var block *chainBlock
+		fullTransactions := s.info.Kind == SubscriptionKindTransactions
+		if err := s.rpc.CallContext(ctx, &block, "eth_getBlockByNumber", (*ethbinding.HexBigInt)(s.nextBlock), fullTransactions); err != nil {
+			return errors.Errorf(errors.RPCCallReturnedError, "eth_getBlockByNumber", err)
+		}
+		if block == nil {
+			// The node we are connected to is behind the head it reported, so we try again on the next poll
+			log.Infof("%s: block %s not available", s.logName, s.nextBlock.String())
+			break
+		}
+		s.processBlock(block, abi)
+		s.lp.markNoEvents(s.nextBlock)
+		s.nextBlock = new(big.Int).Add(s.nextBlock, big.NewInt(1))
+	}
+	s.info.Synchronized = s.nextBlock.Cmp(headBlock) > 0
+	return nil
+}
+
+// processBlock dispatches the block, or the matching transactions within it, to the stream
+func (s *subscription) processBlock(block *chainBlock, abi *ethbinding.RuntimeABI) {
+	stream := s.lp.stream
+	blockNumber := strconv.FormatUint(uint64(block.Number), 10)
+	timestamp := ""
+	if stream.spec.Timestamps {
+		timestamp = strconv.FormatUint(uint64(block.Timestamp), 10)
+	}
+
+	if s.info.Kind == SubscriptionKindBlocks {
+		txHashes := make([]string, len(block.Transactions))
+		for idx, tx := range block.Transactions {
+			if tx.Hash != nil {
+				txHashes[idx] = tx.Hash.String()
+			}
+		}
+		s.lp.dispatch(s.logName, &eventData{
+			ID:          stream.spec.ID + "/" + blockNumber,
+			BlockNumber: blockNumber,
+			BlockHash:   block.Hash.String(),
+			SubID:       s.info.ID,
+			Timestamp:   timestamp,
+			Data: map[string]interface{}{
+				"number":       blockNumber,
+				"hash":         block.Hash.String(),
+				"parentHash":   block.ParentHash.String(),
+				"timestamp":    strconv.FormatUint(uint64(block.Timestamp), 10),
+				"transactions": txHashes,
+			},
+			batchComplete: s.lp.batchComplete,
+			blockNumber:   uint64(block.Number),
+		}, false)
+		return
+	}
+
+	for idx, tx := range block.Transactions {
+		if !s.matchesTransaction(tx) {
+			continue
+		}
+		txIndex := uint64(idx)
+		if tx.TransactionIndex != nil {
+			txIndex = uint64(*tx.TransactionIndex)
+		}
+		result := &eventData{
+			ID:               stream.spec.ID + "/" + blockNumber + "/" + strconv.FormatUint(txIndex, 10),
+			BlockNumber:      blockNumber,
+			BlockHash:        block.Hash.String(),
+			TransactionIndex: stream.formatTransactionIndex(ethbinding.HexUint(txIndex)),
+			SubID:            s.info.ID,
+			Timestamp:        timestamp,
+			Data:             transactionData(tx),
+			batchComplete:    s.lp.batchComplete,
+			blockNumber:      uint64(block.Number),
+			transactionIndex: txIndex,
+		}
+		if tx.Hash != nil {
+			result.TransactionHash = tx.Hash.String()
+		}
+		if tx.To != nil {
+			result.Address = tx.To.String()
+		}
+		if abi != nil {
+			result.InputSigner, result.InputMethod, result.InputArgs = decodeTransactionInputs(abi, s.logName, &tx.TxnInfo)
+		}
+		s.lp.dispatch(s.logName, result, false)
+	}
+}
+
+// matchesTransaction returns true if the transaction is to or from one of the addresses of the subscription
+func (s *subscription) matchesTransaction(tx *chainTransaction) bool {
+	if len(s.info.Filter.Addresses) == 0 {
+		return true
+	}
+	for _, addr := range s.info.Filter.Addresses {
+		if (tx.From != nil && *tx.From == addr) || (tx.To != nil && *tx.To == addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func transactionData(tx *chainTransaction) map[string]interface{} {
+	data := make(map[string]interface{})
+	if tx.Hash != nil {
+		data["hash"] = tx.Hash.String()
+	}
+	if tx.From != nil {
+		data["from"] = tx.From.String()
+	}
+	if tx.To != nil {
+		data["to"] = tx.To.String()
+	}
+	if tx.Value != nil {
+		data["value"] = tx.Value.ToInt().String()
+	}
+	if tx.Nonce != nil {
+		data["nonce"] = strconv.FormatUint(uint64(*tx.Nonce), 10)
+	}
+	if tx.Gas != nil {
+		data["gas"] = strconv.FormatUint(uint64(*tx.Gas), 10)
+	}
+	if tx.GasPrice != nil {
+		data["gasPrice"] = tx.GasPrice.ToInt().String()
+	}
+	if tx.Input != nil {
+		data["input"] = tx.Input.String()
+	}
+	return data
+}
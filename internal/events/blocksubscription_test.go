@@ -0,0 +1,264 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/ethbind"
+	"github.com/hyperledger/firefly-ethconnect/mocks/ethmocks"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func testHash(n int) string {
+	return fmt.Sprintf("0x%064x", n)
+}
+
+func testAddress(n int) string {
+	return fmt.Sprintf("0x%040x", n)
+}
+
+func newTestBlockSubscription(t *testing.T, rpc *ethmocks.RPCClient, i *SubscriptionInfo, addr *ethbinding.Address) (*subscription, *eventStream) {
+	stream := &eventStream{
+		spec:        &StreamInfo{ID: "es1", Timestamps: true},
+		eventStream: make(chan *eventData, 10),
+		pushNotify:  make(chan struct{}, 1),
+	}
+	i.ID = "sub1"
+	i.Stream = "es1"
+	s, err := newSubscription(&mockSubMgr{stream: stream}, rpc, nil, addr, i)
+	assert.NoError(t, err)
+	s.catchupModePageSize = 10
+	return s, stream
+}
+
+func mockBlockNumber(rpc *ethmocks.RPCClient, head int64) {
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_blockNumber").Run(func(args mock.Arguments) {
+		args[1].(*ethbinding.HexBigInt).ToInt().SetInt64(head)
+	}).Return(nil)
+}
+
+func mockBlock(rpc *ethmocks.RPCClient, number int64, fullTransactions bool, blockJSON string) {
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_getBlockByNumber", mock.MatchedBy(func(n *ethbinding.HexBigInt) bool {
+		return n.ToInt().Int64() == number
+	}), fullTransactions).Run(func(args mock.Arguments) {
+		err := json.Unmarshal([]byte(blockJSON), args[1])
+		if err != nil {
+			panic(err)
+		}
+	}).Return(nil)
+}
+
+func TestBlockSubscriptionBlocks(t *testing.T) {
+	assert := assert.New(t)
+
+	rpc := &ethmocks.RPCClient{}
+	mockBlockNumber(rpc, 101)
+	mockBlock(rpc, 100, false, fmt.Sprintf(`{"number":"0x64","hash":"%s","parentHash":"%s","timestamp":"0x3e8","transactions":["%s"]}`,
+		testHash(100), testHash(99), testHash(1)))
+	mockBlock(rpc, 101, false, fmt.Sprintf(`{"number":"0x65","hash":"%s","parentHash":"%s","timestamp":"0x3e9","transactions":[]}`,
+		testHash(101), testHash(100)))
+	s, stream := newTestBlockSubscription(t, rpc, &SubscriptionInfo{Kind: SubscriptionKindBlocks}, nil)
+	assert.Equal("*:blocks", s.info.Name)
+
+	err := s.restartFilter(context.Background(), big.NewInt(100))
+	assert.NoError(err)
+	assert.False(s.filterStale)
+	err = s.processNewEvents(context.Background())
+	assert.NoError(err)
+	assert.True(s.info.Synchronized)
+
+	ev := <-stream.eventStream
+	assert.Equal("es1/100", ev.ID)
+	assert.Equal("sub1", ev.SubID)
+	assert.Equal(testHash(100), ev.BlockHash)
+	assert.Equal("1000", ev.Timestamp)
+	assert.Equal(testHash(99), ev.Data["parentHash"])
+	assert.Equal([]string{testHash(1)}, ev.Data["transactions"])
+	ev = <-stream.eventStream
+	assert.Equal("es1/101", ev.ID)
+	assert.Equal([]string{}, ev.Data["transactions"])
+
+	// Nothing more to read until the head moves
+	err = s.processNewEvents(context.Background())
+	assert.NoError(err)
+	assert.Empty(stream.eventStream)
+	assert.Equal(int64(102), s.nextBlock.Int64())
+
+	s.unsubscribe(context.Background(), false)
+	assert.True(s.filterStale)
+	assert.Nil(s.nextBlock)
+	rpc.AssertNotCalled(t, "CallContext", mock.Anything, mock.Anything, "eth_uninstallFilter", mock.Anything)
+}
+
+func TestBlockSubscriptionTransactions(t *testing.T) {
+	assert := assert.New(t)
+
+	method1Input := "0xf4e13dc5" + testHash(1)[2:]
+	rpc := &ethmocks.RPCClient{}
+	mockBlockNumber(rpc, 100)
+	mockBlock(rpc, 100, true, fmt.Sprintf(`{"number":"0x64","hash":"%s","parentHash":"%s","timestamp":"0x3e8","transactions":[
+		{"hash":"%s","from":"%s","to":"%s","value":"0x10","nonce":"0x1","gas":"0x5208","gasPrice":"0x2","input":"0x","transactionIndex":"0x0"},
+		{"hash":"%s","from":"%s","to":"%s","value":"0x0","nonce":"0x2","gas":"0x5208","gasPrice":"0x2","input":"0x","transactionIndex":"0x1"},
+		{"hash":"%s","from":"%s","to":"%s","value":"0x0","nonce":"0x3","gas":"0x5208","gasPrice":"0x2","input":"%s","transactionIndex":"0x2"}
+	]}`, testHash(100), testHash(99),
+		testHash(1), testAddress(1), testAddress(2),
+		testHash(2), testAddress(3), testAddress(4),
+		testHash(3), testAddress(5), testAddress(1), method1Input))
+
+	addr := ethbind.API.HexToAddress(testAddress(1))
+	s, stream := newTestBlockSubscription(t, rpc, &SubscriptionInfo{
+		Kind: SubscriptionKindTransactions,
+		ABI: &ABIRefOrInline{
+			Inline: ethbinding.ABIMarshaling{
+				{
+					Type:   "function",
+					Name:   "method1",
+					Inputs: []ethbinding.ABIArgumentMarshaling{{Name: "arg1", Type: "int32"}},
+				},
+			},
+		},
+	}, &addr)
+	assert.Equal(testAddress(1)+":transactions", s.info.Summary)
+
+	err := s.restartFilter(context.Background(), big.NewInt(100))
+	assert.NoError(err)
+	err = s.processNewEvents(context.Background())
+	assert.NoError(err)
+
+	ev := <-stream.eventStream
+	assert.Equal("es1/100/0", ev.ID)
+	assert.Equal(testHash(1), ev.TransactionHash)
+	assert.Equal("0x0", ev.TransactionIndex)
+	assert.Equal("16", ev.Data["value"])
+	assert.Equal("21000", ev.Data["gas"])
+	assert.Equal(ethbind.API.HexToAddress(testAddress(1)).String(), ev.Data["from"])
+	assert.Empty(ev.InputMethod)
+
+	ev = <-stream.eventStream
+	assert.Equal("es1/100/2", ev.ID)
+	assert.Equal(ethbind.API.HexToAddress(testAddress(1)).String(), ev.Address)
+	assert.Equal("method1", ev.InputMethod)
+	assert.Equal(map[string]interface{}{"arg1": "1"}, ev.InputArgs)
+	assert.Equal(ethbind.API.HexToAddress(testAddress(5)).String(), ev.InputSigner)
+	assert.Empty(stream.eventStream)
+}
+
+func TestBlockSubscriptionConfirmations(t *testing.T) {
+	assert := assert.New(t)
+
+	rpc := &ethmocks.RPCClient{}
+	mockBlockNumber(rpc, 100)
+	mockBlock(rpc, 100, false, fmt.Sprintf(`{"number":"0x64","hash":"%s","parentHash":"%s","timestamp":"0x3e8","transactions":[]}`,
+		testHash(100), testHash(99)))
+	s, stream := newTestBlockSubscription(t, rpc, &SubscriptionInfo{Kind: SubscriptionKindBlocks}, nil)
+	bcm, _ := newTestBlockConfirmationManager(t, false)
+	s.bcm = bcm
+	s.lp.confirmationManager = bcm
+
+	err := s.restartFilter(context.Background(), big.NewInt(100))
+	assert.NoError(err)
+	bcm.notifyBlockWatchers()
+	<-stream.pushNotify
+
+	err = s.processNewEvents(context.Background())
+	assert.NoError(err)
+	n := <-bcm.bcmNotifications
+	assert.Equal(bcmNewLog, n.nType)
+	assert.Equal("es1/100", n.event.ID)
+	assert.Equal(uint64(100), n.event.blockNumber)
+	assert.Empty(stream.eventStream)
+
+	s.unsubscribe(context.Background(), false)
+	assert.Empty(bcm.watchers)
+}
+
+func TestBlockSubscriptionRPCErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	rpc := &ethmocks.RPCClient{}
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_blockNumber").Return(fmt.Errorf("pop")).Once()
+	s, _ := newTestBlockSubscription(t, rpc, &SubscriptionInfo{Kind: SubscriptionKindBlocks}, nil)
+	s.restartFilter(context.Background(), big.NewInt(100))
+	err := s.processNewEvents(context.Background())
+	assert.Regexp("eth_blockNumber returned: pop", err)
+
+	mockBlockNumber(rpc, 101)
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_getBlockByNumber", mock.Anything, false).Return(fmt.Errorf("pop")).Once()
+	err = s.processNewEvents(context.Background())
+	assert.Regexp("eth_getBlockByNumber returned: pop", err)
+	assert.Equal(int64(100), s.nextBlock.Int64())
+
+	// A block not yet available on the node is read on the next poll
+	mockBlock(rpc, 100, false, `null`)
+	err = s.processNewEvents(context.Background())
+	assert.NoError(err)
+	assert.Equal(int64(100), s.nextBlock.Int64())
+	assert.False(s.info.Synchronized)
+}
+
+func TestBlockSubscriptionBadKind(t *testing.T) {
+	stream := &eventStream{spec: &StreamInfo{ID: "es1"}}
+	_, err := newSubscription(&mockSubMgr{stream: stream}, nil, nil, nil, &SubscriptionInfo{Kind: "wrong"})
+	assert.Regexp(t, "Unknown subscription kind 'wrong'", err)
+	_, err = newSubscription(&mockSubMgr{stream: stream}, nil, nil, nil, &SubscriptionInfo{
+		Kind:  SubscriptionKindBlocks,
+		Event: &ethbinding.ABIElementMarshaling{Name: "ping"},
+	})
+	assert.Regexp(t, "An event cannot be specified for a subscription of kind 'blocks'", err)
+}
+
+func TestRestoreBlockSubscription(t *testing.T) {
+	stream := &eventStream{spec: &StreamInfo{ID: "es1"}}
+	s, err := restoreSubscription(&mockSubMgr{stream: stream}, nil, nil, &SubscriptionInfo{ID: "sub1", Kind: SubscriptionKindTransactions})
+	assert.NoError(t, err)
+	assert.Equal(t, "sub1:transactions", s.logName)
+	assert.True(t, s.filterStale)
+}
+
+func TestAddBlockSubscriptionDirect(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	rpc := &ethmocks.RPCClient{}
+	rpc.On("CallContext", mock.Anything, mock.Anything, mock.Anything).Return(fmt.Errorf("pop"))
+	sm.rpc = rpc
+	defer sm.Close(true)
+	ctx := context.Background()
+
+	stream, err := sm.AddStream(ctx, &StreamInfo{Type: "websocket"})
+	assert.NoError(err)
+	addr := ethbind.API.HexToAddress(testAddress(1))
+	sub, err := sm.AddSubscriptionDirect(ctx, &SubscriptionCreateDTO{
+		Stream:    stream.ID,
+		Kind:      SubscriptionKindTransactions,
+		Addresses: []ethbinding.Address{addr},
+	})
+	assert.NoError(err)
+	assert.Equal(SubscriptionKindTransactions, sub.Kind)
+	assert.Equal([]ethbinding.Address{addr}, sub.Filter.Addresses)
+	assert.Nil(sub.Filter.Topics)
+
+	_, err = sm.AddSubscriptionDirect(ctx, &SubscriptionCreateDTO{
+		Stream: stream.ID,
+		Kind:   "wrong",
+	})
+	assert.Regexp("Unknown subscription kind", err)
+}
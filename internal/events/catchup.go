@@ -0,0 +1,165 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"math/big"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// tooManyResults matches the errors nodes and RPC providers return when a log query covers too
+// many results, or too wide a block range, for them to serve
+var tooManyResults = regexp.MustCompile(`(?i)(more than \d+ results|too many|response size|limit exceeded|block range)`)
+
+// catchupPage is a range of blocks read concurrently with the other pages of a catchup round
+type catchupPage struct {
+	from *big.Int
+	to   *big.Int
+	logs []*logEntry
+	err  error
+}
+
+func (s *subscription) currentCatchupPageSize() int64 {
+	if s.catchupPageSize > 0 {
+		return s.catchupPageSize
+	}
+	if s.catchupModePageSize > 0 {
+		return s.catchupModePageSize
+	}
+	return defaultCatchupModePageSize
+}
+
+// catchupPages divides the blocks from the catchup block into consecutive pages, one for each
+// parallel request, without going beyond the head of the chain when it is known
+func (s *subscription) catchupPages(pageSize int64) []*catchupPage {
+	parallelism := s.catchupParallelism
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+	pages := make([]*catchupPage, 0, parallelism)
+	from := new(big.Int).Set(s.catchupBlock)
+	for i := 0; i < parallelism; i++ {
+		if s.catchupHead != nil && from.Cmp(s.catchupHead) > 0 {
+			break
+		}
+		to := new(big.Int).Add(from, big.NewInt(pageSize-1))
+		if s.catchupHead != nil && to.Cmp(s.catchupHead) > 0 {
+			to.Set(s.catchupHead)
+		}
+		pages = append(pages, &catchupPage{from: from, to: to})
+		from = new(big.Int).Add(to, big.NewInt(1))
+	}
+	return pages
+}
+
+// adaptCatchupPageSize halves the page size when the node rejects a page as too large, and
+// doubles it (up to the maximum) when a whole round of pages comes back empty
+func (s *subscription) adaptCatchupPageSize(pageSize int64, shrink bool) {
+	if shrink {
+		pageSize /= 2
+		if pageSize < 1 {
+			pageSize = 1
+		}
+	} else {
+		maxPageSize := s.catchupMaxPageSize
+		if maxPageSize < s.catchupModePageSize {
+			maxPageSize = s.catchupModePageSize
+		}
+		pageSize *= 2
+		if pageSize > maxPageSize {
+			pageSize = maxPageSize
+		}
+	}
+	if pageSize != s.catchupPageSize {
+		log.Infof("%s: catchup mode page size %d -> %d", s.logName, s.currentCatchupPageSize(), pageSize)
+		s.catchupPageSize = pageSize
+	}
+}
+
+// processCatchupBlocks reads a round of pages of historical logs concurrently, and processes them in
+// block order. Processing stops at the first page that failed, which is read again on the next round.
+func (s *subscription) processCatchupBlocks(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	pageSize := s.currentCatchupPageSize()
+	pages := s.catchupPages(pageSize)
+	if len(pages) == 0 {
+		return nil
+	}
+	log.Infof("%s: catchup mode. Blocks %d -> %d (pages=%d size=%d)", s.logName, pages[0].from.Int64(), pages[len(pages)-1].to.Int64(), len(pages), pageSize)
+	var wg sync.WaitGroup
+	for _, p := range pages {
+		wg.Add(1)
+		go func(p *catchupPage) {
+			defer wg.Done()
+			f := &ethFilter{}
+			f.persistedFilter = s.info.Filter
+			f.FromBlock.ToInt().Set(p.from)
+			f.ToBlock = "0x" + p.to.Text(16)
+			p.err = s.rpc.CallContext(ctx, &p.logs, "eth_getLogs", f)
+		}(p)
+	}
+	wg.Wait()
+
+	empty := true
+	for _, p := range pages {
+		if p.err != nil {
+			if tooManyResults.MatchString(p.err.Error()) {
+				s.adaptCatchupPageSize(pageSize, true)
+			}
+			return errors.Errorf(errors.RPCCallReturnedError, "eth_getLogs", p.err)
+		}
+		if len(p.logs) == 0 {
+			// We only want to catch up once - so see if we can update our HWM based on the fact
+			// we know these historical blocks are empty.
+			s.lp.markNoEvents(p.to)
+		} else {
+			empty = false
+			s.processLogs(ctx, "eth_getLogs", p.logs)
+		}
+		s.catchupBlock = new(big.Int).Add(p.to, big.NewInt(1))
+	}
+	if empty {
+		s.adaptCatchupPageSize(pageSize, false)
+	}
+	return nil
+}
+
+// catchupProgress is the percentage of the blocks between the start of catchup mode and the
+// head of the chain that have been read
+func (s *subscription) catchupProgress() float64 {
+	start, current, head := s.catchupStartBlock, s.catchupBlock, s.catchupHead
+	if start == nil || current == nil || head == nil {
+		return 0
+	}
+	total := new(big.Int).Sub(head, start)
+	if total.Sign() <= 0 {
+		return 100
+	}
+	done := new(big.Int).Sub(current, start)
+	pct, _ := new(big.Float).Quo(new(big.Float).SetInt(done), new(big.Float).SetInt(total)).Float64()
+	pct = float64(int64(pct*10000)) / 100 // two decimal places
+	if pct > 100 {
+		pct = 100
+	}
+	return pct
+}
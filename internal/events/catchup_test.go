@@ -0,0 +1,184 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/ethbind"
+	"github.com/hyperledger/firefly-ethconnect/mocks/ethmocks"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestCatchupSub(t *testing.T, sm *subscriptionMGR, stream *eventStream, from, head int64) *subscription {
+	event, err := ethbind.API.ABIElementMarshalingToABIEvent(testChangedEventABI)
+	assert.NoError(t, err)
+	info := &SubscriptionInfo{ID: "sub1", Stream: stream.spec.ID, Event: testChangedEventABI}
+	info.Filter.Topics = [][]ethbinding.Hash{{event.ID}}
+	sub, err := restoreSubscription(sm, sm.rpc, sm.cr, info)
+	assert.NoError(t, err)
+	sub.lp.initBlockHWM(big.NewInt(from))
+	sub.catchupStartBlock = big.NewInt(from)
+	sub.catchupBlock = big.NewInt(from)
+	sub.catchupHead = big.NewInt(head)
+	return sub
+}
+
+// mockCatchupLogs returns the test logs in the range of each eth_getLogs call, or an error for pages
+// that start at or after failFrom. Earlier pages take longer, so they complete out of order.
+func mockCatchupLogs(t *testing.T, failFrom int64) (*ethmocks.RPCClient, *[]*ethFilter) {
+	testDataBytes, err := ioutil.ReadFile("../../test/simplevents_logs.json")
+	assert.NoError(t, err)
+	var testData []*logEntry
+	err = json.Unmarshal(testDataBytes, &testData)
+	assert.NoError(t, err)
+
+	var mux sync.Mutex
+	filters := []*ethFilter{}
+	rpc := &ethmocks.RPCClient{}
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_getLogs", mock.Anything).Run(func(args mock.Arguments) {
+		f := args[3].(*ethFilter)
+		mux.Lock()
+		filters = append(filters, f)
+		delay := time.Duration(5-len(filters)) * 5 * time.Millisecond
+		mux.Unlock()
+		time.Sleep(delay)
+		to, _ := new(big.Int).SetString(f.ToBlock[2:], 16)
+		logs := []*logEntry{}
+		for _, l := range testData {
+			if l.BlockNumber.ToInt().Cmp(f.FromBlock.ToInt()) >= 0 && l.BlockNumber.ToInt().Cmp(to) <= 0 {
+				logs = append(logs, l)
+			}
+		}
+		*(args[1].(*[]*logEntry)) = logs
+	}).Return(func(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+		if failFrom >= 0 && args[0].(*ethFilter).FromBlock.ToInt().Int64() >= failFrom {
+			return fmt.Errorf("query returned more than 10000 results")
+		}
+		return nil
+	})
+	return rpc, &filters
+}
+
+func TestCatchupParallelPagesInOrder(t *testing.T) {
+	assert := assert.New(t)
+	sm, stream, svr, eventStream := newTestStreamForBatching(&StreamInfo{
+		BatchSize:      10,
+		BatchTimeoutMS: 50,
+		Webhook:        &webhookActionInfo{},
+	}, nil, 200)
+	defer svr.Close()
+	defer stream.stop(false)
+	rpc, filters := mockCatchupLogs(t, -1)
+	sm.rpc = rpc
+
+	sub := newTestCatchupSub(t, sm, stream, 150600, 150750)
+	sub.catchupParallelism = 3
+	sub.catchupModePageSize = 60
+	err := sub.processNewEvents(context.Background())
+	assert.NoError(err)
+
+	// The last page is cut short at the head of the chain
+	assert.Len(*filters, 3)
+	ranges := map[int64]string{}
+	for _, f := range *filters {
+		ranges[f.FromBlock.ToInt().Int64()] = f.ToBlock
+	}
+	assert.Equal(map[int64]string{150600: "0x24c83", 150660: "0x24cbf", 150720: "0x24cde"}, ranges)
+	assert.Equal(int64(150751), sub.catchupBlock.Int64())
+	assert.Equal(int64(60), sub.currentCatchupPageSize())
+
+	var events []*eventData
+	for len(events) < 3 {
+		events = append(events, <-eventStream...)
+	}
+	assert.Equal("150665", events[0].BlockNumber)
+	assert.Equal("150665", events[1].BlockNumber)
+	assert.Equal("150721", events[2].BlockNumber)
+
+	// Nothing more to read until the head moves on
+	err = sub.processNewEvents(context.Background())
+	assert.NoError(err)
+	assert.Len(*filters, 3)
+}
+
+func TestCatchupAdaptivePageSize(t *testing.T) {
+	assert := assert.New(t)
+	sm, stream, svr, _ := newTestStreamForBatching(&StreamInfo{Webhook: &webhookActionInfo{}}, nil, 200)
+	defer svr.Close()
+	defer stream.stop(false)
+	rpc, filters := mockCatchupLogs(t, 1200)
+	sm.rpc = rpc
+
+	sub := newTestCatchupSub(t, sm, stream, 1000, 100000)
+	sub.catchupParallelism = 2
+	sub.catchupModePageSize = 100
+	sub.catchupMaxPageSize = 300
+
+	// Empty pages grow the page size, up to the maximum
+	err := sub.processNewEvents(context.Background())
+	assert.NoError(err)
+	assert.Equal(int64(1200), sub.catchupBlock.Int64())
+	assert.Equal(int64(200), sub.currentCatchupPageSize())
+	hwm := sub.blockHWM()
+	assert.Equal(int64(1200), hwm.Int64())
+
+	// Rejected pages shrink it, and processing stops at the first failed page
+	err = sub.processNewEvents(context.Background())
+	assert.Regexp("eth_getLogs returned: query returned more than 10000 results", err)
+	assert.Equal(int64(1200), sub.catchupBlock.Int64())
+	assert.Equal(int64(100), sub.currentCatchupPageSize())
+	assert.Len(*filters, 4)
+
+	sub.catchupPageSize = 250
+	sub.adaptCatchupPageSize(250, false)
+	assert.Equal(int64(300), sub.currentCatchupPageSize())
+	sub.adaptCatchupPageSize(1, true)
+	assert.Equal(int64(1), sub.currentCatchupPageSize())
+}
+
+func TestCatchupProgressStatus(t *testing.T) {
+	assert := assert.New(t)
+	sub := &subscription{
+		info:                &SubscriptionInfo{ID: "sub1"},
+		lp:                  &logProcessor{blockHWM: *big.NewInt(1000)},
+		catchupModePageSize: 250,
+	}
+	assert.Equal(float64(0), sub.catchupProgress())
+
+	sub.catchupStartBlock = big.NewInt(1000)
+	sub.catchupBlock = big.NewInt(1250)
+	sub.catchupHead = big.NewInt(4000)
+	status := sub.status(big.NewInt(4000), nil)
+	assert.True(status.InCatchupMode)
+	assert.Equal("1250", status.CatchupBlock)
+	assert.Equal("4000", status.CatchupTargetBlock)
+	assert.Equal(int64(250), status.CatchupPageSize)
+	assert.Equal(8.33, status.CatchupProgress)
+
+	sub.catchupBlock = big.NewInt(4001)
+	assert.Equal(float64(100), sub.catchupProgress())
+	sub.catchupHead = big.NewInt(1000)
+	assert.Equal(float64(100), sub.catchupProgress())
+}
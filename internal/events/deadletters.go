@@ -0,0 +1,239 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/errors"
+	"github.com/hyperledger/firefly-ethconnect/internal/kvstore"
+	"github.com/hyperledger/firefly-ethconnect/internal/messages"
+	"github.com/hyperledger/firefly-ethconnect/internal/utils"
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	deadLetterIDPrefix = "dl-"
+)
+
+// DeadLetter is a batch of events that was skipped by a stream with ErrorHandlingSkip,
+// after exhausting the retry behavior configured on the stream
+type DeadLetter struct {
+	messages.TimeSorted
+	ID       string       `json:"id"`
+	Stream   string       `json:"stream"`
+	BatchID  string       `json:"batchId"`
+	Attempts int          `json:"attempts"`
+	Error    string       `json:"error,omitempty"`
+	Events   []*eventData `json:"events"`
+}
+
+// GetID returns the ID (for sorting)
+func (dl *DeadLetter) GetID() string {
+	return dl.ID
+}
+
+func deadLetterKey(streamID, id string) string {
+	return deadLetterIDPrefix + streamID + "/" + id
+}
+
+// deadLetter records a skipped batch against the stream
+func (a *eventStream) deadLetter(batchNumber uint64, attempts int, events []*eventData, batchErr error) {
+	dl := &DeadLetter{
+		TimeSorted: messages.TimeSorted{
+			CreatedISO8601: time.Now().UTC().Format(time.RFC3339),
+		},
+		ID:       utils.UUIDv4(),
+		Stream:   a.spec.ID,
+		BatchID:  batchID(events),
+		Attempts: attempts,
+		Events:   events,
+	}
+	if batchErr != nil {
+		dl.Error = batchErr.Error()
+	}
+	if err := a.sm.storeDeadLetter(dl); err != nil {
+		log.Errorf("%s: Failed to store dead letter for batch %d: %s", a.spec.ID, batchNumber, err)
+		return
+	}
+	log.Warnf("%s: Batch %d skipped with %d events. Stored as dead letter %s", a.spec.ID, batchNumber, len(events), dl.ID)
+	a.updateDeadLetterCount(1)
+}
+
+func (a *eventStream) updateDeadLetterCount(delta int64) {
+	a.batchCond.L.Lock()
+	defer a.batchCond.L.Unlock()
+	count := int64(a.deadLetters) + delta
+	if count < 0 {
+		count = 0
+	}
+	a.deadLetters = uint64(count)
+}
+
+// requeueBatch pushes a previously formed batch back onto the queue for the batch processor.
+// The batch will not advance the HWM of any subscription, unless the caller has set batchComplete
+// on the events.
+func (a *eventStream) requeueBatch(events []*eventData, front bool) {
+	for _, event := range events {
+		if event.batchComplete == nil {
+			event.batchComplete = func(*eventData) {}
+		}
+	}
+	a.batchCond.L.Lock()
+	defer a.batchCond.L.Unlock()
+	a.inFlight += uint64(len(events))
+	if front {
+		a.batchQueue.PushFront(events)
+	} else {
+		a.batchQueue.PushBack(events)
+	}
+	a.batchCond.Broadcast()
+}
+
+func (s *subscriptionMGR) storeDeadLetter(dl *DeadLetter) error {
+	b, _ := json.MarshalIndent(dl, "", "  ")
+	if err := s.db.Put(deadLetterKey(dl.Stream, dl.ID), b); err != nil {
+		return errors.Errorf(errors.EventStreamsDeadLetterStoreFailed, err)
+	}
+	return nil
+}
+
+func (s *subscriptionMGR) deadLetterByID(streamID, id string) (*DeadLetter, error) {
+	var dl DeadLetter
+	err := s.db.GetJSON(deadLetterKey(streamID, id), &dl)
+	if err == leveldb.ErrNotFound {
+		return nil, errors.Errorf(errors.EventStreamsDeadLetterNotFound, id)
+	} else if err != nil {
+		return nil, err
+	}
+	return &dl, nil
+}
+
+func deadLetterRange(streamID string) *kvstore.Range {
+	prefix := deadLetterIDPrefix + streamID
+	return &kvstore.Range{
+		Start: []byte(prefix + "/"), // the beginning of the key sets with the `prefix/`
+		Limit: []byte(prefix + "0"), // this is after the last key with a `prefix/` ('0' is after '/')
+	}
+}
+
+// deadLetterKeys returns the keys of all the dead letters stored for a stream, without loading them
+func (s *subscriptionMGR) deadLetterKeys(streamID string) []string {
+	it := s.db.NewIteratorWithRange(deadLetterRange(streamID))
+	defer it.Release()
+	keys := make([]string, 0)
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	return keys
+}
+
+func (s *subscriptionMGR) deadLettersForStream(streamID string) ([]*DeadLetter, error) {
+	it := s.db.NewIteratorWithRange(deadLetterRange(streamID))
+	defer it.Release()
+	dls := make([]*DeadLetter, 0)
+	for it.Next() {
+		var dl DeadLetter
+		if err := it.ValueJSON(&dl); err != nil {
+			return nil, err
+		}
+		dls = append(dls, &dl)
+	}
+	sort.Slice(dls, func(i, j int) bool {
+		return dls[i].IsLessThan(dls[i], dls[j])
+	})
+	return dls, nil
+}
+
+// DeadLetters lists the skipped batches for a stream, newest first
+func (s *subscriptionMGR) DeadLetters(ctx context.Context, streamID string) ([]*DeadLetter, error) {
+	if _, err := s.streamByID(streamID); err != nil {
+		return nil, err
+	}
+	return s.deadLettersForStream(streamID)
+}
+
+// DeadLetterByID returns a single skipped batch, including the events
+func (s *subscriptionMGR) DeadLetterByID(ctx context.Context, streamID, id string) (*DeadLetter, error) {
+	if _, err := s.streamByID(streamID); err != nil {
+		return nil, err
+	}
+	return s.deadLetterByID(streamID, id)
+}
+
+// RedeliverDeadLetter queues the events of a dead letter for delivery on the stream again,
+// and removes the dead letter. If delivery fails again, a new dead letter will be recorded.
+func (s *subscriptionMGR) RedeliverDeadLetter(ctx context.Context, streamID, id string) error {
+	stream, err := s.streamByID(streamID)
+	if err != nil {
+		return err
+	}
+	dl, err := s.deadLetterByID(streamID, id)
+	if err != nil {
+		return err
+	}
+	if err := s.db.Delete(deadLetterKey(streamID, id)); err != nil {
+		return err
+	}
+	log.Infof("%s: Redelivering dead letter %s with %d events", streamID, id, len(dl.Events))
+	stream.updateDeadLetterCount(-1)
+	stream.requeueBatch(dl.Events, false)
+	return nil
+}
+
+// DeleteDeadLetter removes a single dead letter without redelivery
+func (s *subscriptionMGR) DeleteDeadLetter(ctx context.Context, streamID, id string) error {
+	stream, err := s.streamByID(streamID)
+	if err != nil {
+		return err
+	}
+	if _, err := s.deadLetterByID(streamID, id); err != nil {
+		return err
+	}
+	if err := s.db.Delete(deadLetterKey(streamID, id)); err != nil {
+		return err
+	}
+	stream.updateDeadLetterCount(-1)
+	return nil
+}
+
+// PurgeDeadLetters removes all dead letters for a stream
+func (s *subscriptionMGR) PurgeDeadLetters(ctx context.Context, streamID string) error {
+	stream, err := s.streamByID(streamID)
+	if err != nil {
+		return err
+	}
+	purged, err := s.purgeDeadLetters(streamID)
+	if purged > 0 {
+		stream.updateDeadLetterCount(-int64(purged))
+	}
+	return err
+}
+
+// purgeDeadLetters removes every key under the dead letter prefix of the stream, including any
+// that cannot be parsed, so nothing is left behind when a stream is deleted
+func (s *subscriptionMGR) purgeDeadLetters(streamID string) (purged int, err error) {
+	for _, key := range s.deadLetterKeys(streamID) {
+		if err := s.db.Delete(key); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/kvstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkippedBatchDeadLetterLifecycle(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+
+	db, _ := kvstore.NewLDBKeyValueStore(path.Join(dir, "db"))
+	sm, stream, svr, eventStream := newTestStreamForBatching(
+		&StreamInfo{
+			BatchSize:     1,
+			ErrorHandling: ErrorHandlingSkip,
+			Webhook:       &webhookActionInfo{},
+		}, db, 500, 200)
+	defer svr.Close()
+	defer sm.Close(true)
+	ctx := context.Background()
+
+	// First delivery fails, and is skipped into the dead letter store
+	ev1 := testEvent("sub1")
+	ev1.ID = "ev1"
+	stream.handleEvent(ev1)
+	<-eventStream
+	for stream.status().DeadLetters == 0 {
+		time.Sleep(1 * time.Millisecond)
+	}
+	dls, err := sm.DeadLetters(ctx, stream.spec.ID)
+	assert.NoError(err)
+	assert.Len(dls, 1)
+	assert.Equal(batchID([]*eventData{{ID: "ev1"}}), dls[0].BatchID)
+	assert.Regexp("Failed with status=500", dls[0].Error)
+
+	dl, err := sm.DeadLetterByID(ctx, stream.spec.ID, dls[0].ID)
+	assert.NoError(err)
+	assert.Equal("ev1", dl.Events[0].ID)
+
+	// Redeliver succeeds, and removes the dead letter
+	err = sm.RedeliverDeadLetter(ctx, stream.spec.ID, dl.ID)
+	assert.NoError(err)
+	redelivered := <-eventStream
+	assert.Equal("ev1", redelivered[0].ID)
+	assert.Equal(uint64(0), stream.status().DeadLetters)
+	_, err = sm.DeadLetterByID(ctx, stream.spec.ID, dl.ID)
+	assert.Regexp("not found", err)
+
+	// Purge and delete
+	sm.storeDeadLetter(&DeadLetter{ID: "dl1", Stream: stream.spec.ID})
+	sm.storeDeadLetter(&DeadLetter{ID: "dl2", Stream: stream.spec.ID})
+	stream.updateDeadLetterCount(2)
+	err = sm.DeleteDeadLetter(ctx, stream.spec.ID, "dl1")
+	assert.NoError(err)
+	assert.Equal(uint64(1), stream.status().DeadLetters)
+	err = sm.PurgeDeadLetters(ctx, stream.spec.ID)
+	assert.NoError(err)
+	assert.Equal(uint64(0), stream.status().DeadLetters)
+	dls, err = sm.DeadLetters(ctx, stream.spec.ID)
+	assert.NoError(err)
+	assert.Empty(dls)
+	close(eventStream)
+}
+
+func TestDeadLetterErrors(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	ctx := context.Background()
+
+	_, err := sm.DeadLetters(ctx, "nope")
+	assert.Regexp("not found", err)
+	_, err = sm.DeadLetterByID(ctx, "nope", "dl1")
+	assert.Regexp("not found", err)
+	err = sm.RedeliverDeadLetter(ctx, "nope", "dl1")
+	assert.Regexp("not found", err)
+	err = sm.DeleteDeadLetter(ctx, "nope", "dl1")
+	assert.Regexp("not found", err)
+	err = sm.PurgeDeadLetters(ctx, "nope")
+	assert.Regexp("not found", err)
+
+	stream, err := sm.AddStream(ctx, &StreamInfo{
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: "http://test.invalid"},
+	})
+	assert.NoError(err)
+	defer sm.Close(true)
+
+	err = sm.RedeliverDeadLetter(ctx, stream.ID, "dl1")
+	assert.Regexp("Dead letter with ID 'dl1' not found", err)
+	err = sm.DeleteDeadLetter(ctx, stream.ID, "dl1")
+	assert.Regexp("Dead letter with ID 'dl1' not found", err)
+
+	sm.db.(*kvstore.MockKV).StoreErr = fmt.Errorf("pop")
+	err = sm.storeDeadLetter(&DeadLetter{ID: "dl1", Stream: stream.ID})
+	assert.Regexp("pop", err)
+	sm.db.(*kvstore.MockKV).StoreErr = nil
+
+	sm.db.(*kvstore.MockKV).LoadErr = fmt.Errorf("pop")
+	_, err = sm.DeadLetterByID(ctx, stream.ID, "dl1")
+	assert.Regexp("pop", err)
+}
+
+func TestDeadLettersRecoveredAndPurgedOnDelete(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	ctx := context.Background()
+
+	stream, err := sm.AddStream(ctx, &StreamInfo{
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: "http://test.invalid"},
+	})
+	assert.NoError(err)
+	sm.storeDeadLetter(&DeadLetter{ID: "dl1", Stream: stream.ID})
+	sm.storeDeadLetter(&DeadLetter{ID: "dl2", Stream: stream.ID})
+	sm.db.Put(deadLetterKey(stream.ID, "dl3"), []byte("!json"))
+
+	// The count is rebuilt from the dead letter store on restart, rather than stored on the stream
+	sm.streams[stream.ID].stop(false)
+	delete(sm.streams, stream.ID)
+	sm.recoverStreams()
+	assert.Equal(uint64(3), sm.streams[stream.ID].status().DeadLetters)
+
+	// Every dead letter is removed with the stream
+	err = sm.DeleteStream(ctx, stream.ID)
+	assert.NoError(err)
+	assert.Empty(sm.deadLetterKeys(stream.ID))
+	sm.Close(true)
+}
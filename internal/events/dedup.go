@@ -0,0 +1,145 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"strconv"
+
+	lru "github.com/hashicorp/golang-lru"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// MaxDeduplicationWindow is the maximum that a user can specify for the deduplication window of a stream
+	MaxDeduplicationWindow = 10000
+)
+
+// dedupEntry tracks an event dispatched on a stream that deduplicates events, along with the
+// duplicates of it detected by other subscriptions on the stream. The duplicates are dropped, but
+// their subscriptions are completed along with the event, so the high water marks move on.
+// Once the event is in a batch, the entry is guarded by the batch lock.
+type dedupEntry struct {
+	event      *eventData
+	batched    bool // only accessed by the batch dispatcher
+	completed  bool
+	abandoned  bool // the batch was dropped when the stream was suspended, so the event will be re-detected
+	duplicates []*eventData
+}
+
+// deduplicator is owned by the batch dispatcher, and remembers the last events dispatched
+type deduplicator struct {
+	stream *eventStream
+	recent *lru.Cache
+}
+
+func (a *eventStream) newDeduplicator() *deduplicator {
+	if a.spec.DeduplicationWindow == 0 {
+		return nil
+	}
+	recent, _ := lru.New(int(a.spec.DeduplicationWindow))
+	return &deduplicator{stream: a, recent: recent}
+}
+
+// dedupKey identifies the log (or block or transaction) of an event on the chain
+func dedupKey(event *eventData) string {
+	logIndex := ""
+	if event.LogIndex != "" {
+		logIndex = strconv.FormatUint(event.blockLogIndex, 10)
+	}
+	return event.BlockHash + "/" + event.TransactionHash + "/" + logIndex + "/" + event.Status
+}
+
+// isDuplicate returns true if the event is the same log as a recent event from another subscription,
+// in which case the subscription is added to the subIds of that event, and the event is not dispatched
+func (d *deduplicator) isDuplicate(event *eventData) bool {
+	if d == nil || event.BlockHash == "" {
+		return false
+	}
+	key := dedupKey(event)
+	if cached, ok := d.recent.Get(key); ok {
+		entry := cached.(*dedupEntry)
+		if !entry.hasSubscription(event.SubID) && d.addDuplicate(entry, event) {
+			log.Debugf("%s: Event %s from subscription %s is a duplicate of %s", d.stream.spec.ID, key, event.SubID, entry.event.ID)
+			return true
+		}
+	}
+	event.SubIDs = []string{event.SubID}
+	event.dedup = &dedupEntry{event: event}
+	d.recent.Add(key, event.dedup)
+	return false
+}
+
+func (d *deduplicator) addDuplicate(entry *dedupEntry, event *eventData) bool {
+	if !entry.batched {
+		// The event is still being built into a batch by the dispatcher, so we can update it
+		entry.event.SubIDs = append(entry.event.SubIDs, event.SubID)
+		entry.duplicates = append(entry.duplicates, event)
+		return true
+	}
+	d.stream.batchCond.L.Lock()
+	defer d.stream.batchCond.L.Unlock()
+	switch {
+	case entry.abandoned:
+		return false
+	case entry.completed:
+		if !event.provisional() {
+			event.batchComplete(event)
+		}
+	default:
+		entry.duplicates = append(entry.duplicates, event)
+	}
+	return true
+}
+
+func (entry *dedupEntry) hasSubscription(subID string) bool {
+	for _, s := range entry.event.SubIDs {
+		if s == subID {
+			return true
+		}
+	}
+	return false
+}
+
+// markBatched is called by the dispatcher, with the batch lock held, as it queues a batch
+func markBatched(events []*eventData) {
+	for _, event := range events {
+		if event.dedup != nil {
+			event.dedup.batched = true
+		}
+	}
+}
+
+// markCompleted is called with the batch lock held, and returns the events to complete for the batch,
+// with the duplicates of each event following it
+func markCompleted(events []*eventData) (toComplete []*eventData) {
+	toComplete = make([]*eventData, 0, len(events))
+	for _, event := range events {
+		toComplete = append(toComplete, event)
+		if event.dedup != nil {
+			event.dedup.completed = true
+			toComplete = append(toComplete, event.dedup.duplicates...)
+		}
+	}
+	return toComplete
+}
+
+// markAbandoned is called with the batch lock held, for batches that will be re-detected
+func markAbandoned(events []*eventData) {
+	for _, event := range events {
+		if event.dedup != nil {
+			event.dedup.abandoned = true
+		}
+	}
+}
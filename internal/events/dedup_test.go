@@ -0,0 +1,120 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeduplicateAcrossSubscriptions(t *testing.T) {
+	assert := assert.New(t)
+	_, stream, svr, eventStream := newTestStreamForBatching(&StreamInfo{
+		BatchSize:           2,
+		BatchTimeoutMS:      60000,
+		DeduplicationWindow: 10,
+		Webhook:             &webhookActionInfo{},
+	}, nil, 200)
+	defer svr.Close()
+	defer stream.stop(false)
+
+	var completedMux sync.Mutex
+	completed := make(map[string]string)
+	newEvent := func(subID, blockNumber string, logIndex uint64) *eventData {
+		return &eventData{
+			SubID:           subID,
+			BlockNumber:     blockNumber,
+			BlockHash:       "0x" + blockNumber,
+			TransactionHash: "0xabcd",
+			LogIndex:        "0", // the position in the logs returned to each subscription
+			blockLogIndex:   logIndex,
+			batchComplete: func(e *eventData) {
+				completedMux.Lock()
+				completed[subID] = e.BlockNumber
+				completedMux.Unlock()
+			},
+		}
+	}
+	getCompleted := func(subID string) string {
+		completedMux.Lock()
+		defer completedMux.Unlock()
+		return completed[subID]
+	}
+
+	// The same log detected by two subscriptions is delivered once
+	stream.handleEvent(newEvent("sub1", "10", 0))
+	stream.handleEvent(newEvent("sub2", "10", 0))
+	stream.handleEvent(newEvent("sub1", "11", 0))
+	batch := <-eventStream
+	assert.Len(batch, 2)
+	assert.Equal([]string{"sub1", "sub2"}, batch[0].SubIDs)
+	assert.Equal([]string{"sub1"}, batch[1].SubIDs)
+
+	// Both subscriptions are completed along with the batch
+	assert.Eventually(func() bool { return getCompleted("sub1") == "11" }, 5*time.Second, time.Millisecond)
+	assert.Equal("10", getCompleted("sub2"))
+
+	// A duplicate of an event that has already completed is completed immediately
+	stream.handleEvent(newEvent("sub2", "11", 0))
+	assert.Eventually(func() bool { return getCompleted("sub2") == "11" }, 5*time.Second, time.Millisecond)
+
+	// The same subscription detecting the log again is not deduplicated
+	stream.handleEvent(newEvent("sub1", "11", 0))
+	stream.handleEvent(newEvent("sub1", "12", 1))
+	batch = <-eventStream
+	assert.Len(batch, 2)
+	assert.Equal("11", batch[0].BlockNumber)
+}
+
+func TestDeduplicateBatchedEvents(t *testing.T) {
+	assert := assert.New(t)
+	stream := &eventStream{
+		spec:      &StreamInfo{ID: "es1", DeduplicationWindow: 10},
+		batchCond: sync.NewCond(&sync.Mutex{}),
+	}
+	d := stream.newDeduplicator()
+	newEvent := func(subID string) *eventData {
+		return &eventData{SubID: subID, BlockHash: "0x12345", TransactionHash: "0xabcd", LogIndex: "1", blockLogIndex: 5}
+	}
+
+	// Duplicates of events in a batch that is in flight are completed with the batch
+	original := newEvent("sub1")
+	assert.False(d.isDuplicate(original))
+	markBatched([]*eventData{original})
+	duplicate := newEvent("sub2")
+	assert.True(d.isDuplicate(duplicate))
+	assert.Equal([]string{"sub1"}, original.SubIDs)
+	assert.Equal([]*eventData{original, duplicate}, markCompleted([]*eventData{original}))
+
+	// Events in a batch that was abandoned are dispatched again when re-detected
+	markAbandoned([]*eventData{original})
+	redetected := newEvent("sub2")
+	assert.False(d.isDuplicate(redetected))
+	assert.Equal([]string{"sub2"}, redetected.SubIDs)
+
+	// Other logs in the same transaction are not duplicates
+	other := newEvent("sub3")
+	other.blockLogIndex = 6
+	assert.False(d.isDuplicate(other))
+
+	// Events without a block hash, and streams without deduplication, are not deduplicated
+	assert.False(d.isDuplicate(&eventData{SubID: "sub3"}))
+	stream.spec.DeduplicationWindow = 0
+	assert.Nil(stream.newDeduplicator())
+	assert.False(stream.newDeduplicator().isDuplicate(newEvent("sub3")))
+}
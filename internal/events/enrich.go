@@ -0,0 +1,142 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/hyperledger/firefly-ethconnect/internal/eth"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	log "github.com/sirupsen/logrus"
+)
+
+// logEnricher adds block timestamps and transaction inputs to pages of log entries.
+// Timestamps are added when it has a timestamp cache, and inputs when it has an ABI.
+type logEnricher struct {
+	rpc            eth.RPCClient
+	logName        string
+	timestampCache *lru.Cache // block number -> timestamp
+	txInfoCache    *lru.Cache // transaction hash -> *eth.TxnInfo
+	abi            *ethbinding.RuntimeABI
+}
+
+// logEnricher returns the enricher for the logs of the subscription, based on the options of its stream
+func (s *subscription) logEnricher() *logEnricher {
+	stream := s.lp.stream
+	e := &logEnricher{rpc: s.rpc, logName: s.logName}
+	if stream.spec.Timestamps {
+		e.timestampCache = stream.blockTimestampCache
+	}
+	if stream.spec.Inputs {
+		abi, err := loadABI(s.cr, s.info.ABI)
+		if err == nil && abi != nil {
+			e.abi = abi
+			e.txInfoCache = stream.txInfoCache
+		}
+	}
+	return e
+}
+
+// enrichLogs adds the block timestamp and/or the transaction inputs to each of the log entries.
+// The LRU caches are checked first, and any block headers and transactions that are not cached
+// are retrieved together in a single JSON/RPC batch request. Failed lookups leave the timestamp
+// as zero, or the inputs empty, and are not cached so they are attempted again for later logs.
+func (e *logEnricher) enrichLogs(ctx context.Context, logs []*logEntry) {
+	if e.timestampCache == nil && e.abi == nil {
+		return
+	}
+	var batch []eth.BatchElem
+	blockLogs := make(map[string][]*logEntry)
+	txLogs := make(map[string][]*logEntry)
+	for _, l := range logs {
+		if e.timestampCache != nil {
+			// the key in the cache is the block number represented as a string
+			blockNumber := l.BlockNumber.String()
+			if ts, ok := e.timestampCache.Get(blockNumber); ok {
+				l.Timestamp = ts.(uint64)
+			} else {
+				l.Timestamp = 0
+				if _, pending := blockLogs[blockNumber]; !pending {
+					// 2nd parameter (false) indicates it is sufficient to retrieve only hashes of tx objects
+					batch = append(batch, eth.BatchElem{Method: "eth_getBlockByNumber", Args: []interface{}{blockNumber, false}, Result: &ethbinding.Header{}})
+				}
+				blockLogs[blockNumber] = append(blockLogs[blockNumber], l)
+			}
+		}
+		if e.abi != nil {
+			txHash := l.TransactionHash.String()
+			if info, ok := e.getCachedTxInfo(txHash); ok {
+				e.setTransactionInputs(l, info)
+			} else {
+				if _, pending := txLogs[txHash]; !pending {
+					batch = append(batch, eth.BatchElem{Method: "eth_getTransactionByHash", Args: []interface{}{txHash}, Result: &eth.TxnInfo{}})
+				}
+				txLogs[txHash] = append(txLogs[txHash], l)
+			}
+		}
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	log.Debugf("%s: retrieving %d blocks and transactions for %d events", e.logName, len(batch), len(logs))
+	if err := eth.BatchCall(ctx, e.rpc, batch); err != nil {
+		log.Errorf("%s: unable to retrieve blocks and transactions: %s", e.logName, err)
+		return
+	}
+	for _, elem := range batch {
+		key := elem.Args[0].(string)
+		switch result := elem.Result.(type) {
+		case *ethbinding.Header:
+			if elem.Error != nil {
+				log.Errorf("Unable to retrieve block[%s] timestamp: %s", key, elem.Error)
+				continue
+			}
+			for _, l := range blockLogs[key] {
+				l.Timestamp = result.Time
+			}
+			e.timestampCache.Add(key, result.Time)
+		case *eth.TxnInfo:
+			if elem.Error != nil || result.Input == nil {
+				log.Infof("%s: error querying transaction info", e.logName)
+				continue
+			}
+			for _, l := range txLogs[key] {
+				e.setTransactionInputs(l, result)
+			}
+			if e.txInfoCache != nil {
+				e.txInfoCache.Add(key, result)
+			}
+		}
+	}
+}
+
+func (e *logEnricher) getCachedTxInfo(txHash string) (*eth.TxnInfo, bool) {
+	if e.txInfoCache == nil {
+		return nil, false
+	}
+	if info, ok := e.txInfoCache.Get(txHash); ok {
+		return info.(*eth.TxnInfo), true
+	}
+	return nil, false
+}
+
+func (e *logEnricher) setTransactionInputs(l *logEntry, info *eth.TxnInfo) {
+	l.InputSigner, l.InputMethod, l.InputArgs = decodeTransactionInputs(e.abi, e.logName, info)
+}
@@ -0,0 +1,131 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/hyperledger/firefly-ethconnect/internal/eth"
+	"github.com/hyperledger/firefly-ethconnect/internal/ethbind"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+// testBatchRPC is an RPC client that supports batches, and records the requests in each batch
+type testBatchRPC struct {
+	batches  [][]eth.BatchElem
+	batchErr error
+}
+
+func (r *testBatchRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	return fmt.Errorf("unexpected call to %s", method)
+}
+
+func (r *testBatchRPC) BatchCallContext(ctx context.Context, b []eth.BatchElem) error {
+	r.batches = append(r.batches, b)
+	if r.batchErr != nil {
+		return r.batchErr
+	}
+	for i, elem := range b {
+		switch result := elem.Result.(type) {
+		case *ethbinding.Header:
+			if elem.Args[0] == "0x12c" {
+				b[i].Error = fmt.Errorf("pop")
+				continue
+			}
+			result.Time = 1000 + uint64(len(elem.Args[0].(string)))
+		case *eth.TxnInfo:
+			input := append(ethbinding.HexBytes{0xf4, 0xe1, 0x3d, 0xc5}, make([]byte, 32)...) // method1(0)
+			from := ethbind.API.HexToAddress("0x0123456789AbcdeF0123456789abCdef01234567")
+			result.Input = &input
+			result.From = &from
+		}
+	}
+	return nil
+}
+
+func testEnricher(t *testing.T, rpc eth.RPCClient) *logEnricher {
+	abi, err := ethbind.API.ABIMarshalingToABIRuntime(ethbinding.ABIMarshaling{
+		{Type: "function", Name: "method1", Inputs: []ethbinding.ABIArgumentMarshaling{{Name: "arg1", Type: "int32"}}},
+	})
+	assert.NoError(t, err)
+	e := &logEnricher{rpc: rpc, logName: "test", abi: abi}
+	e.timestampCache, _ = lru.New(10)
+	e.txInfoCache, _ = lru.New(10)
+	return e
+}
+
+func testEnrichLog(block int64, tx byte) *logEntry {
+	l := &logEntry{TransactionHash: [32]byte{tx}}
+	l.BlockNumber.ToInt().SetInt64(block)
+	return l
+}
+
+func TestEnrichLogsBatch(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &testBatchRPC{}
+	e := testEnricher(t, rpc)
+
+	logs := []*logEntry{testEnrichLog(100, 1), testEnrichLog(100, 1), testEnrichLog(2000, 2), testEnrichLog(300, 3)}
+	e.enrichLogs(context.Background(), logs)
+
+	// One request for each distinct block and transaction, in a single batch
+	assert.Len(rpc.batches, 1)
+	assert.Len(rpc.batches[0], 6)
+	assert.Equal(uint64(1004), logs[0].Timestamp)
+	assert.Equal(uint64(1004), logs[1].Timestamp)
+	assert.Equal(uint64(1005), logs[2].Timestamp)
+	assert.Equal(uint64(0), logs[3].Timestamp)
+	for _, l := range logs {
+		assert.Equal("method1", l.InputMethod)
+		assert.Equal(ethbind.API.HexToAddress("0x0123456789AbcdeF0123456789abCdef01234567").String(), l.InputSigner)
+	}
+
+	// Only the failed block is requested again
+	logs = []*logEntry{testEnrichLog(100, 1), testEnrichLog(300, 2)}
+	e.enrichLogs(context.Background(), logs)
+	assert.Len(rpc.batches, 2)
+	assert.Len(rpc.batches[1], 1)
+	assert.Equal("eth_getBlockByNumber", rpc.batches[1][0].Method)
+	assert.Equal([]interface{}{"0x12c", false}, rpc.batches[1][0].Args)
+	assert.Equal(uint64(1004), logs[0].Timestamp)
+	assert.Equal("method1", logs[1].InputMethod)
+
+	// Nothing to request when everything is cached
+	e.enrichLogs(context.Background(), []*logEntry{testEnrichLog(2000, 3)})
+	assert.Len(rpc.batches, 2)
+}
+
+func TestEnrichLogsBatchFail(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &testBatchRPC{batchErr: fmt.Errorf("pop")}
+	e := testEnricher(t, rpc)
+
+	l := testEnrichLog(100, 1)
+	l.Timestamp = 100
+	e.enrichLogs(context.Background(), []*logEntry{l})
+	assert.Len(rpc.batches, 1)
+	assert.Equal(uint64(0), l.Timestamp)
+	assert.Empty(l.InputMethod)
+	assert.Equal(0, e.timestampCache.Len())
+	assert.Equal(0, e.txInfoCache.Len())
+
+	e = &logEnricher{rpc: rpc}
+	e.enrichLogs(context.Background(), []*logEntry{l})
+	assert.Len(rpc.batches, 1)
+}
@@ -15,19 +15,26 @@
 package events
 
 import (
+	"bytes"
 	"container/list"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"math/big"
 	"net"
 	"net/url"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/hyperledger/firefly-ethconnect/internal/auth"
 	"github.com/hyperledger/firefly-ethconnect/internal/errors"
 	"github.com/hyperledger/firefly-ethconnect/internal/messages"
+	"github.com/hyperledger/firefly-ethconnect/internal/utils"
 	"github.com/hyperledger/firefly-ethconnect/internal/ws"
 	ethbinding "github.com/kaleido-io/ethbinding/pkg"
 
@@ -38,8 +45,9 @@ import (
 type DistributionMode string
 
 const (
-	DistributionModeBroadcast DistributionMode = "broadcast"
-	DistributionModeWLD       DistributionMode = "workloadDistribution"
+	DistributionModeBroadcast     DistributionMode = "broadcast"
+	DistributionModeWLD           DistributionMode = "workloadDistribution"
+	DistributionModeConsumerGroup DistributionMode = "consumerGroup" // each batch is acked by the member of the group it was sent to
 )
 
 const (
@@ -57,6 +65,8 @@ const (
 	DefaultExponentialBackoffFactor = float64(2.0)
 	// DefaultTimestampCacheSize is the number of entries we will hold in a LRU cache for block timestamps
 	DefaultTimestampCacheSize = 1000
+	// DefaultTxInfoCacheSize is the number of entries we will hold in a LRU cache for transaction info
+	DefaultTxInfoCacheSize = 1000
 )
 
 // StreamInfo configures the stream to perform an action for each event
@@ -69,27 +79,44 @@ type StreamInfo struct {
 	Type                 string               `json:"type,omitempty"`
 	BatchSize            uint64               `json:"batchSize,omitempty"`
 	BatchTimeoutMS       uint64               `json:"batchTimeoutMS,omitempty"`
+	MaxInFlightBatches   uint64               `json:"maxInFlightBatches,omitempty"`  // Batches delivered concurrently, while waiting for earlier batches to be acked
+	BatchOrdering        string               `json:"batchOrdering,omitempty"`       // One of the BatchOrdering constants - events are delivered in order for each subscription by default
+	DeduplicationWindow  uint64               `json:"deduplicationWindow,omitempty"` // Number of recent events checked for duplicates detected by other subscriptions - zero disables deduplication
+	Ordered              bool                 `json:"ordered,omitempty"`             // Deliver events in chain order across all subscriptions, holding each block until every subscription has read past it
 	ErrorHandling        string               `json:"errorHandling,omitempty"`
 	RetryTimeoutSec      uint64               `json:"retryTimeoutSec,omitempty"`
 	TypoReryDelaySec     uint64               `json:"blockedReryDelaySec,omitempty"`
 	BlockedRetryDelaySec *uint64              `json:"blockedRetryDelaySec,omitempty"`
 	Webhook              *webhookActionInfo   `json:"webhook,omitempty"`
 	WebSocket            *webSocketActionInfo `json:"websocket,omitempty"`
+	SSE                  *sseActionInfo       `json:"sse,omitempty"`
+	Plugin               json.RawMessage      `json:"plugin,omitempty"`     // Opaque configuration for a stream type provided by a plugin
 	Timestamps           bool                 `json:"timestamps,omitempty"` // Include block timestamps in the events generated
 	TimestampCacheSize   int                  `json:"timestampCacheSize,omitempty"`
-	Inputs               bool                 `json:"inputs,omitempty"` // Include input args in the events generated
+	TxInfoCacheSize      int                  `json:"txInfoCacheSize,omitempty"`
+	Inputs               bool                 `json:"inputs,omitempty"`         // Include input args in the events generated
+	PersistBatches       bool                 `json:"persistBatches,omitempty"` // Persist the in-flight batch, so it is replayed with the same composition after a restart
+	Confirmations        *int                 `json:"confirmations,omitempty"`  // Overrides the confirmations required by the block confirmation manager - a negative value on update removes the override
+	// Dispatch each event as "unconfirmed" as soon as it is detected, then as "confirmed" or "removed"
+	ProvisionalNotifications bool `json:"provisionalNotifications,omitempty"`
 }
 
 type webhookActionInfo struct {
 	URL               string            `json:"url,omitempty"`
 	Headers           map[string]string `json:"headers,omitempty"`
-	TLSkipHostVerify  bool              `json:"tlsSkipHostVerify,omitempty"`
+	TLSkipHostVerify  bool              `json:"tlsSkipHostVerify,omitempty"` // deprecated - migrated to tls.insecureSkipVerify
+	TLS               *utils.TLSConfig  `json:"tls,omitempty"`
+	OAuth2            *webhookOAuth2    `json:"oauth2,omitempty"`
 	RequestTimeoutSec uint32            `json:"requestTimeoutSec,omitempty"`
+	Secret            string            `json:"secret,omitempty"`   // when set, each delivery is signed with HMAC-SHA256 in the X-Ethconnect-Signature header
+	Format            string            `json:"format,omitempty"`   // one of the WebhookFormat constants - the default is WebhookFormatArray
+	Template          string            `json:"template,omitempty"` // a Go text/template applied to each event, for WebhookFormatTemplate
 }
 
 type webSocketActionInfo struct {
 	Topic            string           `json:"topic,omitempty"`
 	DistributionMode DistributionMode `json:"distributionMode,omitempty"`
+	ConsumerGroup    string           `json:"consumerGroup,omitempty"` // for DistributionModeConsumerGroup
 }
 
 type eventStream struct {
@@ -103,14 +130,26 @@ type eventStream struct {
 	batchCond               *sync.Cond
 	batchQueue              *list.List
 	batchCount              uint64
+	inFlightBatches         *list.List // batches taken from the queue and not yet completed, in batch number order
+	completionMux           sync.Mutex // serializes the completion of batches that are delivered concurrently
 	initialRetryDelay       time.Duration
 	backoffFactor           float64
 	updateInProgress        bool
 	updateInterrupt         chan struct{} // a zero-sized struct used only for signaling (hand rolled alternative to context)
 	blockTimestampCache     *lru.Cache
+	txInfoCache             *lru.Cache
 	action                  eventStreamAction
 	wsChannels              ws.WebSocketChannels
 	decimalTransactionIndex bool
+	checkpointMux           sync.Mutex      // serializes checkpoint writes between the event poller and batch completion
+	replayedEvents          map[string]bool // subscription and event IDs of events in a replayed batch, that will be re-detected by the poller
+	replayMux               sync.Mutex
+	lastBatchTime           time.Time // time of the last successfully delivered batch
+	lastError               error     // the last error returned by the action, cleared on success
+	lastErrorTime           time.Time
+	pushNotify              chan struct{} // wakes the event poller when logs are pushed by an eth_subscribe subscription
+	ordering                *orderingBuffer
+	deadLetters             uint64 // count of skipped batches held in the dead letter store, guarded by the batch lock
 
 	eventPollerDone     chan struct{}
 	batchProcessorDone  chan struct{}
@@ -122,7 +161,13 @@ type eventStreamAction interface {
 }
 
 func validateWebSocket(w *webSocketActionInfo) error {
-	if w.DistributionMode != "" && w.DistributionMode != DistributionModeBroadcast && w.DistributionMode != DistributionModeWLD {
+	switch w.DistributionMode {
+	case "", DistributionModeBroadcast, DistributionModeWLD:
+	case DistributionModeConsumerGroup:
+		if w.ConsumerGroup == "" {
+			return errors.Errorf(errors.EventStreamsWebSocketNoConsumerGroup)
+		}
+	default:
 		return errors.Errorf(errors.EventStreamsInvalidDistributionMode, w.DistributionMode)
 	}
 	return nil
@@ -142,6 +187,15 @@ func newEventStream(sm subscriptionManager, spec *StreamInfo, wsChannels ws.WebS
 	} else if spec.BatchSize > MaxBatchSize {
 		spec.BatchSize = MaxBatchSize
 	}
+	if spec.MaxInFlightBatches > MaxInFlightBatchesLimit {
+		spec.MaxInFlightBatches = MaxInFlightBatchesLimit
+	}
+	if spec.DeduplicationWindow > MaxDeduplicationWindow {
+		spec.DeduplicationWindow = MaxDeduplicationWindow
+	}
+	if err := validatePipelining(spec); err != nil {
+		return nil, err
+	}
 	if spec.BatchTimeoutMS == 0 {
 		spec.BatchTimeoutMS = 5000
 	}
@@ -153,6 +207,9 @@ func newEventStream(sm subscriptionManager, spec *StreamInfo, wsChannels ws.WebS
 	if spec.TimestampCacheSize == 0 {
 		spec.TimestampCacheSize = DefaultTimestampCacheSize
 	}
+	if spec.TxInfoCacheSize == 0 {
+		spec.TxInfoCacheSize = DefaultTxInfoCacheSize
+	}
 
 	a = &eventStream{
 		sm:                      sm,
@@ -161,16 +218,22 @@ func newEventStream(sm subscriptionManager, spec *StreamInfo, wsChannels ws.WebS
 		eventStream:             make(chan *eventData),
 		batchCond:               sync.NewCond(&sync.Mutex{}),
 		batchQueue:              list.New(),
+		inFlightBatches:         list.New(),
 		initialRetryDelay:       DefaultExponentialBackoffInitial,
 		backoffFactor:           DefaultExponentialBackoffFactor,
 		pollingInterval:         time.Duration(sm.config().EventPollingIntervalSec) * time.Second,
 		wsChannels:              wsChannels,
 		decimalTransactionIndex: sm.config().DecimalTransactionIndex,
+		pushNotify:              make(chan struct{}, 1),
+		ordering:                newOrderingBuffer(),
 	}
 
 	if a.blockTimestampCache, err = lru.New(spec.TimestampCacheSize); err != nil {
 		return nil, errors.Errorf(errors.EventStreamsCreateStreamResourceErr, err)
 	}
+	if a.txInfoCache, err = lru.New(spec.TxInfoCacheSize); err != nil {
+		return nil, errors.Errorf(errors.EventStreamsCreateStreamResourceErr, err)
+	}
 	if a.pollingInterval == 0 {
 		// Let's us do this from UTs, without exposing it
 		a.pollingInterval = 10 * time.Millisecond
@@ -193,8 +256,19 @@ func newEventStream(sm subscriptionManager, spec *StreamInfo, wsChannels ws.WebS
 		if a.action, err = newWebSocketAction(a, spec.WebSocket); err != nil {
 			return nil, err
 		}
+	case "sse":
+		if spec.SSE == nil {
+			spec.SSE = &sseActionInfo{}
+		}
+		a.action = newSSEAction(a)
 	default:
-		return nil, errors.Errorf(errors.EventStreamsInvalidActionType, spec.Type)
+		p, ok := actionPlugins[spec.Type]
+		if !ok {
+			return nil, errors.Errorf(errors.EventStreamsInvalidActionType, spec.Type)
+		}
+		if a.action, err = newPluginAction(a, p, spec); err != nil {
+			return nil, err
+		}
 	}
 
 	a.startEventHandlers(false)
@@ -205,12 +279,28 @@ func newEventStream(sm subscriptionManager, spec *StreamInfo, wsChannels ws.WebS
 // hex string on the return. This was a bug in earlier version of ethconnect, and an option
 // is provided to restore the old behavior in case an application was depending on it.
 func (a *eventStream) formatTransactionIndex(txIndex ethbinding.HexUint) string {
-	if a.decimalTransactionIndex {
+	return formatTransactionIndex(txIndex, a.decimalTransactionIndex)
+}
+
+func formatTransactionIndex(txIndex ethbinding.HexUint, decimal bool) string {
+	if decimal {
 		return strconv.FormatUint(uint64(txIndex), 10)
 	}
 	return txIndex.String()
 }
 
+// batchID is a deterministic identifier for a batch, derived from the IDs of the events it contains.
+// Redelivery of the same batch composition (including after a restart) results in the same ID,
+// so it can be used by the receiving application to de-duplicate.
+func batchID(events []*eventData) string {
+	h := sha256.New()
+	for _, event := range events {
+		h.Write([]byte(event.ID))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 // helper to kick off go routines and any tracking entities
 func (a *eventStream) startEventHandlers(resume bool) {
 	// create a context that can be used to indicate an update to the eventstream
@@ -231,6 +321,24 @@ func (spec *StreamInfo) GetID() string {
 	return spec.ID
 }
 
+// redacted returns a copy of the stream to return from the API, with the secrets masked
+func (spec *StreamInfo) redacted() *StreamInfo {
+	redacted := *spec
+	if spec.Webhook != nil {
+		redacted.Webhook = spec.Webhook.redacted()
+	}
+	return &redacted
+}
+
+// withoutSecrets returns a copy of the stream with the secrets removed, for an export
+func (spec *StreamInfo) withoutSecrets() *StreamInfo {
+	stripped := *spec
+	if spec.Webhook != nil {
+		stripped.Webhook = spec.Webhook.withoutSecrets()
+	}
+	return &stripped
+}
+
 func (spec *StreamInfo) blockedRetryDelaySec() uint64 {
 	if spec.BlockedRetryDelaySec == nil {
 		if spec.TypoReryDelaySec > 0 {
@@ -297,11 +405,24 @@ func (a *eventStream) checkUpdate(newSpec *StreamInfo) (updatedSpec *StreamInfo,
 		return nil, errors.Errorf(errors.EventStreamsCannotUpdateType)
 	}
 	if specCopy.Type == "webhook" && newSpec.Webhook != nil {
+		webhookSpec := *newSpec
+		webhookSpec.Webhook = newSpec.Webhook.withSecretsFrom(specCopy.Webhook)
+		newSpec = &webhookSpec
 		if newSpec.Webhook.RequestTimeoutSec != 0 && newSpec.Webhook.RequestTimeoutSec != specCopy.Webhook.RequestTimeoutSec {
 			setUpdated().Webhook.RequestTimeoutSec = newSpec.Webhook.RequestTimeoutSec
 		}
-		if newSpec.Webhook.TLSkipHostVerify != specCopy.Webhook.TLSkipHostVerify {
-			setUpdated().Webhook.TLSkipHostVerify = newSpec.Webhook.TLSkipHostVerify
+		newSpec.Webhook.migrateTLS()
+		if newSpec.Webhook.TLS != nil && !reflect.DeepEqual(newSpec.Webhook.TLS, specCopy.Webhook.TLS) {
+			if _, err := utils.CreateTLSConfiguration(newSpec.Webhook.TLS); err != nil {
+				return nil, errors.Errorf(errors.EventStreamsWebhookTLSConfig, err)
+			}
+			setUpdated().Webhook.TLS = newSpec.Webhook.TLS
+		}
+		if newSpec.Webhook.OAuth2 != nil && !reflect.DeepEqual(newSpec.Webhook.OAuth2, specCopy.Webhook.OAuth2) {
+			if err := newSpec.Webhook.OAuth2.validate(); err != nil {
+				return nil, err
+			}
+			setUpdated().Webhook.OAuth2 = newSpec.Webhook.OAuth2
 		}
 		if newSpec.Webhook.URL != "" && newSpec.Webhook.URL != specCopy.Webhook.URL {
 			if _, err = url.Parse(newSpec.Webhook.URL); err != nil {
@@ -309,6 +430,24 @@ func (a *eventStream) checkUpdate(newSpec *StreamInfo) (updatedSpec *StreamInfo,
 			}
 			setUpdated().Webhook.URL = newSpec.Webhook.URL
 		}
+		if (newSpec.Webhook.Format != "" && newSpec.Webhook.Format != specCopy.Webhook.Format) ||
+			(newSpec.Webhook.Template != "" && newSpec.Webhook.Template != specCopy.Webhook.Template) {
+			formatSpec := &webhookActionInfo{Format: specCopy.Webhook.Format, Template: specCopy.Webhook.Template}
+			if newSpec.Webhook.Format != "" {
+				formatSpec.Format = newSpec.Webhook.Format
+			}
+			if newSpec.Webhook.Template != "" {
+				formatSpec.Template = newSpec.Webhook.Template
+			}
+			if _, err := formatSpec.validateFormat(); err != nil {
+				return nil, err
+			}
+			setUpdated().Webhook.Format = formatSpec.Format
+			setUpdated().Webhook.Template = formatSpec.Template
+		}
+		if newSpec.Webhook.Secret != "" && newSpec.Webhook.Secret != specCopy.Webhook.Secret {
+			setUpdated().Webhook.Secret = newSpec.Webhook.Secret
+		}
 		for k, v := range newSpec.Webhook.Headers {
 			if specCopy.Webhook.Headers == nil || specCopy.Webhook.Headers[k] != v {
 				setUpdated().Webhook.Headers = newSpec.Webhook.Headers
@@ -323,20 +462,52 @@ func (a *eventStream) checkUpdate(newSpec *StreamInfo) (updatedSpec *StreamInfo,
 		if newSpec.WebSocket.DistributionMode != specCopy.WebSocket.DistributionMode {
 			setUpdated().WebSocket.DistributionMode = newSpec.WebSocket.DistributionMode
 		}
+		if newSpec.WebSocket.ConsumerGroup != "" && newSpec.WebSocket.ConsumerGroup != specCopy.WebSocket.ConsumerGroup {
+			setUpdated().WebSocket.ConsumerGroup = newSpec.WebSocket.ConsumerGroup
+		}
 		// Validate if we changed it
 		if updatedSpec != nil {
-			if err := validateWebSocket(newSpec.WebSocket); err != nil {
+			if err := validateWebSocket(updatedSpec.WebSocket); err != nil {
 				return nil, err
 			}
 		}
 	}
 
+	if specCopy.Type == "sse" && newSpec.SSE != nil {
+		if specCopy.SSE == nil || newSpec.SSE.AutoAck != specCopy.SSE.AutoAck {
+			setUpdated().SSE = &sseActionInfo{AutoAck: newSpec.SSE.AutoAck}
+		}
+	}
+
+	if p, ok := actionPlugins[specCopy.Type]; ok && newSpec.Plugin != nil && !bytes.Equal(newSpec.Plugin, specCopy.Plugin) {
+		if err := validatePluginConfig(p, &StreamInfo{Type: specCopy.Type, Plugin: newSpec.Plugin}); err != nil {
+			return nil, err
+		}
+		setUpdated().Plugin = newSpec.Plugin
+	}
+
 	if specCopy.BatchSize != newSpec.BatchSize && newSpec.BatchSize != 0 && newSpec.BatchSize < MaxBatchSize {
 		setUpdated().BatchSize = newSpec.BatchSize
 	}
 	if specCopy.BatchTimeoutMS != newSpec.BatchTimeoutMS && newSpec.BatchTimeoutMS != 0 {
 		setUpdated().BatchTimeoutMS = newSpec.BatchTimeoutMS
 	}
+	if specCopy.MaxInFlightBatches != newSpec.MaxInFlightBatches && newSpec.MaxInFlightBatches != 0 && newSpec.MaxInFlightBatches <= MaxInFlightBatchesLimit {
+		setUpdated().MaxInFlightBatches = newSpec.MaxInFlightBatches
+	}
+	if newSpec.BatchOrdering != "" && specCopy.BatchOrdering != newSpec.BatchOrdering {
+		setUpdated().BatchOrdering = newSpec.BatchOrdering
+	}
+	if specCopy.Ordered != newSpec.Ordered {
+		setUpdated().Ordered = newSpec.Ordered
+	}
+	deduplicationWindow := newSpec.DeduplicationWindow
+	if deduplicationWindow > MaxDeduplicationWindow {
+		deduplicationWindow = MaxDeduplicationWindow
+	}
+	if specCopy.DeduplicationWindow != deduplicationWindow {
+		setUpdated().DeduplicationWindow = deduplicationWindow
+	}
 	if newSpec.BlockedRetryDelaySec != nil && specCopy.blockedRetryDelaySec() != newSpec.blockedRetryDelaySec() {
 		blockedRetryDelaySec := newSpec.blockedRetryDelaySec()
 		setUpdated().BlockedRetryDelaySec = &blockedRetryDelaySec
@@ -357,6 +528,32 @@ func (a *eventStream) checkUpdate(newSpec *StreamInfo) (updatedSpec *StreamInfo,
 	if specCopy.Inputs != newSpec.Inputs {
 		setUpdated().Inputs = newSpec.Inputs
 	}
+	if specCopy.PersistBatches != newSpec.PersistBatches {
+		setUpdated().PersistBatches = newSpec.PersistBatches
+	}
+	if newSpec.Confirmations != nil && *newSpec.Confirmations < 0 {
+		// Revert to the confirmations required by the block confirmation manager
+		if specCopy.Confirmations != nil {
+			setUpdated().Confirmations = nil
+		}
+	} else if newSpec.Confirmations != nil && (specCopy.Confirmations == nil || *specCopy.Confirmations != *newSpec.Confirmations) {
+		if err := validateConfirmations(a.sm, newSpec.Confirmations); err != nil {
+			return nil, err
+		}
+		confirmations := *newSpec.Confirmations
+		setUpdated().Confirmations = &confirmations
+	}
+	if specCopy.ProvisionalNotifications != newSpec.ProvisionalNotifications {
+		if err := validateSharedLogs(a.sm, newSpec.ProvisionalNotifications); err != nil {
+			return nil, err
+		}
+		setUpdated().ProvisionalNotifications = newSpec.ProvisionalNotifications
+	}
+	if updatedSpec != nil {
+		if err := validatePipelining(updatedSpec); err != nil {
+			return nil, err
+		}
+	}
 
 	// Return a non-nil object ONLY if there's a change
 	return updatedSpec, nil
@@ -374,6 +571,23 @@ func (a *eventStream) update(newSpec *StreamInfo) (spec *StreamInfo, err error)
 		return a.spec, nil
 	}
 
+	// A plugin action is replaced with one using the new configuration, which is created
+	// before the stream is interrupted so a failure leaves the stream running unchanged
+	var newAction *pluginAction
+	if p, ok := actionPlugins[updatedSpec.Type]; ok && !bytes.Equal(updatedSpec.Plugin, a.spec.Plugin) {
+		if newAction, err = newPluginAction(a, p, updatedSpec); err != nil {
+			return nil, err
+		}
+	}
+
+	// A webhook template is parsed up front in the same way, and swapped in once no batches are in flight
+	var newTemplate *template.Template
+	if updatedSpec.Webhook != nil && updatedSpec.Webhook.Format == WebhookFormatTemplate {
+		if newTemplate, err = parseWebhookTemplate(updatedSpec.Webhook.Template); err != nil {
+			return nil, err
+		}
+	}
+
 	// set a flag to indicate updateInProgress
 	// For any go routines that are Wait() ing on the eventListener, wake them up
 	if err := a.preUpdateStream(); err != nil {
@@ -384,12 +598,23 @@ func (a *eventStream) update(newSpec *StreamInfo) (spec *StreamInfo, err error)
 	<-a.eventPollerDone
 	<-a.batchProcessorDone
 	<-a.batchDispatcherDone
+	if newAction != nil {
+		a.closeAction()
+		a.action = newAction
+	}
+	if w, ok := a.action.(*webhookAction); ok {
+		w.tmpl = newTemplate
+	}
 	defer a.postUpdateStream()
 	return a.spec, nil
 }
 
 // HandleEvent is the entry point for the stream from the event detection logic
 func (a *eventStream) handleEvent(event *eventData) {
+	if a.isReplayed(event) {
+		log.Infof("%s: Event %s already dispatched in replayed batch", a.spec.ID, event.ID)
+		return
+	}
 	// Does nothing more than add it to the batch, to be picked up
 	// by the batchDispatcher
 	select {
@@ -408,6 +633,9 @@ func (a *eventStream) stop(wait bool) {
 		if a.updateInterrupt != nil {
 			close(a.updateInterrupt)
 		}
+		if _, ok := a.action.(*pluginAction); ok {
+			go a.closeActionOnExit(a.eventPollerDone, a.batchProcessorDone, a.batchDispatcherDone)
+		}
 	}
 	a.batchCond.Broadcast()
 	a.batchCond.L.Unlock()
@@ -418,6 +646,20 @@ func (a *eventStream) stop(wait bool) {
 	}
 }
 
+// closeActionOnExit closes the action once the goroutines that use it have exited
+func (a *eventStream) closeActionOnExit(done ...chan struct{}) {
+	for _, c := range done {
+		<-c
+	}
+	a.closeAction()
+}
+
+func (a *eventStream) closeAction() {
+	if pa, ok := a.action.(*pluginAction); ok {
+		pa.close()
+	}
+}
+
 // suspend only stops the dispatcher, pushing back as if we're in blocking mode
 func (a *eventStream) suspend() {
 	a.batchCond.L.Lock()
@@ -462,12 +704,12 @@ func (a *eventStream) resume() error {
 func (a *eventStream) isBlocked() bool {
 	a.batchCond.L.Lock()
 	inFlight := a.inFlight
-	isBlocked := inFlight >= a.spec.BatchSize
+	isBlocked := inFlight >= a.spec.maxInFlightEvents()
 	a.batchCond.L.Unlock()
 	if isBlocked {
-		log.Warnf("%s: Is currently blocked. InFlight=%d BatchSize=%d", a.spec.ID, inFlight, a.spec.BatchSize)
+		log.Warnf("%s: Is currently blocked. InFlight=%d BatchSize=%d MaxInFlightBatches=%d", a.spec.ID, inFlight, a.spec.BatchSize, a.spec.maxInFlightBatches())
 	} else if inFlight > 0 {
-		log.Debugf("%s: InFlight=%d BatchSize=%d", a.spec.ID, inFlight, a.spec.BatchSize)
+		log.Debugf("%s: InFlight=%d BatchSize=%d MaxInFlightBatches=%d", a.spec.ID, inFlight, a.spec.BatchSize, a.spec.maxInFlightBatches())
 	}
 	return isBlocked
 }
@@ -478,6 +720,7 @@ func (a *eventStream) markAllSubscriptionsStale(ctx context.Context) {
 	for _, sub := range subs {
 		sub.markFilterStale(ctx, true)
 	}
+	a.ordering.reset()
 }
 
 // eventPoller checks every few seconds against the ethereum node for any
@@ -493,11 +736,22 @@ func (a *eventStream) eventPoller() {
 		if checkpoint == nil {
 			if checkpoint, err = a.sm.loadCheckpoint(a.spec.ID); err != nil {
 				log.Errorf("%s: Failed to load checkpoint: %s", a.spec.ID, err)
+			} else if a.spec.PersistBatches {
+				a.replayInflightBatch()
 			}
 		}
 		// If we're not blocked, then grab some more events
 		subs := a.sm.subscriptionsForStream(a.spec.ID)
 		if err == nil && !a.isBlocked() {
+			// In ordered mode, events are held until every subscription has read past their block
+			var head *big.Int
+			var headErr error
+			if a.spec.Ordered {
+				if head, headErr = a.orderedHead(ctx, subs); headErr != nil {
+					log.Errorf("%s: Failed to read the head block for ordered delivery: %s", a.spec.ID, headErr)
+				}
+			}
+			failed := make(map[string]bool)
 			for _, sub := range subs {
 				// We do the reset on the event processing thread, to avoid any concurrency issue.
 				// It's just an unsubscribe, which clears the resetRequested flag and sets us stale.
@@ -523,9 +777,14 @@ func (a *eventStream) eventPoller() {
 				}
 				if err != nil {
 					log.Errorf("%s: subscription error: %s", a.spec.ID, err)
+					failed[sub.info.ID] = true
 					err = nil
 				}
 			}
+			a.fetchSharedLogs(ctx, subs, failed)
+			if headErr == nil {
+				a.dispatchOrdered(subs, head, failed)
+			}
 		}
 		// Record a new checkpoint if needed
 		if checkpoint != nil {
@@ -542,9 +801,11 @@ func (a *eventStream) eventPoller() {
 				checkpoint[sub.info.ID] = new(big.Int).Set(&i2)
 			}
 			if changed {
+				a.checkpointMux.Lock()
 				if err = a.sm.storeCheckpoint(a.spec.ID, checkpoint); err != nil {
 					log.Errorf("%s: Failed to store checkpoint: %s", a.spec.ID, err)
 				}
+				a.checkpointMux.Unlock()
 			}
 		}
 		// the event poller reacts to notification about a stream update, else it starts
@@ -555,6 +816,7 @@ func (a *eventStream) eventPoller() {
 			log.Infof("%s: Notified of an ongoing stream update, existing event poller", a.spec.ID)
 			a.markAllSubscriptionsStale(ctx)
 			return
+		case <-a.pushNotify: // logs were pushed to one of our subscriptions, so process them now
 		case <-time.After(a.pollingInterval): //fall through and continue to the next iteration
 		}
 	}
@@ -571,6 +833,7 @@ func (a *eventStream) batchDispatcher() {
 	defer close(a.batchDispatcherDone)
 	var currentBatch []*eventData
 	var batchStart time.Time
+	dedup := a.newDeduplicator()
 	batchTimeout := time.Duration(a.spec.BatchTimeoutMS) * time.Millisecond
 	for {
 		// Wait for the next event - if we're in the middle of a batch, we
@@ -591,6 +854,9 @@ func (a *eventStream) batchDispatcher() {
 					log.Infof("%s: Event stream stopped while waiting for in-flight batch to fill", a.spec.ID)
 					return
 				}
+				if dedup.isDuplicate(event) {
+					continue
+				}
 				currentBatch = append(currentBatch, event)
 			case <-a.updateInterrupt:
 				// we were notified by the caller about an ongoing update, cancel the timeout ctx and return
@@ -610,6 +876,9 @@ func (a *eventStream) batchDispatcher() {
 					log.Infof("%s: Event stream stopped", a.spec.ID)
 					return
 				}
+				if dedup.isDuplicate(event) {
+					continue
+				}
 				currentBatch = []*eventData{event}
 				log.Infof("%s: New batch length %d", a.spec.ID, len(currentBatch))
 				batchStart = time.Now()
@@ -621,6 +890,7 @@ func (a *eventStream) batchDispatcher() {
 			if !timeout {
 				a.inFlight++
 			}
+			markBatched(currentBatch)
 			a.batchQueue.PushBack(currentBatch)
 			a.batchCond.Broadcast()
 			a.batchCond.L.Unlock()
@@ -641,14 +911,27 @@ func (a *eventStream) suspendOrStop() bool {
 // batchProcessor picks up batches from the batchDispatcher, and performs the blocking
 // actions required to perform the action itself.
 // We use a sync.Cond rather than a channel to communicate with this goroutine, as
-// it might be blocked for very large periods of time
+// it might be blocked for very large periods of time.
+// When the stream allows multiple batches in flight, each batch is delivered on its own
+// goroutine, and the processor waits for them all to return before it exits.
 func (a *eventStream) batchProcessor() {
+	var delivering sync.WaitGroup
 	defer close(a.batchProcessorDone)
+	defer func() {
+		delivering.Wait()
+		// Batches that were not completed are re-detected from the checkpoint
+		a.batchCond.L.Lock()
+		for e := a.inFlightBatches.Front(); e != nil; e = e.Next() {
+			markAbandoned(e.Value.(*inFlightBatch).events)
+		}
+		a.inFlightBatches.Init()
+		a.batchCond.L.Unlock()
+	}()
 
 	for {
-		// Wait for the next batch, or to be stopped
+		// Wait for the next batch that can be delivered, or to be stopped
 		a.batchCond.L.Lock()
-		for !a.suspendOrStop() && a.batchQueue.Len() == 0 {
+		for !a.suspendOrStop() && (a.batchQueue.Len() == 0 || !a.canStartBatch(a.batchQueue.Front().Value.([]*eventData))) {
 			if a.updateInProgress {
 				a.batchCond.L.Unlock()
 				<-a.updateInterrupt
@@ -668,11 +951,35 @@ func (a *eventStream) batchProcessor() {
 		a.batchCount++
 		batchNumber := a.batchCount
 		a.batchQueue.Remove(batchElem)
+		events := batchElem.Value.([]*eventData)
+		if len(events) == 0 {
+			a.batchCond.L.Unlock()
+			continue
+		}
+		a.inFlightBatches.PushBack(&inFlightBatch{
+			batchNumber: batchNumber,
+			events:      events,
+			keys:        a.orderingKeys(events),
+		})
 		a.batchCond.L.Unlock()
+		if a.spec.PersistBatches && len(events) > 0 {
+			// Record the batch before we attempt it, so the same composition is replayed if we restart
+			if err := a.sm.storeInflightBatch(a.spec.ID, events); err != nil {
+				log.Errorf("%s: Failed to store in-flight batch %d: %s", a.spec.ID, batchNumber, err)
+			}
+		}
 		// Process the batch - could block for a very long time, particularly if
 		// ErrorHandlingBlock is configured.
 		// Track this as an item in the update wait group
-		a.processBatch(batchNumber, batchElem.Value.([]*eventData))
+		if a.spec.maxInFlightBatches() > 1 {
+			delivering.Add(1)
+			go func() {
+				defer delivering.Done()
+				a.processBatch(batchNumber, events)
+			}()
+		} else {
+			a.processBatch(batchNumber, events)
+		}
 	}
 }
 
@@ -705,6 +1012,9 @@ func (a *eventStream) processBatch(batchNumber uint64, events []*eventData) {
 			log.Errorf("%s: Batch %d attempt %d failed. ErrorHandling=%s BlockedRetryDelay=%ds err=%s",
 				a.spec.ID, batchNumber, attempt, a.spec.ErrorHandling, a.spec.BlockedRetryDelaySec, err)
 			processed = (a.spec.ErrorHandling == ErrorHandlingSkip)
+			if processed && !a.suspendOrStop() {
+				a.deadLetter(batchNumber, attempt, events, err)
+			}
 		}
 	}
 
@@ -720,16 +1030,86 @@ func (a *eventStream) processBatch(batchNumber uint64, events []*eventData) {
 		return
 	}
 
-	// Call all the callbacks on the events, so they can update their high water marks
-	// If there are multiple events from one SubID, we call it only once with the
-	// last message in the batch
-	cbs := make(map[string]*eventData)
+	a.completeBatch(batchNumber)
+}
+
+func (a *eventStream) provisionalNotifications() bool {
+	return a.spec != nil && a.spec.ProvisionalNotifications
+}
+
+// recordBatchResult keeps track of the outcome of the latest batch attempt, for status reporting
+func (a *eventStream) recordBatchResult(err error) {
+	a.batchCond.L.Lock()
+	defer a.batchCond.L.Unlock()
+	if err != nil {
+		a.lastError = err
+		a.lastErrorTime = time.Now().UTC()
+	} else {
+		a.lastError = nil
+		a.lastBatchTime = time.Now().UTC()
+	}
+}
+
+// checkpointBatch records a checkpoint covering a completed batch, and only then removes
+// the persisted copy of the batch. A crash between the two results in the same batch being
+// replayed with the same batch ID, rather than a new batch being formed from re-detected events.
+func (a *eventStream) checkpointBatch() {
+	a.checkpointMux.Lock()
+	defer a.checkpointMux.Unlock()
+	checkpoint := make(map[string]*big.Int)
+	for _, sub := range a.sm.subscriptionsForStream(a.spec.ID) {
+		hwm := sub.blockHWM()
+		checkpoint[sub.info.ID] = new(big.Int).Set(&hwm)
+	}
+	if err := a.sm.storeCheckpoint(a.spec.ID, checkpoint); err != nil {
+		log.Errorf("%s: Failed to store checkpoint for completed batch: %s", a.spec.ID, err)
+		return
+	}
+	a.sm.deleteInflightBatch(a.spec.ID)
+}
+
+// replayInflightBatch re-queues a batch that was persisted before a restart (or suspend/update),
+// ahead of any newly detected events. The events in the batch will be re-detected by the
+// poller from the previous checkpoint, so we record their IDs to avoid dispatching them twice.
+func (a *eventStream) replayInflightBatch() {
+	events, err := a.sm.loadInflightBatch(a.spec.ID)
+	if err != nil {
+		log.Errorf("%s: Failed to load in-flight batch: %s", a.spec.ID, err)
+		return
+	}
+	if len(events) == 0 {
+		return
+	}
+	log.Infof("%s: Replaying in-flight batch %s with %d events", a.spec.ID, batchID(events), len(events))
+	a.replayMux.Lock()
+	a.replayedEvents = make(map[string]bool)
 	for _, event := range events {
-		cbs[event.SubID] = event
+		a.replayedEvents[replayKey(event)] = true
+		event.batchComplete = func(*eventData) {}
+		if sub, err := a.sm.subscriptionByID(event.SubID); err == nil && !event.provisional() {
+			event.batchComplete = sub.lp.batchComplete
+		}
 	}
-	for _, event := range cbs {
-		event.batchComplete(event)
+	a.replayMux.Unlock()
+	a.requeueBatch(events, true)
+}
+
+// replayKey identifies an event detected by a subscription, as the same block or transaction can be
+// detected by more than one subscription on a stream
+func replayKey(event *eventData) string {
+	return event.SubID + "/" + event.ID
+}
+
+// isReplayed checks (and clears) whether an event was already part of a replayed batch
+func (a *eventStream) isReplayed(event *eventData) bool {
+	a.replayMux.Lock()
+	defer a.replayMux.Unlock()
+	key := replayKey(event)
+	if a.replayedEvents[key] {
+		delete(a.replayedEvents, key)
+		return true
 	}
+	return false
 }
 
 // performActionWithRetry performs an action, with exponential backoff retry up
@@ -755,6 +1135,7 @@ func (a *eventStream) performActionWithRetry(batchNumber uint64, events []*event
 		}
 		attempt++
 		err = a.action.attemptBatch(batchNumber, attempt, events)
+		a.recordBatchResult(err)
 		complete = err == nil || time.Until(endTime) < 0
 	}
 	return err
@@ -16,6 +16,9 @@ package events
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -86,7 +89,7 @@ func TestConstructorBadWebSocketDistributionMode(t *testing.T) {
 			DistributionMode: "banana",
 		},
 	}, nil)
-	assert.Regexp("Invalid distribution mode 'banana'. Valid distribution modes are: 'workloadDistribution' and 'broadcast'.", err)
+	assert.Regexp("Invalid distribution mode 'banana'. Valid distribution modes are: 'workloadDistribution', 'broadcast' and 'consumerGroup'.", err)
 }
 
 func testEvent(subID string) *eventData {
@@ -1036,6 +1039,55 @@ func TestInterruptWebSocketBroadcast(t *testing.T) {
 	wg.Wait()
 }
 
+func TestWebSocketConsumerGroup(t *testing.T) {
+	assert := assert.New(t)
+	wsChannels := newMockWebSocket()
+	es := &eventStream{
+		spec:            &StreamInfo{ID: "es1"},
+		wsChannels:      wsChannels,
+		updateInterrupt: make(chan struct{}),
+	}
+	sio, _ := newWebSocketAction(es, &webSocketActionInfo{
+		Topic:            "topic1",
+		DistributionMode: DistributionModeConsumerGroup,
+		ConsumerGroup:    "group1",
+	})
+	go func() {
+		<-wsChannels.sender
+		wsChannels.receiver <- fmt.Errorf("pop")
+	}()
+	err := sio.attemptBatch(5, 1, []*eventData{})
+	assert.EqualError(err, "pop")
+	assert.Equal("topic1", wsChannels.capturedNamespace)
+	assert.Equal("group1", wsChannels.capturedGroup)
+	assert.Equal("es1", wsChannels.capturedStream)
+}
+
+func TestWebSocketConsumerGroupValidation(t *testing.T) {
+	assert := assert.New(t)
+	_, err := newEventStream(newTestSubscriptionManager(), &StreamInfo{
+		ID:        "123",
+		Type:      "websocket",
+		WebSocket: &webSocketActionInfo{DistributionMode: DistributionModeConsumerGroup},
+	}, nil)
+	assert.Regexp("FFEC100266", err)
+
+	sm, stream, _ := newTestStreamForWebSocket(&StreamInfo{
+		Type:      "websocket",
+		WebSocket: &webSocketActionInfo{Topic: "test1"},
+	}, nil)
+	defer sm.Close(true)
+	_, err = sm.UpdateStream(context.Background(), stream.spec.ID, &StreamInfo{
+		WebSocket: &webSocketActionInfo{Topic: "test1", DistributionMode: DistributionModeConsumerGroup},
+	})
+	assert.Regexp("FFEC100266", err)
+	updated, err := sm.UpdateStream(context.Background(), stream.spec.ID, &StreamInfo{
+		WebSocket: &webSocketActionInfo{Topic: "test1", DistributionMode: DistributionModeConsumerGroup, ConsumerGroup: "group1"},
+	})
+	assert.NoError(err)
+	assert.Equal("group1", updated.WebSocket.ConsumerGroup)
+}
+
 func TestInterruptWebSocketSend(t *testing.T) {
 	wsChannels := &mockWebSocket{
 		sender:   make(chan interface{}),
@@ -1471,7 +1523,7 @@ func TestUpdateWebSocketBadDistributionMode(t *testing.T) {
 		},
 	}
 	_, err := sm.UpdateStream(ctx, stream.spec.ID, updateSpec)
-	assert.Regexp("Invalid distribution mode 'banana'. Valid distribution modes are: 'workloadDistribution' and 'broadcast'.", err)
+	assert.Regexp("Invalid distribution mode 'banana'. Valid distribution modes are: 'workloadDistribution', 'broadcast' and 'consumerGroup'.", err)
 }
 
 func TestUpdateWebSocket(t *testing.T) {
@@ -1587,3 +1639,155 @@ func TestDrainBlockConfirmationManager(t *testing.T) {
 
 	stream.drainBlockConfirmationManager()
 }
+
+func TestWebhookIdempotencyKey(t *testing.T) {
+	assert := assert.New(t)
+
+	keys := make(chan string, 1)
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		keys <- req.Header.Get("Idempotency-Key")
+		res.WriteHeader(200)
+	}))
+	defer svr.Close()
+
+	sm := newTestSubscriptionManager()
+	spec, err := sm.AddStream(context.Background(), &StreamInfo{
+		Type:      "webhook",
+		BatchSize: 2,
+		Webhook:   &webhookActionInfo{URL: svr.URL},
+	})
+	assert.NoError(err)
+	stream := sm.streams[spec.ID]
+	defer stream.stop(false)
+
+	e1 := testEvent("sub1")
+	e1.ID = "es1/100/0/0"
+	e2 := testEvent("sub1")
+	e2.ID = "es1/100/0/1"
+	stream.handleEvent(e1)
+	stream.handleEvent(e2)
+
+	assert.Equal(batchID([]*eventData{e1, e2}), <-keys)
+	assert.NotEqual(batchID([]*eventData{e1}), batchID([]*eventData{e1, e2}))
+}
+
+func TestWebhookSignature(t *testing.T) {
+	assert := assert.New(t)
+
+	type delivery struct {
+		signature string
+		body      []byte
+	}
+	deliveries := make(chan *delivery, 1)
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		deliveries <- &delivery{signature: req.Header.Get(WebhookSignatureHeader), body: body}
+		res.WriteHeader(200)
+	}))
+	defer svr.Close()
+
+	verify := func(secret string, d *delivery) {
+		var timestamp int64
+		var sig string
+		_, err := fmt.Sscanf(d.signature, "t=%d,v1=%s", &timestamp, &sig)
+		assert.NoError(err)
+		assert.InDelta(time.Now().Unix(), timestamp, 60)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(fmt.Sprintf("%d.%s", timestamp, d.body)))
+		assert.Equal(hex.EncodeToString(mac.Sum(nil)), sig)
+	}
+
+	sm := newTestSubscriptionManager()
+	spec, err := sm.AddStream(context.Background(), &StreamInfo{
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: svr.URL, Secret: "secret1"},
+	})
+	assert.NoError(err)
+	stream := sm.streams[spec.ID]
+	defer stream.stop(false)
+
+	stream.handleEvent(testEvent("sub1"))
+	verify("secret1", <-deliveries)
+
+	// Rotate the secret
+	spec, err = sm.UpdateStream(context.Background(), spec.ID, &StreamInfo{
+		Webhook: &webhookActionInfo{Secret: "secret2"},
+	})
+	assert.NoError(err)
+	assert.Equal(RedactedSecret, spec.Webhook.Secret)
+	assert.Equal("secret2", stream.spec.Webhook.Secret)
+	stream.handleEvent(testEvent("sub1"))
+	verify("secret2", <-deliveries)
+
+	// The secret is write-only, and kept by updates that omit it or supply the placeholder
+	spec, err = sm.StreamByID(context.Background(), spec.ID)
+	assert.NoError(err)
+	assert.Equal(RedactedSecret, spec.Webhook.Secret)
+	assert.Equal(RedactedSecret, sm.Streams(context.Background())[0].Webhook.Secret)
+	_, err = sm.UpdateStream(context.Background(), spec.ID, spec)
+	assert.NoError(err)
+	_, err = sm.UpdateStream(context.Background(), spec.ID, &StreamInfo{
+		Webhook: &webhookActionInfo{URL: svr.URL},
+	})
+	assert.NoError(err)
+	assert.Equal("secret2", stream.spec.Webhook.Secret)
+	stream.handleEvent(testEvent("sub1"))
+	verify("secret2", <-deliveries)
+
+	// The placeholder cannot be used as the secret of a new stream
+	_, err = sm.AddStream(context.Background(), spec)
+	assert.Regexp("FFEC100274", err)
+
+	assert.Equal("t=1000,v1=61b764235a94f407a10bcf756ee0972f1341f88f2a522db1a619463449dd5fc2", signWebhook("secret", 1000, []byte(`[]`)))
+}
+
+func TestPersistBatchReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	keys := make(chan string, 1)
+	var delivered []*eventData
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		json.NewDecoder(req.Body).Decode(&delivered)
+		keys <- req.Header.Get("Idempotency-Key")
+		res.WriteHeader(200)
+	}))
+	defer svr.Close()
+
+	sm := newTestSubscriptionManager()
+	spec, err := sm.AddStream(context.Background(), &StreamInfo{
+		Type:           "webhook",
+		PersistBatches: true,
+		Webhook:        &webhookActionInfo{URL: svr.URL},
+	})
+	assert.NoError(err)
+	stream := sm.streams[spec.ID]
+	defer stream.stop(false)
+	stream.suspend()
+
+	// Simulate a batch that was in-flight when we previously stopped
+	persisted := []*eventData{
+		{ID: spec.ID + "/sub1/100/0/0", SubID: "sub1", BlockNumber: "100", Confirmations: []*blockInfo{{Number: 101, Timestamp: 12345}}},
+	}
+	err = sm.storeInflightBatch(spec.ID, persisted)
+	assert.NoError(err)
+
+	err = stream.resume()
+	assert.NoError(err)
+	assert.Equal(batchID(persisted), <-keys)
+	assert.Equal(spec.ID+"/sub1/100/0/0", delivered[0].ID)
+	assert.Equal(ethbinding.HexUint(101), delivered[0].Confirmations[0].Number)
+
+	// The same event re-detected by the poller is not re-dispatched
+	assert.True(stream.isReplayed(&eventData{ID: spec.ID + "/sub1/100/0/0", SubID: "sub1"}))
+	assert.False(stream.isReplayed(&eventData{ID: spec.ID + "/sub1/100/0/0", SubID: "sub1"}))
+
+	// Once complete, the checkpoint is stored and the in-flight batch removed
+	for {
+		if _, err := sm.db.Get(inflightIDPrefix + spec.ID); err != nil {
+			break
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+	_, err = sm.loadCheckpoint(spec.ID)
+	assert.NoError(err)
+}
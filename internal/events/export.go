@@ -0,0 +1,345 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/errors"
+	"github.com/hyperledger/firefly-ethconnect/internal/ethbind"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// AdminPathPrefix is the path prefix for the export and import of event streams
+	AdminPathPrefix = "/admin/events"
+
+	exportVersion = 1
+
+	// ImportConflictFail fails the whole import if any stream or subscription already exists (the default)
+	ImportConflictFail = "fail"
+	// ImportConflictSkip leaves existing streams and subscriptions unchanged, and imports the rest
+	ImportConflictSkip = "skip"
+	// ImportConflictReplace deletes existing streams and subscriptions, and replaces them with those in the import.
+	// Replacing a stream also deletes all subscriptions of the existing stream.
+	ImportConflictReplace = "replace"
+
+	importActionCreate  = "create"
+	importActionReplace = "replace"
+	importActionSkip    = "skip"
+)
+
+// EventsExport is the stored configuration and progress of all event streams, for moving them to another server
+type EventsExport struct {
+	Version         int                            `json:"version"`
+	ExportedISO8601 string                         `json:"exported,omitempty"`
+	Streams         []*StreamInfo                  `json:"streams"`
+	Subscriptions   []*SubscriptionInfo            `json:"subscriptions"`
+	Checkpoints     map[string]map[string]*big.Int `json:"checkpoints"`
+}
+
+// ExportOptions control what is included in an export
+type ExportOptions struct {
+	IncludeSecrets bool // the secrets of webhooks are only exported if explicitly requested
+}
+
+// ImportOptions control how an export is imported
+type ImportOptions struct {
+	DryRun   bool
+	Conflict string
+}
+
+// ImportItem is the outcome of the import of a single stream, subscription or checkpoint
+type ImportItem struct {
+	ID     string `json:"id"`
+	Action string `json:"action,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ImportResult reports what was imported, or for a dry run what would be imported
+type ImportResult struct {
+	DryRun        bool          `json:"dryRun"`
+	Streams       []*ImportItem `json:"streams"`
+	Subscriptions []*ImportItem `json:"subscriptions"`
+	Checkpoints   []*ImportItem `json:"checkpoints"`
+}
+
+// Export reads all streams, subscriptions and checkpoints from the events DB
+func (s *subscriptionMGR) Export(ctx context.Context, opts *ExportOptions) (*EventsExport, error) {
+	export := &EventsExport{
+		Version:         exportVersion,
+		ExportedISO8601: time.Now().UTC().Format(time.RFC3339),
+		Streams:         []*StreamInfo{},
+		Subscriptions:   []*SubscriptionInfo{},
+		Checkpoints:     make(map[string]map[string]*big.Int),
+	}
+	it := s.db.NewIterator()
+	defer it.Release()
+	for it.Next() {
+		var err error
+		k := it.Key()
+		switch {
+		case strings.HasPrefix(k, streamIDPrefix):
+			var spec StreamInfo
+			if err = json.Unmarshal(it.Value(), &spec); err == nil {
+				if opts.IncludeSecrets {
+					export.Streams = append(export.Streams, &spec)
+				} else {
+					export.Streams = append(export.Streams, spec.withoutSecrets())
+				}
+			}
+		case strings.HasPrefix(k, subIDPrefix):
+			var info SubscriptionInfo
+			if err = json.Unmarshal(it.Value(), &info); err == nil {
+				export.Subscriptions = append(export.Subscriptions, &info)
+			}
+		case strings.HasPrefix(k, checkpointIDPrefix):
+			var checkpoint map[string]*big.Int
+			if err = json.Unmarshal(it.Value(), &checkpoint); err == nil {
+				export.Checkpoints[strings.TrimPrefix(k, checkpointIDPrefix)] = checkpoint
+			}
+		}
+		if err != nil {
+			return nil, errors.Errorf(errors.EventStreamsExportFailed, k, err)
+		}
+	}
+	log.Infof("Exported %d streams, %d subscriptions and %d checkpoints", len(export.Streams), len(export.Subscriptions), len(export.Checkpoints))
+	return export, nil
+}
+
+// Import creates the streams, subscriptions and checkpoints of an export, preserving their IDs.
+// The whole document is validated before anything is changed, and nothing is changed for a dry run.
+func (s *subscriptionMGR) Import(ctx context.Context, export *EventsExport, opts *ImportOptions) (*ImportResult, error) {
+	switch opts.Conflict {
+	case "":
+		opts.Conflict = ImportConflictFail
+	case ImportConflictFail, ImportConflictSkip, ImportConflictReplace:
+	default:
+		return nil, errors.Errorf(errors.EventStreamsImportBadConflictMode, opts.Conflict)
+	}
+
+	result := &ImportResult{
+		DryRun:        opts.DryRun,
+		Streams:       make([]*ImportItem, len(export.Streams)),
+		Subscriptions: make([]*ImportItem, len(export.Subscriptions)),
+		Checkpoints:   []*ImportItem{},
+	}
+	var problems []string
+	check := func(item *ImportItem, err error) {
+		if err != nil {
+			item.Action = ""
+			item.Error = err.Error()
+			problems = append(problems, item.ID+": "+item.Error)
+		}
+	}
+
+	importedStreams := make(map[string]string)
+	for idx, spec := range export.Streams {
+		item := &ImportItem{ID: spec.ID}
+		result.Streams[idx] = item
+		existing, exists := s.streams[spec.ID]
+		item.Action = s.importAction(exists, opts.Conflict)
+		if item.Action == importActionReplace && spec.Webhook != nil && existing.spec.Webhook != nil {
+			// Exports do not include secrets by default, so keep those of the stream being replaced
+			spec.Webhook = spec.Webhook.withSecretsFrom(existing.spec.Webhook)
+		}
+		err := s.validateImportStream(spec)
+		if err == nil && item.Action == "" {
+			err = errors.Errorf(errors.EventStreamsImportConflict, spec.ID)
+		}
+		check(item, err)
+		importedStreams[spec.ID] = item.Action
+	}
+
+	for idx, info := range export.Subscriptions {
+		item := &ImportItem{ID: info.ID}
+		result.Subscriptions[idx] = item
+		_, err := s.subscriptionByID(info.ID)
+		item.Action = s.importAction(err == nil, opts.Conflict)
+		err = s.validateImportSubscription(info)
+		if err == nil {
+			if _, inImport := importedStreams[info.Stream]; !inImport {
+				_, err = s.streamByID(info.Stream)
+			}
+		}
+		if err == nil && item.Action == "" {
+			err = errors.Errorf(errors.EventStreamsImportConflict, info.ID)
+		}
+		check(item, err)
+	}
+
+	for streamID := range export.Checkpoints {
+		item := &ImportItem{ID: streamID}
+		result.Checkpoints = append(result.Checkpoints, item)
+		action, inImport := importedStreams[streamID]
+		if !inImport {
+			check(item, errors.Errorf(errors.EventStreamsImportCheckpointNoStream, streamID))
+		} else if action == importActionSkip {
+			item.Action = importActionSkip
+		} else {
+			item.Action = importActionCreate
+		}
+	}
+
+	if len(problems) > 0 {
+		return result, errors.Errorf(errors.EventStreamsImportInvalid, strings.Join(problems, "; "))
+	}
+	if opts.DryRun {
+		return result, nil
+	}
+	return result, s.applyImport(ctx, export, result)
+}
+
+// importAction returns what to do with an entry in the import, or an empty string if it conflicts
+func (s *subscriptionMGR) importAction(exists bool, conflict string) string {
+	switch {
+	case !exists:
+		return importActionCreate
+	case conflict == ImportConflictSkip:
+		return importActionSkip
+	case conflict == ImportConflictReplace:
+		return importActionReplace
+	default:
+		return ""
+	}
+}
+
+// validateImportStream performs the checks of newEventStream, without starting the stream
+func (s *subscriptionMGR) validateImportStream(spec *StreamInfo) error {
+	if !strings.HasPrefix(spec.ID, streamIDPrefix) {
+		return errors.Errorf(errors.EventStreamsImportBadID, spec.ID, streamIDPrefix)
+	}
+	switch strings.ToLower(spec.Type) {
+	case "webhook":
+		if _, err := newWebhookAction(nil, spec.Webhook); err != nil {
+			return err
+		}
+	case "websocket":
+		if spec.WebSocket != nil {
+			if err := validateWebSocket(spec.WebSocket); err != nil {
+				return err
+			}
+		}
+	case "sse":
+	default:
+		p, ok := actionPlugins[strings.ToLower(spec.Type)]
+		if !ok {
+			return errors.Errorf(errors.EventStreamsInvalidActionType, spec.Type)
+		}
+		if err := validatePluginConfig(p, spec); err != nil {
+			return err
+		}
+	}
+	if err := validateSharedLogs(s, spec.ProvisionalNotifications); err != nil {
+		return err
+	}
+	return validateConfirmations(s, spec.Confirmations)
+}
+
+// validateImportSubscription performs the checks of newSubscription, without subscribing
+func (s *subscriptionMGR) validateImportSubscription(info *SubscriptionInfo) error {
+	if !strings.HasPrefix(info.ID, subIDPrefix) {
+		return errors.Errorf(errors.EventStreamsImportBadID, info.ID, subIDPrefix)
+	}
+	switch info.Kind {
+	case "", SubscriptionKindEvents:
+		if info.rawLogs() {
+			if err := validateRawLogs(info); err != nil {
+				return err
+			}
+		} else if _, err := ethbind.API.ABIElementMarshalingToABIEvent(info.Event); err != nil {
+			return err
+		}
+	case SubscriptionKindBlocks, SubscriptionKindTransactions, SubscriptionKindReceipts:
+		if info.Event != nil {
+			return errors.Errorf(errors.EventStreamsSubscribeKindNoEvent, info.Kind)
+		}
+	default:
+		return errors.Errorf(errors.EventStreamsSubscribeBadKind, info.Kind)
+	}
+	return validateConfirmations(s, info.Confirmations)
+}
+
+func (s *subscriptionMGR) applyImport(ctx context.Context, export *EventsExport, result *ImportResult) error {
+	// Remove everything being replaced first. Replacing a stream removes all its subscriptions.
+	for idx, spec := range export.Streams {
+		if result.Streams[idx].Action == importActionReplace {
+			if err := s.DeleteStream(ctx, spec.ID); err != nil {
+				return err
+			}
+		}
+	}
+	for idx, info := range export.Subscriptions {
+		if result.Subscriptions[idx].Action == importActionReplace {
+			if sub, err := s.subscriptionByID(info.ID); err == nil {
+				if err := s.deleteSubscription(ctx, sub); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Checkpoints must be stored before the streams start, as they are only loaded by the poller on startup
+	for _, item := range result.Checkpoints {
+		if item.Action != importActionSkip {
+			if err := s.storeCheckpoint(item.ID, export.Checkpoints[item.ID]); err != nil {
+				return err
+			}
+		}
+	}
+
+	for idx, spec := range export.Streams {
+		if result.Streams[idx].Action == importActionSkip {
+			continue
+		}
+		if spec.Path == "" {
+			spec.Path = StreamPathPrefix + "/" + spec.ID
+		}
+		stream, err := newEventStream(s, spec, s.wsChannels)
+		if err != nil {
+			return err
+		}
+		s.streams[spec.ID] = stream
+		if _, err := s.storeStream(spec); err != nil {
+			return err
+		}
+	}
+
+	for idx, info := range export.Subscriptions {
+		if result.Subscriptions[idx].Action == importActionSkip {
+			continue
+		}
+		if info.Path == "" {
+			info.Path = SubPathPrefix + "/" + info.ID
+		}
+		sub, err := restoreSubscription(s, s.rpc, s.cr, info)
+		if err != nil {
+			return err
+		}
+		s.subscriptionsMutex.Lock()
+		s.subscriptions[info.ID] = sub
+		_, err = s.storeSubscription(info)
+		s.subscriptionsMutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	log.Infof("Imported %d streams and %d subscriptions", len(export.Streams), len(export.Subscriptions))
+	return nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"path"
+	"testing"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/kvstore"
+	"github.com/hyperledger/firefly-ethconnect/mocks/ethmocks"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestExportSubscriptionManager(t *testing.T, dir, name string) *subscriptionMGR {
+	rpc := &ethmocks.RPCClient{}
+	rpc.On("CallContext", mock.Anything, mock.Anything, mock.Anything).Return(fmt.Errorf("pop")).Maybe()
+	rpc.On("CallContext", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(fmt.Errorf("pop")).Maybe()
+	sm := newTestSubscriptionManager()
+	sm.rpc = rpc
+	var err error
+	sm.db, err = kvstore.NewLDBKeyValueStore(path.Join(dir, name))
+	assert.NoError(t, err)
+	return sm
+}
+
+func TestExportImport(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+	ctx := context.Background()
+
+	source := newTestExportSubscriptionManager(t, dir, "source")
+	defer source.Close(true)
+	stream, err := source.AddStream(ctx, &StreamInfo{
+		Name:    "stream1",
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: "http://test.invalid", Secret: "secret1"},
+	})
+	assert.NoError(err)
+	err = source.SuspendStream(ctx, stream.ID)
+	assert.NoError(err)
+	sub, err := source.AddSubscription(ctx, nil, nil, &ethbinding.ABIElementMarshaling{Name: "ping"}, stream.ID, "0", "sub1")
+	assert.NoError(err)
+	err = source.storeCheckpoint(stream.ID, map[string]*big.Int{sub.ID: big.NewInt(12345)})
+	assert.NoError(err)
+
+	// Secrets are only exported when requested
+	export, err := source.Export(ctx, &ExportOptions{})
+	assert.NoError(err)
+	assert.Empty(export.Streams[0].Webhook.Secret)
+	export, err = source.Export(ctx, &ExportOptions{IncludeSecrets: true})
+	assert.NoError(err)
+	assert.Equal("secret1", export.Streams[0].Webhook.Secret)
+	assert.Equal(exportVersion, export.Version)
+	assert.Len(export.Streams, 1)
+	assert.Equal(stream.ID, export.Streams[0].ID)
+	assert.Len(export.Subscriptions, 1)
+	assert.Equal(sub.ID, export.Subscriptions[0].ID)
+	assert.Equal(int64(12345), export.Checkpoints[stream.ID][sub.ID].Int64())
+
+	target := newTestExportSubscriptionManager(t, dir, "target")
+	defer target.Close(true)
+
+	// A dry run changes nothing
+	result, err := target.Import(ctx, export, &ImportOptions{DryRun: true})
+	assert.NoError(err)
+	assert.True(result.DryRun)
+	assert.Equal(importActionCreate, result.Streams[0].Action)
+	assert.Equal(importActionCreate, result.Subscriptions[0].Action)
+	assert.Equal(importActionCreate, result.Checkpoints[0].Action)
+	assert.Empty(target.streams)
+	assert.Empty(target.subscriptions)
+
+	result, err = target.Import(ctx, export, &ImportOptions{})
+	assert.NoError(err)
+	assert.False(result.DryRun)
+	imported, err := target.StreamByID(ctx, stream.ID)
+	assert.NoError(err)
+	assert.Equal("stream1", imported.Name)
+	assert.True(imported.Suspended)
+	importedSub, err := target.SubscriptionByID(ctx, sub.ID)
+	assert.NoError(err)
+	assert.Equal("sub1", importedSub.Name)
+	checkpoint, err := target.loadCheckpoint(stream.ID)
+	assert.NoError(err)
+	assert.Equal(int64(12345), checkpoint[sub.ID].Int64())
+
+	// A second import conflicts, unless the conflicts are skipped or replaced
+	_, err = target.Import(ctx, export, &ImportOptions{})
+	assert.Regexp("FFEC100245.*already exists", err)
+
+	result, err = target.Import(ctx, export, &ImportOptions{Conflict: ImportConflictSkip})
+	assert.NoError(err)
+	assert.Equal(importActionSkip, result.Streams[0].Action)
+	assert.Equal(importActionSkip, result.Subscriptions[0].Action)
+	assert.Equal(importActionSkip, result.Checkpoints[0].Action)
+
+	// Replacing a stream with an export without secrets keeps the existing secrets
+	export, err = source.Export(ctx, &ExportOptions{})
+	assert.NoError(err)
+	export.Streams[0].Name = "stream1-updated"
+	result, err = target.Import(ctx, export, &ImportOptions{Conflict: ImportConflictReplace})
+	assert.NoError(err)
+	assert.Equal(importActionReplace, result.Streams[0].Action)
+	assert.Equal(importActionReplace, result.Subscriptions[0].Action)
+	imported, err = target.StreamByID(ctx, stream.ID)
+	assert.NoError(err)
+	assert.Equal("stream1-updated", imported.Name)
+	assert.Equal("secret1", target.streams[stream.ID].spec.Webhook.Secret)
+	_, err = target.SubscriptionByID(ctx, sub.ID)
+	assert.NoError(err)
+	checkpoint, err = target.loadCheckpoint(stream.ID)
+	assert.NoError(err)
+	assert.Equal(int64(12345), checkpoint[sub.ID].Int64())
+
+	// The imported state is stored in the DB
+	export2, err := target.Export(ctx, &ExportOptions{IncludeSecrets: true})
+	assert.NoError(err)
+	assert.Len(export2.Streams, 1)
+	assert.Len(export2.Subscriptions, 1)
+	assert.Len(export2.Checkpoints, 1)
+	assert.Equal("secret1", export2.Streams[0].Webhook.Secret)
+}
+
+func TestImportValidation(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+	ctx := context.Background()
+	sm := newTestExportSubscriptionManager(t, dir, "db")
+	defer sm.Close(true)
+
+	_, err := sm.Import(ctx, &EventsExport{}, &ImportOptions{Conflict: "merge"})
+	assert.Regexp("FFEC100246", err)
+
+	result, err := sm.Import(ctx, &EventsExport{
+		Streams: []*StreamInfo{
+			{ID: "stream1", Type: "webhook", Webhook: &webhookActionInfo{URL: "http://test.invalid"}},
+			{ID: "es-2", Type: "webhook"},
+			{ID: "es-3", Type: "websocket", WebSocket: &webSocketActionInfo{DistributionMode: "random"}},
+			{ID: "es-4", Type: "smoke"},
+		},
+		Subscriptions: []*SubscriptionInfo{
+			{ID: "sub1", Stream: "es-2"},
+			{ID: "sb-2", Stream: "es-unknown", Kind: SubscriptionKindBlocks},
+			{ID: "sb-3", Stream: "es-2", Kind: SubscriptionKindBlocks, Event: &ethbinding.ABIElementMarshaling{Name: "ping"}},
+			{ID: "sb-4", Stream: "es-2", Kind: "logs"},
+		},
+		Checkpoints: map[string]map[string]*big.Int{
+			"es-unknown": {},
+		},
+	}, &ImportOptions{DryRun: true})
+	assert.Regexp("FFEC100245", err)
+	assert.Regexp("FFEC100247.*stream1", result.Streams[0].Error)
+	assert.Regexp("FFEC100031", result.Streams[1].Error)
+	assert.Regexp("FFEC100051", result.Streams[2].Error)
+	assert.Regexp("FFEC100030", result.Streams[3].Error)
+	assert.Regexp("FFEC100247.*sub1", result.Subscriptions[0].Error)
+	assert.Regexp("FFEC100042", result.Subscriptions[1].Error)
+	assert.Regexp("FFEC100243", result.Subscriptions[2].Error)
+	assert.Regexp("FFEC100242", result.Subscriptions[3].Error)
+	assert.Regexp("FFEC100249", result.Checkpoints[0].Error)
+	assert.Empty(sm.streams)
+}
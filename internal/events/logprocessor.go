@@ -15,6 +15,7 @@
 package events
 
 import (
+	"fmt"
 	"math/big"
 	"strconv"
 	"strings"
@@ -27,12 +28,24 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// EventStatusUnconfirmed is the status of the provisional notification of an event, dispatched as soon as it is detected
+	EventStatusUnconfirmed = "unconfirmed"
+	// EventStatusConfirmed is the status of an event that has reached its required confirmations
+	EventStatusConfirmed = "confirmed"
+	// EventStatusRemoved is the status of the notification that an event already dispatched was removed from the chain
+	EventStatusRemoved = "removed"
+	// EventStatusReplayComplete is the status of the marker dispatched after the last event of a replay
+	EventStatusReplayComplete = "replayComplete"
+)
+
 type logEntry struct {
 	Address          ethbinding.Address     `json:"address"`
 	BlockNumber      ethbinding.HexBigInt   `json:"blockNumber"`
 	BlockHash        ethbinding.Hash        `json:"blockHash"`
 	TransactionIndex ethbinding.HexUint     `json:"transactionIndex"`
 	TransactionHash  ethbinding.Hash        `json:"transactionHash"`
+	LogIndex         flexUint               `json:"logIndex"`
 	Data             string                 `json:"data"`
 	Topics           []*ethbinding.Hash     `json:"topics"`
 	Timestamp        uint64                 `json:"timestamp,omitempty"`
@@ -42,7 +55,26 @@ type logEntry struct {
 	Removed          bool                   `json:"removed,omitempty"`
 }
 
+// flexUint accepts either a hex string (as per the JSON/RPC spec) or a plain JSON number,
+// as some nodes return the latter for logIndex
+type flexUint uint64
+
+func (f *flexUint) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		*f = 0
+		return nil
+	}
+	v, err := strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		return err
+	}
+	*f = flexUint(v)
+	return nil
+}
+
 type eventData struct {
+	ID               string                 `json:"id"`
 	Address          string                 `json:"address"`
 	BlockNumber      string                 `json:"blockNumber"`
 	BlockHash        string                 `json:"blockHash"`
@@ -57,20 +89,44 @@ type eventData struct {
 	InputArgs        map[string]interface{} `json:"inputArgs,omitempty"`
 	InputSigner      string                 `json:"inputSigner,omitempty"`
 	Confirmations    []*blockInfo           `json:"confirmations,omitempty"`
+	Status           string                 `json:"status,omitempty"` // Set for removed events, for streams with provisional notifications, and for the end of a replay
+	Topics           []string               `json:"topics,omitempty"` // Set for raw logs that could not be decoded, with the undecoded data in rawData
+	RawData          string                 `json:"rawData,omitempty"`
+	SubIDs           []string               `json:"subIds,omitempty"` // Set on streams that deduplicate events, to all the subscriptions that detected the event
 	// Used for callback handling
 	batchComplete func(*eventData)
+	dedup         *dedupEntry
 
 	// Used to avoid string serialization/de-serialization to block confirmation manager
 	blockNumber      uint64
 	transactionIndex uint64
 	logIndex         uint64
+	blockLogIndex    uint64 // the index of the log in the block, as logIndex is the position in the logs returned to the subscription
+}
+
+// provisional returns true for the early notification of an event that has not been confirmed,
+// and for the notification that an event was removed from the chain
+func (e *eventData) provisional() bool {
+	return e.Status == EventStatusUnconfirmed || e.Status == EventStatusRemoved
+}
+
+// provisionalCopy returns a copy of the event to dispatch with the given status, with a distinct ID
+// so it is not treated as a duplicate of the confirmed event
+func (e *eventData) provisionalCopy(status string) *eventData {
+	provisional := *e
+	provisional.ID = e.ID + "/" + status
+	provisional.Status = status
+	provisional.batchComplete = func(*eventData) {}
+	return &provisional
 }
 
 type logProcessor struct {
 	subID               string
 	event               *ethbinding.ABIEvent
 	stream              *eventStream
+	confirmations       *int // set if the subscription overrides the confirmations required
 	confirmationManager *blockConfirmationManager
+	rawEvents           *rawEventResolver // set for subscriptions to raw logs, to decode them when an ABI is available
 	blockHWM            big.Int
 	highestDispatched   big.Int
 	hwnSync             sync.Mutex
@@ -87,10 +143,22 @@ func newLogProcessor(subID string, event *ethbinding.ABIEvent, stream *eventStre
 	return lp
 }
 
+// requiredConfirmations returns the confirmations required for events on this subscription, if
+// overridden by the subscription or the stream, or nil to use the default of the confirmation manager
+func (lp *logProcessor) requiredConfirmations() *int {
+	if lp.confirmations != nil {
+		return lp.confirmations
+	}
+	return lp.stream.spec.Confirmations
+}
+
 func (lp *logProcessor) batchComplete(newestEvent *eventData) {
 	lp.hwnSync.Lock()
 	i := new(big.Int)
-	i.SetString(newestEvent.BlockNumber, 10)
+	if _, ok := i.SetString(newestEvent.BlockNumber, 10); !ok {
+		lp.hwnSync.Unlock()
+		return
+	}
 	i.Add(i, big.NewInt(1)) // restart from the next block
 	if i.Cmp(&lp.blockHWM) > 0 {
 		lp.blockHWM.Set(i)
@@ -124,13 +192,17 @@ func (lp *logProcessor) initBlockHWM(intVal *big.Int) {
 func (lp *logProcessor) processLogEntry(subInfo string, entry *logEntry, idx int) (err error) {
 
 	blockNumber := entry.BlockNumber.ToInt()
+	event := lp.event
+	if lp.rawEvents != nil {
+		event = lp.rawEvents.resolve(subInfo, entry)
+	}
 	result := &eventData{
+		ID:               eventID(lp.stream.spec.ID, lp.subID, blockNumber, entry),
 		Address:          entry.Address.String(),
 		BlockNumber:      blockNumber.String(),
 		BlockHash:        entry.BlockHash.String(),
 		TransactionIndex: lp.stream.formatTransactionIndex(entry.TransactionIndex),
 		TransactionHash:  entry.TransactionHash.String(),
-		Signature:        ethbind.API.ABIEventSignature(lp.event),
 		Data:             make(map[string]interface{}),
 		SubID:            lp.subID,
 		LogIndex:         strconv.Itoa(idx),
@@ -142,18 +214,98 @@ func (lp *logProcessor) processLogEntry(subInfo string, entry *logEntry, idx int
 		blockNumber:      blockNumber.Uint64(),
 		transactionIndex: uint64(entry.TransactionIndex),
 		logIndex:         uint64(idx),
+		blockLogIndex:    uint64(entry.LogIndex),
 	}
 
-	if entry.Removed {
-		if lp.confirmationManager != nil {
+	if lp.stream.spec.Timestamps {
+		result.Timestamp = strconv.FormatUint(entry.Timestamp, 10)
+	}
+	switch {
+	case event == nil:
+		setRawLogData(entry, result)
+	case lp.rawEvents != nil:
+		// The ABI found for a raw log might not match how the log was emitted, in which case
+		// the log is still dispatched undecoded
+		if err := decodeLogData(subInfo, event, entry, result); err != nil {
+			log.Warnf("%s: Unable to decode raw log with %s: %s", subInfo, ethbind.API.ABIEventSignature(event), err)
+			result.Data = make(map[string]interface{})
+			setRawLogData(entry, result)
+		} else {
+			result.Signature = ethbind.API.ABIEventSignature(event)
+		}
+	default:
+		result.Signature = ethbind.API.ABIEventSignature(event)
+		if err = decodeLogData(subInfo, event, entry, result); err != nil {
+			return err
+		}
+	}
+	lp.dispatch(subInfo, result, entry.Removed)
+	return nil
+}
+
+// dispatch passes an event to the stream, via the confirmation manager if confirmations are required.
+// A removed event is dispatched as a removal notification, if the original was dispatched.
+// In ordered mode, the stream holds the event until it can be dispatched in chain order.
+func (lp *logProcessor) dispatch(subInfo string, result *eventData, removed bool) {
+	if !removed {
+		// Record the block before the event is held in the ordering buffer, so markNoEvents
+		// cannot move the HWM past it
+		lp.hwnSync.Lock()
+		if blockNumber := new(big.Int).SetUint64(result.blockNumber); blockNumber.Cmp(&lp.highestDispatched) > 0 {
+			lp.highestDispatched.Set(blockNumber)
+		}
+		lp.hwnSync.Unlock()
+	}
+	if lp.stream.spec.Ordered {
+		lp.stream.ordering.add(result, removed, func() { lp.dispatchNow(subInfo, result, removed) })
+		return
+	}
+	lp.dispatchNow(subInfo, result, removed)
+}
+
+func (lp *logProcessor) dispatchNow(subInfo string, result *eventData, removed bool) {
+	required := lp.requiredConfirmations()
+	waitForConfirmations := lp.confirmationManager != nil && (required == nil || *required > 0)
+	if removed {
+		if waitForConfirmations {
+			// The confirmation manager knows whether the event was dispatched (provisionally, or after confirmation)
 			lp.confirmationManager.notify(&bcmNotification{
-				nType: bcmRemovedLog,
-				event: result,
+				nType:       bcmRemovedLog,
+				event:       result,
+				eventStream: lp.stream,
 			})
+		} else {
+			// The node only reports a log as removed after it has reported it, so we have dispatched it
+			log.Infof("%s: Dispatching removed event. Address=%s BlockNumber=%s TxIndex=%s", subInfo, result.Address, result.BlockNumber, result.TransactionIndex)
+			lp.stream.handleEvent(result.provisionalCopy(EventStatusRemoved))
 		}
-		return nil
+		return
+	}
+
+	// Ok, now we have the full event in a friendly map output. Pass it down to the event processor
+	log.Infof("%s: Dispatching event. Address=%s BlockNumber=%s TxIndex=%s", subInfo, result.Address, result.BlockNumber, result.TransactionIndex)
+
+	if waitForConfirmations {
+		n := &bcmNotification{
+			nType:       bcmNewLog,
+			event:       result,
+			eventStream: lp.stream,
+		}
+		if required != nil {
+			n.requiredConfirmations = *required
+		}
+		if lp.stream.spec.ProvisionalNotifications {
+			lp.stream.handleEvent(result.provisionalCopy(EventStatusUnconfirmed))
+		}
+		lp.confirmationManager.notify(n)
+	} else {
+		lp.stream.handleEvent(result)
 	}
+}
 
+// decodeLogData decodes the indexed topics and the data of a log entry into the data map
+// of the event, according to the ABI of the event
+func decodeLogData(subInfo string, event *ethbinding.ABIEvent, entry *logEntry, result *eventData) (err error) {
 	var data []byte
 	if strings.HasPrefix(entry.Data, "0x") {
 		data, err = ethbind.API.HexDecode(entry.Data)
@@ -162,22 +314,19 @@ func (lp *logProcessor) processLogEntry(subInfo string, entry *logEntry, idx int
 		}
 	}
 
-	if lp.stream.spec.Timestamps {
-		result.Timestamp = strconv.FormatUint(entry.Timestamp, 10)
-	}
 	topicIdx := 0
-	if !lp.event.Anonymous {
+	if !event.Anonymous {
 		topicIdx++ // first index is the hash of the event description
 	}
 
 	// We need split out the indexed args that we parse out of the topic, from the data args
 	var dataArgs ethbinding.ABIArguments
-	dataArgs = make([]ethbinding.ABIArgument, 0, len(lp.event.Inputs))
-	for idx, input := range lp.event.Inputs {
+	dataArgs = make([]ethbinding.ABIArgument, 0, len(event.Inputs))
+	for idx, input := range event.Inputs {
 		var val interface{}
 		if input.Indexed {
 			if topicIdx >= len(entry.Topics) {
-				return errors.Errorf(errors.EventStreamsLogDecodeInsufficientTopics, subInfo, idx, ethbind.API.ABIEventSignature(lp.event))
+				return errors.Errorf(errors.EventStreamsLogDecodeInsufficientTopics, subInfo, idx, ethbind.API.ABIEventSignature(event))
 			}
 			topic := entry.Topics[topicIdx]
 			topicIdx++
@@ -199,25 +348,30 @@ func (lp *logProcessor) processLogEntry(subInfo string, entry *logEntry, idx int
 			result.Data[k] = v
 		}
 	}
+	return nil
+}
 
-	// Ok, now we have the full event in a friendly map output. Pass it down to the event processor
-	log.Infof("%s: Dispatching event. Address=%s BlockNumber=%s TxIndex=%s", subInfo, result.Address, result.BlockNumber, result.TransactionIndex)
-	lp.hwnSync.Lock()
-	if blockNumber.Cmp(&lp.highestDispatched) > 0 {
-		lp.highestDispatched.Set(blockNumber)
+// setRawLogData sets the undecoded topics and data of a log entry on the event
+func setRawLogData(entry *logEntry, result *eventData) {
+	result.Topics = make([]string, len(entry.Topics))
+	for i, topic := range entry.Topics {
+		if topic != nil {
+			result.Topics[i] = topic.Hex()
+		}
 	}
-	lp.hwnSync.Unlock()
+	result.RawData = entry.Data
+}
 
-	if lp.confirmationManager != nil {
-		lp.confirmationManager.notify(&bcmNotification{
-			nType:       bcmNewLog,
-			event:       result,
-			eventStream: lp.stream,
-		})
-	} else {
-		lp.stream.handleEvent(result)
-	}
-	return nil
+// eventID is a deterministic identifier for an event on a stream, based on the subscription that detected
+// it and its position in the chain. The same log re-detected after a restart or reset results in the same ID,
+// but the same log detected by two subscriptions on the stream does not.
+func eventID(streamID, subID string, blockNumber *big.Int, entry *logEntry) string {
+	return streamID + "/" + subID + "/" + logPosition(blockNumber, entry)
+}
+
+// logPosition identifies a log by its block number, transaction index and log index
+func logPosition(blockNumber *big.Int, entry *logEntry) string {
+	return fmt.Sprintf("%s/%d/%d", blockNumber.String(), uint64(entry.TransactionIndex), uint64(entry.LogIndex))
 }
 
 func topicToValue(topic *ethbinding.Hash, input *ethbinding.ABIArgument) interface{} {
@@ -229,6 +229,25 @@ func TestProcessLogEntryRemovedWithConfirmationManager(t *testing.T) {
 	assert.Equal(uint64(2), notification.event.logIndex)
 }
 
+func TestProcessLogEntryRemovedWithoutConfirmations(t *testing.T) {
+	assert := assert.New(t)
+
+	zero := 0
+	lp, bcm, stream := newTestConfirmationsLogProcessor(t, &StreamInfo{ID: "es1"}, &zero)
+	err := lp.processLogEntry("ut", &logEntry{
+		BlockNumber:      ethbinding.HexBigInt(*big.NewInt(255)),
+		TransactionIndex: ethbinding.HexUint(10),
+		LogIndex:         2,
+		Removed:          true,
+	}, 2)
+	assert.NoError(err)
+	ev := <-stream.eventStream
+	assert.Equal("es1/sub1/255/10/2/removed", ev.ID)
+	assert.Equal(EventStatusRemoved, ev.Status)
+	assert.True(ev.provisional())
+	assert.Empty(bcm.bcmNotifications)
+}
+
 func TestProcessLogEntryDispatchWithConfirmationManager(t *testing.T) {
 	assert := assert.New(t)
 
@@ -271,3 +290,126 @@ func TestProcessLogEntryDispatchWithConfirmationManager(t *testing.T) {
 	assert.Equal(uint64(10), notification.event.transactionIndex)
 	assert.Equal(uint64(2), notification.event.logIndex)
 }
+
+func TestProcessLogEntryDeterministicID(t *testing.T) {
+	assert := assert.New(t)
+
+	stream := &eventStream{
+		spec:        &StreamInfo{ID: "es1"},
+		eventStream: make(chan *eventData, 1),
+	}
+	var marshaling ethbinding.ABIElementMarshaling
+	json.Unmarshal([]byte(sampleEventABIAllIndexedNoData), &marshaling)
+	event, _ := ethbind.API.ABIElementMarshalingToABIEvent(&marshaling)
+	lp := &logProcessor{
+		subID:  "sub1",
+		event:  event,
+		stream: stream,
+	}
+	var l logEntry
+	err := json.Unmarshal([]byte(sampleEventLogAllIndexedNoData), &l)
+	assert.NoError(err)
+	err = lp.processLogEntry(t.Name(), &l, 5)
+	assert.NoError(err)
+	ev := <-stream.eventStream
+	assert.Equal("es1/sub1/475266/0/1", ev.ID)
+}
+
+func TestProcessLogEntrySameLogTwoSubscriptions(t *testing.T) {
+	assert := assert.New(t)
+
+	stream := &eventStream{
+		spec:           &StreamInfo{ID: "es1"},
+		eventStream:    make(chan *eventData, 2),
+		replayedEvents: make(map[string]bool),
+	}
+	var marshaling ethbinding.ABIElementMarshaling
+	json.Unmarshal([]byte(sampleEventABIAllIndexedNoData), &marshaling)
+	event, _ := ethbind.API.ABIElementMarshalingToABIEvent(&marshaling)
+	lp1 := &logProcessor{subID: "sub1", event: event, stream: stream}
+	lp2 := &logProcessor{subID: "sub2", event: event, stream: stream}
+
+	// A replayed batch from sub1 covers the log for sub1 only
+	stream.replayedEvents[replayKey(&eventData{ID: "es1/sub1/475266/0/1", SubID: "sub1"})] = true
+
+	var l logEntry
+	err := json.Unmarshal([]byte(sampleEventLogAllIndexedNoData), &l)
+	assert.NoError(err)
+	err = lp1.processLogEntry(t.Name(), &l, 5)
+	assert.NoError(err)
+	err = lp2.processLogEntry(t.Name(), &l, 5)
+	assert.NoError(err)
+
+	assert.Len(stream.eventStream, 1)
+	ev := <-stream.eventStream
+	assert.Equal("sub2", ev.SubID)
+	assert.Equal("es1/sub2/475266/0/1", ev.ID)
+	assert.NotEqual(batchID([]*eventData{ev}), batchID([]*eventData{{ID: "es1/sub1/475266/0/1"}}))
+}
+
+func newTestConfirmationsLogProcessor(t *testing.T, spec *StreamInfo, confirmations *int) (*logProcessor, *blockConfirmationManager, *eventStream) {
+	bcm, _ := newTestBlockConfirmationManager(t, false)
+	stream := &eventStream{
+		spec:        spec,
+		eventStream: make(chan *eventData, 1),
+	}
+	var marshaling ethbinding.ABIElementMarshaling
+	json.Unmarshal([]byte(`{"name": "testEvent", "anonymous": true, "inputs": []}`), &marshaling)
+	event, err := ethbind.API.ABIElementMarshalingToABIEvent(&marshaling)
+	assert.NoError(t, err)
+	lp := &logProcessor{
+		subID:               "sub1",
+		event:               event,
+		stream:              stream,
+		confirmations:       confirmations,
+		confirmationManager: bcm,
+	}
+	return lp, bcm, stream
+}
+
+func TestProcessLogEntryZeroConfirmationsOverride(t *testing.T) {
+	assert := assert.New(t)
+
+	five, zero := 5, 0
+	lp, bcm, stream := newTestConfirmationsLogProcessor(t, &StreamInfo{ID: "es1", Confirmations: &five}, &zero)
+	err := lp.processLogEntry("ut", &logEntry{BlockNumber: ethbinding.HexBigInt(*big.NewInt(255))}, 0)
+	assert.NoError(err)
+	ev := <-stream.eventStream
+	assert.Equal("255", ev.BlockNumber)
+	assert.Empty(ev.Status)
+	assert.Empty(bcm.bcmNotifications)
+}
+
+func TestProcessLogEntryStreamConfirmationsOverride(t *testing.T) {
+	assert := assert.New(t)
+
+	five := 5
+	lp, bcm, stream := newTestConfirmationsLogProcessor(t, &StreamInfo{ID: "es1", Confirmations: &five}, nil)
+	err := lp.processLogEntry("ut", &logEntry{BlockNumber: ethbinding.HexBigInt(*big.NewInt(255))}, 0)
+	assert.NoError(err)
+	notification := <-bcm.bcmNotifications
+	assert.Equal(5, notification.requiredConfirmations)
+	assert.Empty(stream.eventStream)
+
+	pending := bcm.addEvent(notification.event, stream, notification.requiredConfirmations)
+	assert.Equal(5, pending.requiredConfirmations)
+	pending = bcm.addEvent(&eventData{}, stream, 0)
+	assert.Equal(3, pending.requiredConfirmations)
+}
+
+func TestProcessLogEntryProvisionalNotifications(t *testing.T) {
+	assert := assert.New(t)
+
+	lp, bcm, stream := newTestConfirmationsLogProcessor(t, &StreamInfo{ID: "es1", ProvisionalNotifications: true}, nil)
+	err := lp.processLogEntry("ut", &logEntry{BlockNumber: ethbinding.HexBigInt(*big.NewInt(255))}, 0)
+	assert.NoError(err)
+	provisional := <-stream.eventStream
+	assert.Equal(EventStatusUnconfirmed, provisional.Status)
+	assert.Equal("es1/sub1/255/0/0/unconfirmed", provisional.ID)
+	assert.True(provisional.provisional())
+	notification := <-bcm.bcmNotifications
+	assert.Equal(0, notification.requiredConfirmations)
+	assert.Equal("es1/sub1/255/0/0", notification.event.ID)
+	assert.Empty(notification.event.Status)
+	assert.False(notification.event.provisional())
+}
@@ -0,0 +1,174 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/errors"
+	"github.com/hyperledger/firefly-ethconnect/internal/eth"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// pushBufferSize is the number of pushed notifications we buffer, before the RPC client starts queuing them
+	pushBufferSize = 100
+	// maxPushPending is the number of pushed logs we hold while the stream is not processing them, such as
+	// when it is blocked or suspended. Beyond that we drop them, and catch up from the checkpoint with eth_getLogs.
+	maxPushPending = 10000
+)
+
+// logPush collects the logs pushed by the node for an eth_subscribe("logs") subscription,
+// which replaces polling a filter when the RPC connection is a websocket
+type logPush struct {
+	sub          eth.RPCClientSubscription
+	logs         chan *logEntry
+	notify       chan struct{}
+	done         chan struct{}
+	mux          sync.Mutex
+	pending      []*logEntry
+	overflowed   bool // pending logs were dropped, so we must restart from the checkpoint
+	err          error
+	backfilledTo *big.Int // logs pushed at or below this block were delivered by the backfill
+}
+
+// receive moves pushed logs into the pending list, and wakes the event poller to process them
+func (p *logPush) receive() {
+	for {
+		select {
+		case entry := <-p.logs:
+			p.mux.Lock()
+			if !p.overflowed && len(p.pending) >= maxPushPending {
+				p.overflowed = true
+				p.pending = nil
+			}
+			if !p.overflowed {
+				p.pending = append(p.pending, entry)
+			}
+			p.mux.Unlock()
+		case err := <-p.sub.Err():
+			select {
+			case <-p.done:
+				return
+			default:
+			}
+			if err == nil {
+				err = errors.Errorf(errors.EventStreamsPushSubscriptionClosed)
+			}
+			p.mux.Lock()
+			p.err = err
+			p.mux.Unlock()
+			signal(p.notify)
+			return
+		case <-p.done:
+			return
+		}
+		signal(p.notify)
+	}
+}
+
+// take returns the logs pushed since the last call, whether logs were dropped because too many
+// were pending, and any error that ended the subscription
+func (p *logPush) take() ([]*logEntry, bool, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	logs := p.pending
+	p.pending = nil
+	return logs, p.overflowed, p.err
+}
+
+func (p *logPush) close() {
+	close(p.done)
+	p.sub.Unsubscribe()
+}
+
+// subscribeLogs starts an eth_subscribe("logs") subscription, then backfills from the checkpoint
+// to the current head with eth_getLogs, as the node only pushes logs for new blocks.
+// If the node does not accept the subscription, we fall back to polling a filter.
+func (s *subscription) subscribeLogs(ctx context.Context, since *big.Int) error {
+	p := &logPush{
+		logs:   make(chan *logEntry, pushBufferSize),
+		notify: s.lp.stream.pushNotify,
+		done:   make(chan struct{}),
+	}
+	sub, err := s.pushRPC.Subscribe(ctx, "eth", p.logs, "logs", &s.info.Filter)
+	if err != nil {
+		log.Warnf("%s: eth_subscribe failed, falling back to polling: %s", s.logName, err)
+		return s.createFilter(ctx, since)
+	}
+	p.sub = sub
+	go p.receive()
+
+	// We query the head after subscribing, so there is no gap between the backfill and the subscription
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	head := ethbinding.HexBigInt{}
+	if err := s.rpc.CallContext(ctx, &head, "eth_blockNumber"); err != nil {
+		p.close()
+		return errors.Errorf(errors.RPCCallReturnedError, "eth_blockNumber", err)
+	}
+	p.backfilledTo = head.ToInt()
+	if since.Cmp(p.backfilledTo) <= 0 {
+		f := &ethFilter{}
+		f.persistedFilter = s.info.Filter
+		f.FromBlock.ToInt().Set(since)
+		f.ToBlock = "0x" + p.backfilledTo.Text(16)
+		var logs []*logEntry
+		if err := s.rpc.CallContext(ctx, &logs, "eth_getLogs", f); err != nil {
+			p.close()
+			return errors.Errorf(errors.RPCCallReturnedError, "eth_getLogs", err)
+		}
+		s.processLogs(ctx, "eth_getLogs", logs)
+	}
+
+	s.push = p
+	s.catchupBlock = nil
+	s.filteredOnce = true
+	s.info.Synchronized = true
+	s.markFilterStale(ctx, false)
+	log.Infof("%s: subscribed with eth_subscribe after backfilling blocks %s -> %s - %+v", s.logName, since.String(), p.backfilledTo.String(), s.info.Filter)
+	return nil
+}
+
+// processPushedLogs processes the logs pushed since the last poll. If the subscription has
+// failed (typically because the websocket disconnected), the filter is marked stale so we
+// restart from the checkpoint - backfilling any gap, and falling back to polling if the
+// node does not accept a new subscription. The same happens if pushed logs were dropped,
+// because too many arrived while the stream was not processing them.
+func (s *subscription) processPushedLogs(ctx context.Context) error {
+	logs, overflowed, err := s.push.take()
+	if overflowed {
+		log.Warnf("%s: More than %d pushed logs were pending. Restarting from the checkpoint", s.logName, maxPushPending)
+		s.markFilterStale(ctx, true)
+		return nil
+	}
+	newLogs := make([]*logEntry, 0, len(logs))
+	for _, entry := range logs {
+		if entry.Removed || entry.BlockNumber.ToInt().Cmp(s.push.backfilledTo) > 0 {
+			newLogs = append(newLogs, entry)
+		}
+	}
+	s.processLogs(ctx, "eth_subscribe", newLogs)
+	if err != nil {
+		log.Warnf("%s: eth_subscribe subscription failed: %s", s.logName, err)
+		s.markFilterStale(ctx, true)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/eth"
+	"github.com/hyperledger/firefly-ethconnect/mocks/ethmocks"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// testPushRPC is a fake eth_subscribe client, that records each subscription
+type testPushRPC struct {
+	mux  sync.Mutex
+	err  error
+	subs []*testPushSubscription
+}
+
+type testPushSubscription struct {
+	channel      interface{}
+	args         []interface{}
+	errChan      chan error
+	closeOnce    sync.Once
+	unsubscribed bool
+}
+
+func (r *testPushRPC) Subscribe(ctx context.Context, namespace string, channel interface{}, args ...interface{}) (eth.RPCClientSubscription, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.err != nil {
+		return nil, r.err
+	}
+	sub := &testPushSubscription{
+		channel: channel,
+		args:    args,
+		errChan: make(chan error, 1),
+	}
+	r.subs = append(r.subs, sub)
+	return sub, nil
+}
+
+func (r *testPushRPC) lastSub() *testPushSubscription {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if len(r.subs) == 0 {
+		return nil
+	}
+	return r.subs[len(r.subs)-1]
+}
+
+func (s *testPushSubscription) Err() <-chan error {
+	return s.errChan
+}
+
+// close mimics the RPC client, which closes the error channel when the subscription ends
+func (s *testPushSubscription) close() {
+	s.closeOnce.Do(func() { close(s.errChan) })
+}
+
+func (s *testPushSubscription) Unsubscribe() {
+	s.unsubscribed = true
+	s.close()
+}
+
+func newTestPushSubscription(rpc *ethmocks.RPCClient, pushRPC *testPushRPC) (*subscription, *eventStream) {
+	stream := &eventStream{
+		spec:        &StreamInfo{ID: "es1"},
+		eventStream: make(chan *eventData, 10),
+		pushNotify:  make(chan struct{}, 1),
+	}
+	s := &subscription{
+		info:        &SubscriptionInfo{ID: "sub1"},
+		rpc:         rpc,
+		pushRPC:     pushRPC,
+		lp:          newLogProcessor("sub1", &ethbinding.ABIEvent{}, stream, nil),
+		logName:     "sub1",
+		filterStale: true,
+	}
+	return s, stream
+}
+
+func testPushLog(blockNumber int64) *logEntry {
+	entry := &logEntry{Data: "0x"}
+	entry.BlockNumber.ToInt().SetInt64(blockNumber)
+	return entry
+}
+
+func waitPushPending(t *testing.T, p *logPush, count int) {
+	assert.Eventually(t, func() bool {
+		p.mux.Lock()
+		defer p.mux.Unlock()
+		return len(p.pending) >= count || p.err != nil
+	}, 5*time.Second, 1*time.Millisecond)
+}
+
+func TestSubscribeLogsBackfillAndPush(t *testing.T) {
+	assert := assert.New(t)
+
+	rpc := &ethmocks.RPCClient{}
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_blockNumber").Run(func(args mock.Arguments) {
+		args[1].(*ethbinding.HexBigInt).ToInt().SetInt64(100)
+	}).Return(nil)
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_getLogs", mock.MatchedBy(func(f *ethFilter) bool {
+		return f.FromBlock.ToInt().Int64() == 90 && f.ToBlock == "0x64"
+	})).Run(func(args mock.Arguments) {
+		*(args[1].(*[]*logEntry)) = []*logEntry{testPushLog(95)}
+	}).Return(nil)
+	pushRPC := &testPushRPC{}
+	s, stream := newTestPushSubscription(rpc, pushRPC)
+
+	err := s.restartFilter(context.Background(), big.NewInt(90))
+	assert.NoError(err)
+	assert.NotNil(s.push)
+	assert.False(s.filterStale)
+	assert.True(s.info.Synchronized)
+	ev := <-stream.eventStream
+	assert.Equal("95", ev.BlockNumber)
+
+	sub := pushRPC.lastSub()
+	assert.Equal([]interface{}{"logs", &s.info.Filter}, sub.args)
+	logs := sub.channel.(chan *logEntry)
+	logs <- testPushLog(100) // already delivered by the backfill
+	removed := testPushLog(99)
+	removed.Removed = true
+	logs <- removed
+	logs <- testPushLog(101)
+	waitPushPending(t, s.push, 3)
+	<-stream.pushNotify
+
+	err = s.processNewEvents(context.Background())
+	assert.NoError(err)
+	ev = <-stream.eventStream
+	assert.Equal("99", ev.BlockNumber)
+	assert.Equal(EventStatusRemoved, ev.Status)
+	ev = <-stream.eventStream
+	assert.Equal("101", ev.BlockNumber)
+	assert.Empty(stream.eventStream)
+
+	p := s.push
+	sub.errChan <- fmt.Errorf("pop")
+	waitPushPending(t, p, 1)
+	err = s.processNewEvents(context.Background())
+	assert.Regexp("pop", err)
+	assert.True(s.filterStale)
+	assert.Nil(s.push)
+	assert.True(sub.unsubscribed)
+}
+
+func TestSubscribeLogsClosedByNode(t *testing.T) {
+	assert := assert.New(t)
+
+	rpc := &ethmocks.RPCClient{}
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_blockNumber").Run(func(args mock.Arguments) {
+		args[1].(*ethbinding.HexBigInt).ToInt().SetInt64(100)
+	}).Return(nil)
+	pushRPC := &testPushRPC{}
+	s, _ := newTestPushSubscription(rpc, pushRPC)
+
+	err := s.subscribeLogs(context.Background(), big.NewInt(101))
+	assert.NoError(err)
+	rpc.AssertNotCalled(t, "CallContext", mock.Anything, mock.Anything, "eth_getLogs", mock.Anything)
+
+	p := s.push
+	pushRPC.lastSub().close()
+	waitPushPending(t, p, 1)
+	err = s.processNewEvents(context.Background())
+	assert.Regexp("eth_subscribe subscription closed", err)
+	assert.True(s.filterStale)
+}
+
+func TestSubscribeLogsPendingOverflow(t *testing.T) {
+	assert := assert.New(t)
+
+	rpc := &ethmocks.RPCClient{}
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_blockNumber").Run(func(args mock.Arguments) {
+		args[1].(*ethbinding.HexBigInt).ToInt().SetInt64(100)
+	}).Return(nil)
+	pushRPC := &testPushRPC{}
+	s, stream := newTestPushSubscription(rpc, pushRPC)
+
+	err := s.subscribeLogs(context.Background(), big.NewInt(101))
+	assert.NoError(err)
+
+	// While the stream is not processing pushed logs, they are dropped beyond the limit
+	p := s.push
+	sub := pushRPC.lastSub()
+	logs := sub.channel.(chan *logEntry)
+	for i := 0; i <= maxPushPending; i++ {
+		logs <- testPushLog(101)
+	}
+	assert.Eventually(func() bool {
+		p.mux.Lock()
+		defer p.mux.Unlock()
+		return p.overflowed
+	}, 5*time.Second, 1*time.Millisecond)
+	logs <- testPushLog(102)
+	p.mux.Lock()
+	assert.Empty(p.pending)
+	p.mux.Unlock()
+
+	// We restart from the checkpoint, rather than process a partial set of logs
+	err = s.processNewEvents(context.Background())
+	assert.NoError(err)
+	assert.True(s.filterStale)
+	assert.Nil(s.push)
+	assert.True(sub.unsubscribed)
+	assert.Empty(stream.eventStream)
+}
+
+func TestSubscribeLogsFallbackToPolling(t *testing.T) {
+	assert := assert.New(t)
+
+	rpc := &ethmocks.RPCClient{}
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_newFilter", mock.Anything).Run(func(args mock.Arguments) {
+		*args[1].(*string) = "filter1"
+	}).Return(nil)
+	s, _ := newTestPushSubscription(rpc, &testPushRPC{err: fmt.Errorf("notifications not supported")})
+
+	err := s.subscribeLogs(context.Background(), big.NewInt(90))
+	assert.NoError(err)
+	assert.Nil(s.push)
+	assert.Equal("filter1", s.filterID)
+	assert.False(s.filterStale)
+}
+
+func TestSubscribeLogsBackfillFail(t *testing.T) {
+	assert := assert.New(t)
+
+	rpc := &ethmocks.RPCClient{}
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_blockNumber").Run(func(args mock.Arguments) {
+		args[1].(*ethbinding.HexBigInt).ToInt().SetInt64(100)
+	}).Return(nil)
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_getLogs", mock.Anything).Return(fmt.Errorf("pop"))
+	pushRPC := &testPushRPC{}
+	s, _ := newTestPushSubscription(rpc, pushRPC)
+
+	err := s.subscribeLogs(context.Background(), big.NewInt(90))
+	assert.Regexp("eth_getLogs returned: pop", err)
+	assert.Nil(s.push)
+	assert.True(s.filterStale)
+	assert.True(pushRPC.lastSub().unsubscribed)
+}
+
+func TestSubscribeLogsHeadFail(t *testing.T) {
+	assert := assert.New(t)
+
+	rpc := &ethmocks.RPCClient{}
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_blockNumber").Return(fmt.Errorf("pop"))
+	pushRPC := &testPushRPC{}
+	s, _ := newTestPushSubscription(rpc, pushRPC)
+
+	err := s.subscribeLogs(context.Background(), big.NewInt(90))
+	assert.Regexp("eth_blockNumber returned: pop", err)
+	assert.True(pushRPC.lastSub().unsubscribed)
+}
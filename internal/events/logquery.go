@@ -0,0 +1,193 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"math/big"
+	"strconv"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/hyperledger/firefly-ethconnect/internal/errors"
+	"github.com/hyperledger/firefly-ethconnect/internal/eth"
+	"github.com/hyperledger/firefly-ethconnect/internal/ethbind"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultLogQueryPageSize is the number of blocks requested in each eth_getLogs call of a historical query
+	DefaultLogQueryPageSize = int64(250)
+	// DefaultLogQueryLimit is the number of events after which a historical query stops paging
+	DefaultLogQueryLimit = 1000
+)
+
+// LogQuery is a one-off query for the historical logs of an event, without a subscription
+type LogQuery struct {
+	Address                 *ethbinding.Address    // optional - all addresses are queried if nil
+	Event                   *ethbinding.ABIEvent   // the event to query and decode
+	ABI                     *ethbinding.RuntimeABI // used to decode the transaction inputs, when Inputs is set
+	FromBlock               string
+	ToBlock                 string // defaults to latest
+	PageSize                int64
+	Limit                   int
+	Timestamps              bool // Include block timestamps in the events returned
+	Inputs                  bool // Include input args in the events returned
+	DecimalTransactionIndex bool // Format the transactionIndex as for the events of a stream, per the subscription manager configuration
+}
+
+// LogQueryResult is the result of a historical query. If the limit was reached before the
+// end of the range, NextBlock is the block to pass as fromBlock to continue the query.
+type LogQueryResult struct {
+	FromBlock string       `json:"fromBlock"`
+	ToBlock   string       `json:"toBlock"`
+	NextBlock string       `json:"nextBlock,omitempty"`
+	Events    []*eventData `json:"events"`
+}
+
+func parseQueryBlock(ctx context.Context, rpc eth.RPCClient, name, value string) (*big.Int, error) {
+	if value == "" || value == FromBlockLatest {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		blockNumber := ethbinding.HexBigInt{}
+		if err := rpc.CallContext(ctx, &blockNumber, "eth_blockNumber"); err != nil {
+			return nil, errors.Errorf(errors.RPCCallReturnedError, "eth_blockNumber", err)
+		}
+		return blockNumber.ToInt(), nil
+	}
+	var i big.Int
+	if _, ok := i.SetString(value, 0); !ok || i.Sign() < 0 {
+		return nil, errors.Errorf(errors.EventQueryBadBlock, name, value)
+	}
+	return &i, nil
+}
+
+// QueryLogs pages through eth_getLogs for the block range of the query, in the same way
+// as a subscription in catchup mode, and returns the decoded events
+func QueryLogs(ctx context.Context, rpc eth.RPCClient, q *LogQuery) (*LogQueryResult, error) {
+	if q.Event == nil || q.Event.Name == "" {
+		return nil, errors.Errorf(errors.EventStreamsSubscribeNoEvent)
+	}
+	if q.FromBlock == "" || q.FromBlock == FromBlockLatest {
+		return nil, errors.Errorf(errors.EventQueryBadBlock, "fromBlock", q.FromBlock)
+	}
+	fromBlock, err := parseQueryBlock(ctx, rpc, "fromBlock", q.FromBlock)
+	if err != nil {
+		return nil, err
+	}
+	toBlock, err := parseQueryBlock(ctx, rpc, "toBlock", q.ToBlock)
+	if err != nil {
+		return nil, err
+	}
+	if fromBlock.Cmp(toBlock) > 0 {
+		return nil, errors.Errorf(errors.EventQueryBadBlockRange, fromBlock.String(), toBlock.String())
+	}
+	pageSize := q.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultLogQueryPageSize
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultLogQueryLimit
+	}
+	signature := ethbind.API.ABIEventSignature(q.Event)
+	enricher := &logEnricher{rpc: rpc, logName: signature}
+	if q.Timestamps {
+		enricher.timestampCache, _ = lru.New(DefaultTimestampCacheSize)
+	}
+	if q.Inputs && q.ABI != nil {
+		enricher.abi = q.ABI
+		enricher.txInfoCache, _ = lru.New(DefaultTxInfoCacheSize)
+	}
+	f := &ethFilter{}
+	if q.Address != nil {
+		f.Addresses = []ethbinding.Address{*q.Address}
+	}
+	f.Topics = [][]ethbinding.Hash{{q.Event.ID}}
+
+	result := &LogQueryResult{
+		FromBlock: fromBlock.String(),
+		ToBlock:   toBlock.String(),
+		Events:    []*eventData{},
+	}
+	pageStart := new(big.Int).Set(fromBlock)
+	for pageStart.Cmp(toBlock) <= 0 {
+		pageEnd := new(big.Int).Add(pageStart, big.NewInt(pageSize-1))
+		if pageEnd.Cmp(toBlock) > 0 {
+			pageEnd.Set(toBlock)
+		}
+		f.FromBlock.ToInt().Set(pageStart)
+		f.ToBlock = "0x" + pageEnd.Text(16)
+
+		log.Infof("%s: event query. Blocks %s -> %s", signature, pageStart.String(), pageEnd.String())
+		var logs []*logEntry
+		if err := queryLogsPage(ctx, rpc, f, &logs); err != nil {
+			return nil, err
+		}
+		enricher.enrichLogs(ctx, logs)
+		for _, entry := range logs {
+			if entry.Removed {
+				continue
+			}
+			event, err := queryResultEvent(signature, q, entry)
+			if err != nil {
+				return nil, err
+			}
+			result.Events = append(result.Events, event)
+		}
+
+		pageStart = pageEnd.Add(pageEnd, big.NewInt(1))
+		if len(result.Events) >= limit && pageStart.Cmp(toBlock) <= 0 {
+			result.NextBlock = pageStart.String()
+			break
+		}
+	}
+	return result, nil
+}
+
+func queryLogsPage(ctx context.Context, rpc eth.RPCClient, f *ethFilter, logs *[]*logEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := rpc.CallContext(ctx, logs, "eth_getLogs", f); err != nil {
+		return errors.Errorf(errors.RPCCallReturnedError, "eth_getLogs", err)
+	}
+	return nil
+}
+
+func queryResultEvent(signature string, q *LogQuery, entry *logEntry) (*eventData, error) {
+	blockNumber := entry.BlockNumber.ToInt()
+	event := &eventData{
+		ID:               logPosition(blockNumber, entry),
+		Address:          entry.Address.String(),
+		BlockNumber:      blockNumber.String(),
+		BlockHash:        entry.BlockHash.String(),
+		TransactionIndex: formatTransactionIndex(entry.TransactionIndex, q.DecimalTransactionIndex),
+		TransactionHash:  entry.TransactionHash.String(),
+		Signature:        signature,
+		Data:             make(map[string]interface{}),
+		LogIndex:         strconv.FormatUint(uint64(entry.LogIndex), 10), // the index of the log in the block, not the position in the page
+		InputMethod:      entry.InputMethod,
+		InputArgs:        entry.InputArgs,
+		InputSigner:      entry.InputSigner,
+	}
+	if q.Timestamps {
+		event.Timestamp = strconv.FormatUint(entry.Timestamp, 10)
+	}
+	if err := decodeLogData(signature, q.Event, entry, event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
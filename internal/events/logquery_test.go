@@ -0,0 +1,183 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/eth"
+	"github.com/hyperledger/firefly-ethconnect/internal/ethbind"
+	"github.com/hyperledger/firefly-ethconnect/mocks/ethmocks"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func testChangedEvent(t *testing.T) *ethbinding.ABIEvent {
+	event, err := ethbind.API.ABIElementMarshalingToABIEvent(&ethbinding.ABIElementMarshaling{
+		Name: "Changed",
+		Inputs: []ethbinding.ABIArgumentMarshaling{
+			{Name: "from", Type: "address", Indexed: true},
+			{Name: "i", Type: "int64", Indexed: true},
+			{Name: "s", Type: "string", Indexed: true},
+			{Name: "h", Type: "bytes32"},
+			{Name: "m", Type: "string"},
+		},
+	})
+	assert.NoError(t, err)
+	return event
+}
+
+func testLogQueryRPC(t *testing.T) *ethmocks.RPCClient {
+	testDataBytes, err := ioutil.ReadFile("../../test/simplevents_logs.json")
+	assert.NoError(t, err)
+	rpc := &ethmocks.RPCClient{}
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_blockNumber").Run(func(args mock.Arguments) {
+		args[1].(*ethbinding.HexBigInt).ToInt().SetInt64(600)
+	}).Return(nil)
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_getLogs", mock.Anything).Run(func(args mock.Arguments) {
+		json.Unmarshal(testDataBytes, args[1])
+	}).Return(nil)
+	return rpc
+}
+
+func TestQueryLogsPaging(t *testing.T) {
+	assert := assert.New(t)
+
+	rpc := testLogQueryRPC(t)
+	addr := ethbind.API.HexToAddress("0x167f57a13a9c35ff92f0649d2be0e52b4f8ac3ca")
+
+	result, err := QueryLogs(context.Background(), rpc, &LogQuery{
+		Address:   &addr,
+		Event:     testChangedEvent(t),
+		FromBlock: "100",
+		PageSize:  200,
+	})
+	assert.NoError(err)
+	assert.Equal("100", result.FromBlock)
+	assert.Equal("600", result.ToBlock)
+	assert.Empty(result.NextBlock)
+	assert.Len(result.Events, 9)
+	assert.Equal("150665/0/0", result.Events[0].ID)
+	assert.Equal("0x0", result.Events[0].TransactionIndex)
+	assert.Equal("0", result.Events[1].LogIndex) // the index of the log in its block, not the position in the page
+	assert.Equal("42", result.Events[0].Data["i"])
+	assert.Equal("But what is the question?", result.Events[0].Data["m"])
+	assert.Empty(result.Events[0].Timestamp)
+	rpc.AssertNumberOfCalls(t, "CallContext", 4)
+}
+
+func TestQueryLogsLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	rpc := testLogQueryRPC(t)
+	result, err := QueryLogs(context.Background(), rpc, &LogQuery{
+		Event:     testChangedEvent(t),
+		FromBlock: "0x0",
+		ToBlock:   "1000",
+		Limit:     2,
+	})
+	assert.NoError(err)
+	assert.Equal("250", result.NextBlock)
+	assert.Len(result.Events, 3)
+	rpc.AssertNumberOfCalls(t, "CallContext", 1)
+}
+
+func TestQueryLogsDecimalTransactionIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	rpc := testLogQueryRPC(t)
+	result, err := QueryLogs(context.Background(), rpc, &LogQuery{
+		Event:                   testChangedEvent(t),
+		FromBlock:               "500",
+		DecimalTransactionIndex: true,
+	})
+	assert.NoError(err)
+	assert.Len(result.Events, 3)
+	assert.Equal("0", result.Events[0].TransactionIndex)
+}
+
+func TestQueryLogsTimestampsAndInputs(t *testing.T) {
+	assert := assert.New(t)
+
+	rpc := testLogQueryRPC(t)
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_getBlockByNumber", mock.Anything, false).Run(func(args mock.Arguments) {
+		args[1].(*ethbinding.Header).Time = 12345
+	}).Return(nil)
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_getTransactionByHash", mock.Anything).Run(func(args mock.Arguments) {
+		*(args[1].(*eth.TxnInfo)) = eth.TxnInfo{
+			Input: &ethbinding.HexBytes{
+				0xf4, 0xe1, 0x3d, 0xc5, // ID of method1
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, // "1" as int32
+			},
+		}
+	}).Return(nil)
+	abi, err := ethbind.API.ABIMarshalingToABIRuntime(ethbinding.ABIMarshaling{
+		{
+			Type:   "function",
+			Name:   "method1",
+			Inputs: []ethbinding.ABIArgumentMarshaling{{Name: "arg1", Type: "int32"}},
+		},
+	})
+	assert.NoError(err)
+
+	result, err := QueryLogs(context.Background(), rpc, &LogQuery{
+		Event:      testChangedEvent(t),
+		ABI:        abi,
+		FromBlock:  "500",
+		ToBlock:    "latest",
+		Timestamps: true,
+		Inputs:     true,
+	})
+	assert.NoError(err)
+	assert.Len(result.Events, 3)
+	assert.Equal("12345", result.Events[0].Timestamp)
+	assert.Equal("method1", result.Events[0].InputMethod)
+	assert.Equal(map[string]interface{}{"arg1": "1"}, result.Events[0].InputArgs)
+}
+
+func TestQueryLogsBadParams(t *testing.T) {
+	assert := assert.New(t)
+
+	rpc := &ethmocks.RPCClient{}
+	event := testChangedEvent(t)
+	_, err := QueryLogs(context.Background(), rpc, &LogQuery{FromBlock: "0"})
+	assert.Regexp("Solidity event name must be specified", err)
+	_, err = QueryLogs(context.Background(), rpc, &LogQuery{Event: event})
+	assert.Regexp("Invalid fromBlock '' for event query", err)
+	_, err = QueryLogs(context.Background(), rpc, &LogQuery{Event: event, FromBlock: "-1"})
+	assert.Regexp("Invalid fromBlock '-1' for event query", err)
+	_, err = QueryLogs(context.Background(), rpc, &LogQuery{Event: event, FromBlock: "0", ToBlock: "abc"})
+	assert.Regexp("Invalid toBlock 'abc' for event query", err)
+	_, err = QueryLogs(context.Background(), rpc, &LogQuery{Event: event, FromBlock: "10", ToBlock: "9"})
+	assert.Regexp("Invalid block range for event query: fromBlock=10 toBlock=9", err)
+}
+
+func TestQueryLogsRPCErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	rpc := &ethmocks.RPCClient{}
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_blockNumber").Return(fmt.Errorf("pop1"))
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_getLogs", mock.Anything).Return(fmt.Errorf("pop2"))
+	event := testChangedEvent(t)
+	_, err := QueryLogs(context.Background(), rpc, &LogQuery{Event: event, FromBlock: "0"})
+	assert.Regexp("pop1", err)
+	_, err = QueryLogs(context.Background(), rpc, &LogQuery{Event: event, FromBlock: "0", ToBlock: "10"})
+	assert.Regexp("pop2", err)
+}
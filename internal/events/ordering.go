@@ -0,0 +1,168 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"math/big"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/errors"
+	"github.com/hyperledger/firefly-ethconnect/internal/eth"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	log "github.com/sirupsen/logrus"
+)
+
+// orderingBuffer holds the events detected by the subscriptions of a stream in ordered mode, until
+// every subscription on the stream has read past their block. They are then merged in chain order
+// across all the subscriptions, before they are passed on to the batch dispatcher.
+type orderingBuffer struct {
+	mux     sync.Mutex
+	seq     uint64
+	pending map[string]*orderedEvent
+}
+
+type orderedEvent struct {
+	seq      uint64
+	event    *eventData
+	dispatch func()
+}
+
+type orderedEvents []*orderedEvent
+
+func (oe orderedEvents) Len() int      { return len(oe) }
+func (oe orderedEvents) Swap(i, j int) { oe[i], oe[j] = oe[j], oe[i] }
+func (oe orderedEvents) Less(i, j int) bool {
+	ei, ej := oe[i].event, oe[j].event
+	if ei.blockNumber != ej.blockNumber {
+		return ei.blockNumber < ej.blockNumber
+	}
+	if ei.transactionIndex != ej.transactionIndex {
+		return ei.transactionIndex < ej.transactionIndex
+	}
+	if ei.blockLogIndex != ej.blockLogIndex {
+		return ei.blockLogIndex < ej.blockLogIndex
+	}
+	return oe[i].seq < oe[j].seq
+}
+
+func newOrderingBuffer() *orderingBuffer {
+	return &orderingBuffer{
+		pending: make(map[string]*orderedEvent),
+	}
+}
+
+// add buffers an event, with the function that dispatches it. An event detected again by the same
+// subscription, because its filter was restarted from the checkpoint, replaces the buffered copy.
+func (ob *orderingBuffer) add(event *eventData, removed bool, dispatch func()) {
+	key := event.SubID + "/" + dedupKey(event) + "/" + strconv.FormatBool(removed)
+	ob.mux.Lock()
+	defer ob.mux.Unlock()
+	ob.seq++
+	ob.pending[key] = &orderedEvent{seq: ob.seq, event: event, dispatch: dispatch}
+}
+
+// take removes the events before a block from the buffer, and returns them in chain order.
+// All events are returned if the block is nil.
+func (ob *orderingBuffer) take(before *big.Int) orderedEvents {
+	ob.mux.Lock()
+	defer ob.mux.Unlock()
+	var ready orderedEvents
+	for key, oe := range ob.pending {
+		if before == nil || new(big.Int).SetUint64(oe.event.blockNumber).Cmp(before) < 0 {
+			ready = append(ready, oe)
+			delete(ob.pending, key)
+		}
+	}
+	sort.Sort(ready)
+	return ready
+}
+
+// reset drops the buffered events, when all the subscriptions are restarted from the checkpoint
+func (ob *orderingBuffer) reset() {
+	ob.mux.Lock()
+	defer ob.mux.Unlock()
+	ob.pending = make(map[string]*orderedEvent)
+}
+
+// readTo returns the next block the subscription has not read all the events of, in the poll cycle
+// that started with the given head block. Returns nil for subscriptions that do not hold back the stream,
+// such as receipt subscriptions whose events are not read from the chain.
+func (s *subscription) readTo(head *big.Int, failed bool) *big.Int {
+	switch {
+	case s.deleting || s.receipts != nil:
+		return nil
+	case s.catchupBlock != nil:
+		return s.catchupBlock
+	case s.nextBlock != nil:
+		return s.nextBlock
+	case s.sharedFetchBlock != nil:
+		return s.sharedFetchBlock
+	case failed || s.filterStale:
+		// Events after the checkpoint will be detected again once the filter is restarted
+		hwm := s.blockHWM()
+		return &hwm
+	case s.push != nil:
+		// The logs of the head block might still be on their way to us
+		return head
+	default:
+		// The filter has returned every log up to the head block
+		return new(big.Int).Add(head, big.NewInt(1))
+	}
+}
+
+// orderedHead reads the head block at the start of a poll cycle of a stream in ordered mode
+func (a *eventStream) orderedHead(ctx context.Context, subs []*subscription) (*big.Int, error) {
+	var rpc eth.RPCClient
+	for _, sub := range subs {
+		if sub.rpc != nil {
+			rpc = sub.rpc // all subscriptions use the RPC client of the subscription manager
+			break
+		}
+	}
+	if rpc == nil {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	head := ethbinding.HexBigInt{}
+	if err := rpc.CallContext(ctx, &head, "eth_blockNumber"); err != nil {
+		return nil, errors.Errorf(errors.RPCCallReturnedError, "eth_blockNumber", err)
+	}
+	return head.ToInt(), nil
+}
+
+// dispatchOrdered passes the buffered events on in chain order, once every subscription on the stream
+// has read past their block. If the stream is no longer in ordered mode, all the events are passed on.
+func (a *eventStream) dispatchOrdered(subs []*subscription, head *big.Int, failed map[string]bool) {
+	var before *big.Int
+	if a.spec.Ordered && head != nil {
+		for _, sub := range subs {
+			if readTo := sub.readTo(head, failed[sub.info.ID]); readTo != nil && (before == nil || readTo.Cmp(before) < 0) {
+				before = readTo
+			}
+		}
+	}
+	ready := a.ordering.take(before)
+	if len(ready) > 0 {
+		log.Debugf("%s: Dispatching %d events in chain order before block %v", a.spec.ID, len(ready), before)
+	}
+	for _, oe := range ready {
+		oe.dispatch()
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/hyperledger/firefly-ethconnect/mocks/ethmocks"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newOrderedTestEvent(subID string, blockNumber, txIndex, logIndex uint64) *eventData {
+	return &eventData{
+		ID:               fmt.Sprintf("%s/%d/%d/%d", subID, blockNumber, txIndex, logIndex),
+		SubID:            subID,
+		BlockNumber:      fmt.Sprintf("%d", blockNumber),
+		BlockHash:        fmt.Sprintf("0x%x", blockNumber),
+		TransactionHash:  fmt.Sprintf("0x%x%x", blockNumber, txIndex),
+		LogIndex:         "0",
+		batchComplete:    func(*eventData) {},
+		blockNumber:      blockNumber,
+		transactionIndex: txIndex,
+		blockLogIndex:    logIndex,
+	}
+}
+
+func TestOrderingBufferTake(t *testing.T) {
+	assert := assert.New(t)
+	ob := newOrderingBuffer()
+	var dispatched []string
+	add := func(e *eventData) {
+		ob.add(e, false, func() { dispatched = append(dispatched, e.ID) })
+	}
+
+	add(newOrderedTestEvent("sub1", 12, 0, 0))
+	add(newOrderedTestEvent("sub1", 10, 1, 3))
+	add(newOrderedTestEvent("sub2", 10, 1, 1))
+	add(newOrderedTestEvent("sub2", 11, 0, 0))
+	add(newOrderedTestEvent("sub2", 10, 0, 5))
+	// Detected again after the filter was restarted
+	add(newOrderedTestEvent("sub1", 10, 1, 3))
+
+	for _, oe := range ob.take(big.NewInt(12)) {
+		oe.dispatch()
+	}
+	assert.Equal([]string{"sub2/10/0/5", "sub2/10/1/1", "sub1/10/1/3", "sub2/11/0/0"}, dispatched)
+
+	dispatched = nil
+	for _, oe := range ob.take(nil) {
+		oe.dispatch()
+	}
+	assert.Equal([]string{"sub1/12/0/0"}, dispatched)
+
+	add(newOrderedTestEvent("sub1", 13, 0, 0))
+	ob.reset()
+	assert.Empty(ob.take(nil))
+}
+
+func TestSubscriptionReadTo(t *testing.T) {
+	assert := assert.New(t)
+	head := big.NewInt(100)
+	lp := &logProcessor{}
+	lp.blockHWM.SetInt64(42)
+
+	assert.Equal(int64(101), (&subscription{lp: lp}).readTo(head, false).Int64())
+	assert.Equal(int64(42), (&subscription{lp: lp}).readTo(head, true).Int64())
+	assert.Equal(int64(42), (&subscription{lp: lp, filterStale: true}).readTo(head, false).Int64())
+	assert.Equal(int64(100), (&subscription{lp: lp, push: &logPush{}}).readTo(head, false).Int64())
+	assert.Equal(int64(50), (&subscription{lp: lp, catchupBlock: big.NewInt(50)}).readTo(head, false).Int64())
+	assert.Equal(int64(60), (&subscription{lp: lp, nextBlock: big.NewInt(60)}).readTo(head, false).Int64())
+	assert.Equal(int64(70), (&subscription{lp: lp, sharedFetchBlock: big.NewInt(70)}).readTo(head, false).Int64())
+	assert.Nil((&subscription{lp: lp, receipts: &receiptQueue{}}).readTo(head, false))
+	assert.Nil((&subscription{lp: lp, deleting: true}).readTo(head, false))
+}
+
+func TestDispatchOrderedAcrossSubscriptions(t *testing.T) {
+	assert := assert.New(t)
+	stream := &eventStream{
+		spec:        &StreamInfo{ID: "es1", Ordered: true},
+		eventStream: make(chan *eventData, 10),
+		ordering:    newOrderingBuffer(),
+	}
+	lp1 := newLogProcessor("sub1", nil, stream, nil)
+	lp2 := newLogProcessor("sub2", nil, stream, nil)
+	subs := []*subscription{
+		{info: &SubscriptionInfo{ID: "sub1"}, lp: lp1},
+		{info: &SubscriptionInfo{ID: "sub2"}, lp: lp2, catchupBlock: big.NewInt(12)},
+	}
+
+	// The first subscription is polled before the second
+	lp1.dispatch(t.Name(), newOrderedTestEvent("sub1", 11, 0, 0), false)
+	lp1.dispatch(t.Name(), newOrderedTestEvent("sub1", 20, 0, 0), false)
+	lp2.dispatch(t.Name(), newOrderedTestEvent("sub2", 10, 0, 0), false)
+	assert.Empty(stream.eventStream)
+
+	// Events are held until the subscription in catchup mode has read past their block
+	stream.dispatchOrdered(subs, big.NewInt(20), map[string]bool{})
+	assert.Equal("sub2/10/0/0", (<-stream.eventStream).ID)
+	assert.Equal("sub1/11/0/0", (<-stream.eventStream).ID)
+	assert.Empty(stream.eventStream)
+
+	// The events of a subscription that failed to poll are held
+	subs[1].catchupBlock = nil
+	stream.dispatchOrdered(subs, big.NewInt(20), map[string]bool{"sub2": true})
+	assert.Empty(stream.eventStream)
+
+	stream.dispatchOrdered(subs, big.NewInt(20), map[string]bool{})
+	assert.Equal("sub1/20/0/0", (<-stream.eventStream).ID)
+	assert.Equal(int64(20), lp1.highestDispatched.Int64())
+
+	// Once the stream is no longer ordered, all the buffered events are dispatched
+	lp1.dispatch(t.Name(), newOrderedTestEvent("sub1", 30, 0, 0), false)
+	stream.spec.Ordered = false
+	stream.dispatchOrdered(subs, nil, nil)
+	assert.Equal("sub1/30/0/0", (<-stream.eventStream).ID)
+	lp1.dispatch(t.Name(), newOrderedTestEvent("sub1", 31, 0, 0), false)
+	assert.Equal("sub1/31/0/0", (<-stream.eventStream).ID)
+}
+
+func TestOrderedEventHoldsBlockHWM(t *testing.T) {
+	assert := assert.New(t)
+	stream := &eventStream{
+		spec:        &StreamInfo{ID: "es1", Ordered: true},
+		eventStream: make(chan *eventData, 10),
+		ordering:    newOrderingBuffer(),
+	}
+	lp := newLogProcessor("sub1", nil, stream, nil)
+	lp.initBlockHWM(big.NewInt(10))
+
+	// The HWM does not move past an event held in the ordering buffer
+	lp.dispatch(t.Name(), newOrderedTestEvent("sub1", 11, 0, 0), false)
+	lp.markNoEvents(big.NewInt(20))
+	hwm := lp.getBlockHWM()
+	assert.Equal(int64(10), hwm.Int64())
+
+	// Once the event is delivered, the HWM moves on
+	stream.dispatchOrdered(nil, nil, nil)
+	lp.batchComplete(<-stream.eventStream)
+	lp.markNoEvents(big.NewInt(20))
+	hwm = lp.getBlockHWM()
+	assert.Equal(int64(21), hwm.Int64())
+}
+
+func TestOrderedHead(t *testing.T) {
+	assert := assert.New(t)
+	stream := &eventStream{spec: &StreamInfo{ID: "es1", Ordered: true}}
+
+	rpc := &ethmocks.RPCClient{}
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_blockNumber").Run(func(args mock.Arguments) {
+		*(args[1].(*ethbinding.HexBigInt)) = ethbinding.HexBigInt(*big.NewInt(123))
+	}).Return(nil).Once()
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_blockNumber").Return(fmt.Errorf("pop"))
+	subs := []*subscription{{}, {rpc: rpc}}
+
+	head, err := stream.orderedHead(context.Background(), subs)
+	assert.NoError(err)
+	assert.Equal(int64(123), head.Int64())
+
+	_, err = stream.orderedHead(context.Background(), subs)
+	assert.Regexp("eth_blockNumber returned: pop", err)
+
+	head, err = stream.orderedHead(context.Background(), nil)
+	assert.NoError(err)
+	assert.Nil(head)
+}
+
+func TestOrderedStreamUpdate(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	ctx := context.Background()
+
+	spec, err := sm.AddStream(ctx, &StreamInfo{Type: "websocket", Ordered: true, DeduplicationWindow: 100000})
+	assert.NoError(err)
+	assert.True(spec.Ordered)
+	assert.Equal(uint64(MaxDeduplicationWindow), spec.DeduplicationWindow)
+
+	spec, err = sm.UpdateStream(ctx, spec.ID, &StreamInfo{DeduplicationWindow: 10})
+	assert.NoError(err)
+	assert.False(spec.Ordered)
+	assert.Equal(uint64(10), spec.DeduplicationWindow)
+
+	// An update above the maximum is clamped, as on create
+	spec, err = sm.UpdateStream(ctx, spec.ID, &StreamInfo{DeduplicationWindow: 100000})
+	assert.NoError(err)
+	assert.Equal(uint64(MaxDeduplicationWindow), spec.DeduplicationWindow)
+	sm.Close(true)
+}
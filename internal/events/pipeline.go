@@ -0,0 +1,160 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"strings"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/errors"
+)
+
+const (
+	// MaxInFlightBatchesLimit is the maximum that a user can specify for the batches in flight on a stream
+	MaxInFlightBatchesLimit = 100
+	// BatchOrderingSubscription delivers the batches containing events from a subscription one at a time
+	BatchOrderingSubscription = "subscription"
+	// BatchOrderingAddress delivers the batches containing events from a contract address one at a time
+	BatchOrderingAddress = "address"
+)
+
+// inFlightBatch is a batch that has been taken from the queue, and not yet completed
+type inFlightBatch struct {
+	batchNumber uint64
+	events      []*eventData
+	keys        map[string]bool // the ordering keys of the events in the batch
+	delivered   bool            // delivered (or skipped), but waiting for an earlier batch to be delivered
+}
+
+func validatePipelining(spec *StreamInfo) error {
+	switch spec.BatchOrdering {
+	case "", BatchOrderingSubscription, BatchOrderingAddress:
+	default:
+		return errors.Errorf(errors.EventStreamsInvalidBatchOrdering, spec.BatchOrdering)
+	}
+	if spec.MaxInFlightBatches > 1 && spec.PersistBatches {
+		return errors.Errorf(errors.EventStreamsPipelinedPersistBatches)
+	}
+	if spec.MaxInFlightBatches > 1 && !acksConcurrentBatches(spec) {
+		return errors.Errorf(errors.EventStreamsPipelinedUncorrelatedAcks, strings.ToLower(spec.Type))
+	}
+	return nil
+}
+
+// acksConcurrentBatches returns false for the stream types that hold a single batch awaiting an ack, or
+// share the acks of a topic between batches, so cannot deliver more than one batch at a time
+func acksConcurrentBatches(spec *StreamInfo) bool {
+	switch strings.ToLower(spec.Type) {
+	case "sse":
+		return false
+	case "websocket":
+		return spec.WebSocket != nil && spec.WebSocket.DistributionMode == DistributionModeConsumerGroup
+	default:
+		return true
+	}
+}
+
+func (spec *StreamInfo) maxInFlightBatches() uint64 {
+	if spec.MaxInFlightBatches == 0 {
+		return 1
+	}
+	return spec.MaxInFlightBatches
+}
+
+// maxInFlightEvents is the number of events dispatched to batches, beyond which the stream is blocked
+func (spec *StreamInfo) maxInFlightEvents() uint64 {
+	return spec.BatchSize * spec.maxInFlightBatches()
+}
+
+func (a *eventStream) orderingKeys(events []*eventData) map[string]bool {
+	keys := make(map[string]bool)
+	for _, event := range events {
+		if a.spec.BatchOrdering == BatchOrderingAddress {
+			keys[event.Address] = true
+		} else {
+			keys[event.SubID] = true
+		}
+	}
+	return keys
+}
+
+// canStartBatch checks whether the batch at the front of the queue can be delivered alongside the batches
+// already in flight. It must not share an ordering key with a batch that is still being delivered, so the
+// events of each subscription (or address) are delivered in order even when an earlier batch is retried.
+// Must be called holding the batch lock.
+func (a *eventStream) canStartBatch(events []*eventData) bool {
+	if uint64(a.inFlightBatches.Len()) >= a.spec.maxInFlightBatches() {
+		return false
+	}
+	keys := a.orderingKeys(events)
+	for e := a.inFlightBatches.Front(); e != nil; e = e.Next() {
+		b := e.Value.(*inFlightBatch)
+		if b.delivered {
+			continue
+		}
+		for k := range keys {
+			if b.keys[k] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// completeBatch marks a batch as delivered, then completes every delivered batch that has no
+// undelivered batch ahead of it, in batch number order. So the high water marks of the
+// subscriptions, and the checkpoint, never move past an event in a batch still in flight.
+func (a *eventStream) completeBatch(batchNumber uint64) {
+	// Serialize the completion callbacks, as batches are delivered concurrently
+	a.completionMux.Lock()
+	defer a.completionMux.Unlock()
+
+	a.batchCond.L.Lock()
+	for e := a.inFlightBatches.Front(); e != nil; e = e.Next() {
+		if b := e.Value.(*inFlightBatch); b.batchNumber == batchNumber {
+			b.delivered = true
+		}
+	}
+	var completed []*inFlightBatch
+	toComplete := make(map[*inFlightBatch][]*eventData)
+	for e := a.inFlightBatches.Front(); e != nil && e.Value.(*inFlightBatch).delivered; e = a.inFlightBatches.Front() {
+		b := e.Value.(*inFlightBatch)
+		completed = append(completed, b)
+		toComplete[b] = markCompleted(b.events)
+		a.inFlightBatches.Remove(e)
+	}
+	a.batchCond.Broadcast()
+	a.batchCond.L.Unlock()
+
+	for _, b := range completed {
+		// Call all the callbacks on the events, so they can update their high water marks
+		// If there are multiple events from one SubID, we call it only once with the
+		// last message in the batch
+		// Provisional notifications do not move the high water mark, as the event is still pending.
+		// Duplicates dropped from the batch complete the subscriptions that detected them too.
+		cbs := make(map[string]*eventData)
+		for _, event := range toComplete[b] {
+			if !event.provisional() {
+				cbs[event.SubID] = event
+			}
+		}
+		for _, event := range cbs {
+			event.batchComplete(event)
+		}
+	}
+
+	if len(completed) > 0 && a.spec.PersistBatches {
+		a.checkpointBatch()
+	}
+}
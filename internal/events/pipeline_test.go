@@ -0,0 +1,187 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testPipelineAction holds each batch until it is released by the test
+type testPipelineAction struct {
+	started chan uint64
+	mux     sync.Mutex
+	release map[uint64]chan struct{}
+}
+
+func (t *testPipelineAction) releaseChan(batchNumber uint64) chan struct{} {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	c, ok := t.release[batchNumber]
+	if !ok {
+		c = make(chan struct{})
+		t.release[batchNumber] = c
+	}
+	return c
+}
+
+func (t *testPipelineAction) attemptBatch(batchNumber, attempt uint64, events []*eventData) error {
+	t.started <- batchNumber
+	<-t.releaseChan(batchNumber)
+	return nil
+}
+
+func assertNoBatchStarted(t *testing.T, action *testPipelineAction) {
+	select {
+	case b := <-action.started:
+		assert.Fail(t, "unexpected batch started", "batch %d", b)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPipelinedBatchesCompleteInOrder(t *testing.T) {
+	assert := assert.New(t)
+	_, stream, svr, _ := newTestStreamForBatching(&StreamInfo{
+		BatchSize:          1,
+		MaxInFlightBatches: 3,
+		BatchOrdering:      BatchOrderingAddress,
+		Webhook:            &webhookActionInfo{},
+	}, nil, 200)
+	defer svr.Close()
+	defer stream.stop(false)
+	action := &testPipelineAction{started: make(chan uint64), release: make(map[uint64]chan struct{})}
+	stream.action = action
+
+	var completedMux sync.Mutex
+	var completed []string
+	newEvent := func(address, blockNumber string) *eventData {
+		return &eventData{
+			SubID:       "sub1",
+			Address:     address,
+			BlockNumber: blockNumber,
+			batchComplete: func(e *eventData) {
+				completedMux.Lock()
+				completed = append(completed, e.BlockNumber)
+				completedMux.Unlock()
+			},
+		}
+	}
+	getCompleted := func() []string {
+		completedMux.Lock()
+		defer completedMux.Unlock()
+		return append([]string{}, completed...)
+	}
+
+	// The batches for different addresses are delivered together, but the second batch for
+	// an address waits for the first
+	stream.handleEvent(newEvent("0xaaa", "10"))
+	stream.handleEvent(newEvent("0xbbb", "11"))
+	stream.handleEvent(newEvent("0xaaa", "12"))
+	assert.ElementsMatch([]uint64{1, 2}, []uint64{<-action.started, <-action.started})
+	assertNoBatchStarted(t, action)
+	assert.Equal(2, stream.status().InFlightBatches)
+
+	// A later batch is not completed until all earlier batches are acked
+	close(action.releaseChan(2))
+	assertNoBatchStarted(t, action)
+	assert.Empty(getCompleted())
+
+	close(action.releaseChan(1))
+	assert.Equal(uint64(3), <-action.started)
+	assert.Eventually(func() bool { return len(getCompleted()) == 2 }, 5*time.Second, time.Millisecond)
+	assert.Equal([]string{"10", "11"}, getCompleted())
+
+	close(action.releaseChan(3))
+	assert.Eventually(func() bool { return len(getCompleted()) == 3 }, 5*time.Second, time.Millisecond)
+	assert.Equal([]string{"10", "11", "12"}, getCompleted())
+	assert.Eventually(func() bool { return stream.status().InFlightBatches == 0 }, 5*time.Second, time.Millisecond)
+}
+
+func TestPipelinedBatchesOrderedBySubscription(t *testing.T) {
+	assert := assert.New(t)
+	_, stream, svr, _ := newTestStreamForBatching(&StreamInfo{
+		BatchSize:          1,
+		MaxInFlightBatches: 2,
+		Webhook:            &webhookActionInfo{},
+	}, nil, 200)
+	defer svr.Close()
+	defer stream.stop(false)
+	action := &testPipelineAction{started: make(chan uint64), release: make(map[uint64]chan struct{})}
+	stream.action = action
+
+	// The limit on batches in flight applies, as well as the ordering
+	stream.handleEvent(&eventData{SubID: "sub1", Address: "0xaaa", batchComplete: func(*eventData) {}})
+	stream.handleEvent(&eventData{SubID: "sub2", Address: "0xaaa", batchComplete: func(*eventData) {}})
+	stream.handleEvent(&eventData{SubID: "sub3", Address: "0xbbb", batchComplete: func(*eventData) {}})
+	assert.ElementsMatch([]uint64{1, 2}, []uint64{<-action.started, <-action.started})
+	assertNoBatchStarted(t, action)
+	assert.True(stream.isBlocked())
+
+	close(action.releaseChan(1))
+	assert.Equal(uint64(3), <-action.started)
+	close(action.releaseChan(2))
+	close(action.releaseChan(3))
+	assert.Eventually(func() bool { return !stream.isBlocked() }, 5*time.Second, time.Millisecond)
+
+	stream.batchCond.L.Lock()
+	stream.inFlightBatches.PushBack(&inFlightBatch{batchNumber: 4, keys: map[string]bool{"sub1": true}})
+	assert.False(stream.canStartBatch([]*eventData{{SubID: "sub1"}}))
+	assert.True(stream.canStartBatch([]*eventData{{SubID: "sub2"}}))
+	stream.inFlightBatches.Init()
+	stream.batchCond.L.Unlock()
+}
+
+func TestPipelinedBatchesValidation(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	ctx := context.Background()
+
+	_, err := sm.AddStream(ctx, &StreamInfo{Type: "websocket", BatchOrdering: "banana"})
+	assert.Regexp("FFEC100267.*banana", err)
+	_, err = sm.AddStream(ctx, &StreamInfo{Type: "websocket", MaxInFlightBatches: 2, PersistBatches: true})
+	assert.Regexp("FFEC100268", err)
+
+	// Stream types that cannot tell apart the acks of concurrent batches deliver one batch at a time
+	_, err = sm.AddStream(ctx, &StreamInfo{Type: "SSE", MaxInFlightBatches: 2})
+	assert.Regexp("FFEC100276.*sse", err)
+	_, err = sm.AddStream(ctx, &StreamInfo{Type: "websocket", MaxInFlightBatches: 2})
+	assert.Regexp("FFEC100276.*websocket", err)
+	_, err = sm.AddStream(ctx, &StreamInfo{Type: "websocket", MaxInFlightBatches: 2, WebSocket: &webSocketActionInfo{DistributionMode: DistributionModeWLD}})
+	assert.Regexp("FFEC100276.*websocket", err)
+	wsSpec, err := sm.AddStream(ctx, &StreamInfo{Type: "websocket", MaxInFlightBatches: 1})
+	assert.NoError(err)
+	_, err = sm.UpdateStream(ctx, wsSpec.ID, &StreamInfo{MaxInFlightBatches: 2})
+	assert.Regexp("FFEC100276.*websocket", err)
+
+	spec, err := sm.AddStream(ctx, &StreamInfo{Type: "websocket", BatchSize: 10, MaxInFlightBatches: 1000, WebSocket: &webSocketActionInfo{
+		DistributionMode: DistributionModeConsumerGroup,
+		ConsumerGroup:    "group1",
+	}})
+	assert.NoError(err)
+	assert.Equal(uint64(MaxInFlightBatchesLimit), spec.MaxInFlightBatches)
+	assert.Equal(uint64(1000), spec.maxInFlightEvents())
+
+	_, err = sm.UpdateStream(ctx, spec.ID, &StreamInfo{PersistBatches: true})
+	assert.Regexp("FFEC100268", err)
+	spec, err = sm.UpdateStream(ctx, spec.ID, &StreamInfo{MaxInFlightBatches: 5, BatchOrdering: BatchOrderingAddress})
+	assert.NoError(err)
+	assert.Equal(uint64(5), spec.MaxInFlightBatches)
+	assert.Equal(BatchOrderingAddress, spec.BatchOrdering)
+	sm.Close(true)
+}
@@ -0,0 +1,85 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/errors"
+	"github.com/hyperledger/firefly-ethconnect/pkg/plugins"
+	log "github.com/sirupsen/logrus"
+)
+
+var actionPlugins = map[string]plugins.EventStreamActionPlugin{}
+
+// RegisterEventStreamActionPlugin makes the action of a plugin available as a stream type.
+// Must be called before the subscription manager is initialized.
+func RegisterEventStreamActionPlugin(streamType string, p plugins.EventStreamActionPlugin) error {
+	streamType = strings.ToLower(streamType)
+	switch streamType {
+	case "", "webhook", "websocket", "sse":
+		return errors.Errorf(errors.EventStreamsActionPluginType, streamType)
+	}
+	actionPlugins[streamType] = p
+	return nil
+}
+
+// pluginAction adapts the action of a plugin to the internal interface of the stream
+type pluginAction struct {
+	es     *eventStream
+	action plugins.EventStreamAction
+}
+
+func validatePluginConfig(p plugins.EventStreamActionPlugin, spec *StreamInfo) error {
+	if err := p.ValidateConfig(spec.Plugin); err != nil {
+		return errors.Errorf(errors.EventStreamsActionPluginConfig, spec.Type, err)
+	}
+	return nil
+}
+
+func newPluginAction(es *eventStream, p plugins.EventStreamActionPlugin, spec *StreamInfo) (*pluginAction, error) {
+	if err := validatePluginConfig(p, spec); err != nil {
+		return nil, err
+	}
+	action, err := p.NewAction(spec.ID, spec.Plugin)
+	if err != nil {
+		return nil, errors.Errorf(errors.EventStreamsActionPluginFailed, spec.Type, err)
+	}
+	return &pluginAction{es: es, action: action}, nil
+}
+
+// attemptBatch passes each event to the plugin as the JSON a webhook would receive,
+// so plugins are insulated from the internal representation of events
+func (p *pluginAction) attemptBatch(batchNumber, attempt uint64, events []*eventData) error {
+	payloads := make([]json.RawMessage, len(events))
+	for i, event := range events {
+		b, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		payloads[i] = b
+	}
+	return p.action.AttemptBatch(batchNumber, attempt, payloads)
+}
+
+func (p *pluginAction) close() {
+	if closer, ok := p.action.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Warnf("%s: Failed to close %s action: %s", p.es.spec.ID, p.es.spec.Type, err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/firefly-ethconnect/pkg/plugins"
+	"github.com/stretchr/testify/assert"
+)
+
+type testActionConfig struct {
+	Topic string `json:"topic"`
+	Fail  bool   `json:"fail"`
+}
+
+type testActionPlugin struct {
+	actions []*testAction
+}
+
+type testAction struct {
+	streamID string
+	conf     testActionConfig
+	batches  [][]json.RawMessage
+	closed   int32
+}
+
+func (p *testActionPlugin) ValidateConfig(config json.RawMessage) error {
+	var conf testActionConfig
+	if err := json.Unmarshal(config, &conf); err != nil {
+		return err
+	}
+	if conf.Topic == "" {
+		return fmt.Errorf("topic is required")
+	}
+	return nil
+}
+
+func (p *testActionPlugin) NewAction(streamID string, config json.RawMessage) (plugins.EventStreamAction, error) {
+	a := &testAction{streamID: streamID}
+	_ = json.Unmarshal(config, &a.conf)
+	if a.conf.Fail {
+		return nil, fmt.Errorf("pop")
+	}
+	p.actions = append(p.actions, a)
+	return a, nil
+}
+
+func (a *testAction) AttemptBatch(batchNumber, attempt uint64, events []json.RawMessage) error {
+	a.batches = append(a.batches, events)
+	return nil
+}
+
+func (a *testAction) Close() error {
+	atomic.AddInt32(&a.closed, 1)
+	return nil
+}
+
+func registerTestActionPlugin(t *testing.T) *testActionPlugin {
+	p := &testActionPlugin{}
+	err := RegisterEventStreamActionPlugin("TestPlugin", p)
+	assert.NoError(t, err)
+	return p
+}
+
+func TestRegisterEventStreamActionPluginBuiltIn(t *testing.T) {
+	err := RegisterEventStreamActionPlugin("WebHook", &testActionPlugin{})
+	assert.Regexp(t, "FFEC100257.*webhook", err)
+	err = RegisterEventStreamActionPlugin("", &testActionPlugin{})
+	assert.Regexp(t, "FFEC100257", err)
+}
+
+func TestPluginActionStream(t *testing.T) {
+	assert := assert.New(t)
+	p := registerTestActionPlugin(t)
+	defer delete(actionPlugins, "testplugin")
+	sm := newTestSubscriptionManager()
+	ctx := context.Background()
+
+	spec, err := sm.AddStream(ctx, &StreamInfo{
+		Type:   "TestPlugin",
+		Plugin: json.RawMessage(`{"topic":"topic1"}`),
+	})
+	assert.NoError(err)
+	assert.Equal("testplugin", spec.Type)
+	assert.Len(p.actions, 1)
+	assert.Equal(spec.ID, p.actions[0].streamID)
+	assert.Equal("topic1", p.actions[0].conf.Topic)
+
+	es := sm.streams[spec.ID]
+	event := testEvent("sub1")
+	err = es.action.attemptBatch(1, 1, []*eventData{event})
+	assert.NoError(err)
+	assert.Len(p.actions[0].batches, 1)
+	var delivered eventData
+	err = json.Unmarshal(p.actions[0].batches[0][0], &delivered)
+	assert.NoError(err)
+	assert.Equal(event.SubID, delivered.SubID)
+
+	// An update to the configuration replaces the action
+	spec, err = sm.UpdateStream(ctx, spec.ID, &StreamInfo{Plugin: json.RawMessage(`{"topic":"topic2"}`)})
+	assert.NoError(err)
+	assert.Equal(`{"topic":"topic2"}`, string(spec.Plugin))
+	assert.Len(p.actions, 2)
+	assert.Equal("topic2", p.actions[1].conf.Topic)
+	assert.Equal(int32(1), atomic.LoadInt32(&p.actions[0].closed))
+	assert.Equal(p.actions[1], es.action.(*pluginAction).action)
+
+	// Other updates keep the action
+	_, err = sm.UpdateStream(ctx, spec.ID, &StreamInfo{BatchSize: 10})
+	assert.NoError(err)
+	assert.Len(p.actions, 2)
+
+	err = sm.DeleteStream(ctx, spec.ID)
+	assert.NoError(err)
+	assert.Eventually(func() bool {
+		return atomic.LoadInt32(&p.actions[1].closed) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPluginActionStreamConfigErrors(t *testing.T) {
+	assert := assert.New(t)
+	p := registerTestActionPlugin(t)
+	defer delete(actionPlugins, "testplugin")
+	sm := newTestSubscriptionManager()
+	ctx := context.Background()
+
+	_, err := sm.AddStream(ctx, &StreamInfo{Type: "unknown"})
+	assert.Regexp("FFEC100030", err)
+
+	_, err = sm.AddStream(ctx, &StreamInfo{Type: "testplugin", Plugin: json.RawMessage(`{}`)})
+	assert.Regexp("FFEC100258.*testplugin.*topic is required", err)
+
+	_, err = sm.AddStream(ctx, &StreamInfo{Type: "testplugin"})
+	assert.Regexp("FFEC100258", err)
+
+	_, err = sm.AddStream(ctx, &StreamInfo{Type: "testplugin", Plugin: json.RawMessage(`{"topic":"topic1","fail":true}`)})
+	assert.Regexp("FFEC100259.*pop", err)
+
+	spec, err := sm.AddStream(ctx, &StreamInfo{Type: "testplugin", Plugin: json.RawMessage(`{"topic":"topic1"}`)})
+	assert.NoError(err)
+	defer sm.streams[spec.ID].stop(false)
+
+	_, err = sm.UpdateStream(ctx, spec.ID, &StreamInfo{Plugin: json.RawMessage(`{"topic":""}`)})
+	assert.Regexp("FFEC100258", err)
+
+	// A failure to create the new action leaves the stream unchanged
+	_, err = sm.UpdateStream(ctx, spec.ID, &StreamInfo{Plugin: json.RawMessage(`{"topic":"topic2","fail":true}`)})
+	assert.Regexp("FFEC100259", err)
+	assert.Equal(`{"topic":"topic1"}`, string(sm.streams[spec.ID].spec.Plugin))
+	assert.Equal(p.actions[0], sm.streams[spec.ID].action.(*pluginAction).action)
+
+	err = sm.validateImportStream(&StreamInfo{ID: streamIDPrefix + "1", Type: "testplugin", Plugin: json.RawMessage(`{}`)})
+	assert.Regexp("FFEC100258", err)
+	err = sm.validateImportStream(&StreamInfo{ID: streamIDPrefix + "1", Type: "testplugin", Plugin: json.RawMessage(`{"topic":"topic1"}`)})
+	assert.NoError(err)
+}
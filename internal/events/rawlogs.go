@@ -0,0 +1,160 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/hyperledger/firefly-ethconnect/internal/contractregistry"
+	"github.com/hyperledger/firefly-ethconnect/internal/errors"
+	"github.com/hyperledger/firefly-ethconnect/internal/eth"
+	"github.com/hyperledger/firefly-ethconnect/internal/ethbind"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// rawLogsSignature is used in place of the event signature, for subscriptions to raw logs
+	rawLogsSignature = "raw"
+	// rawEventCacheSize is the number of resolved events cached by each subscription to raw logs
+	rawEventCacheSize = 100
+)
+
+// rawLogs returns true for an event subscription without an event ABI, that filters on addresses
+// and topics, and decodes the logs only if an ABI is available in the contract registry
+func (info *SubscriptionInfo) rawLogs() bool {
+	return info.Event == nil
+}
+
+// validateRawLogs checks a subscription to raw logs does not match every log on the chain
+func validateRawLogs(info *SubscriptionInfo) error {
+	if len(info.Filter.Addresses) == 0 && len(info.Filter.Topics) == 0 {
+		return errors.Errorf(errors.EventStreamsSubscribeRawNoFilter)
+	}
+	return nil
+}
+
+// newSubscriptionLogProcessor returns the log processor for an event subscription, and the
+// signature of the event it subscribes to
+func newSubscriptionLogProcessor(i *SubscriptionInfo, rpc eth.RPCClient, cr contractregistry.ContractResolver, stream *eventStream, bcm *blockConfirmationManager) (*logProcessor, string, error) {
+	if i.rawLogs() {
+		lp := newLogProcessor(i.ID, nil, stream, bcm)
+		lp.rawEvents = newRawEventResolver(rpc, cr)
+		return lp, rawLogsSignature, nil
+	}
+	event, err := ethbind.API.ABIElementMarshalingToABIEvent(i.Event)
+	if err != nil {
+		return nil, "", err
+	}
+	return newLogProcessor(i.ID, event, stream, bcm), ethbind.API.ABIEventSignature(event), nil
+}
+
+// rawEventResolver finds the definition of the event that emitted a raw log, from the ABI of the
+// contract registered at the address of the log, or failing that from any local ABI with an event
+// matching the first topic. If the contract registered at the address is an upgradeable proxy, the
+// ABI of its implementation at the block of the log is used. Only events that are found are cached,
+// so that logs are decoded as soon as an ABI becomes available.
+type rawEventResolver struct {
+	rpc   eth.RPCClient
+	cr    contractregistry.ContractResolver
+	cache *lru.Cache
+}
+
+func newRawEventResolver(rpc eth.RPCClient, cr contractregistry.ContractResolver) *rawEventResolver {
+	cache, _ := lru.New(rawEventCacheSize)
+	return &rawEventResolver{
+		rpc:   rpc,
+		cr:    cr,
+		cache: cache,
+	}
+}
+
+func (r *rawEventResolver) resolve(subInfo string, entry *logEntry) *ethbinding.ABIEvent {
+	if r.cr == nil || len(entry.Topics) == 0 || entry.Topics[0] == nil {
+		return nil
+	}
+	topic := *entry.Topics[0]
+	abiID := r.abiForAddress(subInfo, entry)
+	key := abiID + "/" + topic.Hex()
+	if cached, ok := r.cache.Get(key); ok {
+		return cached.(*ethbinding.ABIEvent)
+	}
+	var event *ethbinding.ABIEvent
+	if abiID != "" {
+		event = r.resolveInABI(subInfo, abiID, topic)
+	}
+	if event == nil {
+		event = r.resolveBySignature(subInfo, topic)
+	}
+	if event != nil {
+		r.cache.Add(key, event)
+	}
+	return event
+}
+
+// abiForAddress returns the ID of the ABI registered for the address of the log, or an empty string
+func (r *rawEventResolver) abiForAddress(subInfo string, entry *logEntry) string {
+	info, err := r.cr.GetContractByAddress(entry.Address.String())
+	if err != nil || info == nil {
+		return ""
+	}
+	if r.rpc != nil {
+		blockNumber := entry.BlockNumber.String()
+		impl, err := r.cr.GetImplementationContract(context.Background(), r.rpc, entry.Address.String(), blockNumber)
+		if err != nil {
+			log.Warnf("%s: Unable to check for a proxy implementation of %s at block %s: %s", subInfo, entry.Address.String(), blockNumber, err)
+		} else if impl != nil {
+			return impl.ABI
+		}
+	}
+	return info.ABI
+}
+
+func (r *rawEventResolver) resolveInABI(subInfo string, abiID string, topic ethbinding.Hash) *ethbinding.ABIEvent {
+	deployMsg, err := r.cr.GetABI(contractregistry.ABILocation{
+		ABIType: contractregistry.LocalABI,
+		Name:    abiID,
+	}, false)
+	if err != nil || deployMsg == nil || deployMsg.Contract == nil {
+		log.Debugf("%s: Unable to load ABI '%s': %v", subInfo, abiID, err)
+		return nil
+	}
+	abi, err := ethbind.API.ABIMarshalingToABIRuntime(deployMsg.Contract.ABI)
+	if err != nil {
+		log.Warnf("%s: Unable to parse ABI '%s': %s", subInfo, abiID, err)
+		return nil
+	}
+	for _, event := range abi.Events {
+		if !event.Anonymous && event.ID == topic {
+			e := event
+			return &e
+		}
+	}
+	return nil
+}
+
+func (r *rawEventResolver) resolveBySignature(subInfo string, topic ethbinding.Hash) *ethbinding.ABIEvent {
+	element, err := r.cr.GetEventBySignature(topic.Hex())
+	if err != nil || element == nil {
+		return nil
+	}
+	event, err := ethbind.API.ABIElementMarshalingToABIEvent(element)
+	if err != nil {
+		log.Warnf("%s: Unable to parse event '%s' with signature %s: %s", subInfo, element.Name, topic.Hex(), err)
+		return nil
+	}
+	return event
+}
@@ -0,0 +1,206 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/contractregistry"
+	"github.com/hyperledger/firefly-ethconnect/internal/ethbind"
+	"github.com/hyperledger/firefly-ethconnect/internal/messages"
+	"github.com/hyperledger/firefly-ethconnect/mocks/contractregistrymocks"
+	"github.com/hyperledger/firefly-ethconnect/mocks/ethmocks"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCreateRawLogsSubscription(t *testing.T) {
+	assert := assert.New(t)
+	m := &mockSubMgr{stream: newTestStream()}
+
+	_, err := newSubscription(m, nil, nil, nil, testSubInfo(nil))
+	assert.Regexp("FFEC100270", err)
+
+	topic := ethbind.API.HexToHash("0x35d3551f6fc757e3146f18d79fbbaf97d788f77b23b07f25f5a80621072d5c70")
+	info := testSubInfo(&ethbinding.ABIElementMarshaling{Name: "devcon"})
+	info.Filter.Topics = [][]ethbinding.Hash{{topic}}
+	_, err = newSubscription(m, nil, nil, nil, info)
+	assert.Regexp("FFEC100271", err)
+
+	info = testSubInfo(nil)
+	info.Filter.Topics = [][]ethbinding.Hash{{topic}}
+	addr := ethbind.API.HexToAddress("0x0123456789abcDEF0123456789abCDef01234567")
+	s, err := newSubscription(m, nil, nil, &addr, info)
+	assert.NoError(err)
+	assert.Equal("0x0123456789abcDEF0123456789abCDef01234567:raw", s.info.Name)
+	assert.Equal([][]ethbinding.Hash{{topic}}, s.info.Filter.Topics)
+	assert.NotNil(s.lp.rawEvents)
+
+	s, err = restoreSubscription(m, nil, nil, info)
+	assert.NoError(err)
+	assert.Equal("test:raw", s.logName)
+	assert.NotNil(s.lp.rawEvents)
+}
+
+func TestProcessRawLogDecodedWhenABIAvailable(t *testing.T) {
+	assert := assert.New(t)
+
+	var entry logEntry
+	err := json.Unmarshal([]byte(sampleEventLogAllIndexedNoData), &entry)
+	assert.NoError(err)
+	var element ethbinding.ABIElementMarshaling
+	err = json.Unmarshal([]byte(sampleEventABIAllIndexedNoData), &element)
+	assert.NoError(err)
+	addrHex := entry.Address.String()
+	topicHex := entry.Topics[0].Hex()
+
+	mcr := &contractregistrymocks.ContractStore{}
+	mcr.On("GetContractByAddress", addrHex).Return(nil, fmt.Errorf("pop"))
+	mcr.On("GetEventBySignature", topicHex).Return(nil, fmt.Errorf("pop")).Once()
+	mcr.On("GetEventBySignature", topicHex).Return(&element, nil).Once()
+
+	stream := &eventStream{
+		spec:        &StreamInfo{},
+		eventStream: make(chan *eventData, 1),
+	}
+	lp := newLogProcessor("sub1", nil, stream, nil)
+	lp.rawEvents = newRawEventResolver(nil, mcr)
+
+	// No ABI is available, so the topics and data are dispatched undecoded
+	err = lp.processLogEntry(t.Name(), &entry, 0)
+	assert.NoError(err)
+	ev := <-stream.eventStream
+	assert.Empty(ev.Signature)
+	assert.Empty(ev.Data)
+	assert.Equal([]string{
+		topicHex,
+		"0x51b201b016025d42c9a0718b75aacc12b1e9c7f16e4bd2c6618aa944ca399156",
+		"0x00000000000000000000000000000000000000000000000000000000000003e8",
+	}, ev.Topics)
+	assert.Equal("0x", ev.RawData)
+
+	// The signature is then found in a local ABI, and the decoded event is cached
+	for i := 0; i < 2; i++ {
+		err = lp.processLogEntry(t.Name(), &entry, 0)
+		assert.NoError(err)
+		ev = <-stream.eventStream
+		assert.Equal("SampleEvent(string,uint256)", ev.Signature)
+		assert.Equal("1000", ev.Data["data2"])
+		assert.Empty(ev.Topics)
+		assert.Empty(ev.RawData)
+	}
+	mcr.AssertExpectations(t)
+}
+
+func TestRawEventResolverByAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	var entry logEntry
+	err := json.Unmarshal([]byte(sampleEventLogAllIndexedNoData), &entry)
+	assert.NoError(err)
+	var element ethbinding.ABIElementMarshaling
+	err = json.Unmarshal([]byte(sampleEventABIAllIndexedNoData), &element)
+	assert.NoError(err)
+
+	mcr := &contractregistrymocks.ContractStore{}
+	mcr.On("GetContractByAddress", entry.Address.String()).Return(&contractregistry.ContractInfo{ABI: "abi1"}, nil)
+	mcr.On("GetABI", contractregistry.ABILocation{ABIType: contractregistry.LocalABI, Name: "abi1"}, false).Return(&contractregistry.DeployContractWithAddress{
+		Contract: &messages.DeployContract{ABI: ethbinding.ABIMarshaling{element}},
+	}, nil)
+	r := newRawEventResolver(nil, mcr)
+	event := r.resolve(t.Name(), &entry)
+	assert.Equal("SampleEvent", event.Name)
+
+	// Logs without topics cannot be resolved
+	assert.Nil(r.resolve(t.Name(), &logEntry{}))
+	assert.Nil(newRawEventResolver(nil, nil).resolve(t.Name(), &entry))
+	mcr.AssertExpectations(t)
+}
+
+func TestRawEventResolverProxyImplementationAtBlock(t *testing.T) {
+	assert := assert.New(t)
+
+	var entry logEntry
+	err := json.Unmarshal([]byte(sampleEventLogAllIndexedNoData), &entry)
+	assert.NoError(err)
+	implABI := func(name string) *contractregistry.DeployContractWithAddress {
+		var element ethbinding.ABIElementMarshaling
+		err := json.Unmarshal([]byte(sampleEventABIAllIndexedNoData), &element)
+		assert.NoError(err)
+		element.Inputs[1].Name = name
+		return &contractregistry.DeployContractWithAddress{
+			Contract: &messages.DeployContract{ABI: ethbinding.ABIMarshaling{element}},
+		}
+	}
+
+	rpc := &ethmocks.RPCClient{}
+	mcr := &contractregistrymocks.ContractStore{}
+	mcr.On("GetContractByAddress", entry.Address.String()).Return(&contractregistry.ContractInfo{ABI: "proxy"}, nil)
+	mcr.On("GetImplementationContract", mock.Anything, rpc, entry.Address.String(), "0x10").Return(&contractregistry.ContractInfo{ABI: "v1"}, nil)
+	mcr.On("GetImplementationContract", mock.Anything, rpc, entry.Address.String(), "0x20").Return(&contractregistry.ContractInfo{ABI: "v2"}, nil)
+	mcr.On("GetImplementationContract", mock.Anything, rpc, entry.Address.String(), "0x30").Return(nil, fmt.Errorf("pop"))
+	mcr.On("GetABI", contractregistry.ABILocation{ABIType: contractregistry.LocalABI, Name: "v1"}, false).Return(implABI("before"), nil).Once()
+	mcr.On("GetABI", contractregistry.ABILocation{ABIType: contractregistry.LocalABI, Name: "v2"}, false).Return(implABI("after"), nil).Once()
+	mcr.On("GetABI", contractregistry.ABILocation{ABIType: contractregistry.LocalABI, Name: "proxy"}, false).Return(nil, fmt.Errorf("pop"))
+	mcr.On("GetEventBySignature", entry.Topics[0].Hex()).Return(nil, fmt.Errorf("pop"))
+
+	// The log is decoded with the ABI of the implementation of the proxy at the block of the log
+	r := newRawEventResolver(rpc, mcr)
+	for _, b := range []struct {
+		block int64
+		name  string
+	}{{0x10, "before"}, {0x20, "after"}, {0x10, "before"}} {
+		entry.BlockNumber = ethbinding.HexBigInt(*big.NewInt(b.block))
+		event := r.resolve(t.Name(), &entry)
+		assert.Equal(b.name, event.Inputs[1].Name)
+	}
+
+	// The ABI registered for the proxy is used if the implementation cannot be read
+	entry.BlockNumber = ethbinding.HexBigInt(*big.NewInt(0x30))
+	assert.Nil(r.resolve(t.Name(), &entry))
+	mcr.AssertExpectations(t)
+}
+
+func TestProcessRawLogFallbackOnDecodeFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	var element ethbinding.ABIElementMarshaling
+	err := json.Unmarshal([]byte(sampleEventABIAllIndexedNoData), &element)
+	assert.NoError(err)
+	topic := ethbind.API.HexToHash("0x35d3551f6fc757e3146f18d79fbbaf97d788f77b23b07f25f5a80621072d5c70")
+
+	mcr := &contractregistrymocks.ContractStore{}
+	mcr.On("GetContractByAddress", mock.Anything).Return(nil, fmt.Errorf("pop"))
+	mcr.On("GetEventBySignature", topic.Hex()).Return(&element, nil)
+
+	stream := &eventStream{
+		spec:        &StreamInfo{},
+		eventStream: make(chan *eventData, 1),
+	}
+	lp := newLogProcessor("sub1", nil, stream, nil)
+	lp.rawEvents = newRawEventResolver(nil, mcr)
+
+	// The log does not have the topics for the indexed fields of the event found
+	err = lp.processLogEntry(t.Name(), &logEntry{Topics: []*ethbinding.Hash{&topic}, Data: "0x"}, 0)
+	assert.NoError(err)
+	ev := <-stream.eventStream
+	assert.Empty(ev.Signature)
+	assert.Empty(ev.Data)
+	assert.Equal([]string{topic.Hex()}, ev.Topics)
+}
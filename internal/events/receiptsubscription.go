@@ -0,0 +1,312 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/errors"
+	"github.com/hyperledger/firefly-ethconnect/internal/receipts"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxPendingReceipts is the number of receipts we hold for a subscription, while its event stream is not
+	// taking them (such as when it is suspended). Beyond this receipts are dropped, as the processing of replies
+	// must never wait for a stream, and the subscription catches up from the receipt store once it is processed
+	maxPendingReceipts = 1000
+	// receiptCatchupPageSize is the page size used to read the receipts received since the checkpoint of
+	// a subscription from the receipt store, when the subscription is restarted
+	receiptCatchupPageSize = 100
+)
+
+// ReceiptFilter restricts a subscription to receipts to those matching all of the supplied fields
+type ReceiptFilter struct {
+	From    string                 `json:"from,omitempty"`
+	To      string                 `json:"to,omitempty"`
+	Context map[string]interface{} `json:"ctx,omitempty"` // each entry must match the ctx in the headers of the original request
+}
+
+// receiptQueue holds the replies received by a subscription, until the event stream poller dispatches them.
+// The checkpoint of a subscription to receipts is the receivedAt time of the last receipt delivered, so
+// when the subscription is restarted any receipts received since are read back from the receipt store.
+type receiptQueue struct {
+	sm        subscriptionManager
+	mux       sync.Mutex
+	pending   []map[string]interface{}
+	recovered map[string]bool // the request IDs read from the receipt store when the subscription was restarted
+	behind    bool            // receipts were dropped as the queue was full, so must be read from the receipt store
+	closed    bool
+}
+
+func newReceiptQueue(sm subscriptionManager) *receiptQueue {
+	return &receiptQueue{sm: sm}
+}
+
+// close drops the queued replies, when the subscription is deleted
+func (q *receiptQueue) close() {
+	q.mux.Lock()
+	q.closed = true
+	q.pending = nil
+	q.mux.Unlock()
+}
+
+func newReceiptSubscription(sm subscriptionManager, stream *eventStream, i *SubscriptionInfo) (*subscription, error) {
+	if i.Event != nil {
+		return nil, errors.Errorf(errors.EventStreamsSubscribeKindNoEvent, i.Kind)
+	}
+	s := restoreReceiptSubscription(sm, stream, i)
+	var filters []string
+	if f := i.ReceiptFilter; f != nil {
+		if f.From != "" {
+			filters = append(filters, "from="+f.From)
+		}
+		if f.To != "" {
+			filters = append(filters, "to="+f.To)
+		}
+	}
+	filterStr := "*"
+	if len(filters) > 0 {
+		filterStr = strings.Join(filters, ",")
+	}
+	i.Summary = filterStr + ":" + i.Kind
+	if i.Name == "" {
+		log.Debugf("No name provided for subscription, using auto-generated summary:%s", i.Summary)
+		i.Name = i.Summary
+	}
+	log.Infof("Created subscription ID:%s name:%s kind:%s", i.ID, i.Name, i.Kind)
+	return s, nil
+}
+
+func restoreReceiptSubscription(sm subscriptionManager, stream *eventStream, i *SubscriptionInfo) *subscription {
+	return &subscription{
+		info:        i,
+		lp:          newLogProcessor(i.ID, nil, stream, nil),
+		logName:     i.ID + ":" + i.Kind,
+		filterStale: true,
+		receipts:    newReceiptQueue(sm),
+	}
+}
+
+func (f *ReceiptFilter) matches(receipt map[string]interface{}) bool {
+	if f == nil {
+		return true
+	}
+	if f.From != "" && !strings.EqualFold(f.From, receiptString(receipt, "from")) {
+		return false
+	}
+	if f.To != "" && !strings.EqualFold(f.To, receiptString(receipt, "to")) {
+		return false
+	}
+	if len(f.Context) > 0 {
+		headers, _ := receipt["headers"].(map[string]interface{})
+		ctx, _ := headers["ctx"].(map[string]interface{})
+		for k, v := range f.Context {
+			if !reflect.DeepEqual(v, ctx[k]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func receiptString(receipt map[string]interface{}, key string) string {
+	s, _ := receipt[key].(string)
+	return s
+}
+
+// receiptTime returns the receivedAt time of a receipt, in milliseconds since the epoch, which is
+// a different numeric type depending on whether it was read from the receipt store or not
+func receiptTime(receipt map[string]interface{}) int64 {
+	switch v := receipt["receivedAt"].(type) {
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case float64:
+		return int64(v)
+	case json.Number:
+		i, _ := v.Int64()
+		return i
+	default:
+		return 0
+	}
+}
+
+// queueReceipt is called as each reply is written to the receipt store. If it matches the filter,
+// we queue it and wake the event stream poller to dispatch it. This must never block the processing
+// of replies, so if the queue is full the receipt is dropped, and the subscription is marked as behind.
+// It then re-reads the receipts it missed from the receipt store, from its checkpoint.
+func (s *subscription) queueReceipt(receipt map[string]interface{}) {
+	if !s.info.ReceiptFilter.matches(receipt) {
+		return
+	}
+	requestID := receiptString(receipt, "_id")
+	q := s.receipts
+	q.mux.Lock()
+	if q.recovered[requestID] {
+		// Already read from the receipt store when the subscription was restarted
+		q.mux.Unlock()
+		return
+	}
+	if q.closed {
+		q.mux.Unlock()
+		return
+	}
+	if len(q.pending) >= maxPendingReceipts {
+		if !q.behind {
+			log.Warnf("%s: dropped receipt for request '%s' as %d receipts are pending. Will catch up from the receipt store", s.logName, requestID, len(q.pending))
+			q.behind = true
+		}
+	} else {
+		q.pending = append(q.pending, receipt)
+	}
+	q.mux.Unlock()
+	signal(s.lp.stream.pushNotify)
+}
+
+// startReceipts reads any receipts received since the checkpoint from the receipt store, ahead of
+// those queued since the subscription was stopped, then starts dispatching receipts
+func (s *subscription) startReceipts(ctx context.Context, checkpoint *big.Int) error {
+	q := s.receipts
+	store := q.sm.receiptStore()
+	if store == nil {
+		return errors.Errorf(errors.EventStreamsReceiptStoreUnavailable)
+	}
+	q.mux.Lock()
+	if q.behind {
+		// Every receipt we queued is in the receipt store, and receipts queued from here on will be
+		// checked against those we read
+		q.pending = nil
+		q.behind = false
+	}
+	q.mux.Unlock()
+	recovered, err := s.readReceiptsSince(store, checkpoint.Int64())
+	if err != nil {
+		return err
+	}
+
+	q.mux.Lock()
+	q.recovered = make(map[string]bool, len(recovered))
+	for _, receipt := range recovered {
+		q.recovered[receiptString(receipt, "_id")] = true
+	}
+	pending := recovered
+	for _, receipt := range q.pending {
+		if !q.recovered[receiptString(receipt, "_id")] {
+			pending = append(pending, receipt)
+		}
+	}
+	q.pending = pending
+	q.mux.Unlock()
+
+	s.markFilterStale(ctx, false)
+	s.info.Synchronized = true
+	log.Infof("%s: dispatching receipts, after %d read from the receipt store since %s", s.logName, len(recovered), checkpoint)
+	return nil
+}
+
+// readReceiptsSince reads the replies that match the filter, received at or after the given time (in
+// milliseconds since the epoch), from the receipt store. Replies received in the same millisecond as the
+// checkpoint might have already been delivered, but are included so that none are missed.
+func (s *subscription) readReceiptsSince(store receipts.ReceiptStorePersistence, since int64) ([]map[string]interface{}, error) {
+	byID := make(map[string]map[string]interface{})
+	querySince := since - 1
+	for skip := 0; ; skip += receiptCatchupPageSize {
+		page, err := store.GetReceipts(skip, receiptCatchupPageSize, nil, querySince, "", "", "")
+		if err != nil && skip == 0 && querySince > 0 {
+			// Not all receipt stores can filter on time, in which case we filter every receipt they hold
+			querySince = 0
+			page, err = store.GetReceipts(skip, receiptCatchupPageSize, nil, querySince, "", "", "")
+		}
+		if err != nil {
+			return nil, errors.Errorf(errors.EventStreamsReceiptStoreQueryFailed, since, err)
+		}
+		for _, receipt := range *page {
+			// Requests that have been accepted, but not yet replied to, are also in the receipt store
+			if pending, _ := receipt["pending"].(bool); !pending && receiptTime(receipt) >= since && s.info.ReceiptFilter.matches(receipt) {
+				byID[receiptString(receipt, "_id")] = receipt
+			}
+		}
+		if len(*page) < receiptCatchupPageSize {
+			break
+		}
+	}
+	recovered := make([]map[string]interface{}, 0, len(byID))
+	for _, receipt := range byID {
+		recovered = append(recovered, receipt)
+	}
+	sort.Slice(recovered, func(i, j int) bool {
+		ti, tj := receiptTime(recovered[i]), receiptTime(recovered[j])
+		if ti != tj {
+			return ti < tj
+		}
+		return receiptString(recovered[i], "_id") < receiptString(recovered[j], "_id")
+	})
+	return recovered, nil
+}
+
+// receiptComplete moves the checkpoint of the subscription on to the time of a receipt that has been delivered
+func (s *subscription) receiptComplete(receivedAt int64) {
+	lp := s.lp
+	lp.hwnSync.Lock()
+	if i := big.NewInt(receivedAt); i.Cmp(&lp.blockHWM) > 0 {
+		lp.blockHWM.Set(i)
+	}
+	lp.hwnSync.Unlock()
+}
+
+// processNewReceipts dispatches the receipts queued since the last poll. If receipts were dropped,
+// the subscription is restarted instead, to read them from the receipt store in order.
+func (s *subscription) processNewReceipts(ctx context.Context) {
+	q := s.receipts
+	q.mux.Lock()
+	if q.behind {
+		q.mux.Unlock()
+		log.Warnf("%s: receipts were dropped. Restarting from the checkpoint", s.logName)
+		s.markFilterStale(ctx, true)
+		return
+	}
+	queued := q.pending
+	q.pending = nil
+	q.mux.Unlock()
+
+	stream := s.lp.stream
+	for _, receipt := range queued {
+		requestID := receiptString(receipt, "_id")
+		receivedAt := receiptTime(receipt)
+		log.Infof("%s: Dispatching receipt for request '%s'", s.logName, requestID)
+		stream.handleEvent(&eventData{
+			ID:              stream.spec.ID + "/" + requestID,
+			BlockNumber:     receiptString(receipt, "blockNumber"),
+			BlockHash:       receiptString(receipt, "blockHash"),
+			TransactionHash: receiptString(receipt, "transactionHash"),
+			Address:         receiptString(receipt, "contractAddress"),
+			SubID:           s.info.ID,
+			Data:            receipt,
+			batchComplete: func(*eventData) {
+				s.receiptComplete(receivedAt)
+			},
+		})
+	}
+}
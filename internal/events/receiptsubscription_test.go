@@ -0,0 +1,251 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/receipts"
+	"github.com/hyperledger/firefly-ethconnect/mocks/receiptsmocks"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestReceiptSubscription(t *testing.T, filter *ReceiptFilter, store receipts.ReceiptStorePersistence) (*subscription, *eventStream) {
+	stream := &eventStream{
+		spec:        &StreamInfo{ID: "es1"},
+		eventStream: make(chan *eventData, maxPendingReceipts+10),
+		pushNotify:  make(chan struct{}, 1),
+	}
+	s, err := newSubscription(&mockSubMgr{stream: stream, receipts: store}, nil, nil, nil, &SubscriptionInfo{
+		ID:            "sub1",
+		Stream:        "es1",
+		Kind:          SubscriptionKindReceipts,
+		ReceiptFilter: filter,
+	})
+	assert.NoError(t, err)
+	return s, stream
+}
+
+func testReceipt(id, from string, ctx map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"_id":             id,
+		"headers":         map[string]interface{}{"type": "TransactionSuccess", "ctx": ctx},
+		"from":            from,
+		"to":              nil,
+		"blockNumber":     "100",
+		"transactionHash": "0x12345",
+		"receivedAt":      int64(1000),
+	}
+}
+
+func TestReceiptSubscriptionFilterAndDispatch(t *testing.T) {
+	assert := assert.New(t)
+	s, stream := newTestReceiptSubscription(t, &ReceiptFilter{
+		From:    "0xAAAA",
+		Context: map[string]interface{}{"batch": "b1"},
+	}, receipts.NewMemoryReceipts(&receipts.ReceiptStoreConf{MaxDocs: 10}))
+	assert.Equal("from=0xAAAA:receipts", s.info.Name)
+
+	// No RPC calls are made to start a subscription to receipts, which starts from now
+	startTime := time.Now().UnixNano() / int64(time.Millisecond)
+	i, err := s.setInitialBlockHeight(context.Background())
+	assert.NoError(err)
+	checkpoint := i.Int64()
+	assert.GreaterOrEqual(checkpoint, startTime)
+	err = s.restartFilter(context.Background(), i)
+	assert.NoError(err)
+	assert.False(s.filterStale)
+	assert.True(s.info.Synchronized)
+
+	s.queueReceipt(testReceipt("req1", "0xbbbb", map[string]interface{}{"batch": "b1"}))
+	s.queueReceipt(testReceipt("req2", "0xaaaa", map[string]interface{}{"batch": "b2"}))
+	s.queueReceipt(testReceipt("req3", "0xaaaa", nil))
+	assert.Empty(stream.pushNotify)
+	receipt := testReceipt("req4", "0xaaaa", map[string]interface{}{"batch": "b1"})
+	receipt["receivedAt"] = checkpoint + 5
+	s.queueReceipt(receipt)
+	<-stream.pushNotify
+
+	err = s.processNewEvents(context.Background())
+	assert.NoError(err)
+	ev := <-stream.eventStream
+	assert.Equal("es1/req4", ev.ID)
+	assert.Equal("sub1", ev.SubID)
+	assert.Equal("100", ev.BlockNumber)
+	assert.Equal("0x12345", ev.TransactionHash)
+	assert.Equal("req4", ev.Data["_id"])
+	assert.Empty(stream.eventStream)
+
+	// The checkpoint is moved on to the time the receipt was received
+	ev.batchComplete(ev)
+	hwm := s.blockHWM()
+	assert.Equal(checkpoint+5, hwm.Int64())
+
+	// There is no filter to uninstall
+	s.unsubscribe(context.Background(), false)
+	assert.True(s.filterStale)
+}
+
+func TestReceiptSubscriptionQueueFullCatchesUp(t *testing.T) {
+	assert := assert.New(t)
+	store := receipts.NewMemoryReceipts(&receipts.ReceiptStoreConf{MaxDocs: maxPendingReceipts + 10})
+	s, stream := newTestReceiptSubscription(t, nil, store)
+	assert.Equal("*:receipts", s.info.Name)
+	err := s.restartFilter(context.Background(), big.NewInt(1000))
+	assert.NoError(err)
+
+	// Replies are written to the receipt store before they are queued, and are never held up when the
+	// queue is full. The receipts that do not fit are dropped
+	for i := 0; i < maxPendingReceipts+5; i++ {
+		receipt := testReceipt(fmt.Sprintf("req%d", i), "", nil)
+		receipt["receivedAt"] = int64(1000 + i)
+		_ = store.AddReceipt(receipt["_id"].(string), &receipt, false)
+		s.queueReceipt(receipt)
+	}
+	assert.Len(s.receipts.pending, maxPendingReceipts)
+	assert.True(s.receipts.behind)
+
+	// Rather than dispatch a partial set, the subscription restarts from the checkpoint
+	err = s.processNewEvents(context.Background())
+	assert.NoError(err)
+	assert.True(s.filterStale)
+	assert.Empty(stream.eventStream)
+
+	// All the receipts are read back from the receipt store, in order
+	err = s.restartFilter(context.Background(), big.NewInt(1000))
+	assert.NoError(err)
+	assert.False(s.receipts.behind)
+	assert.Len(s.receipts.pending, maxPendingReceipts+5)
+	assert.Equal("req0", s.receipts.pending[0]["_id"])
+	assert.Equal(fmt.Sprintf("req%d", maxPendingReceipts+4), s.receipts.pending[maxPendingReceipts+4]["_id"])
+	err = s.processNewEvents(context.Background())
+	assert.NoError(err)
+	assert.Len(stream.eventStream, maxPendingReceipts+5)
+
+	// Receipts for a subscription that is deleted are dropped
+	s.queueReceipt(testReceipt("reqN", "", nil))
+	s.unsubscribe(context.Background(), true)
+	assert.Empty(s.receipts.pending)
+	s.queueReceipt(testReceipt("reqN", "", nil))
+	assert.Empty(s.receipts.pending)
+}
+
+func TestReceiptSubscriptionRestartFromCheckpoint(t *testing.T) {
+	assert := assert.New(t)
+	store := receipts.NewMemoryReceipts(&receipts.ReceiptStoreConf{MaxDocs: 1000})
+	addReceipt := func(id, from string, receivedAt interface{}, pending bool) {
+		receipt := testReceipt(id, from, nil)
+		receipt["receivedAt"] = receivedAt
+		if pending {
+			receipt["pending"] = true
+		}
+		_ = store.AddReceipt(id, &receipt, false)
+	}
+	addReceipt("req1", "0xaaaa", int64(1000), false) // delivered before the checkpoint
+	addReceipt("req2", "0xaaaa", float64(2000), false)
+	addReceipt("req3", "0xbbbb", int64(2001), false) // does not match the filter
+	addReceipt("req4", "0xaaaa", int64(2002), true)  // accepted, but not yet replied to
+	for i := 0; i < receiptCatchupPageSize; i++ {
+		addReceipt(fmt.Sprintf("req%d", 100+i), "0xaaaa", int64(3000-i), false)
+	}
+
+	s, _ := newTestReceiptSubscription(t, &ReceiptFilter{From: "0xaaaa"}, store)
+	s.queueReceipt(testReceipt("req100", "0xaaaa", nil))
+	s.queueReceipt(testReceipt("req5", "0xaaaa", nil))
+
+	s.setCheckpointBlockHeight(big.NewInt(2000))
+	err := s.restartFilter(context.Background(), big.NewInt(2000))
+	assert.NoError(err)
+	assert.False(s.filterStale)
+
+	// The receipts received since the checkpoint are dispatched oldest first, followed by those
+	// that were queued and not read from the receipt store
+	pending := s.receipts.pending
+	assert.Len(pending, receiptCatchupPageSize+2)
+	assert.Equal("req2", pending[0]["_id"])
+	assert.Equal("req199", pending[1]["_id"])
+	assert.Equal("req100", pending[receiptCatchupPageSize]["_id"])
+	assert.Equal("req5", pending[receiptCatchupPageSize+1]["_id"])
+
+	// Replies already read from the receipt store are not queued again
+	s.queueReceipt(testReceipt("req150", "0xaaaa", nil))
+	assert.Len(s.receipts.pending, receiptCatchupPageSize+2)
+}
+
+func TestReceiptSubscriptionRestartNoStore(t *testing.T) {
+	s, _ := newTestReceiptSubscription(t, nil, nil)
+	err := s.restartFilter(context.Background(), big.NewInt(2000))
+	assert.Regexp(t, "The receipt store is not available", err)
+	assert.True(t, s.filterStale)
+}
+
+func TestReceiptSubscriptionRestartQueryFails(t *testing.T) {
+	store := &receiptsmocks.ReceiptStorePersistence{}
+	store.On("GetReceipts", 0, receiptCatchupPageSize, mock.Anything, int64(1999), "", "", "").Return(nil, fmt.Errorf("pop"))
+	store.On("GetReceipts", 0, receiptCatchupPageSize, mock.Anything, int64(0), "", "", "").Return(nil, fmt.Errorf("pop"))
+	s, _ := newTestReceiptSubscription(t, nil, store)
+	err := s.restartFilter(context.Background(), big.NewInt(2000))
+	assert.Regexp(t, "Failed to read the receipts received since 2000 from the receipt store: pop", err)
+	assert.True(t, s.filterStale)
+	store.AssertExpectations(t)
+}
+
+func TestReceiptTime(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(int64(12345), receiptTime(map[string]interface{}{"receivedAt": int64(12345)}))
+	assert.Equal(int64(12345), receiptTime(map[string]interface{}{"receivedAt": 12345}))
+	assert.Equal(int64(12345), receiptTime(map[string]interface{}{"receivedAt": int32(12345)}))
+	assert.Equal(int64(12345), receiptTime(map[string]interface{}{"receivedAt": float64(12345)}))
+	assert.Equal(int64(12345), receiptTime(map[string]interface{}{"receivedAt": json.Number("12345")}))
+	assert.Equal(int64(0), receiptTime(map[string]interface{}{}))
+}
+
+func TestReceiptSubscriptionWithEvent(t *testing.T) {
+	stream := &eventStream{spec: &StreamInfo{ID: "es1"}}
+	_, err := newSubscription(&mockSubMgr{stream: stream}, nil, nil, nil, &SubscriptionInfo{
+		Kind:  SubscriptionKindReceipts,
+		Event: &ethbinding.ABIElementMarshaling{Name: "ping"},
+	})
+	assert.Regexp(t, "An event cannot be specified for a subscription of kind 'receipts'", err)
+}
+
+func TestRestoreReceiptSubscription(t *testing.T) {
+	stream := &eventStream{spec: &StreamInfo{ID: "es1"}}
+	s, err := restoreSubscription(&mockSubMgr{stream: stream}, nil, nil, &SubscriptionInfo{ID: "sub1", Kind: SubscriptionKindReceipts})
+	assert.NoError(t, err)
+	assert.NotNil(t, s.receipts)
+	assert.True(t, s.filterStale)
+}
+
+func TestDispatchReceipt(t *testing.T) {
+	sm := newTestSubscriptionManager()
+	receiptSub, _ := newTestReceiptSubscription(t, nil, nil)
+	sm.subscriptions["sub1"] = receiptSub
+	sm.subscriptions["sub2"] = &subscription{info: &SubscriptionInfo{ID: "sub2"}}
+
+	sm.DispatchReceipt(testReceipt("req1", "", nil))
+	assert.Len(t, receiptSub.receipts.pending, 1)
+
+	store := receipts.NewMemoryReceipts(&receipts.ReceiptStoreConf{})
+	sm.SetReceiptStore(store)
+	assert.Equal(t, store, sm.receiptStore())
+}
@@ -0,0 +1,328 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/auth"
+	"github.com/hyperledger/firefly-ethconnect/internal/errors"
+	"github.com/hyperledger/firefly-ethconnect/internal/messages"
+	"github.com/hyperledger/firefly-ethconnect/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ReplayPathPrefix is the path prefix for replays of a subscription
+	ReplayPathPrefix = "/replays"
+	replayIDPrefix   = "rp-"
+
+	// ReplayStatusRunning is the status of a replay that is reading or delivering events
+	ReplayStatusRunning = "running"
+	// ReplayStatusCompleted is the status of a replay once the completion marker has been delivered
+	ReplayStatusCompleted = "completed"
+	// ReplayStatusFailed is the status of a replay that stopped because the logs could not be read
+	ReplayStatusFailed = "failed"
+)
+
+// ReplayRequest asks for the events of a subscription between two blocks to be delivered to a temporary stream
+type ReplayRequest struct {
+	FromBlock string      `json:"fromBlock"`
+	ToBlock   string      `json:"toBlock,omitempty"` // defaults to the head of the chain when the replay starts
+	Stream    *StreamInfo `json:"stream"`            // the temporary stream, which is not persisted
+}
+
+// ReplayInfo is the progress of a replay
+type ReplayInfo struct {
+	messages.TimeSorted
+	ID        string `json:"id"`
+	Path      string `json:"path"`
+	SubID     string `json:"subId"`
+	Stream    string `json:"stream"` // the ID of the temporary stream, which is the same as the ID of the replay
+	FromBlock string `json:"fromBlock"`
+	ToBlock   string `json:"toBlock"`
+	NextBlock string `json:"nextBlock"` // the next block to be read
+	Events    uint64 `json:"events"`    // the number of events dispatched to the stream
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+// replay reads the logs of a copy of a subscription between two blocks, and dispatches them to a
+// temporary stream. The copy has its own block high water mark, and the temporary stream is not
+// known to the subscription manager, so no checkpoint is written for either.
+type replay struct {
+	info     ReplayInfo
+	infoMux  sync.Mutex
+	sub      *subscription
+	stream   *eventStream
+	from     *big.Int
+	to       *big.Int
+	pageSize int64
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// ReplaySubscription starts a replay of the events of a subscription between two blocks
+func (s *subscriptionMGR) ReplaySubscription(ctx context.Context, id string, req *ReplayRequest) (*ReplayInfo, error) {
+	sub, err := s.subscriptionByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if sub.info.Kind != "" && sub.info.Kind != SubscriptionKindEvents {
+		return nil, errors.Errorf(errors.EventStreamsReplayBadKind, sub.info.Kind)
+	}
+	if req.Stream == nil {
+		return nil, errors.Errorf(errors.EventStreamsReplayNoStream)
+	}
+	if strings.ToLower(req.Stream.Type) == "sse" {
+		return nil, errors.Errorf(errors.EventStreamsReplayBadStreamType, req.Stream.Type)
+	}
+	if req.FromBlock == "" || req.FromBlock == FromBlockLatest {
+		return nil, errors.Errorf(errors.EventQueryBadBlock, "fromBlock", req.FromBlock)
+	}
+	fromBlock, err := parseQueryBlock(ctx, s.rpc, "fromBlock", req.FromBlock)
+	if err != nil {
+		return nil, err
+	}
+	toBlock, err := parseQueryBlock(ctx, s.rpc, "toBlock", req.ToBlock)
+	if err != nil {
+		return nil, err
+	}
+	if fromBlock.Cmp(toBlock) > 0 {
+		return nil, errors.Errorf(errors.EventQueryBadBlockRange, fromBlock.String(), toBlock.String())
+	}
+
+	// The temporary stream blocks on errors, so the consumer receives every event in the range
+	spec := *req.Stream
+	spec.ID = replayIDPrefix + utils.UUIDv4()
+	spec.CreatedISO8601 = time.Now().UTC().Format(time.RFC3339)
+	spec.Path = ReplayPathPrefix + "/" + spec.ID
+	spec.ErrorHandling = ErrorHandlingBlock
+	spec.Suspended = false
+	spec.PersistBatches = false
+	spec.Confirmations = nil
+	spec.ProvisionalNotifications = false
+	spec.Ordered = false // the replay reads a single subscription in block order
+	stream, err := newEventStream(s, &spec, s.wsChannels)
+	if err != nil {
+		return nil, err
+	}
+
+	// The replayed events have the ID of the live subscription, but are dispatched without
+	// waiting for confirmations, as the blocks are historical
+	subInfo := *sub.info
+	subInfo.Stream = spec.ID
+	lp, signature, err := newSubscriptionLogProcessor(&subInfo, s.rpc, s.cr, stream, nil)
+	if err != nil {
+		stream.stop(false)
+		return nil, err
+	}
+	r := &replay{
+		info: ReplayInfo{
+			TimeSorted: messages.TimeSorted{CreatedISO8601: spec.CreatedISO8601},
+			ID:         spec.ID,
+			Path:       spec.Path,
+			SubID:      sub.info.ID,
+			Stream:     spec.ID,
+			FromBlock:  fromBlock.String(),
+			ToBlock:    toBlock.String(),
+			NextBlock:  fromBlock.String(),
+			Status:     ReplayStatusRunning,
+		},
+		sub: &subscription{
+			info:    &subInfo,
+			rpc:     s.rpc,
+			cr:      s.cr,
+			lp:      lp,
+			logName: spec.ID + ":" + signature,
+		},
+		stream:   stream,
+		from:     fromBlock,
+		to:       toBlock,
+		pageSize: s.config().CatchupModePageSize,
+		done:     make(chan struct{}),
+	}
+	r.sub.lp.initBlockHWM(fromBlock)
+	if r.pageSize <= 0 {
+		r.pageSize = defaultCatchupModePageSize
+	}
+	var replayCtx context.Context
+	replayCtx, r.cancel = context.WithCancel(auth.NewSystemAuthContext())
+
+	s.replaysMutex.Lock()
+	s.replays[r.info.ID] = r
+	s.replaysMutex.Unlock()
+	log.Infof("%s: replaying subscription %s from block %s to %s", r.info.ID, sub.info.ID, r.info.FromBlock, r.info.ToBlock)
+	go r.run(replayCtx)
+	return r.status(), nil
+}
+
+// ReplayByID returns the progress of a replay
+func (s *subscriptionMGR) ReplayByID(ctx context.Context, id string) (*ReplayInfo, error) {
+	s.replaysMutex.Lock()
+	r, exists := s.replays[id]
+	s.replaysMutex.Unlock()
+	if !exists {
+		return nil, errors.Errorf(errors.EventStreamsReplayNotFound, id)
+	}
+	return r.status(), nil
+}
+
+// CancelReplay stops a replay if it is still running, and removes it
+func (s *subscriptionMGR) CancelReplay(ctx context.Context, id string) error {
+	s.replaysMutex.Lock()
+	r, exists := s.replays[id]
+	delete(s.replays, id)
+	s.replaysMutex.Unlock()
+	if !exists {
+		return errors.Errorf(errors.EventStreamsReplayNotFound, id)
+	}
+	r.stop()
+	return nil
+}
+
+func (s *subscriptionMGR) stopReplays() {
+	s.replaysMutex.Lock()
+	defer s.replaysMutex.Unlock()
+	for _, r := range s.replays {
+		r.stop()
+	}
+}
+
+func (r *replay) status() *ReplayInfo {
+	r.infoMux.Lock()
+	defer r.infoMux.Unlock()
+	info := r.info
+	return &info
+}
+
+func (r *replay) stop() {
+	r.cancel()
+	r.stream.stop(false)
+	<-r.done
+}
+
+func (r *replay) run(ctx context.Context) {
+	defer close(r.done)
+	err := r.dispatchEvents(ctx)
+	if err == nil {
+		err = r.waitForDelivery(ctx)
+	}
+	if err == nil {
+		err = r.dispatchCompletion(ctx)
+	}
+	r.stream.stop(false)
+
+	r.infoMux.Lock()
+	defer r.infoMux.Unlock()
+	if err != nil {
+		log.Errorf("%s: replay failed: %s", r.info.ID, err)
+		r.info.Status = ReplayStatusFailed
+		r.info.Error = err.Error()
+	} else {
+		log.Infof("%s: replay completed with %d events", r.info.ID, r.info.Events)
+		r.info.Status = ReplayStatusCompleted
+	}
+}
+
+// wait returns false if the replay was cancelled during the polling interval
+func (r *replay) wait(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(r.stream.pollingInterval):
+		return true
+	}
+}
+
+// dispatchEvents reads the logs of the block range a page at a time, and dispatches the events to the
+// stream. In the same way as the event poller, it does not read more logs while the stream is blocked.
+func (r *replay) dispatchEvents(ctx context.Context) error {
+	f := &ethFilter{}
+	f.persistedFilter = r.sub.info.Filter
+	from := new(big.Int).Set(r.from)
+	for from.Cmp(r.to) <= 0 {
+		for r.stream.isBlocked() {
+			if !r.wait(ctx) {
+				return errors.Errorf(errors.EventStreamsReplayCancelled)
+			}
+		}
+		to := new(big.Int).Add(from, big.NewInt(r.pageSize-1))
+		if to.Cmp(r.to) > 0 {
+			to.Set(r.to)
+		}
+		f.FromBlock.ToInt().Set(from)
+		f.ToBlock = "0x" + to.Text(16)
+		var logs []*logEntry
+		if err := queryLogsPage(ctx, r.sub.rpc, f, &logs); err != nil {
+			if ctx.Err() != nil {
+				return errors.Errorf(errors.EventStreamsReplayCancelled)
+			}
+			return err
+		}
+		if len(logs) == 0 {
+			r.sub.lp.markNoEvents(to)
+		} else {
+			r.sub.processLogs(ctx, "eth_getLogs", logs)
+		}
+		from = new(big.Int).Add(to, big.NewInt(1))
+
+		r.infoMux.Lock()
+		r.info.Events += uint64(len(logs))
+		r.info.NextBlock = from.String()
+		r.infoMux.Unlock()
+	}
+	return nil
+}
+
+// waitForDelivery waits for every event dispatched to the stream to be delivered, which is
+// when the high water mark of the subscription copy moves beyond the end of the range
+func (r *replay) waitForDelivery(ctx context.Context) error {
+	end := new(big.Int).Add(r.to, big.NewInt(1))
+	for {
+		r.sub.lp.markNoEvents(r.to)
+		hwm := r.sub.lp.getBlockHWM()
+		if hwm.Cmp(end) >= 0 {
+			return nil
+		}
+		if !r.wait(ctx) {
+			return errors.Errorf(errors.EventStreamsReplayCancelled)
+		}
+	}
+}
+
+// dispatchCompletion delivers a marker to the consumer after the last event of the replay
+func (r *replay) dispatchCompletion(ctx context.Context) error {
+	delivered := make(chan struct{})
+	r.stream.handleEvent(&eventData{
+		ID:            r.info.ID + "/" + EventStatusReplayComplete,
+		BlockNumber:   r.to.String(),
+		Data:          map[string]interface{}{},
+		SubID:         r.info.SubID,
+		Status:        EventStatusReplayComplete,
+		batchComplete: func(*eventData) { close(delivered) },
+		blockNumber:   r.to.Uint64(),
+	})
+	select {
+	case <-ctx.Done():
+		return errors.Errorf(errors.EventStreamsReplayCancelled)
+	case <-delivered:
+		return nil
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/ethbind"
+	"github.com/hyperledger/firefly-ethconnect/mocks/ethmocks"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// newTestReplaySub registers a subscription that is not attached to a running stream, so only the replay reads its logs
+func newTestReplaySub(t *testing.T, sm *subscriptionMGR) *subscription {
+	event, err := ethbind.API.ABIElementMarshalingToABIEvent(testChangedEventABI)
+	assert.NoError(t, err)
+	info := &SubscriptionInfo{ID: "sub1", Stream: "es-live", Event: testChangedEventABI}
+	info.Filter.Topics = [][]ethbinding.Hash{{event.ID}}
+	sub := &subscription{info: info, lp: &logProcessor{}}
+	sub.lp.initBlockHWM(big.NewInt(150800))
+	sm.subscriptions[info.ID] = sub
+	return sub
+}
+
+func TestReplaySubscription(t *testing.T) {
+	assert := assert.New(t)
+	sm, stream, svr, eventStream := newTestStreamForBatching(&StreamInfo{Webhook: &webhookActionInfo{}}, nil, 200)
+	defer svr.Close()
+	defer stream.stop(false)
+	rpc, filters := mockCatchupLogs(t, -1)
+	sm.rpc = rpc
+	sm.config().CatchupModePageSize = 60
+	sub := newTestReplaySub(t, sm)
+
+	r, err := sm.ReplaySubscription(context.Background(), "sub1", &ReplayRequest{
+		FromBlock: "150600",
+		ToBlock:   "150750",
+		Stream: &StreamInfo{
+			Type:           "webhook",
+			BatchSize:      10,
+			BatchTimeoutMS: 50,
+			ErrorHandling:  ErrorHandlingSkip,
+			PersistBatches: true,
+			Webhook:        &webhookActionInfo{URL: svr.URL},
+		},
+	})
+	assert.NoError(err)
+	assert.Equal(ReplayStatusRunning, r.Status)
+	assert.Equal(ReplayPathPrefix+"/"+r.ID, r.Path)
+	assert.Equal(r.ID, r.Stream)
+
+	// The events are followed by the completion marker, once they have been delivered
+	var events []*eventData
+	for len(events) < 4 {
+		events = append(events, <-eventStream...)
+	}
+	for _, e := range events[0:3] {
+		assert.Equal("sub1", e.SubID)
+		assert.Empty(e.Status)
+	}
+	assert.Equal(EventStatusReplayComplete, events[3].Status)
+	assert.Equal("150750", events[3].BlockNumber)
+	assert.Equal(r.ID+"/"+EventStatusReplayComplete, events[3].ID)
+
+	assert.Eventually(func() bool {
+		r, _ = sm.ReplayByID(context.Background(), r.ID)
+		return r.Status == ReplayStatusCompleted
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(uint64(3), r.Events)
+	assert.Equal("150751", r.NextBlock)
+	assert.Len(*filters, 3)
+
+	// Neither the live subscription, nor the replay, has a checkpoint
+	hwm := sub.lp.getBlockHWM()
+	assert.Equal(int64(150800), hwm.Int64())
+	_, err = sm.db.Get(checkpointIDPrefix + r.ID)
+	assert.Error(err)
+	_, err = sm.StreamByID(context.Background(), r.ID)
+	assert.Regexp("FFEC100042", err)
+
+	err = sm.CancelReplay(context.Background(), r.ID)
+	assert.NoError(err)
+	_, err = sm.ReplayByID(context.Background(), r.ID)
+	assert.Regexp("FFEC100264", err)
+}
+
+func TestReplaySubscriptionCancel(t *testing.T) {
+	assert := assert.New(t)
+	sm, stream, svr, eventStream := newTestStreamForBatching(&StreamInfo{Webhook: &webhookActionInfo{}}, nil, 500)
+	defer svr.Close()
+	defer stream.stop(false)
+	rpc, _ := mockCatchupLogs(t, -1)
+	sm.rpc = rpc
+	newTestReplaySub(t, sm)
+
+	r, err := sm.ReplaySubscription(context.Background(), "sub1", &ReplayRequest{
+		FromBlock: "150600",
+		ToBlock:   "150750",
+		Stream: &StreamInfo{
+			Type:    "webhook",
+			Webhook: &webhookActionInfo{URL: svr.URL},
+		},
+	})
+	assert.NoError(err)
+
+	// The consumer rejects the events, so the replay cannot complete
+	<-eventStream
+	go func() {
+		for range eventStream {
+		}
+	}()
+	r, err = sm.ReplayByID(context.Background(), r.ID)
+	assert.NoError(err)
+	assert.Equal(ReplayStatusRunning, r.Status)
+
+	err = sm.CancelReplay(context.Background(), r.ID)
+	assert.NoError(err)
+	_, err = sm.ReplayByID(context.Background(), r.ID)
+	assert.Regexp("FFEC100264", err)
+	err = sm.CancelReplay(context.Background(), r.ID)
+	assert.Regexp("FFEC100264", err)
+}
+
+func TestReplaySubscriptionQueryFail(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	rpc := &ethmocks.RPCClient{}
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_blockNumber").Run(func(args mock.Arguments) {
+		args[1].(*ethbinding.HexBigInt).ToInt().SetInt64(2000)
+	}).Return(nil)
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_getLogs", mock.Anything).Return(fmt.Errorf("pop"))
+	sm.rpc = rpc
+	newTestReplaySub(t, sm)
+
+	r, err := sm.ReplaySubscription(context.Background(), "sub1", &ReplayRequest{
+		FromBlock: "1000",
+		Stream:    &StreamInfo{Type: "websocket"},
+	})
+	assert.NoError(err)
+	assert.Equal("2000", r.ToBlock)
+	assert.Eventually(func() bool {
+		r, _ = sm.ReplayByID(context.Background(), r.ID)
+		return r.Status == ReplayStatusFailed
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Regexp("eth_getLogs returned: pop", r.Error)
+	assert.Equal("1000", r.NextBlock)
+	sm.Close(false)
+}
+
+func TestReplaySubscriptionBadRequest(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	sub := newTestReplaySub(t, sm)
+	ctx := context.Background()
+	stream := &StreamInfo{Type: "websocket"}
+
+	_, err := sm.ReplaySubscription(ctx, "unknown", &ReplayRequest{})
+	assert.Regexp("FFEC100039", err)
+	_, err = sm.ReplaySubscription(ctx, "sub1", &ReplayRequest{FromBlock: "0"})
+	assert.Regexp("FFEC100262", err)
+	_, err = sm.ReplaySubscription(ctx, "sub1", &ReplayRequest{FromBlock: "0", Stream: &StreamInfo{Type: "SSE"}})
+	assert.Regexp("FFEC100263", err)
+	_, err = sm.ReplaySubscription(ctx, "sub1", &ReplayRequest{Stream: stream})
+	assert.Regexp("FFEC100229.*fromBlock", err)
+	_, err = sm.ReplaySubscription(ctx, "sub1", &ReplayRequest{FromBlock: "-1", Stream: stream})
+	assert.Regexp("FFEC100229.*fromBlock", err)
+	_, err = sm.ReplaySubscription(ctx, "sub1", &ReplayRequest{FromBlock: "0", ToBlock: "abc", Stream: stream})
+	assert.Regexp("FFEC100229.*toBlock", err)
+	_, err = sm.ReplaySubscription(ctx, "sub1", &ReplayRequest{FromBlock: "10", ToBlock: "9", Stream: stream})
+	assert.Regexp("FFEC100230", err)
+	_, err = sm.ReplaySubscription(ctx, "sub1", &ReplayRequest{FromBlock: "0", ToBlock: "9", Stream: &StreamInfo{Type: "unknown"}})
+	assert.Regexp("FFEC100030", err)
+
+	sub.info.Kind = SubscriptionKindBlocks
+	_, err = sm.ReplaySubscription(ctx, "sub1", &ReplayRequest{FromBlock: "0", Stream: stream})
+	assert.Regexp("FFEC100261.*blocks", err)
+}
@@ -0,0 +1,226 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/errors"
+	"github.com/hyperledger/firefly-ethconnect/internal/eth"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	log "github.com/sirupsen/logrus"
+)
+
+// sharedLogGroup is the set of event subscriptions on a stream that are due to read logs from the same block
+type sharedLogGroup struct {
+	from *big.Int
+	subs []*subscription
+}
+
+// startSharedLogFetch positions a subscription to have its logs read by its stream, along with
+// the other event subscriptions of the stream, rather than through a filter of its own
+func (s *subscription) startSharedLogFetch(ctx context.Context, since *big.Int) {
+	s.sharedFetchBlock = new(big.Int).Set(since)
+	s.catchupBlock = nil
+	s.markFilterStale(ctx, false)
+	log.Infof("%s: reading logs with the stream from block %s", s.logName, since.String())
+}
+
+// validateSharedLogs rejects provisional notifications when logs are read with eth_getLogs, which only
+// returns the logs of the current chain. A log removed by a re-org is never reported, so a provisional
+// notification for it could not be retracted. Confirmed events are unaffected, as the confirmation manager
+// checks the block of each event is still part of the chain before dispatching it.
+func validateSharedLogs(sm subscriptionManager, provisionalNotifications bool) error {
+	if provisionalNotifications && sm.config().SharedLogFetching {
+		return errors.Errorf(errors.EventStreamsSharedLogsProvisional)
+	}
+	return nil
+}
+
+// matches applies the filter to a log, in the same way as the node
+func (f *persistedFilter) matches(l *logEntry) bool {
+	if len(f.Addresses) > 0 {
+		found := false
+		for _, addr := range f.Addresses {
+			if addr == l.Address {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for i, options := range f.Topics {
+		if len(options) == 0 {
+			continue
+		}
+		if i >= len(l.Topics) || l.Topics[i] == nil {
+			return false
+		}
+		found := false
+		for _, topic := range options {
+			if topic == *l.Topics[i] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// combineFilters returns a filter for the logs of all the subscriptions. Addresses are combined unless a
+// subscription is for any address, and event signatures in the first topic are combined unless a
+// subscription is for any event. The filter of each subscription is applied to the results.
+func combineFilters(subs []*subscription) persistedFilter {
+	var combined persistedFilter
+	var signatures []ethbinding.Hash
+	anyAddress, anyEvent := false, false
+	addrSeen := make(map[ethbinding.Address]bool)
+	sigSeen := make(map[ethbinding.Hash]bool)
+	for _, sub := range subs {
+		f := &sub.info.Filter
+		if len(f.Addresses) == 0 {
+			anyAddress = true
+		}
+		for _, addr := range f.Addresses {
+			if !addrSeen[addr] {
+				addrSeen[addr] = true
+				combined.Addresses = append(combined.Addresses, addr)
+			}
+		}
+		if len(f.Topics) == 0 || len(f.Topics[0]) == 0 {
+			anyEvent = true
+			continue
+		}
+		for _, sig := range f.Topics[0] {
+			if !sigSeen[sig] {
+				sigSeen[sig] = true
+				signatures = append(signatures, sig)
+			}
+		}
+	}
+	if anyAddress {
+		combined.Addresses = nil
+	}
+	if !anyEvent {
+		combined.Topics = [][]ethbinding.Hash{signatures}
+	}
+	return combined
+}
+
+// fetchSharedLogs reads the logs for the event subscriptions of the stream with one eth_getLogs call
+// per block range, and passes each subscription the logs that match its own filter. Subscriptions that
+// are due to read from the same block share a call, which once caught up to the head is all of them.
+// Each subscription keeps its own block high water mark, so checkpoints are unaffected.
+// A failure is recorded against the subscriptions that were due to read the logs, and the
+// remaining groups are still read.
+func (a *eventStream) fetchSharedLogs(ctx context.Context, subs []*subscription, failed map[string]bool) {
+	var rpc eth.RPCClient
+	groups := make(map[string]*sharedLogGroup)
+	for _, sub := range subs {
+		if sub.sharedFetchBlock == nil || sub.deleting {
+			continue
+		}
+		rpc = sub.rpc // all subscriptions use the RPC client of the subscription manager
+		key := sub.sharedFetchBlock.String()
+		g, exists := groups[key]
+		if !exists {
+			g = &sharedLogGroup{from: sub.sharedFetchBlock}
+			groups[key] = g
+		}
+		g.subs = append(g.subs, sub)
+	}
+	if len(groups) == 0 {
+		return
+	}
+	ordered := make([]*sharedLogGroup, 0, len(groups))
+	for _, g := range groups {
+		ordered = append(ordered, g)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].from.Cmp(ordered[j].from) < 0 })
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	head := ethbinding.HexBigInt{}
+	var headErr error
+	if err := rpc.CallContext(ctx, &head, "eth_blockNumber"); err != nil {
+		headErr = errors.Errorf(errors.RPCCallReturnedError, "eth_blockNumber", err)
+	}
+	for _, g := range ordered {
+		err := headErr
+		if err == nil {
+			err = a.fetchSharedLogGroup(ctx, rpc, g, head.ToInt())
+		}
+		if err != nil {
+			log.Errorf("%s: shared log fetch error from block %s: %s", a.spec.ID, g.from.String(), err)
+			for _, sub := range g.subs {
+				failed[sub.info.ID] = true
+			}
+		}
+	}
+}
+
+func (a *eventStream) fetchSharedLogGroup(ctx context.Context, rpc eth.RPCClient, g *sharedLogGroup, headBlock *big.Int) error {
+	if g.from.Cmp(headBlock) > 0 {
+		// No new blocks since the last poll
+		for _, sub := range g.subs {
+			sub.info.Synchronized = true
+		}
+		return nil
+	}
+	pageSize := a.sm.config().CatchupModePageSize
+	if pageSize <= 0 {
+		pageSize = defaultCatchupModePageSize
+	}
+	endBlock := new(big.Int).Add(g.from, big.NewInt(pageSize-1))
+	if endBlock.Cmp(headBlock) > 0 {
+		endBlock.Set(headBlock)
+	}
+
+	f := &ethFilter{}
+	f.persistedFilter = combineFilters(g.subs)
+	f.FromBlock.ToInt().Set(g.from)
+	f.ToBlock = "0x" + endBlock.Text(16)
+	var logs []*logEntry
+	log.Debugf("%s: reading logs for %d subscriptions. Blocks %s -> %s", a.spec.ID, len(g.subs), g.from.String(), endBlock.String())
+	if err := rpc.CallContext(ctx, &logs, "eth_getLogs", f); err != nil {
+		return errors.Errorf(errors.RPCCallReturnedError, "eth_getLogs", err)
+	}
+
+	synchronized := endBlock.Cmp(headBlock) == 0
+	for _, sub := range g.subs {
+		var matched []*logEntry
+		for _, l := range logs {
+			if sub.info.Filter.matches(l) {
+				matched = append(matched, l)
+			}
+		}
+		if len(matched) == 0 {
+			sub.lp.markNoEvents(endBlock)
+		} else {
+			sub.processLogs(ctx, "eth_getLogs", matched)
+		}
+		sub.sharedFetchBlock = new(big.Int).Add(endBlock, big.NewInt(1))
+		sub.info.Synchronized = synchronized
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"testing"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/ethbind"
+	"github.com/hyperledger/firefly-ethconnect/mocks/ethmocks"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var testChangedEventABI = &ethbinding.ABIElementMarshaling{
+	Name: "Changed",
+	Inputs: []ethbinding.ABIArgumentMarshaling{
+		{Name: "from", Type: "address", Indexed: true},
+		{Name: "i", Type: "int64", Indexed: true},
+		{Name: "s", Type: "string", Indexed: true},
+		{Name: "h", Type: "bytes32"},
+		{Name: "m", Type: "string"},
+	},
+}
+
+func newTestSharedLogSub(t *testing.T, sm *subscriptionMGR, stream *eventStream, id string, since int64, addresses ...string) *subscription {
+	event, err := ethbind.API.ABIElementMarshalingToABIEvent(testChangedEventABI)
+	assert.NoError(t, err)
+	info := &SubscriptionInfo{ID: id, Stream: stream.spec.ID, Event: testChangedEventABI}
+	for _, addr := range addresses {
+		info.Filter.Addresses = append(info.Filter.Addresses, ethbind.API.HexToAddress(addr))
+	}
+	info.Filter.Topics = [][]ethbinding.Hash{{event.ID}}
+	sub, err := restoreSubscription(sm, sm.rpc, sm.cr, info)
+	assert.NoError(t, err)
+	sub.lp.initBlockHWM(big.NewInt(since))
+	err = sub.restartFilter(context.Background(), big.NewInt(since))
+	assert.NoError(t, err)
+	return sub
+}
+
+func TestFilterMatches(t *testing.T) {
+	assert := assert.New(t)
+	addr1 := ethbind.API.HexToAddress("0x14c2d07516b7678597068f81d91b3124471703e8")
+	addr2 := ethbind.API.HexToAddress("0x167f57a13a9c35ff92f0649d2be0e52b4f8ac3ca")
+	topic1 := ethbind.API.HexToHash("0x01")
+	topic2 := ethbind.API.HexToHash("0x02")
+	l := &logEntry{Address: addr1, Topics: []*ethbinding.Hash{&topic1, &topic2}}
+
+	assert.True((&persistedFilter{}).matches(l))
+	assert.True((&persistedFilter{Addresses: []ethbinding.Address{addr2, addr1}}).matches(l))
+	assert.False((&persistedFilter{Addresses: []ethbinding.Address{addr2}}).matches(l))
+	assert.True((&persistedFilter{Topics: [][]ethbinding.Hash{{topic2, topic1}}}).matches(l))
+	assert.False((&persistedFilter{Topics: [][]ethbinding.Hash{{topic2}}}).matches(l))
+	assert.True((&persistedFilter{Topics: [][]ethbinding.Hash{{}, {topic2}}}).matches(l))
+	assert.False((&persistedFilter{Topics: [][]ethbinding.Hash{{topic1}, {topic2}, {topic1}}}).matches(l))
+}
+
+func TestCombineFilters(t *testing.T) {
+	assert := assert.New(t)
+	addr1 := ethbind.API.HexToAddress("0x14c2d07516b7678597068f81d91b3124471703e8")
+	addr2 := ethbind.API.HexToAddress("0x167f57a13a9c35ff92f0649d2be0e52b4f8ac3ca")
+	topic1 := ethbind.API.HexToHash("0x01")
+	topic2 := ethbind.API.HexToHash("0x02")
+	sub := func(f persistedFilter) *subscription {
+		return &subscription{info: &SubscriptionInfo{Filter: f}}
+	}
+
+	f := combineFilters([]*subscription{
+		sub(persistedFilter{Addresses: []ethbinding.Address{addr1}, Topics: [][]ethbinding.Hash{{topic1}}}),
+		sub(persistedFilter{Addresses: []ethbinding.Address{addr2, addr1}, Topics: [][]ethbinding.Hash{{topic2}, {topic1}}}),
+	})
+	assert.Equal([]ethbinding.Address{addr1, addr2}, f.Addresses)
+	assert.Equal([][]ethbinding.Hash{{topic1, topic2}}, f.Topics)
+
+	f = combineFilters([]*subscription{
+		sub(persistedFilter{Addresses: []ethbinding.Address{addr1}, Topics: [][]ethbinding.Hash{{topic1}}}),
+		sub(persistedFilter{}),
+	})
+	assert.Nil(f.Addresses)
+	assert.Nil(f.Topics)
+}
+
+func TestFetchSharedLogs(t *testing.T) {
+	assert := assert.New(t)
+	sm, stream, svr, eventStream := newTestStreamForBatching(&StreamInfo{
+		BatchSize:      10,
+		BatchTimeoutMS: 50,
+		Webhook:        &webhookActionInfo{},
+	}, nil, 200)
+	defer svr.Close()
+	defer stream.stop(false)
+	sm.config().SharedLogFetching = true
+	sm.config().CatchupModePageSize = 1000
+
+	testDataBytes, err := ioutil.ReadFile("../../test/simplevents_logs.json")
+	assert.NoError(err)
+	var testData []*logEntry
+	err = json.Unmarshal(testDataBytes, &testData)
+	assert.NoError(err)
+
+	var filters []*ethFilter
+	rpc := &ethmocks.RPCClient{}
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_blockNumber").Run(func(args mock.Arguments) {
+		args[1].(*ethbinding.HexBigInt).ToInt().SetInt64(150800)
+	}).Return(nil)
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_getLogs", mock.Anything).Run(func(args mock.Arguments) {
+		f := args[3].(*ethFilter)
+		filters = append(filters, f)
+		to, _ := new(big.Int).SetString(f.ToBlock[2:], 16)
+		logs := []*logEntry{}
+		for _, l := range testData {
+			if l.BlockNumber.ToInt().Cmp(f.FromBlock.ToInt()) >= 0 && l.BlockNumber.ToInt().Cmp(to) <= 0 {
+				logs = append(logs, l)
+			}
+		}
+		*(args[1].(*[]*logEntry)) = logs
+	}).Return(nil)
+	sm.rpc = rpc
+
+	sub1 := newTestSharedLogSub(t, sm, stream, "sub1", 150000, "0x14c2d07516b7678597068f81d91b3124471703e8")
+	sub2 := newTestSharedLogSub(t, sm, stream, "sub2", 150000, "0x167f57a13a9c35ff92f0649d2be0e52b4f8ac3ca")
+	sub3 := newTestSharedLogSub(t, sm, stream, "sub3", 150790)
+	assert.Equal(int64(150000), sub1.sharedFetchBlock.Int64())
+	assert.False(sub1.filterStale)
+	assert.NoError(sub1.processNewEvents(context.Background()))
+	rpc.AssertNotCalled(t, "CallContext", mock.Anything, mock.Anything, "eth_newFilter", mock.Anything)
+
+	// One call for the two subscriptions at the same block, and another for the third
+	failed := make(map[string]bool)
+	stream.fetchSharedLogs(context.Background(), []*subscription{sub1, sub2, sub3}, failed)
+	assert.Empty(failed)
+	assert.Len(filters, 2)
+	assert.Equal(int64(150000), filters[0].FromBlock.ToInt().Int64())
+	assert.Equal("0x24d10", filters[0].ToBlock)
+	assert.Len(filters[0].Addresses, 2)
+	assert.Equal(sub1.info.Filter.Topics, filters[0].Topics)
+	assert.Equal(int64(150790), filters[1].FromBlock.ToInt().Int64())
+	assert.Nil(filters[1].Addresses)
+
+	// Only the matching subscription receives the events
+	var events []*eventData
+	for len(events) < len(testData) {
+		events = append(events, <-eventStream...)
+	}
+	for _, e := range events {
+		assert.Equal("sub1", e.SubID)
+	}
+	for _, sub := range []*subscription{sub1, sub2, sub3} {
+		assert.Equal(int64(150801), sub.sharedFetchBlock.Int64())
+		assert.True(sub.info.Synchronized)
+	}
+	hwm := sub2.blockHWM()
+	assert.Equal(int64(150801), hwm.Int64())
+	hwm = sub3.blockHWM()
+	assert.Equal(int64(150801), hwm.Int64())
+
+	// No new blocks means no logs to read
+	stream.fetchSharedLogs(context.Background(), []*subscription{sub1, sub2, sub3}, failed)
+	assert.Empty(failed)
+	assert.Len(filters, 2)
+
+	// Marking stale does not need to uninstall a filter
+	sub1.markFilterStale(context.Background(), true)
+	assert.Nil(sub1.sharedFetchBlock)
+	rpc.AssertNotCalled(t, "CallContext", mock.Anything, mock.Anything, "eth_uninstallFilter", mock.Anything)
+}
+
+func TestFetchSharedLogsFail(t *testing.T) {
+	assert := assert.New(t)
+	sm, stream, svr, _ := newTestStreamForBatching(&StreamInfo{Webhook: &webhookActionInfo{}}, nil, 200)
+	defer svr.Close()
+	defer stream.stop(false)
+	sm.config().SharedLogFetching = true
+
+	rpc := &ethmocks.RPCClient{}
+	sm.rpc = rpc
+	sub1 := newTestSharedLogSub(t, sm, stream, "sub1", 100)
+	sub2 := newTestSharedLogSub(t, sm, stream, "sub2", 150)
+
+	failed := make(map[string]bool)
+	stream.fetchSharedLogs(context.Background(), []*subscription{}, failed)
+	assert.Empty(failed)
+
+	// Without the head block, every subscription fails
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_blockNumber").Return(fmt.Errorf("pop")).Once()
+	stream.fetchSharedLogs(context.Background(), []*subscription{sub1, sub2}, failed)
+	assert.True(failed[sub1.info.ID])
+	assert.True(failed[sub2.info.ID])
+
+	// A failure to read the logs of one group does not stop the other groups being read
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_blockNumber").Run(func(args mock.Arguments) {
+		args[1].(*ethbinding.HexBigInt).ToInt().SetInt64(200)
+	}).Return(nil)
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_getLogs", mock.MatchedBy(func(f *ethFilter) bool {
+		return f.FromBlock.ToInt().Int64() == 100
+	})).Return(fmt.Errorf("pop"))
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_getLogs", mock.Anything).Return(nil)
+	failed = make(map[string]bool)
+	stream.fetchSharedLogs(context.Background(), []*subscription{sub1, sub2}, failed)
+	assert.True(failed[sub1.info.ID])
+	assert.False(failed[sub2.info.ID])
+	assert.Equal(int64(100), sub1.sharedFetchBlock.Int64())
+	assert.Equal(int64(201), sub2.sharedFetchBlock.Int64())
+}
+
+func TestSharedLogsRejectProvisionalNotifications(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	sm.config().SharedLogFetching = true
+	ctx := context.Background()
+
+	_, err := sm.AddStream(ctx, &StreamInfo{
+		Type:                     "webhook",
+		Webhook:                  &webhookActionInfo{URL: "http://test.invalid"},
+		ProvisionalNotifications: true,
+	})
+	assert.Regexp("FFEC100277", err)
+
+	spec, err := sm.AddStream(ctx, &StreamInfo{
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: "http://test.invalid"},
+	})
+	assert.NoError(err)
+	defer sm.streams[spec.ID].stop(false)
+	_, err = sm.UpdateStream(ctx, spec.ID, &StreamInfo{ProvisionalNotifications: true})
+	assert.Regexp("FFEC100277", err)
+
+	err = sm.validateImportStream(&StreamInfo{
+		ID:                       streamIDPrefix + "1",
+		Type:                     "sse",
+		ProvisionalNotifications: true,
+	})
+	assert.Regexp("FFEC100277", err)
+}
@@ -0,0 +1,239 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultSSEHeartbeatInterval is how often we write a comment line to an idle SSE connection,
+	// so that proxies do not time it out
+	defaultSSEHeartbeatInterval = 30 * time.Second
+)
+
+type sseActionInfo struct {
+	AutoAck bool `json:"autoAck,omitempty"` // Treat each batch as acknowledged as soon as it is written to the client
+}
+
+// sseBatch is a batch handed from the batch processor to a connected client
+type sseBatch struct {
+	id        string
+	events    []*eventData
+	acked     chan struct{}
+	redeliver chan struct{}
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+type sseAction struct {
+	es                *eventStream
+	batches           chan *sseBatch
+	heartbeatInterval time.Duration
+	mux               sync.Mutex
+	inflight          *sseBatch // the batch currently being delivered
+	resumeID          string    // the Last-Event-ID supplied by a reconnecting client
+}
+
+func newSSEAction(es *eventStream) *sseAction {
+	return &sseAction{
+		es:                es,
+		batches:           make(chan *sseBatch),
+		heartbeatInterval: defaultSSEHeartbeatInterval,
+	}
+}
+
+func (s *sseAction) autoAck() bool {
+	return s.es.spec.SSE != nil && s.es.spec.SSE.AutoAck
+}
+
+// attemptBatch waits for a connected client to take the batch, then for it to be acknowledged.
+// If the client disconnects before acknowledging, the batch is offered to the next client
+// to connect. A client that reconnects with the ID of the batch as its Last-Event-ID
+// acknowledges it, rather than receiving it again.
+func (s *sseAction) attemptBatch(batchNumber, attempt uint64, events []*eventData) (err error) {
+	b := &sseBatch{
+		id:        batchID(events),
+		events:    events,
+		acked:     make(chan struct{}, 1),
+		redeliver: make(chan struct{}, 1),
+	}
+	s.mux.Lock()
+	resumed := s.resumeID == b.id
+	s.resumeID = ""
+	if !resumed {
+		s.inflight = b
+	}
+	s.mux.Unlock()
+	if resumed {
+		log.Infof("%s: SSE event batch %d acknowledged by Last-Event-ID on reconnect", s.es.spec.ID, batchNumber)
+		return nil
+	}
+	defer func() {
+		s.mux.Lock()
+		s.inflight = nil
+		s.mux.Unlock()
+	}()
+
+	for acked := false; !acked && err == nil; {
+		select {
+		case s.batches <- b:
+			select {
+			case <-b.acked:
+				acked = true
+			case <-b.redeliver:
+				log.Infof("%s: SSE client disconnected before acknowledging batch %d. Waiting for a new connection", s.es.spec.ID, batchNumber)
+			case <-s.es.updateInterrupt:
+				err = errors.Errorf(errors.EventStreamsSSEInterruptedReceive)
+			}
+		case <-b.acked:
+			acked = true
+		case <-s.es.updateInterrupt:
+			err = errors.Errorf(errors.EventStreamsSSEInterruptedSend)
+		}
+	}
+
+	log.Infof("%s: SSE event batch %d complete (len=%d). err=%v", s.es.spec.ID, batchNumber, len(events), err)
+	return err
+}
+
+// resume handles the Last-Event-ID of a reconnecting client, which is the last batch it acknowledged
+func (s *sseAction) resume(lastEventID string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.inflight != nil && s.inflight.id == lastEventID {
+		signal(s.inflight.acked)
+		return
+	}
+	// The batch might be between retries, so we check it on the next attempt
+	s.resumeID = lastEventID
+}
+
+func (s *sseAction) ack(batchID string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.inflight == nil || s.inflight.id != batchID {
+		return errors.Errorf(errors.EventStreamsSSEAckNotInFlight, batchID, s.es.spec.ID)
+	}
+	signal(s.inflight.acked)
+	return nil
+}
+
+func (s *sseAction) write(w io.Writer, flusher http.Flusher, b *sseBatch) error {
+	data, _ := json.Marshal(b.events)
+	if _, err := fmt.Fprintf(w, "id: %s\ndata: %s\n\n", b.id, data); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+// serve streams batches to the client until it disconnects. Errors are only returned before
+// anything has been written to the response.
+func (s *sseAction) serve(res http.ResponseWriter, req *http.Request) error {
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		return errors.Errorf(errors.EventStreamsSSEStreamingUnsupported)
+	}
+	if lastEventID := req.Header.Get("Last-Event-ID"); lastEventID != "" {
+		s.resume(lastEventID)
+	}
+
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	res.WriteHeader(200)
+	flusher.Flush()
+	log.Infof("%s: SSE client connected", s.es.spec.ID)
+
+	// A batch written to this client, that has not yet been acknowledged
+	var unacked *sseBatch
+	defer func() {
+		if unacked != nil {
+			signal(unacked.redeliver)
+		}
+	}()
+
+	heartbeat := time.NewTicker(s.heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			log.Infof("%s: SSE client disconnected", s.es.spec.ID)
+			return nil
+		case <-heartbeat.C:
+			if _, err := io.WriteString(res, ": heartbeat\n\n"); err != nil {
+				return nil
+			}
+			flusher.Flush()
+		case b := <-s.batches:
+			if err := s.write(res, flusher, b); err != nil {
+				log.Errorf("%s: Failed to write SSE batch %s: %s", s.es.spec.ID, b.id, err)
+				signal(b.redeliver)
+				return nil
+			}
+			if s.autoAck() {
+				signal(b.acked)
+			} else {
+				unacked = b
+			}
+		}
+	}
+}
+
+func (s *subscriptionMGR) sseActionForStream(id string) (*sseAction, error) {
+	stream, err := s.streamByID(id)
+	if err != nil {
+		return nil, err
+	}
+	action, ok := stream.action.(*sseAction)
+	if !ok {
+		return nil, errors.Errorf(errors.EventStreamsSSENotSSEStream, id)
+	}
+	return action, nil
+}
+
+// StreamSSE delivers the batches of an SSE event stream to the client as Server-Sent Events,
+// until the client disconnects
+func (s *subscriptionMGR) StreamSSE(res http.ResponseWriter, req *http.Request, id string) error {
+	action, err := s.sseActionForStream(id)
+	if err != nil {
+		return err
+	}
+	return action.serve(res, req)
+}
+
+// AckSSE acknowledges the batch currently being delivered on an SSE event stream
+func (s *subscriptionMGR) AckSSE(ctx context.Context, id, batchID string) error {
+	action, err := s.sseActionForStream(id)
+	if err != nil {
+		return err
+	}
+	return action.ack(batchID)
+}
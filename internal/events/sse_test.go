@@ -0,0 +1,271 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/kvstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSSEAction(autoAck bool) (*sseAction, *httptest.Server) {
+	es := &eventStream{
+		spec:            &StreamInfo{ID: "es1", Type: "sse", SSE: &sseActionInfo{AutoAck: autoAck}},
+		updateInterrupt: make(chan struct{}),
+	}
+	a := newSSEAction(es)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if err := a.serve(res, req); err != nil {
+			res.WriteHeader(500)
+		}
+	}))
+	return a, server
+}
+
+type testSSEClient struct {
+	cancel context.CancelFunc
+	reader *bufio.Reader
+}
+
+func connectTestSSEClient(t *testing.T, url, lastEventID string) *testSSEClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	return &testSSEClient{cancel: cancel, reader: bufio.NewReader(res.Body)}
+}
+
+// readEvent returns the id and data lines of the next event
+func (c *testSSEClient) readEvent(t *testing.T) (string, string) {
+	var id, data string
+	for {
+		line, err := c.reader.ReadString('\n')
+		assert.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "" && id != "":
+			return id, data
+		}
+	}
+}
+
+func TestSSEDeliverAndAck(t *testing.T) {
+	assert := assert.New(t)
+	a, server := newTestSSEAction(false)
+	defer server.Close()
+
+	client := connectTestSSEClient(t, server.URL, "")
+	defer client.cancel()
+
+	events := []*eventData{{ID: "ev1"}}
+	done := make(chan error)
+	go func() {
+		done <- a.attemptBatch(1, 1, events)
+	}()
+
+	id, data := client.readEvent(t)
+	assert.Equal(batchID(events), id)
+	assert.Regexp(`"id":"ev1"`, data)
+
+	err := a.ack("wrong")
+	assert.Regexp("Batch 'wrong' is not awaiting acknowledgement on event stream 'es1'", err)
+	assert.NoError(a.ack(id))
+	assert.NoError(<-done)
+
+	err = a.ack(id)
+	assert.Regexp("is not awaiting acknowledgement", err)
+}
+
+func TestSSEAutoAck(t *testing.T) {
+	assert := assert.New(t)
+	a, server := newTestSSEAction(true)
+	defer server.Close()
+
+	client := connectTestSSEClient(t, server.URL, "")
+	defer client.cancel()
+
+	for i, evID := range []string{"ev1", "ev2"} {
+		events := []*eventData{{ID: evID}}
+		done := make(chan error)
+		go func() {
+			done <- a.attemptBatch(uint64(i), 1, events)
+		}()
+		id, _ := client.readEvent(t)
+		assert.Equal(batchID(events), id)
+		assert.NoError(<-done)
+	}
+}
+
+func TestSSERedeliverAfterDisconnect(t *testing.T) {
+	assert := assert.New(t)
+	a, server := newTestSSEAction(false)
+	defer server.Close()
+
+	events := []*eventData{{ID: "ev1"}}
+	done := make(chan error)
+	go func() {
+		done <- a.attemptBatch(1, 1, events)
+	}()
+
+	client1 := connectTestSSEClient(t, server.URL, "")
+	id1, _ := client1.readEvent(t)
+	client1.cancel()
+
+	client2 := connectTestSSEClient(t, server.URL, "")
+	defer client2.cancel()
+	id2, _ := client2.readEvent(t)
+	assert.Equal(id1, id2)
+
+	assert.NoError(a.ack(id2))
+	assert.NoError(<-done)
+}
+
+func TestSSEResumeAcksInFlight(t *testing.T) {
+	assert := assert.New(t)
+	a, server := newTestSSEAction(false)
+	defer server.Close()
+
+	events := []*eventData{{ID: "ev1"}}
+	done := make(chan error)
+	go func() {
+		done <- a.attemptBatch(1, 1, events)
+	}()
+
+	client1 := connectTestSSEClient(t, server.URL, "")
+	id, _ := client1.readEvent(t)
+	client1.cancel()
+
+	client2 := connectTestSSEClient(t, server.URL, id)
+	defer client2.cancel()
+	assert.NoError(<-done)
+}
+
+func TestSSEResumeBetweenAttempts(t *testing.T) {
+	assert := assert.New(t)
+	a, _ := newTestSSEAction(false)
+
+	events := []*eventData{{ID: "ev1"}}
+	a.resume(batchID(events))
+	assert.NoError(a.attemptBatch(1, 2, events))
+	assert.Empty(a.resumeID)
+}
+
+func TestSSEInterruptSend(t *testing.T) {
+	a, _ := newTestSSEAction(false)
+	close(a.es.updateInterrupt)
+	err := a.attemptBatch(1, 1, []*eventData{{ID: "ev1"}})
+	assert.Regexp(t, "Interrupted waiting for SSE connection", err)
+}
+
+func TestSSEInterruptReceive(t *testing.T) {
+	assert := assert.New(t)
+	a, server := newTestSSEAction(false)
+	defer server.Close()
+
+	client := connectTestSSEClient(t, server.URL, "")
+	defer client.cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- a.attemptBatch(1, 1, []*eventData{{ID: "ev1"}})
+	}()
+	client.readEvent(t)
+	close(a.es.updateInterrupt)
+	assert.Regexp("Interrupted waiting for SSE acknowledgment", <-done)
+}
+
+func TestSSEHeartbeat(t *testing.T) {
+	assert := assert.New(t)
+	a, server := newTestSSEAction(false)
+	defer server.Close()
+	a.heartbeatInterval = 1 * time.Millisecond
+
+	client := connectTestSSEClient(t, server.URL, "")
+	defer client.cancel()
+	line, err := client.reader.ReadString('\n')
+	assert.NoError(err)
+	assert.Equal(": heartbeat\n", line)
+}
+
+type testNoFlushWriter struct {
+	http.ResponseWriter
+}
+
+func TestSSEStreamingUnsupported(t *testing.T) {
+	a, _ := newTestSSEAction(false)
+	req := httptest.NewRequest("GET", "/", nil)
+	err := a.serve(testNoFlushWriter{httptest.NewRecorder()}, req)
+	assert.Regexp(t, "Streaming is not supported", err)
+}
+
+func TestSSEStreamNotSSE(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	sm.db = kvstore.NewMockKV(nil)
+	defer sm.Close(true)
+	stream, err := sm.AddStream(context.Background(), &StreamInfo{Type: "websocket"})
+	assert.NoError(err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	err = sm.StreamSSE(httptest.NewRecorder(), req, stream.ID)
+	assert.Regexp("is not of type 'sse'", err)
+	err = sm.AckSSE(context.Background(), stream.ID, "batch1")
+	assert.Regexp("is not of type 'sse'", err)
+	err = sm.StreamSSE(httptest.NewRecorder(), req, "unknown")
+	assert.Regexp("Stream with ID 'unknown' not found", err)
+	err = sm.AckSSE(context.Background(), "unknown", "batch1")
+	assert.Regexp("Stream with ID 'unknown' not found", err)
+}
+
+func TestSSEStreamAndAck(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	sm.db = kvstore.NewMockKV(nil)
+	defer sm.Close(true)
+	stream, err := sm.AddStream(context.Background(), &StreamInfo{Type: "sse"})
+	assert.NoError(err)
+	assert.NotNil(stream.SSE)
+	assert.False(stream.SSE.AutoAck)
+
+	err = sm.AckSSE(context.Background(), stream.ID, "batch1")
+	assert.Regexp("Batch 'batch1' is not awaiting acknowledgement", err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	res := httptest.NewRecorder()
+	err = sm.StreamSSE(res, req, stream.ID)
+	assert.NoError(err)
+	assert.Equal(200, res.Code)
+
+	updated, err := sm.UpdateStream(context.Background(), stream.ID, &StreamInfo{SSE: &sseActionInfo{AutoAck: true}})
+	assert.NoError(err)
+	assert.True(updated.SSE.AutoAck)
+}
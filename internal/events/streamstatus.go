@@ -0,0 +1,189 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"math/big"
+	"sort"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// pendingConfirmationsTimeout limits how long the status of a stream waits for the confirmation manager,
+	// which only handles requests between its polls of the chain
+	pendingConfirmationsTimeout = 5 * time.Second
+)
+
+// StreamStatus is the runtime state of an event stream, for diagnosing stalls
+type StreamStatus struct {
+	ID                       string                `json:"id"`
+	Suspended                bool                  `json:"suspended"`
+	Blocked                  bool                  `json:"blocked"`
+	InFlight                 uint64                `json:"inFlight"`
+	BatchQueueDepth          int                   `json:"batchQueueDepth"`
+	InFlightBatches          int                   `json:"inFlightBatches"`
+	BatchCount               uint64                `json:"batchCount"`
+	LastBatchTime            string                `json:"lastBatchTime,omitempty"`
+	LastError                string                `json:"lastError,omitempty"`
+	LastErrorTime            string                `json:"lastErrorTime,omitempty"`
+	DeadLetters              uint64                `json:"deadLetters,omitempty"`
+	ChainHead                string                `json:"chainHead,omitempty"`
+	ConfirmationsUnavailable bool                  `json:"confirmationsUnavailable,omitempty"` // the confirmation manager did not respond in time, so pendingConfirmations is omitted
+	Subscriptions            []*SubscriptionStatus `json:"subscriptions"`
+}
+
+// SubscriptionStatus is the runtime state of a subscription on a stream
+type SubscriptionStatus struct {
+	ID                   string  `json:"id"`
+	Name                 string  `json:"name,omitempty"`
+	BlockHWM             string  `json:"blockHWM"`
+	BlocksBehind         string  `json:"blocksBehind,omitempty"`
+	InCatchupMode        bool    `json:"inCatchupMode"`
+	CatchupBlock         string  `json:"catchupBlock,omitempty"`
+	CatchupTargetBlock   string  `json:"catchupTargetBlock,omitempty"` // the head of the chain when catchup mode last checked
+	CatchupPageSize      int64   `json:"catchupPageSize,omitempty"`
+	CatchupProgress      float64 `json:"catchupProgress,omitempty"` // percentage of the blocks from the start of catchup mode to the target that have been read
+	Synchronized         bool    `json:"synchronized"`
+	FilterStale          bool    `json:"filterStale"`
+	PendingConfirmations *int    `json:"pendingConfirmations,omitempty"`
+}
+
+// status builds the status of the stream, without the subscription details
+func (a *eventStream) status() *StreamStatus {
+	a.batchCond.L.Lock()
+	defer a.batchCond.L.Unlock()
+	status := &StreamStatus{
+		ID:              a.spec.ID,
+		Suspended:       a.spec.Suspended,
+		Blocked:         a.inFlight >= a.spec.maxInFlightEvents(),
+		InFlight:        a.inFlight,
+		BatchQueueDepth: a.batchQueue.Len(),
+		InFlightBatches: a.inFlightBatches.Len(),
+		BatchCount:      a.batchCount,
+		DeadLetters:     a.deadLetters,
+		Subscriptions:   []*SubscriptionStatus{},
+	}
+	if !a.lastBatchTime.IsZero() {
+		status.LastBatchTime = a.lastBatchTime.Format(time.RFC3339Nano)
+	}
+	if a.lastError != nil {
+		status.LastError = a.lastError.Error()
+		status.LastErrorTime = a.lastErrorTime.Format(time.RFC3339Nano)
+	}
+	return status
+}
+
+// pendingConfirmations asks the confirmation manager for the number of events for each
+// subscription on the stream, that are waiting for confirmations. Returns nil if the
+// confirmation manager does not respond before the context is done, or the timeout.
+func (a *eventStream) pendingConfirmations(ctx context.Context) map[string]int {
+	bcm := a.sm.confirmationManager()
+	if bcm == nil {
+		return map[string]int{}
+	}
+	n := &bcmNotification{
+		nType:       bcmStreamStatus,
+		eventStream: a,
+		complete:    make(chan struct{}),
+		pending:     make(map[string]int),
+	}
+	ctx, cancel := context.WithTimeout(ctx, pendingConfirmationsTimeout)
+	defer cancel()
+	select {
+	case bcm.bcmNotifications <- n:
+	case <-ctx.Done():
+		log.Warnf("%s: Confirmation manager did not accept the request for pending confirmations: %s", a.spec.ID, ctx.Err())
+		return nil
+	}
+	select {
+	case <-n.complete:
+		return n.pending
+	case <-ctx.Done():
+		// The confirmation manager still owns the map, so we must not read it
+		log.Warnf("%s: Confirmation manager did not return the pending confirmations: %s", a.spec.ID, ctx.Err())
+		return nil
+	}
+}
+
+func (s *subscription) status(head *big.Int, pendingConfirmations *int) *SubscriptionStatus {
+	hwm := s.blockHWM()
+	status := &SubscriptionStatus{
+		ID:                   s.info.ID,
+		Name:                 s.info.Name,
+		BlockHWM:             hwm.String(),
+		InCatchupMode:        s.inCatchupMode(),
+		Synchronized:         s.info.Synchronized,
+		FilterStale:          s.filterStale,
+		PendingConfirmations: pendingConfirmations,
+	}
+	if catchupBlock := s.catchupBlock; catchupBlock != nil {
+		status.CatchupBlock = catchupBlock.String()
+		status.CatchupPageSize = s.currentCatchupPageSize()
+		status.CatchupProgress = s.catchupProgress()
+		if s.catchupHead != nil {
+			status.CatchupTargetBlock = s.catchupHead.String()
+		}
+	}
+	if head != nil {
+		behind := new(big.Int).Sub(head, &hwm)
+		if behind.Sign() < 0 {
+			behind.SetInt64(0)
+		}
+		status.BlocksBehind = behind.String()
+	}
+	return status
+}
+
+func (s *subscriptionMGR) chainHead(ctx context.Context) *big.Int {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	blockNumber := ethbinding.HexBigInt{}
+	if err := s.rpc.CallContext(ctx, &blockNumber, "eth_blockNumber"); err != nil {
+		log.Warnf("Unable to query chain head for stream status: %s", err)
+		return nil
+	}
+	return blockNumber.ToInt()
+}
+
+// StreamStatus returns the runtime status of a stream, and each of its subscriptions
+func (s *subscriptionMGR) StreamStatus(ctx context.Context, id string) (*StreamStatus, error) {
+	stream, err := s.streamByID(id)
+	if err != nil {
+		return nil, err
+	}
+	status := stream.status()
+	head := s.chainHead(ctx)
+	if head != nil {
+		status.ChainHead = head.String()
+	}
+	pending := stream.pendingConfirmations(ctx)
+	status.ConfirmationsUnavailable = pending == nil
+	for _, sub := range s.subscriptionsForStream(id) {
+		var subPending *int
+		if pending != nil {
+			count := pending[sub.info.ID]
+			subPending = &count
+		}
+		status.Subscriptions = append(status.Subscriptions, sub.status(head, subPending))
+	}
+	sort.Slice(status.Subscriptions, func(i, j int) bool {
+		return status.Subscriptions[i].ID < status.Subscriptions[j].ID
+	})
+	return status, nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	ethmocks "github.com/hyperledger/firefly-ethconnect/mocks/ethmocks"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestStreamForStatus(sm *subscriptionMGR) *eventStream {
+	stream := &eventStream{
+		sm:              sm,
+		spec:            &StreamInfo{ID: "es1", BatchSize: 2},
+		batchCond:       sync.NewCond(&sync.Mutex{}),
+		batchQueue:      list.New(),
+		inFlightBatches: list.New(),
+	}
+	sm.streams["es1"] = stream
+	sm.subscriptions["sub2"] = &subscription{
+		info: &SubscriptionInfo{ID: "sub2", Stream: "es1", Synchronized: true},
+		lp:   &logProcessor{blockHWM: *big.NewInt(95)},
+	}
+	sm.subscriptions["sub1"] = &subscription{
+		info:         &SubscriptionInfo{ID: "sub1", Stream: "es1"},
+		lp:           &logProcessor{blockHWM: *big.NewInt(10)},
+		catchupBlock: big.NewInt(11),
+	}
+	return stream
+}
+
+func TestStreamStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := newTestSubscriptionManager()
+	rpc := sm.rpc.(*ethmocks.RPCClient)
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_blockNumber").Run(func(args mock.Arguments) {
+		args[1].(*ethbinding.HexBigInt).ToInt().SetInt64(100)
+	}).Return(nil)
+	stream := newTestStreamForStatus(sm)
+	stream.inFlight = 2
+	stream.batchQueue.PushBack([]*eventData{testEvent("sub1")})
+	stream.recordBatchResult(fmt.Errorf("pop"))
+
+	status, err := sm.StreamStatus(context.Background(), "es1")
+	assert.NoError(err)
+	assert.True(status.Blocked)
+	assert.Equal(uint64(2), status.InFlight)
+	assert.Equal(1, status.BatchQueueDepth)
+	assert.Equal("pop", status.LastError)
+	assert.NotEmpty(status.LastErrorTime)
+	assert.Empty(status.LastBatchTime)
+	assert.Equal("100", status.ChainHead)
+	assert.Len(status.Subscriptions, 2)
+	assert.Equal("sub1", status.Subscriptions[0].ID)
+	assert.Equal("10", status.Subscriptions[0].BlockHWM)
+	assert.Equal("90", status.Subscriptions[0].BlocksBehind)
+	assert.True(status.Subscriptions[0].InCatchupMode)
+	assert.Equal("11", status.Subscriptions[0].CatchupBlock)
+	assert.Equal("sub2", status.Subscriptions[1].ID)
+	assert.Equal("5", status.Subscriptions[1].BlocksBehind)
+	assert.False(status.Subscriptions[1].InCatchupMode)
+	assert.True(status.Subscriptions[1].Synchronized)
+	assert.False(status.ConfirmationsUnavailable)
+	assert.Equal(0, *status.Subscriptions[1].PendingConfirmations)
+
+	stream.recordBatchResult(nil)
+	status, err = sm.StreamStatus(context.Background(), "es1")
+	assert.NoError(err)
+	assert.Empty(status.LastError)
+	assert.NotEmpty(status.LastBatchTime)
+}
+
+func TestStreamStatusNoChainHead(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := newTestSubscriptionManager()
+	rpc := sm.rpc.(*ethmocks.RPCClient)
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_blockNumber").Return(fmt.Errorf("pop"))
+	newTestStreamForStatus(sm)
+
+	status, err := sm.StreamStatus(context.Background(), "es1")
+	assert.NoError(err)
+	assert.False(status.Blocked)
+	assert.Empty(status.ChainHead)
+	assert.Empty(status.Subscriptions[0].BlocksBehind)
+	assert.Equal("10", status.Subscriptions[0].BlockHWM)
+}
+
+func TestStreamStatusNotFound(t *testing.T) {
+	sm := newTestSubscriptionManager()
+	_, err := sm.StreamStatus(context.Background(), "es1")
+	assert.Regexp(t, "Stream with ID 'es1' not found", err)
+}
+
+func TestStreamStatusPendingConfirmations(t *testing.T) {
+	assert := assert.New(t)
+
+	stream := &eventStream{}
+	otherStream := &eventStream{}
+	bcm := &blockConfirmationManager{
+		pending: map[string]*pendingEvent{
+			"e1": {event: testEvent("sub1"), eventStream: stream},
+			"e2": {event: testEvent("sub1"), eventStream: stream},
+			"e3": {event: testEvent("sub2"), eventStream: stream},
+			"e4": {event: testEvent("sub3"), eventStream: otherStream},
+		},
+	}
+	n := &bcmNotification{
+		nType:       bcmStreamStatus,
+		eventStream: stream,
+		complete:    make(chan struct{}),
+		pending:     make(map[string]int),
+	}
+	bcm.streamStatus(n)
+	<-n.complete
+	assert.Equal(map[string]int{"sub1": 2, "sub2": 1}, n.pending)
+}
+
+func TestStreamStatusConfirmationsUnavailable(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := newTestSubscriptionManager()
+	rpc := sm.rpc.(*ethmocks.RPCClient)
+	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_blockNumber").Return(fmt.Errorf("pop"))
+	stream := newTestStreamForStatus(sm)
+
+	// The confirmation manager is busy, and does not take the request
+	sm.bcm = &blockConfirmationManager{bcmNotifications: make(chan *bcmNotification)}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	status, err := sm.StreamStatus(ctx, "es1")
+	assert.NoError(err)
+	assert.True(status.ConfirmationsUnavailable)
+	assert.Nil(status.Subscriptions[0].PendingConfirmations)
+
+	// The confirmation manager takes the request, but does not respond
+	go func() {
+		<-sm.bcm.bcmNotifications
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Nil(stream.pendingConfirmations(ctx))
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"encoding/json"
 	"math/big"
+	"net/http"
 	"strings"
 	"sync"
 	"time"
@@ -29,6 +30,7 @@ import (
 	"github.com/hyperledger/firefly-ethconnect/internal/eth"
 	"github.com/hyperledger/firefly-ethconnect/internal/kvstore"
 	"github.com/hyperledger/firefly-ethconnect/internal/messages"
+	"github.com/hyperledger/firefly-ethconnect/internal/receipts"
 	"github.com/hyperledger/firefly-ethconnect/internal/utils"
 	"github.com/hyperledger/firefly-ethconnect/internal/ws"
 	ethbinding "github.com/kaleido-io/ethbinding/pkg"
@@ -44,9 +46,12 @@ const (
 	subIDPrefix        = "sb-"
 	streamIDPrefix     = "es-"
 	checkpointIDPrefix = "cp-"
+	inflightIDPrefix   = "ib-"
 
 	defaultCatchupModeBlockGap = int64(250)
 	defaultCatchupModePageSize = int64(250)
+
+	defaultCatchupModeMaxPageFactor = int64(10)
 )
 
 // SubscriptionManager provides REST APIs for managing events
@@ -55,6 +60,9 @@ type SubscriptionManager interface {
 	AddStream(ctx context.Context, spec *StreamInfo) (*StreamInfo, error)
 	Streams(ctx context.Context) []*StreamInfo
 	StreamByID(ctx context.Context, id string) (*StreamInfo, error)
+	StreamStatus(ctx context.Context, id string) (*StreamStatus, error)
+	StreamSSE(res http.ResponseWriter, req *http.Request, id string) error
+	AckSSE(ctx context.Context, id, batchID string) error
 	UpdateStream(ctx context.Context, id string, spec *StreamInfo) (*StreamInfo, error)
 	SuspendStream(ctx context.Context, id string) error
 	ResumeStream(ctx context.Context, id string) error
@@ -64,7 +72,19 @@ type SubscriptionManager interface {
 	Subscriptions(ctx context.Context) []*SubscriptionInfo
 	SubscriptionByID(ctx context.Context, id string) (*SubscriptionInfo, error)
 	ResetSubscription(ctx context.Context, id, initialBlock string) error
+	ReplaySubscription(ctx context.Context, id string, req *ReplayRequest) (*ReplayInfo, error)
+	ReplayByID(ctx context.Context, id string) (*ReplayInfo, error)
+	CancelReplay(ctx context.Context, id string) error
 	DeleteSubscription(ctx context.Context, id string) error
+	DeadLetters(ctx context.Context, streamID string) ([]*DeadLetter, error)
+	DeadLetterByID(ctx context.Context, streamID, id string) (*DeadLetter, error)
+	RedeliverDeadLetter(ctx context.Context, streamID, id string) error
+	DeleteDeadLetter(ctx context.Context, streamID, id string) error
+	PurgeDeadLetters(ctx context.Context, streamID string) error
+	DispatchReceipt(receipt map[string]interface{})
+	SetReceiptStore(persistence receipts.ReceiptStorePersistence)
+	Export(ctx context.Context, opts *ExportOptions) (*EventsExport, error)
+	Import(ctx context.Context, export *EventsExport, opts *ImportOptions) (*ImportResult, error)
 	Close(wait bool)
 }
 
@@ -75,7 +95,14 @@ type subscriptionManager interface {
 	subscriptionsForStream(string) []*subscription
 	loadCheckpoint(string) (map[string]*big.Int, error)
 	storeCheckpoint(string, map[string]*big.Int) error
+	loadInflightBatch(string) ([]*eventData, error)
+	storeInflightBatch(string, []*eventData) error
+	deleteInflightBatch(string)
+	storeStream(*StreamInfo) (*StreamInfo, error)
+	storeDeadLetter(*DeadLetter) error
 	confirmationManager() *blockConfirmationManager
+	pushClient() eth.RPCClientAsync
+	receiptStore() receipts.ReceiptStorePersistence
 }
 
 // SubscriptionManagerConf configuration
@@ -84,8 +111,11 @@ type SubscriptionManagerConf struct {
 	EventPollingIntervalSec uint64          `json:"eventPollingIntervalSec,omitempty"`
 	CatchupModeBlockGap     int64           `json:"catchupModeBlockGap,omitempty"`
 	CatchupModePageSize     int64           `json:"catchupModePageSize,omitempty"`
+	CatchupModeMaxPageSize  int64           `json:"catchupModeMaxPageSize,omitempty"` // The page size grows up to this while pages are empty
+	CatchupModeParallelism  int             `json:"catchupModeParallelism,omitempty"` // The number of pages read concurrently in catchup mode
 	WebhooksAllowPrivateIPs bool            `json:"webhooksAllowPrivateIPs,omitempty"`
 	DecimalTransactionIndex bool            `json:"decimalTransactionIndex,omitempty"`
+	SharedLogFetching       bool            `json:"sharedLogFetching,omitempty"` // Each stream reads the logs of all its event subscriptions together, with eth_getLogs. Removed logs are not reported, so provisional notifications are not supported
 	Confirmations           bcmConfExternal `json:"confirmations,omitempty"`
 }
 
@@ -93,6 +123,7 @@ type subscriptionMGR struct {
 	conf               *SubscriptionManagerConf
 	db                 kvstore.KVStore
 	rpc                eth.RPCClient
+	pushRPC            eth.RPCClientAsync
 	subscriptions      map[string]*subscription
 	bcm                *blockConfirmationManager
 	streams            map[string]*eventStream
@@ -100,6 +131,10 @@ type subscriptionMGR struct {
 	cr                 contractregistry.ContractResolver
 	wsChannels         ws.WebSocketChannels
 	subscriptionsMutex sync.RWMutex
+	replays            map[string]*replay
+	replaysMutex       sync.Mutex
+	receipts           receipts.ReceiptStorePersistence
+	receiptsMutex      sync.Mutex
 }
 
 // CobraInitSubscriptionManager standard naming for cobra command params
@@ -114,8 +149,10 @@ func NewSubscriptionManager(conf *SubscriptionManagerConf, rpc eth.RPCClient, cr
 	sm := &subscriptionMGR{
 		conf:          conf,
 		rpc:           rpc,
+		pushRPC:       eth.SubscriptionClient(rpc),
 		subscriptions: make(map[string]*subscription),
 		streams:       make(map[string]*eventStream),
+		replays:       make(map[string]*replay),
 		cr:            cr,
 		wsChannels:    wsChannels,
 	}
@@ -128,6 +165,12 @@ func NewSubscriptionManager(conf *SubscriptionManagerConf, rpc eth.RPCClient, cr
 	if conf.CatchupModePageSize <= 0 {
 		conf.CatchupModePageSize = defaultCatchupModePageSize
 	}
+	if conf.CatchupModeMaxPageSize <= 0 {
+		conf.CatchupModeMaxPageSize = conf.CatchupModePageSize * defaultCatchupModeMaxPageFactor
+	}
+	if conf.CatchupModeParallelism <= 0 {
+		conf.CatchupModeParallelism = 1
+	}
 	if conf.CatchupModeBlockGap < conf.CatchupModePageSize {
 		log.Warnf("catchupModeBlockGap=%d must be >= catchupModePageSize=%d - setting to %d", conf.CatchupModeBlockGap, conf.CatchupModePageSize, conf.CatchupModePageSize)
 		conf.CatchupModeBlockGap = conf.CatchupModePageSize
@@ -209,10 +252,18 @@ func (s *subscriptionMGR) addSubscriptionCommon(ctx context.Context, abi *ABIRef
 		TimeSorted: messages.TimeSorted{
 			CreatedISO8601: time.Now().UTC().Format(time.RFC3339),
 		},
-		ID:     subIDPrefix + utils.UUIDv4(),
-		Event:  newSub.Event,
-		Stream: newSub.Stream,
-		ABI:    abi,
+		ID:            subIDPrefix + utils.UUIDv4(),
+		Event:         newSub.Event,
+		Stream:        newSub.Stream,
+		Kind:          newSub.Kind,
+		ReceiptFilter: newSub.ReceiptFilter,
+		ABI:           abi,
+		Confirmations: newSub.Confirmations,
+	}
+	i.Filter.Addresses = newSub.Addresses
+	i.Filter.Topics = newSub.Topics
+	if err := validateConfirmations(s, i.Confirmations); err != nil {
+		return nil, err
 	}
 	i.Path = SubPathPrefix + "/" + i.ID
 
@@ -233,6 +284,35 @@ func (s *subscriptionMGR) addSubscriptionCommon(ctx context.Context, abi *ABIRef
 	return subInfo, err
 }
 
+// DispatchReceipt passes a reply written to the receipt store, to every subscription to receipts.
+// This blocks while the queue of a subscription is full, until its event stream catches up.
+func (s *subscriptionMGR) DispatchReceipt(receipt map[string]interface{}) {
+	s.subscriptionsMutex.RLock()
+	var receiptSubs []*subscription
+	for _, sub := range s.subscriptions {
+		if sub.receipts != nil {
+			receiptSubs = append(receiptSubs, sub)
+		}
+	}
+	s.subscriptionsMutex.RUnlock()
+	for _, sub := range receiptSubs {
+		sub.queueReceipt(receipt)
+	}
+}
+
+// SetReceiptStore provides the receipt store that subscriptions to receipts catch up from, after a restart
+func (s *subscriptionMGR) SetReceiptStore(persistence receipts.ReceiptStorePersistence) {
+	s.receiptsMutex.Lock()
+	defer s.receiptsMutex.Unlock()
+	s.receipts = persistence
+}
+
+func (s *subscriptionMGR) receiptStore() receipts.ReceiptStorePersistence {
+	s.receiptsMutex.Lock()
+	defer s.receiptsMutex.Unlock()
+	return s.receipts
+}
+
 func (s *subscriptionMGR) config() *SubscriptionManagerConf {
 	return s.conf
 }
@@ -293,14 +373,14 @@ func (s *subscriptionMGR) StreamByID(ctx context.Context, id string) (*StreamInf
 	if err != nil {
 		return nil, err
 	}
-	return stream.spec, nil
+	return stream.spec.redacted(), nil
 }
 
 // Streams used externally to get list streams
 func (s *subscriptionMGR) Streams(ctx context.Context) []*StreamInfo {
 	l := make([]*StreamInfo, 0, len(s.streams))
 	for _, stream := range s.streams {
-		l = append(l, stream.spec)
+		l = append(l, stream.spec.redacted())
 	}
 	return l
 }
@@ -310,12 +390,21 @@ func (s *subscriptionMGR) AddStream(ctx context.Context, spec *StreamInfo) (*Str
 	spec.ID = streamIDPrefix + utils.UUIDv4()
 	spec.CreatedISO8601 = time.Now().UTC().Format(time.RFC3339)
 	spec.Path = StreamPathPrefix + "/" + spec.ID
+	if err := validateConfirmations(s, spec.Confirmations); err != nil {
+		return nil, err
+	}
+	if err := validateSharedLogs(s, spec.ProvisionalNotifications); err != nil {
+		return nil, err
+	}
 	stream, err := newEventStream(s, spec, s.wsChannels)
 	if err != nil {
 		return nil, err
 	}
 	s.streams[stream.spec.ID] = stream
-	return s.storeStream(stream.spec)
+	if _, err := s.storeStream(stream.spec); err != nil {
+		return nil, err
+	}
+	return stream.spec.redacted(), nil
 }
 
 // UpdateStream updates an existing stream
@@ -328,7 +417,10 @@ func (s *subscriptionMGR) UpdateStream(ctx context.Context, id string, spec *Str
 	if err != nil {
 		return nil, err
 	}
-	return s.storeStream(updatedSpec)
+	if _, err := s.storeStream(updatedSpec); err != nil {
+		return nil, err
+	}
+	return updatedSpec.redacted(), nil
 }
 
 func (s *subscriptionMGR) storeStream(spec *StreamInfo) (*StreamInfo, error) {
@@ -365,6 +457,10 @@ func (s *subscriptionMGR) DeleteStream(ctx context.Context, id string) error {
 		return err
 	}
 	s.deleteCheckpoint(stream.spec.ID)
+	s.deleteInflightBatch(stream.spec.ID)
+	if _, err = s.purgeDeadLetters(stream.spec.ID); err != nil {
+		log.Errorf("%s: Failed to purge dead letters: %s", stream.spec.ID, err)
+	}
 	return nil
 }
 
@@ -455,6 +551,34 @@ func (s *subscriptionMGR) deleteCheckpoint(streamID string) {
 	_ = s.db.Delete(cpID)
 }
 
+func (s *subscriptionMGR) loadInflightBatch(streamID string) ([]*eventData, error) {
+	ibID := inflightIDPrefix + streamID
+	b, err := s.db.Get(ibID)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var events []*eventData
+	err = json.Unmarshal(b, &events)
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (s *subscriptionMGR) storeInflightBatch(streamID string, events []*eventData) error {
+	ibID := inflightIDPrefix + streamID
+	b, _ := json.Marshal(&events)
+	log.Tracef("Storing in-flight batch %s: %s", ibID, string(b))
+	return s.db.Put(ibID, b)
+}
+
+func (s *subscriptionMGR) deleteInflightBatch(streamID string) {
+	ibID := inflightIDPrefix + streamID
+	_ = s.db.Delete(ibID)
+}
+
 func (s *subscriptionMGR) Init() (err error) {
 	if s.db, err = kvstore.NewLDBKeyValueStore(s.conf.EventLevelDBPath); err != nil {
 		return errors.Errorf(errors.EventStreamsDBLoad, s.conf.EventLevelDBPath, err)
@@ -481,6 +605,7 @@ func (s *subscriptionMGR) recoverStreams() {
 			if err != nil {
 				log.Errorf("Failed to recover stream '%s': %s", streamInfo.ID, err)
 			} else {
+				stream.deadLetters = uint64(len(s.deadLetterKeys(streamInfo.ID)))
 				s.streams[streamInfo.ID] = stream
 			}
 		}
@@ -514,6 +639,7 @@ func (s *subscriptionMGR) recoverSubscriptions() {
 
 func (s *subscriptionMGR) Close(wait bool) {
 	log.Infof("Event stream subscription manager shutting down")
+	s.stopReplays()
 	for _, stream := range s.streams {
 		stream.stop(wait)
 	}
@@ -529,3 +655,8 @@ func (s *subscriptionMGR) Close(wait bool) {
 func (s *subscriptionMGR) confirmationManager() *blockConfirmationManager {
 	return s.bcm
 }
+
+// pushClient returns the client to use for eth_subscribe, or nil if we are polling
+func (s *subscriptionMGR) pushClient() eth.RPCClientAsync {
+	return s.pushRPC
+}
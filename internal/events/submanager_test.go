@@ -38,6 +38,8 @@ import (
 
 type mockWebSocket struct {
 	capturedNamespace string
+	capturedGroup     string
+	capturedStream    string
 	sender            chan interface{}
 	broadcast         chan interface{}
 	receiver          chan error
@@ -50,6 +52,14 @@ func (m *mockWebSocket) GetChannels(namespace string) (chan<- interface{}, chan<
 
 func (m *mockWebSocket) SendReply(message interface{}) {}
 
+func (m *mockWebSocket) SendToGroup(topic, group, stream string, batchNumber uint64, message interface{}, interrupt <-chan struct{}) error {
+	m.capturedNamespace = topic
+	m.capturedGroup = group
+	m.capturedStream = stream
+	m.sender <- message
+	return <-m.receiver
+}
+
 func tempdir(t *testing.T) string {
 	dir, _ := ioutil.TempDir("", "fly")
 	t.Logf("tmpdir/create: %s", dir)
@@ -453,3 +463,49 @@ func TestAddSubscriptionConcurrently(t *testing.T) {
 	wg.Wait()
 	sm.Close(true)
 }
+
+func TestConfirmationsOverrideValidation(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	rpc := &ethmocks.RPCClient{}
+	rpc.On("CallContext", mock.Anything, mock.Anything, mock.Anything).Return(fmt.Errorf("pop"))
+	rpc.On("CallContext", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(fmt.Errorf("pop"))
+	sm.rpc = rpc
+	defer sm.Close(true)
+	ctx := context.Background()
+
+	minusOne, zero, five, ten := -1, 0, 5, 10
+	_, err := sm.AddStream(ctx, &StreamInfo{Type: "websocket", Confirmations: &minusOne})
+	assert.Regexp("Invalid confirmations count -1", err)
+	_, err = sm.AddStream(ctx, &StreamInfo{Type: "websocket", Confirmations: &five})
+	assert.Regexp("block confirmations are not enabled", err)
+	stream, err := sm.AddStream(ctx, &StreamInfo{Type: "websocket", Confirmations: &zero})
+	assert.NoError(err)
+	_, err = sm.AddSubscriptionDirect(ctx, &SubscriptionCreateDTO{
+		Stream:        stream.ID,
+		Event:         &ethbinding.ABIElementMarshaling{Name: "ping"},
+		Confirmations: &five,
+	})
+	assert.Regexp("block confirmations are not enabled", err)
+
+	sm.bcm = &blockConfirmationManager{}
+	sub, err := sm.AddSubscriptionDirect(ctx, &SubscriptionCreateDTO{
+		Stream:        stream.ID,
+		Event:         &ethbinding.ABIElementMarshaling{Name: "ping"},
+		Confirmations: &five,
+	})
+	assert.NoError(err)
+	assert.Equal(5, *sm.subscriptions[sub.ID].lp.confirmations)
+	sm.bcm = nil
+
+	_, err = sm.UpdateStream(ctx, stream.ID, &StreamInfo{Confirmations: &ten})
+	assert.Regexp("block confirmations are not enabled", err)
+	updated, err := sm.UpdateStream(ctx, stream.ID, &StreamInfo{Confirmations: &zero, ProvisionalNotifications: true})
+	assert.NoError(err)
+	assert.Equal(0, *updated.Confirmations)
+	assert.True(updated.ProvisionalNotifications)
+	// A negative value on update removes the override
+	updated, err = sm.UpdateStream(ctx, stream.ID, &StreamInfo{Confirmations: &minusOne})
+	assert.NoError(err)
+	assert.Nil(updated.Confirmations)
+}
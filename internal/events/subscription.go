@@ -29,6 +29,17 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// SubscriptionKindEvents subscribes to the logs of a contract event (the default)
+	SubscriptionKindEvents = "events"
+	// SubscriptionKindBlocks subscribes to every block header
+	SubscriptionKindBlocks = "blocks"
+	// SubscriptionKindTransactions subscribes to every transaction, optionally only those to or from a set of addresses
+	SubscriptionKindTransactions = "transactions"
+	// SubscriptionKindReceipts subscribes to the receipts and errors replied to requests submitted to this gateway
+	SubscriptionKindReceipts = "receipts"
+)
+
 // persistedFilter is the part of the filter we record to storage
 type persistedFilter struct {
 	Addresses []ethbinding.Address `json:"address,omitempty"`
@@ -43,12 +54,17 @@ type ethFilter struct {
 }
 
 type SubscriptionCreateDTO struct {
-	Name      string                           `json:"name,omitempty"`
-	Stream    string                           `json:"stream,omitempty"`
-	Event     *ethbinding.ABIElementMarshaling `json:"event,omitempty"`
-	Methods   ethbinding.ABIMarshaling         `json:"methods,omitempty"` // an inline set of methods that might emit the event
-	FromBlock string                           `json:"fromBlock,omitempty"`
-	Address   *ethbinding.Address              `json:"address,omitempty"`
+	Name          string                           `json:"name,omitempty"`
+	Stream        string                           `json:"stream,omitempty"`
+	Kind          string                           `json:"kind,omitempty"` // events (the default), blocks or transactions
+	Event         *ethbinding.ABIElementMarshaling `json:"event,omitempty"`
+	Methods       ethbinding.ABIMarshaling         `json:"methods,omitempty"` // an inline set of methods that might emit the event, or be invoked by a transaction
+	FromBlock     string                           `json:"fromBlock,omitempty"`
+	Address       *ethbinding.Address              `json:"address,omitempty"`
+	Addresses     []ethbinding.Address             `json:"addresses,omitempty"`     // additional addresses to filter on - for transactions, those they must be to or from
+	Topics        [][]ethbinding.Hash              `json:"topics,omitempty"`        // for events without an event ABI, the topics to filter on
+	ReceiptFilter *ReceiptFilter                   `json:"receiptFilter,omitempty"` // for receipts, the fields the replies must match
+	Confirmations *int                             `json:"confirmations,omitempty"` // Overrides the confirmations required by the stream
 }
 
 type ABIRefOrInline struct {
@@ -59,22 +75,27 @@ type ABIRefOrInline struct {
 // SubscriptionInfo is the persisted data for the subscription
 type SubscriptionInfo struct {
 	messages.TimeSorted
-	ID           string                           `json:"id,omitempty"`
-	Path         string                           `json:"path"`
-	Summary      string                           `json:"-"`    // System generated name for the subscription
-	Name         string                           `json:"name"` // User provided name for the subscription, set to Summary if missing
-	Stream       string                           `json:"stream"`
-	Filter       persistedFilter                  `json:"filter"`
-	Event        *ethbinding.ABIElementMarshaling `json:"event"`
-	FromBlock    string                           `json:"fromBlock,omitempty"`
-	ABI          *ABIRefOrInline                  `json:"abi,omitempty"`
-	Synchronized bool                             `json:"synchronized"`
+	ID            string                           `json:"id,omitempty"`
+	Path          string                           `json:"path"`
+	Summary       string                           `json:"-"`    // System generated name for the subscription
+	Name          string                           `json:"name"` // User provided name for the subscription, set to Summary if missing
+	Stream        string                           `json:"stream"`
+	Kind          string                           `json:"kind,omitempty"`
+	Filter        persistedFilter                  `json:"filter"`
+	ReceiptFilter *ReceiptFilter                   `json:"receiptFilter,omitempty"`
+	Event         *ethbinding.ABIElementMarshaling `json:"event"`
+	FromBlock     string                           `json:"fromBlock,omitempty"`
+	ABI           *ABIRefOrInline                  `json:"abi,omitempty"`
+	Synchronized  bool                             `json:"synchronized"`
+	Confirmations *int                             `json:"confirmations,omitempty"`
 }
 
 // subscription is the runtime that manages the subscription
 type subscription struct {
 	info                *SubscriptionInfo
 	rpc                 eth.RPCClient
+	pushRPC             eth.RPCClientAsync
+	push                *logPush
 	cr                  contractregistry.ContractResolver
 	lp                  *logProcessor
 	logName             string
@@ -86,6 +107,16 @@ type subscription struct {
 	catchupBlock        *big.Int
 	catchupModeBlockGap int64
 	catchupModePageSize int64
+	catchupParallelism  int
+	catchupMaxPageSize  int64
+	catchupPageSize     int64    // the current page size in catchup mode, adapted to the results returned by the node
+	catchupStartBlock   *big.Int // the block catchup mode started from, for progress reporting
+	catchupHead         *big.Int // the head of the chain when catchup mode last checked the gap
+	sharedLogs          bool     // logs are read by the stream for all its event subscriptions, rather than by a filter
+	nextBlock           *big.Int // for subscriptions to blocks and transactions, the next block to read
+	sharedFetchBlock    *big.Int // for event subscriptions when logs are read by the stream, the next block to read
+	bcm                 *blockConfirmationManager
+	receipts            *receiptQueue // for subscriptions to receipts
 }
 
 func newSubscription(sm subscriptionManager, rpc eth.RPCClient, cr contractregistry.ContractResolver, addr *ethbinding.Address, i *SubscriptionInfo) (*subscription, error) {
@@ -93,32 +124,55 @@ func newSubscription(sm subscriptionManager, rpc eth.RPCClient, cr contractregis
 	if err != nil {
 		return nil, err
 	}
-	event, err := ethbind.API.ABIElementMarshalingToABIEvent(i.Event)
+	if i.watchesBlocks() {
+		return newBlockSubscription(sm, rpc, cr, stream, addr, i)
+	} else if i.Kind == SubscriptionKindReceipts {
+		return newReceiptSubscription(sm, stream, i)
+	} else if i.Kind != "" && i.Kind != SubscriptionKindEvents {
+		return nil, errors.Errorf(errors.EventStreamsSubscribeBadKind, i.Kind)
+	}
+	lp, signature, err := newSubscriptionLogProcessor(i, rpc, cr, stream, sm.confirmationManager())
 	if err != nil {
 		return nil, err
 	}
 	s := &subscription{
 		info:                i,
 		rpc:                 rpc,
+		pushRPC:             sm.pushClient(),
 		cr:                  cr,
-		lp:                  newLogProcessor(i.ID, event, stream, sm.confirmationManager()),
-		logName:             i.ID + ":" + ethbind.API.ABIEventSignature(event),
+		lp:                  lp,
+		logName:             i.ID + ":" + signature,
 		filterStale:         true,
 		catchupModeBlockGap: sm.config().CatchupModeBlockGap,
 		catchupModePageSize: sm.config().CatchupModePageSize,
+		catchupParallelism:  sm.config().CatchupModeParallelism,
+		catchupMaxPageSize:  sm.config().CatchupModeMaxPageSize,
+		sharedLogs:          sm.config().SharedLogFetching,
 	}
+	s.lp.confirmations = i.Confirmations
 	f := &i.Filter
 	addrStr := "*"
 	if addr != nil {
-		f.Addresses = []ethbinding.Address{*addr}
+		f.Addresses = append(f.Addresses, *addr)
 		addrStr = addr.String()
 	}
-	i.Summary = addrStr + ":" + ethbind.API.ABIEventSignature(event)
+	i.Summary = addrStr + ":" + signature
 	// If a name was not provided by the end user, set it to the system generated summary
 	if i.Name == "" {
 		log.Debugf("No name provided for subscription, using auto-generated summary:%s", i.Summary)
 		i.Name = i.Summary
 	}
+	if i.rawLogs() {
+		if err := validateRawLogs(i); err != nil {
+			return nil, err
+		}
+		log.Infof("Created subscription ID:%s name:%s to raw logs topics:%v", i.ID, i.Name, f.Topics)
+		return s, nil
+	}
+	event := lp.event
+	if len(f.Topics) > 0 {
+		return nil, errors.Errorf(errors.EventStreamsSubscribeEventAndTopics)
+	}
 	if event == nil || event.Name == "" {
 		return nil, errors.Errorf(errors.EventStreamsSubscribeNoEvent)
 	}
@@ -158,24 +212,41 @@ func restoreSubscription(sm subscriptionManager, rpc eth.RPCClient, cr contractr
 	if err != nil {
 		return nil, err
 	}
-	event, err := ethbind.API.ABIElementMarshalingToABIEvent(i.Event)
+	if i.watchesBlocks() {
+		return restoreBlockSubscription(sm, rpc, cr, stream, i), nil
+	} else if i.Kind == SubscriptionKindReceipts {
+		return restoreReceiptSubscription(sm, stream, i), nil
+	}
+	lp, signature, err := newSubscriptionLogProcessor(i, rpc, cr, stream, sm.confirmationManager())
 	if err != nil {
 		return nil, err
 	}
 	s := &subscription{
 		rpc:                 rpc,
+		pushRPC:             sm.pushClient(),
 		cr:                  cr,
 		info:                i,
-		lp:                  newLogProcessor(i.ID, event, stream, sm.confirmationManager()),
-		logName:             i.ID + ":" + ethbind.API.ABIEventSignature(event),
+		lp:                  lp,
+		logName:             i.ID + ":" + signature,
 		filterStale:         true,
 		catchupModeBlockGap: sm.config().CatchupModeBlockGap,
 		catchupModePageSize: sm.config().CatchupModePageSize,
+		catchupParallelism:  sm.config().CatchupModeParallelism,
+		catchupMaxPageSize:  sm.config().CatchupModeMaxPageSize,
+		sharedLogs:          sm.config().SharedLogFetching,
 	}
+	s.lp.confirmations = i.Confirmations
 	return s, nil
 }
 
 func (s *subscription) setInitialBlockHeight(ctx context.Context) (*big.Int, error) {
+	if s.receipts != nil {
+		// Receipts do not have a position on the chain, so the checkpoint is the time the last receipt
+		// delivered was received, and a new subscription starts from the receipts received from now on
+		i := big.NewInt(time.Now().UnixNano() / int64(time.Millisecond))
+		s.lp.initBlockHWM(i)
+		return i, nil
+	}
 	if s.info.FromBlock != "" && s.info.FromBlock != FromBlockLatest {
 		var i big.Int
 		if _, ok := i.SetString(s.info.FromBlock, 10); !ok {
@@ -222,6 +293,17 @@ func (s *subscription) createFilter(ctx context.Context, since *big.Int) error {
 }
 
 func (s *subscription) restartFilter(ctx context.Context, checkpoint *big.Int) error {
+	if s.info.watchesBlocks() {
+		// Blocks are read page by page, so there is no separate catchup mode
+		s.startBlockWatch(ctx, checkpoint)
+		return nil
+	} else if s.receipts != nil {
+		return s.startReceipts(ctx, checkpoint)
+	} else if s.sharedLogs {
+		s.startSharedLogFetch(ctx, checkpoint)
+		return nil
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
@@ -241,11 +323,18 @@ func (s *subscription) restartFilter(ctx context.Context, checkpoint *big.Int) e
 	blockGap := new(big.Int).Sub(blockNumber.ToInt(), since).Int64()
 	log.Debugf("%s: new filter. Head=%s Position=%s Gap=%d (catchup threshold: %d)", s.logName, blockNumber.ToInt().String(), since.String(), blockGap, s.catchupModeBlockGap)
 	if s.catchupModeBlockGap > 0 && blockGap > s.catchupModeBlockGap {
+		if s.catchupBlock == nil {
+			s.catchupStartBlock = since
+		}
 		s.catchupBlock = since // note if we were already in catchup, this does not change anything
+		s.catchupHead = blockNumber.ToInt()
 		s.info.Synchronized = false
 		return nil
 	}
 
+	if s.pushRPC != nil {
+		return s.subscribeLogs(ctx, since)
+	}
 	return s.createFilter(ctx, since)
 }
 
@@ -253,83 +342,24 @@ func (s *subscription) inCatchupMode() bool {
 	return s.catchupBlock != nil
 }
 
-// getEventTimestamp adds the block timestamp to the log entry.
-// It uses a lru cache (blocknumber, timestamp) in the eventstream to determine the timestamp
-// and falls back to querying the node if we don't have timestamp in the cache (at which point it gets
-// added to the cache)
-func (s *subscription) getEventTimestamp(ctx context.Context, l *logEntry) {
-	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-	defer cancel()
-	// the key in the cache is the block number represented as a string
-	blockNumber := l.BlockNumber.String()
-	if ts, ok := s.lp.stream.blockTimestampCache.Get(blockNumber); ok {
-		// we found the timestamp for the block in our local cache, assert it's type and return, no need to query the chain
-		l.Timestamp = ts.(uint64)
-		return
-	}
-	// we didn't find the timestamp in our cache, query the node for the block header where we can find the timestamp
-	rpcMethod := "eth_getBlockByNumber"
-
-	var hdr ethbinding.Header
-	// 2nd parameter (false) indicates it is sufficient to retrieve only hashes of tx objects
-	if err := s.rpc.CallContext(ctx, &hdr, rpcMethod, blockNumber, false); err != nil {
-		log.Errorf("Unable to retrieve block[%s] timestamp: %s", blockNumber, err)
-		l.Timestamp = 0 // set to 0, we were not able to retrieve the timestamp.
-		return
-	}
-	l.Timestamp = hdr.Time
-	s.lp.stream.blockTimestampCache.Add(blockNumber, l.Timestamp)
-}
-
-func (s *subscription) getTransactionInputs(ctx context.Context, l *logEntry) {
-	abi, err := loadABI(s.cr, s.info.ABI)
-	if err != nil || abi == nil {
-		return
-	}
-	info, err := eth.GetTransactionInfo(ctx, s.rpc, l.TransactionHash.String())
-	if err != nil {
-		log.Infof("%s: error querying transaction info", s.logName)
-		return
-	}
+// decodeTransactionInputs returns the signer of a transaction, and the method and arguments it invoked if they match the ABI
+func decodeTransactionInputs(abi *ethbinding.RuntimeABI, logName string, info *eth.TxnInfo) (signer, methodName string, args map[string]interface{}) {
 	if info.From != nil {
-		l.InputSigner = info.From.String()
+		signer = info.From.String()
+	}
+	if info.Input == nil {
+		return signer, "", nil
 	}
 	method, err := abi.MethodById(*info.Input)
 	if err != nil {
-		log.Infof("%s: could not find matching method", s.logName)
-		return
+		log.Infof("%s: could not find matching method", logName)
+		return signer, "", nil
 	}
-	args, err := eth.DecodeInputs(method, info.Input)
-	if err == nil {
-		l.InputMethod = method.Name
-		l.InputArgs = args
-	}
-}
-
-func (s *subscription) processCatchupBlocks(ctx context.Context) error {
-	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-	defer cancel()
-	var logs []*logEntry
-
-	f := &ethFilter{}
-	f.persistedFilter = s.info.Filter
-	f.FromBlock.ToInt().Set(s.catchupBlock)
-	endBlock := new(big.Int).Add(s.catchupBlock, big.NewInt(s.catchupModePageSize-1))
-	f.ToBlock = "0x" + endBlock.Text(16)
-
-	log.Infof("%s: catchup mode. Blocks %d -> %d", s.logName, s.catchupBlock.Int64(), endBlock.Int64())
-	if err := s.rpc.CallContext(ctx, &logs, "eth_getLogs", f); err != nil {
-		return errors.Errorf(errors.RPCCallReturnedError, "eth_getLogs", err)
-	}
-	if len(logs) == 0 {
-		// We only want to catch up once - so see if we can update our HWM based on the fact
-		// we know these historical blocks are empty.
-		s.lp.markNoEvents(endBlock)
-	} else {
-		s.processLogs(ctx, "eth_getLogs", logs)
+	args, err = eth.DecodeInputs(method, info.Input)
+	if err != nil {
+		return signer, "", nil
 	}
-	s.catchupBlock = endBlock.Add(endBlock, big.NewInt(1))
-	return nil
+	return signer, method.Name, args
 }
 
 func (s *subscription) processLogs(ctx context.Context, rpcMethod string, logs []*logEntry) {
@@ -337,13 +367,8 @@ func (s *subscription) processLogs(ctx context.Context, rpcMethod string, logs [
 		// Only log if we received at least one event
 		log.Debugf("%s: received %d events (%s)", s.logName, len(logs), rpcMethod)
 	}
+	s.logEnricher().enrichLogs(ctx, logs)
 	for idx, logEntry := range logs {
-		if s.lp.stream.spec.Timestamps {
-			s.getEventTimestamp(context.Background(), logEntry)
-		}
-		if s.lp.stream.spec.Inputs {
-			s.getTransactionInputs(ctx, logEntry)
-		}
 		if err := s.lp.processLogEntry(s.logName, logEntry, idx); err != nil {
 			log.Errorf("Failed to process event: %s", err)
 		}
@@ -351,9 +376,23 @@ func (s *subscription) processLogs(ctx context.Context, rpcMethod string, logs [
 }
 
 func (s *subscription) processNewEvents(ctx context.Context) error {
+	if s.sharedFetchBlock != nil {
+		// Logs are read by the stream, for all its subscriptions
+		return nil
+	}
 	if s.catchupBlock != nil {
 		return s.processCatchupBlocks(ctx)
 	}
+	if s.push != nil {
+		return s.processPushedLogs(ctx)
+	}
+	if s.nextBlock != nil {
+		return s.processNewBlocks(ctx)
+	}
+	if s.receipts != nil {
+		s.processNewReceipts(ctx)
+		return nil
+	}
 
 	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
@@ -378,6 +417,9 @@ func (s *subscription) unsubscribe(ctx context.Context, deleting bool) (err erro
 	log.Infof("%s: Unsubscribing existing filter (deleting=%t)", s.logName, deleting)
 	s.deleting = deleting
 	s.resetRequested = false
+	if deleting && s.receipts != nil {
+		s.receipts.close()
+	}
 	s.markFilterStale(ctx, true)
 	return err
 }
@@ -397,12 +439,22 @@ func (s *subscription) markFilterStale(ctx context.Context, newFilterStale bool)
 	log.Debugf("%s: Marking filter stale=%t, current sub filter stale=%t", s.logName, newFilterStale, s.filterStale)
 	// If unsubscribe is called multiple times, we might not have a filter
 	if newFilterStale && !s.filterStale {
-		var retval bool
-		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-		defer cancel()
-		err := s.rpc.CallContext(ctx, &retval, "eth_uninstallFilter", s.filterID)
-		// We treat error as informational here - the filter might already not be valid (if the node restarted)
-		log.Infof("%s: Uninstalled filter. ok=%t (%s)", s.logName, retval, err)
+		if s.push != nil {
+			s.push.close()
+			s.push = nil
+			log.Infof("%s: Unsubscribed eth_subscribe subscription", s.logName)
+		} else if s.nextBlock != nil {
+			s.stopBlockWatch()
+		} else if s.sharedFetchBlock != nil {
+			s.sharedFetchBlock = nil
+		} else if s.receipts == nil {
+			var retval bool
+			ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			defer cancel()
+			err := s.rpc.CallContext(ctx, &retval, "eth_uninstallFilter", s.filterID)
+			// We treat error as informational here - the filter might already not be valid (if the node restarted)
+			log.Infof("%s: Uninstalled filter. ok=%t (%s)", s.logName, retval, err)
+		}
 		// Clear any catchup mode state. We will restart from the last checkpoint
 		s.catchupBlock = nil
 		s.info.Synchronized = false
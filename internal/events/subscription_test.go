@@ -26,6 +26,7 @@ import (
 	"github.com/hyperledger/firefly-ethconnect/internal/ethbind"
 	"github.com/hyperledger/firefly-ethconnect/internal/kvstore"
 	"github.com/hyperledger/firefly-ethconnect/internal/messages"
+	"github.com/hyperledger/firefly-ethconnect/internal/receipts"
 	"github.com/hyperledger/firefly-ethconnect/mocks/contractregistrymocks"
 	"github.com/hyperledger/firefly-ethconnect/mocks/ethmocks"
 	ethbinding "github.com/kaleido-io/ethbinding/pkg"
@@ -39,6 +40,7 @@ type mockSubMgr struct {
 	subscription  *subscription
 	err           error
 	subscriptions []*subscription
+	receipts      receipts.ReceiptStorePersistence
 }
 
 func (m *mockSubMgr) config() *SubscriptionManagerConf {
@@ -61,10 +63,28 @@ func (m *mockSubMgr) loadCheckpoint(string) (map[string]*big.Int, error) { retur
 
 func (m *mockSubMgr) storeCheckpoint(string, map[string]*big.Int) error { return nil }
 
+func (m *mockSubMgr) loadInflightBatch(string) ([]*eventData, error) { return nil, nil }
+
+func (m *mockSubMgr) storeInflightBatch(string, []*eventData) error { return nil }
+
+func (m *mockSubMgr) deleteInflightBatch(string) {}
+
+func (m *mockSubMgr) storeStream(spec *StreamInfo) (*StreamInfo, error) { return spec, nil }
+
+func (m *mockSubMgr) storeDeadLetter(*DeadLetter) error { return nil }
+
 func (m *mockSubMgr) confirmationManager() *blockConfirmationManager {
 	return nil
 }
 
+func (m *mockSubMgr) pushClient() eth.RPCClientAsync {
+	return nil
+}
+
+func (m *mockSubMgr) receiptStore() receipts.ReceiptStorePersistence {
+	return m.receipts
+}
+
 func newTestStream() *eventStream {
 	a, _ := newEventStream(newTestSubscriptionManager(), &StreamInfo{
 		ID:   "123",
@@ -321,7 +341,8 @@ func TestEventTimestampFail(t *testing.T) {
 		rpc:  rpc,
 	}
 	l := &logEntry{Timestamp: 100} // set it to a fake value, should get overwritten
-	s.getEventTimestamp(context.Background(), l)
+	stream.spec.Timestamps = true
+	s.logEnricher().enrichLogs(context.Background(), []*logEntry{l})
 	assert.Equal(l.Timestamp, uint64(0))
 	rpc.AssertExpectations(t)
 }
@@ -357,13 +378,14 @@ func TestGetTransactionInputsNoABI(t *testing.T) {
 	cr := &contractregistrymocks.ContractStore{}
 
 	s := &subscription{
+		lp:   &logProcessor{stream: &eventStream{spec: &StreamInfo{Inputs: true}}},
 		info: &SubscriptionInfo{},
 		rpc:  rpc,
 		cr:   cr,
 	}
 	l := logEntry{}
 	lCopy := l
-	s.getTransactionInputs(context.Background(), &l)
+	s.logEnricher().enrichLogs(context.Background(), []*logEntry{&l})
 
 	result, err := json.Marshal(l)
 	assert.NoError(err)
@@ -382,6 +404,7 @@ func TestGetTransactionInputsLoadABIFail(t *testing.T) {
 	}, false).Return(nil, fmt.Errorf("pop"))
 
 	s := &subscription{
+		lp: &logProcessor{stream: &eventStream{spec: &StreamInfo{Inputs: true}}},
 		info: &SubscriptionInfo{
 			ABI: &ABIRefOrInline{
 				ABILocation: contractregistry.ABILocation{
@@ -395,7 +418,7 @@ func TestGetTransactionInputsLoadABIFail(t *testing.T) {
 	}
 	l := logEntry{}
 	lCopy := l
-	s.getTransactionInputs(context.Background(), &l)
+	s.logEnricher().enrichLogs(context.Background(), []*logEntry{&l})
 
 	result, err := json.Marshal(l)
 	assert.NoError(err)
@@ -414,6 +437,7 @@ func TestGetTransactionInputsMissingABI(t *testing.T) {
 	}, false).Return(nil, nil)
 
 	s := &subscription{
+		lp: &logProcessor{stream: &eventStream{spec: &StreamInfo{Inputs: true}}},
 		info: &SubscriptionInfo{
 			ABI: &ABIRefOrInline{
 				ABILocation: contractregistry.ABILocation{
@@ -427,7 +451,7 @@ func TestGetTransactionInputsMissingABI(t *testing.T) {
 	}
 	l := logEntry{}
 	lCopy := l
-	s.getTransactionInputs(context.Background(), &l)
+	s.logEnricher().enrichLogs(context.Background(), []*logEntry{&l})
 
 	result, err := json.Marshal(l)
 	assert.NoError(err)
@@ -450,6 +474,7 @@ func TestGetTransactionInputsTxnInfoFail(t *testing.T) {
 	}, false).Return(&deployMsg, nil)
 
 	s := &subscription{
+		lp: &logProcessor{stream: &eventStream{spec: &StreamInfo{Inputs: true}}},
 		info: &SubscriptionInfo{
 			ABI: &ABIRefOrInline{
 				ABILocation: contractregistry.ABILocation{
@@ -469,7 +494,7 @@ func TestGetTransactionInputsTxnInfoFail(t *testing.T) {
 	rpc.On("CallContext", mock.Anything, mock.Anything, "eth_getTransactionByHash", "0x0000000000000000000000000000000000000000000000000000000000000001").
 		Return(fmt.Errorf("pop"))
 
-	s.getTransactionInputs(context.Background(), &l)
+	s.logEnricher().enrichLogs(context.Background(), []*logEntry{&l})
 
 	result, err := json.Marshal(l)
 	assert.NoError(err)
@@ -492,6 +517,7 @@ func TestGetTransactionInputsBadMethod(t *testing.T) {
 	}, false).Return(&deployMsg, nil)
 
 	s := &subscription{
+		lp: &logProcessor{stream: &eventStream{spec: &StreamInfo{Inputs: true}}},
 		info: &SubscriptionInfo{
 			ABI: &ABIRefOrInline{
 				ABILocation: contractregistry.ABILocation{
@@ -520,7 +546,7 @@ func TestGetTransactionInputsBadMethod(t *testing.T) {
 		}).
 		Return(nil)
 
-	s.getTransactionInputs(context.Background(), &l)
+	s.logEnricher().enrichLogs(context.Background(), []*logEntry{&l})
 
 	result, err := json.Marshal(l)
 	assert.NoError(err)
@@ -562,6 +588,7 @@ func TestGetTransactionInputsSuccess(t *testing.T) {
 	}, false).Return(deployMsg, nil)
 
 	s := &subscription{
+		lp: &logProcessor{stream: &eventStream{spec: &StreamInfo{Inputs: true}}},
 		info: &SubscriptionInfo{
 			ABI: &ABIRefOrInline{
 				ABILocation: contractregistry.ABILocation{
@@ -587,7 +614,7 @@ func TestGetTransactionInputsSuccess(t *testing.T) {
 		}).
 		Return(nil)
 
-	s.getTransactionInputs(context.Background(), &l)
+	s.logEnricher().enrichLogs(context.Background(), []*logEntry{&l})
 
 	result, err := json.Marshal(l)
 	assert.NoError(err)
@@ -610,6 +637,7 @@ func TestGetTransactionInputsSuccessInline(t *testing.T) {
 	expectedArgs := map[string]interface{}{"arg1": "1"}
 
 	s := &subscription{
+		lp: &logProcessor{stream: &eventStream{spec: &StreamInfo{Inputs: true}}},
 		info: &SubscriptionInfo{
 			ABI: &ABIRefOrInline{
 				Inline: ethbinding.ABIMarshaling{
@@ -643,7 +671,7 @@ func TestGetTransactionInputsSuccessInline(t *testing.T) {
 		}).
 		Return(nil)
 
-	s.getTransactionInputs(context.Background(), &l)
+	s.logEnricher().enrichLogs(context.Background(), []*logEntry{&l})
 
 	result, err := json.Marshal(l)
 	assert.NoError(err)
@@ -0,0 +1,166 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/errors"
+)
+
+const (
+	// WebhookFormatArray posts each batch as a JSON array of events (the default)
+	WebhookFormatArray = "array"
+	// WebhookFormatEvent posts each event in its own request, as a JSON object
+	WebhookFormatEvent = "event"
+	// WebhookFormatCloudEvents posts each event in its own request, as a CloudEvents 1.0 structured mode JSON envelope
+	WebhookFormatCloudEvents = "cloudevents"
+	// WebhookFormatTemplate posts each event in its own request, with a body generated by the Go template of the stream
+	WebhookFormatTemplate = "template"
+
+	cloudEventsSpecVersion = "1.0"
+	cloudEventsType        = "io.ethconnect.event"
+	cloudEventsContentType = "application/cloudevents+json"
+)
+
+// webhookPayload is the body of a single request of a webhook action
+type webhookPayload struct {
+	body           []byte
+	contentType    string
+	idempotencyKey string
+}
+
+// cloudEvent is the CloudEvents 1.0 envelope of an event
+type cloudEvent struct {
+	SpecVersion     string     `json:"specversion"`
+	ID              string     `json:"id"`
+	Source          string     `json:"source"`
+	Type            string     `json:"type"`
+	Subject         string     `json:"subject,omitempty"`
+	Time            string     `json:"time,omitempty"`
+	DataContentType string     `json:"datacontenttype"`
+	Data            *eventData `json:"data"`
+}
+
+var webhookTemplateFuncs = template.FuncMap{
+	// json allows a value to be embedded in a JSON body, with quoting and escaping
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func parseWebhookTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, errors.Errorf(errors.EventStreamsWebhookBadTemplate, "template is required")
+	}
+	tmpl, err := template.New("webhook").Funcs(webhookTemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, errors.Errorf(errors.EventStreamsWebhookBadTemplate, err)
+	}
+	return tmpl, nil
+}
+
+func (spec *webhookActionInfo) validateFormat() (*template.Template, error) {
+	spec.Format = strings.ToLower(spec.Format)
+	switch spec.Format {
+	case "", WebhookFormatArray, WebhookFormatEvent, WebhookFormatCloudEvents:
+		return nil, nil
+	case WebhookFormatTemplate:
+		return parseWebhookTemplate(spec.Template)
+	default:
+		return nil, errors.Errorf(errors.EventStreamsWebhookBadFormat, spec.Format)
+	}
+}
+
+// payloads builds the requests for a batch. For all formats other than an array, each event is posted
+// in its own request. A failure of any request fails the batch, so the whole batch is retried and
+// receivers should use the Idempotency-Key header to discard events they have already processed.
+func (w *webhookAction) payloads(events []*eventData) ([]*webhookPayload, error) {
+	switch w.spec.Format {
+	case WebhookFormatEvent, WebhookFormatCloudEvents, WebhookFormatTemplate:
+		payloads := make([]*webhookPayload, len(events))
+		for i, event := range events {
+			p, err := w.eventPayload(event)
+			if err != nil {
+				return nil, err
+			}
+			payloads[i] = p
+		}
+		return payloads, nil
+	default:
+		body, err := json.Marshal(&events)
+		if err != nil {
+			return nil, err
+		}
+		return []*webhookPayload{{body: body, contentType: "application/json", idempotencyKey: batchID(events)}}, nil
+	}
+}
+
+func (w *webhookAction) eventPayload(event *eventData) (p *webhookPayload, err error) {
+	p = &webhookPayload{
+		contentType:    "application/json",
+		idempotencyKey: batchID([]*eventData{event}),
+	}
+	switch w.spec.Format {
+	case WebhookFormatCloudEvents:
+		p.contentType = cloudEventsContentType
+		p.body, err = json.Marshal(w.cloudEvent(event))
+	case WebhookFormatTemplate:
+		p.body, err = w.applyTemplate(event)
+	default:
+		p.body, err = json.Marshal(event)
+	}
+	return p, err
+}
+
+func (w *webhookAction) cloudEvent(event *eventData) *cloudEvent {
+	ce := &cloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              event.ID,
+		Source:          StreamPathPrefix + "/" + w.es.spec.ID,
+		Type:            cloudEventsType,
+		Subject:         event.SubID,
+		DataContentType: "application/json",
+		Data:            event,
+	}
+	if event.Status != "" && event.Status != EventStatusConfirmed {
+		ce.Type += "." + event.Status
+	}
+	if secs, err := strconv.ParseInt(event.Timestamp, 10, 64); err == nil {
+		ce.Time = time.Unix(secs, 0).UTC().Format(time.RFC3339)
+	}
+	return ce
+}
+
+// applyTemplate executes the template against the JSON representation of the event,
+// so the template refers to fields by the names a receiver of the default format sees.
+// The template is parsed when the action is created or the stream updated, and is read-only
+// while batches are in flight.
+func (w *webhookAction) applyTemplate(event *eventData) ([]byte, error) {
+	var fields map[string]interface{}
+	b, _ := json.Marshal(event)
+	_ = json.Unmarshal(b, &fields)
+	buf := new(bytes.Buffer)
+	if err := w.tmpl.Execute(buf, fields); err != nil {
+		return nil, errors.Errorf(errors.EventStreamsWebhookTemplateFailed, event.ID, err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,223 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testWebhookRequest struct {
+	contentType    string
+	idempotencyKey string
+	body           []byte
+}
+
+func newTestWebhookFormatServer() (*httptest.Server, *[]*testWebhookRequest) {
+	requests := []*testWebhookRequest{}
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		requests = append(requests, &testWebhookRequest{
+			contentType:    req.Header.Get("Content-Type"),
+			idempotencyKey: req.Header.Get("Idempotency-Key"),
+			body:           body,
+		})
+		res.WriteHeader(200)
+	}))
+	return svr, &requests
+}
+
+func testFormatEvents() []*eventData {
+	e1 := testEvent("sub1")
+	e1.ID = "es1/100/0/0"
+	e1.Data = map[string]interface{}{"message": `say "hello"`}
+	e1.Timestamp = "1600000000"
+	e2 := testEvent("sub1")
+	e2.ID = "es1/100/0/1"
+	e2.Data = map[string]interface{}{"message": "goodbye"}
+	e2.Status = EventStatusRemoved
+	return []*eventData{e1, e2}
+}
+
+func TestWebhookFormatArray(t *testing.T) {
+	assert := assert.New(t)
+	svr, requests := newTestWebhookFormatServer()
+	defer svr.Close()
+
+	_, w := newTestWebhookAction(t, &webhookActionInfo{URL: svr.URL, Format: "ARRAY"})
+	assert.Equal(WebhookFormatArray, w.spec.Format)
+	events := testFormatEvents()
+	err := w.attemptBatch(1, 1, events)
+	assert.NoError(err)
+	assert.Len(*requests, 1)
+	var posted []*eventData
+	err = json.Unmarshal((*requests)[0].body, &posted)
+	assert.NoError(err)
+	assert.Len(posted, 2)
+	assert.Equal("application/json", (*requests)[0].contentType)
+	assert.Equal(batchID(events), (*requests)[0].idempotencyKey)
+}
+
+func TestWebhookFormatEvent(t *testing.T) {
+	assert := assert.New(t)
+	svr, requests := newTestWebhookFormatServer()
+	defer svr.Close()
+
+	_, w := newTestWebhookAction(t, &webhookActionInfo{URL: svr.URL, Format: WebhookFormatEvent})
+	events := testFormatEvents()
+	err := w.attemptBatch(1, 1, events)
+	assert.NoError(err)
+	assert.Len(*requests, 2)
+	for i, req := range *requests {
+		var posted eventData
+		err = json.Unmarshal(req.body, &posted)
+		assert.NoError(err)
+		assert.Equal(events[i].ID, posted.ID)
+		assert.Equal("application/json", req.contentType)
+		assert.Equal(batchID(events[i:i+1]), req.idempotencyKey)
+	}
+}
+
+func TestWebhookFormatCloudEvents(t *testing.T) {
+	assert := assert.New(t)
+	svr, requests := newTestWebhookFormatServer()
+	defer svr.Close()
+
+	_, w := newTestWebhookAction(t, &webhookActionInfo{URL: svr.URL, Format: WebhookFormatCloudEvents})
+	err := w.attemptBatch(1, 1, testFormatEvents())
+	assert.NoError(err)
+	assert.Len(*requests, 2)
+
+	var ce map[string]interface{}
+	err = json.Unmarshal((*requests)[0].body, &ce)
+	assert.NoError(err)
+	assert.Equal(cloudEventsContentType, (*requests)[0].contentType)
+	assert.Equal("1.0", ce["specversion"])
+	assert.Equal("es1/100/0/0", ce["id"])
+	assert.Equal(StreamPathPrefix+"/"+w.es.spec.ID, ce["source"])
+	assert.Equal("io.ethconnect.event", ce["type"])
+	assert.Equal("sub1", ce["subject"])
+	assert.Equal("2020-09-13T12:26:40Z", ce["time"])
+	assert.Equal("application/json", ce["datacontenttype"])
+	assert.Equal(`say "hello"`, ce["data"].(map[string]interface{})["data"].(map[string]interface{})["message"])
+
+	var removed map[string]interface{}
+	err = json.Unmarshal((*requests)[1].body, &removed)
+	assert.NoError(err)
+	assert.Equal("io.ethconnect.event.removed", removed["type"])
+	assert.Nil(removed["time"])
+}
+
+func TestWebhookFormatTemplate(t *testing.T) {
+	assert := assert.New(t)
+	svr, requests := newTestWebhookFormatServer()
+	defer svr.Close()
+
+	sm := newTestSubscriptionManager()
+	ctx := context.Background()
+	spec, err := sm.AddStream(ctx, &StreamInfo{
+		Type: "webhook",
+		Webhook: &webhookActionInfo{
+			URL:      svr.URL,
+			Format:   WebhookFormatTemplate,
+			Template: `{"text":{{json .data.message}},"sub":"{{.subId}}"}`,
+			Headers:  map[string]string{"Content-Type": "application/vnd.test+json"},
+		},
+	})
+	assert.NoError(err)
+	es := sm.streams[spec.ID]
+	defer es.stop(false)
+	w := es.action.(*webhookAction)
+
+	err = w.attemptBatch(1, 1, testFormatEvents())
+	assert.NoError(err)
+	assert.Len(*requests, 2)
+	assert.Equal(`{"text":"say \"hello\"","sub":"sub1"}`, string((*requests)[0].body))
+	assert.Equal(`{"text":"goodbye","sub":"sub1"}`, string((*requests)[1].body))
+	assert.Equal("application/vnd.test+json", (*requests)[0].contentType)
+
+	// A change to the template is picked up on update
+	_, err = sm.UpdateStream(ctx, spec.ID, &StreamInfo{Webhook: &webhookActionInfo{Template: `{{.id}}`}})
+	assert.NoError(err)
+	err = w.attemptBatch(2, 1, testFormatEvents()[0:1])
+	assert.NoError(err)
+	assert.Equal("es1/100/0/0", string((*requests)[2].body))
+
+	_, err = sm.UpdateStream(ctx, spec.ID, &StreamInfo{Webhook: &webhookActionInfo{Template: `{{template "missing"}}`}})
+	assert.NoError(err)
+	err = w.attemptBatch(3, 1, testFormatEvents()[0:1])
+	assert.Regexp("FFEC100256.*es1/100/0/0", err)
+	assert.Len(*requests, 3)
+
+	// An invalid template is rejected, leaving the previous template in place
+	_, err = sm.UpdateStream(ctx, spec.ID, &StreamInfo{Webhook: &webhookActionInfo{Template: `{{`}})
+	assert.Regexp("FFEC100255", err)
+	assert.Equal(`{{template "missing"}}`, w.spec.Template)
+}
+
+func TestWebhookFormatValidation(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	ctx := context.Background()
+
+	_, err := sm.AddStream(ctx, &StreamInfo{
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: "http://test.invalid", Format: "xml"},
+	})
+	assert.Regexp("FFEC100254", err)
+
+	_, err = sm.AddStream(ctx, &StreamInfo{
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: "http://test.invalid", Format: WebhookFormatTemplate},
+	})
+	assert.Regexp("FFEC100255.*template is required", err)
+
+	_, err = sm.AddStream(ctx, &StreamInfo{
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: "http://test.invalid", Format: WebhookFormatTemplate, Template: "{{"},
+	})
+	assert.Regexp("FFEC100255", err)
+
+	spec, err := sm.AddStream(ctx, &StreamInfo{
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: "http://test.invalid"},
+	})
+	assert.NoError(err)
+	defer sm.streams[spec.ID].stop(false)
+
+	_, err = sm.UpdateStream(ctx, spec.ID, &StreamInfo{
+		Webhook: &webhookActionInfo{Format: WebhookFormatTemplate},
+	})
+	assert.Regexp("FFEC100255", err)
+
+	spec, err = sm.UpdateStream(ctx, spec.ID, &StreamInfo{
+		Webhook: &webhookActionInfo{Format: WebhookFormatTemplate, Template: "{{.id}}"},
+	})
+	assert.NoError(err)
+	assert.Equal(WebhookFormatTemplate, spec.Webhook.Format)
+	assert.Equal("{{.id}}", spec.Webhook.Template)
+
+	spec, err = sm.UpdateStream(ctx, spec.ID, &StreamInfo{
+		Webhook: &webhookActionInfo{Format: WebhookFormatCloudEvents},
+	})
+	assert.NoError(err)
+	assert.Equal(WebhookFormatCloudEvents, spec.Webhook.Format)
+}
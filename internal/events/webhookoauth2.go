@@ -0,0 +1,136 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// oauth2ExpiryMargin is how long before expiry we refresh a token, so it does not expire in flight
+	oauth2ExpiryMargin = 30 * time.Second
+)
+
+// webhookOAuth2 configures the OAuth2 client credentials grant, to obtain a bearer token for each delivery
+type webhookOAuth2 struct {
+	TokenURL     string   `json:"tokenUrl"`
+	ClientID     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret,omitempty"`
+	Scopes       []string `json:"scopes,omitempty"`
+}
+
+// oauth2Token is a token cached by the webhook action, along with the configuration used to obtain it
+type oauth2Token struct {
+	conf        webhookOAuth2
+	accessToken string
+	expiry      time.Time // zero if the token endpoint did not give an expiry
+}
+
+type oauth2TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func (o *webhookOAuth2) validate() error {
+	if o.TokenURL == "" || o.ClientID == "" {
+		return errors.Errorf(errors.EventStreamsWebhookOAuth2Config)
+	}
+	if _, err := url.Parse(o.TokenURL); err != nil {
+		return errors.Errorf(errors.EventStreamsWebhookInvalidURL)
+	}
+	if o.ClientSecret == RedactedSecret {
+		return errors.Errorf(errors.EventStreamsWebhookRedactedSecret, RedactedSecret)
+	}
+	return nil
+}
+
+func (t *oauth2Token) valid(conf *webhookOAuth2) bool {
+	if t == nil || !reflect.DeepEqual(&t.conf, conf) {
+		return false
+	}
+	return t.expiry.IsZero() || time.Now().Add(oauth2ExpiryMargin).Before(t.expiry)
+}
+
+// accessToken returns the cached token, or requests a new one if it has expired or the configuration changed
+func (w *webhookAction) accessToken(client *http.Client) (string, error) {
+	w.tokenMux.Lock()
+	defer w.tokenMux.Unlock()
+	conf := w.spec.OAuth2
+	if w.token.valid(conf) {
+		return w.token.accessToken, nil
+	}
+
+	esID := w.es.spec.ID
+	u, err := url.Parse(conf.TokenURL)
+	if err == nil {
+		_, err = w.checkURL(u)
+	}
+	if err != nil {
+		return "", errors.Errorf(errors.EventStreamsWebhookOAuth2TokenFailed, conf.TokenURL, err)
+	}
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(conf.Scopes) > 0 {
+		form.Set("scope", strings.Join(conf.Scopes, " "))
+	}
+	req, _ := http.NewRequest("POST", u.String(), strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(conf.ClientID), url.QueryEscape(conf.ClientSecret))
+
+	log.Infof("%s: POST --> %s (OAuth2 token)", esID, u.String())
+	res, err := client.Do(req)
+	if err != nil {
+		return "", errors.Errorf(errors.EventStreamsWebhookOAuth2TokenFailed, conf.TokenURL, err)
+	}
+	defer res.Body.Close()
+	log.Infof("%s: POST <-- %s [%d] (OAuth2 token)", esID, u.String(), res.StatusCode)
+	body, _ := ioutil.ReadAll(res.Body)
+	var tokenRes oauth2TokenResponse
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		err = fmt.Errorf("[%d] %s", res.StatusCode, body)
+	} else if err = json.Unmarshal(body, &tokenRes); err == nil && tokenRes.AccessToken == "" {
+		err = fmt.Errorf("no access_token in response")
+	}
+	if err != nil {
+		return "", errors.Errorf(errors.EventStreamsWebhookOAuth2TokenFailed, conf.TokenURL, err)
+	}
+
+	w.token = &oauth2Token{
+		conf:        *conf,
+		accessToken: tokenRes.AccessToken,
+	}
+	if tokenRes.ExpiresIn > 0 {
+		w.token.expiry = time.Now().Add(time.Duration(tokenRes.ExpiresIn) * time.Second)
+	}
+	return w.token.accessToken, nil
+}
+
+func (w *webhookAction) clearToken() {
+	w.tokenMux.Lock()
+	w.token = nil
+	w.tokenMux.Unlock()
+}
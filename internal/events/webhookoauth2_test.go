@@ -0,0 +1,310 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/firefly-ethconnect/internal/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestWebhookAction(t *testing.T, spec *webhookActionInfo) (*subscriptionMGR, *webhookAction) {
+	sm := newTestSubscriptionManager()
+	stream, err := sm.AddStream(context.Background(), &StreamInfo{
+		Type:    "webhook",
+		Webhook: spec,
+	})
+	assert.NoError(t, err)
+	es := sm.streams[stream.ID]
+	es.stop(false)
+	return sm, es.action.(*webhookAction)
+}
+
+func TestWebhookOAuth2(t *testing.T) {
+	assert := assert.New(t)
+
+	tokenRequests := 0
+	hookStatus := 200
+	var authorization string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(res http.ResponseWriter, req *http.Request) {
+		tokenRequests++
+		id, secret, _ := req.BasicAuth()
+		assert.Equal("client1", id)
+		assert.Equal("secret1", secret)
+		_ = req.ParseForm()
+		assert.Equal("client_credentials", req.PostForm.Get("grant_type"))
+		assert.Equal("read write", req.PostForm.Get("scope"))
+		res.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(res, `{"access_token":"token%d","token_type":"bearer","expires_in":3600}`, tokenRequests)
+	})
+	mux.HandleFunc("/hook", func(res http.ResponseWriter, req *http.Request) {
+		authorization = req.Header.Get("Authorization")
+		res.WriteHeader(hookStatus)
+	})
+	svr := httptest.NewServer(mux)
+	defer svr.Close()
+
+	_, w := newTestWebhookAction(t, &webhookActionInfo{
+		URL: svr.URL + "/hook",
+		OAuth2: &webhookOAuth2{
+			TokenURL:     svr.URL + "/token",
+			ClientID:     "client1",
+			ClientSecret: "secret1",
+			Scopes:       []string{"read", "write"},
+		},
+	})
+
+	// The token is cached across deliveries
+	err := w.attemptBatch(1, 1, []*eventData{testEvent("sub1")})
+	assert.NoError(err)
+	assert.Equal("Bearer token1", authorization)
+	err = w.attemptBatch(2, 1, []*eventData{testEvent("sub1")})
+	assert.NoError(err)
+	assert.Equal("Bearer token1", authorization)
+	assert.Equal(1, tokenRequests)
+
+	// A token close to expiry is refreshed
+	w.token.expiry = time.Now().Add(oauth2ExpiryMargin / 2)
+	err = w.attemptBatch(3, 1, []*eventData{testEvent("sub1")})
+	assert.NoError(err)
+	assert.Equal("Bearer token2", authorization)
+
+	// A rejected token is discarded
+	hookStatus = 401
+	err = w.attemptBatch(4, 1, []*eventData{testEvent("sub1")})
+	assert.Regexp("401", err)
+	assert.Nil(w.token)
+	hookStatus = 200
+	err = w.attemptBatch(4, 2, []*eventData{testEvent("sub1")})
+	assert.NoError(err)
+	assert.Equal("Bearer token3", authorization)
+
+	// A change to the configuration requires a new token
+	w.spec.OAuth2 = &webhookOAuth2{
+		TokenURL:     svr.URL + "/token",
+		ClientID:     "client1",
+		ClientSecret: "secret1",
+		Scopes:       []string{"read write"},
+	}
+	err = w.attemptBatch(5, 1, []*eventData{testEvent("sub1")})
+	assert.NoError(err)
+	assert.Equal("Bearer token4", authorization)
+}
+
+func TestWebhookOAuth2TokenErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	tokenStatus := 500
+	tokenBody := `{"error":"pop"}`
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(tokenStatus)
+		res.Write([]byte(tokenBody))
+	})
+	mux.HandleFunc("/hook", func(res http.ResponseWriter, req *http.Request) {
+		assert.Fail("should not be called")
+	})
+	svr := httptest.NewServer(mux)
+	defer svr.Close()
+
+	_, w := newTestWebhookAction(t, &webhookActionInfo{
+		URL:    svr.URL + "/hook",
+		OAuth2: &webhookOAuth2{TokenURL: svr.URL + "/token", ClientID: "client1"},
+	})
+
+	err := w.attemptBatch(1, 1, []*eventData{testEvent("sub1")})
+	assert.Regexp("FFEC100253.*500", err)
+
+	tokenStatus = 200
+	tokenBody = `{}`
+	err = w.attemptBatch(1, 2, []*eventData{testEvent("sub1")})
+	assert.Regexp("FFEC100253.*no access_token", err)
+
+	tokenBody = `!json`
+	err = w.attemptBatch(1, 3, []*eventData{testEvent("sub1")})
+	assert.Regexp("FFEC100253", err)
+
+	w.es.allowPrivateIPs = false
+	w.spec.OAuth2.TokenURL = "http://127.0.0.1/token"
+	_, err = w.accessToken(http.DefaultClient)
+	assert.Regexp("FFEC100253.*FFEC100034", err)
+
+	w.spec.OAuth2.TokenURL = ":badurl"
+	_, err = w.accessToken(http.DefaultClient)
+	assert.Regexp("FFEC100253", err)
+}
+
+func TestWebhookOAuth2Config(t *testing.T) {
+	sm := newTestSubscriptionManager()
+	_, err := sm.AddStream(context.Background(), &StreamInfo{
+		Type: "webhook",
+		Webhook: &webhookActionInfo{
+			URL:    "http://test.invalid",
+			OAuth2: &webhookOAuth2{TokenURL: "http://test.invalid/token"},
+		},
+	})
+	assert.Regexp(t, "FFEC100252", err)
+
+	_, err = sm.AddStream(context.Background(), &StreamInfo{
+		Type: "webhook",
+		Webhook: &webhookActionInfo{
+			URL:    "http://test.invalid",
+			OAuth2: &webhookOAuth2{TokenURL: ":badurl", ClientID: "client1"},
+		},
+	})
+	assert.Regexp(t, "FFEC100032", err)
+}
+
+func TestWebhookTLS(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+
+	svr := httptest.NewTLSServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(200)
+	}))
+	defer svr.Close()
+	caFile := path.Join(dir, "ca.pem")
+	err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: svr.Certificate().Raw}), 0644)
+	assert.NoError(err)
+
+	// The server certificate is not trusted by default
+	sm, w := newTestWebhookAction(t, &webhookActionInfo{URL: svr.URL})
+	err = w.attemptBatch(1, 1, []*eventData{testEvent("sub1")})
+	assert.Regexp("certificate", err)
+
+	_, w = newTestWebhookAction(t, &webhookActionInfo{
+		URL: svr.URL,
+		TLS: &utils.TLSConfig{Enabled: true, CACertsFile: caFile},
+	})
+	err = w.attemptBatch(1, 1, []*eventData{testEvent("sub1")})
+	assert.NoError(err)
+
+	// The deprecated option is migrated
+	_, w = newTestWebhookAction(t, &webhookActionInfo{URL: svr.URL, TLSkipHostVerify: true})
+	assert.False(w.spec.TLSkipHostVerify)
+	assert.True(w.spec.TLS.InsecureSkipVerify)
+	err = w.attemptBatch(1, 1, []*eventData{testEvent("sub1")})
+	assert.NoError(err)
+
+	_, err = sm.AddStream(context.Background(), &StreamInfo{
+		Type: "webhook",
+		Webhook: &webhookActionInfo{
+			URL: svr.URL,
+			TLS: &utils.TLSConfig{Enabled: true, ClientCertsFile: path.Join(dir, "cert.pem")},
+		},
+	})
+	assert.Regexp("FFEC100251", err)
+
+	// The files are loaded for each attempt, so are checked again
+	_, w = newTestWebhookAction(t, &webhookActionInfo{
+		URL: svr.URL,
+		TLS: &utils.TLSConfig{Enabled: true, CACertsFile: caFile},
+	})
+	w.spec.TLS.CACertsFile = path.Join(dir, "missing.pem")
+	err = w.attemptBatch(1, 1, []*eventData{testEvent("sub1")})
+	assert.Regexp("FFEC100251", err)
+}
+
+func TestUpdateStreamWebhookTLSAndOAuth2(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	ctx := context.Background()
+	spec, err := sm.AddStream(ctx, &StreamInfo{
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: "http://test.invalid"},
+	})
+	assert.NoError(err)
+	defer sm.streams[spec.ID].stop(false)
+
+	_, err = sm.UpdateStream(ctx, spec.ID, &StreamInfo{
+		Webhook: &webhookActionInfo{TLS: &utils.TLSConfig{Enabled: true, ClientKeyFile: "key.pem"}},
+	})
+	assert.Regexp("FFEC100251", err)
+
+	_, err = sm.UpdateStream(ctx, spec.ID, &StreamInfo{
+		Webhook: &webhookActionInfo{OAuth2: &webhookOAuth2{ClientID: "client1"}},
+	})
+	assert.Regexp("FFEC100252", err)
+
+	spec, err = sm.UpdateStream(ctx, spec.ID, &StreamInfo{
+		Webhook: &webhookActionInfo{
+			TLSkipHostVerify: true,
+			OAuth2:           &webhookOAuth2{TokenURL: "http://test.invalid/token", ClientID: "client1"},
+		},
+	})
+	assert.NoError(err)
+	assert.True(spec.Webhook.TLS.InsecureSkipVerify)
+	assert.Equal("client1", spec.Webhook.OAuth2.ClientID)
+}
+
+func TestWebhookOAuth2ClientSecretWriteOnly(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	ctx := context.Background()
+	oauth2 := &webhookOAuth2{TokenURL: "http://test.invalid/token", ClientID: "client1", ClientSecret: "secret1"}
+	spec, err := sm.AddStream(ctx, &StreamInfo{
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: "http://test.invalid", OAuth2: oauth2},
+	})
+	assert.NoError(err)
+	stream := sm.streams[spec.ID]
+	defer stream.stop(false)
+	assert.Equal(RedactedSecret, spec.Webhook.OAuth2.ClientSecret)
+	assert.Equal("secret1", stream.spec.Webhook.OAuth2.ClientSecret)
+
+	// Updates that omit the client secret, or supply the placeholder, keep the existing secret
+	spec, err = sm.StreamByID(ctx, spec.ID)
+	assert.NoError(err)
+	assert.Equal(RedactedSecret, spec.Webhook.OAuth2.ClientSecret)
+	spec, err = sm.UpdateStream(ctx, spec.ID, spec)
+	assert.NoError(err)
+	assert.Equal(RedactedSecret, spec.Webhook.OAuth2.ClientSecret)
+	_, err = sm.UpdateStream(ctx, spec.ID, &StreamInfo{
+		Webhook: &webhookActionInfo{OAuth2: &webhookOAuth2{TokenURL: "http://test.invalid/token", ClientID: "client2"}},
+	})
+	assert.NoError(err)
+	assert.Equal("client2", stream.spec.Webhook.OAuth2.ClientID)
+	assert.Equal("secret1", stream.spec.Webhook.OAuth2.ClientSecret)
+
+	// The client secret can be rotated
+	_, err = sm.UpdateStream(ctx, spec.ID, &StreamInfo{
+		Webhook: &webhookActionInfo{OAuth2: &webhookOAuth2{TokenURL: "http://test.invalid/token", ClientID: "client2", ClientSecret: "secret2"}},
+	})
+	assert.NoError(err)
+	assert.Equal("secret2", stream.spec.Webhook.OAuth2.ClientSecret)
+
+	// The client secret is only exported when requested
+	assert.Empty(stream.spec.withoutSecrets().Webhook.OAuth2.ClientSecret)
+	assert.Equal("secret2", stream.spec.Webhook.OAuth2.ClientSecret)
+
+	// The placeholder cannot be used as the client secret of a new stream
+	oauth2.ClientSecret = RedactedSecret
+	_, err = sm.AddStream(ctx, &StreamInfo{
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: "http://test.invalid", OAuth2: oauth2},
+	})
+	assert.Regexp("FFEC100274", err)
+}
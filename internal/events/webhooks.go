@@ -16,22 +16,40 @@ package events
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/tls"
-	"encoding/json"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/hyperledger/firefly-ethconnect/internal/errors"
+	"github.com/hyperledger/firefly-ethconnect/internal/utils"
 
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// WebhookSignatureHeader carries the signature of a webhook delivery, when the stream has a secret.
+	// The value is "t=<unix seconds>,v1=<hex HMAC-SHA256 of the secret over '<unix seconds>.<body>'>".
+	WebhookSignatureHeader = "X-Ethconnect-Signature"
+	// RedactedSecret is returned by the API in place of the secrets of a webhook, which are write-only.
+	// Supplying it, or omitting the secret, on update keeps the existing secret.
+	RedactedSecret = "********"
+)
+
 type webhookAction struct {
-	es   *eventStream
-	spec *webhookActionInfo
+	es       *eventStream
+	spec     *webhookActionInfo
+	tokenMux sync.Mutex
+	token    *oauth2Token
+	tmpl     *template.Template
 }
 
 func newWebhookAction(es *eventStream, spec *webhookActionInfo) (*webhookAction, error) {
@@ -41,28 +59,120 @@ func newWebhookAction(es *eventStream, spec *webhookActionInfo) (*webhookAction,
 	if _, err := url.Parse(spec.URL); err != nil {
 		return nil, errors.Errorf(errors.EventStreamsWebhookInvalidURL)
 	}
+	spec.migrateTLS()
+	if spec.TLS != nil {
+		if _, err := utils.CreateTLSConfiguration(spec.TLS); err != nil {
+			return nil, errors.Errorf(errors.EventStreamsWebhookTLSConfig, err)
+		}
+	}
+	if spec.OAuth2 != nil {
+		if err := spec.OAuth2.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if spec.Secret == RedactedSecret {
+		return nil, errors.Errorf(errors.EventStreamsWebhookRedactedSecret, RedactedSecret)
+	}
+	tmpl, err := spec.validateFormat()
+	if err != nil {
+		return nil, err
+	}
 	if spec.RequestTimeoutSec == 0 {
 		spec.RequestTimeoutSec = 120
 	}
 	return &webhookAction{
 		es:   es,
 		spec: spec,
+		tmpl: tmpl,
 	}, nil
 }
 
+// migrateTLS moves the deprecated tlsSkipHostVerify option into the TLS configuration
+func (spec *webhookActionInfo) migrateTLS() {
+	if spec.TLSkipHostVerify {
+		if spec.TLS == nil {
+			spec.TLS = &utils.TLSConfig{Enabled: true}
+		}
+		spec.TLS.InsecureSkipVerify = true
+		spec.TLSkipHostVerify = false
+	}
+}
+
+// redacted returns a copy of the webhook configuration with the secrets masked, to return from the API
+func (spec *webhookActionInfo) redacted() *webhookActionInfo {
+	redacted := *spec
+	if redacted.Secret != "" {
+		redacted.Secret = RedactedSecret
+	}
+	if spec.OAuth2 != nil && spec.OAuth2.ClientSecret != "" {
+		oauth2 := *spec.OAuth2
+		oauth2.ClientSecret = RedactedSecret
+		redacted.OAuth2 = &oauth2
+	}
+	return &redacted
+}
+
+// withoutSecrets returns a copy of the webhook configuration with the secrets removed, for an export
+func (spec *webhookActionInfo) withoutSecrets() *webhookActionInfo {
+	stripped := *spec
+	stripped.Secret = ""
+	if spec.OAuth2 != nil {
+		oauth2 := *spec.OAuth2
+		oauth2.ClientSecret = ""
+		stripped.OAuth2 = &oauth2
+	}
+	return &stripped
+}
+
+// withSecretsFrom returns a copy of the webhook configuration of an update, with the existing secrets
+// kept where the update omits them or supplies the redacted placeholder
+func (spec *webhookActionInfo) withSecretsFrom(existing *webhookActionInfo) *webhookActionInfo {
+	merged := *spec
+	if existing == nil {
+		existing = &webhookActionInfo{}
+	}
+	if merged.Secret == "" || merged.Secret == RedactedSecret {
+		merged.Secret = existing.Secret
+	}
+	if spec.OAuth2 != nil && (spec.OAuth2.ClientSecret == "" || spec.OAuth2.ClientSecret == RedactedSecret) {
+		oauth2 := *spec.OAuth2
+		oauth2.ClientSecret = ""
+		if existing.OAuth2 != nil {
+			oauth2.ClientSecret = existing.OAuth2.ClientSecret
+		}
+		merged.OAuth2 = &oauth2
+	}
+	return &merged
+}
+
+// checkURL resolves the host of a URL we are about to call, and checks it is not in a prohibited range
+func (w *webhookAction) checkURL(u *url.URL) (*net.IPAddr, error) {
+	addr, err := net.ResolveIPAddr("ip4", u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	if w.es.isAddressUnsafe(addr) {
+		err := errors.Errorf(errors.EventStreamsWebhookProhibitedAddress, u.Hostname())
+		log.Errorf(err.Error())
+		return nil, err
+	}
+	return addr, nil
+}
+
 // attemptWebhookAction performs a single attempt of a webhook action
 func (w *webhookAction) attemptBatch(batchNumber, attempt uint64, events []*eventData) error {
 	// We perform DNS resolution before each attempt, to exclude private IP address ranges from the target
 	esID := w.es.spec.ID
 	u, _ := url.Parse(w.spec.URL)
-	addr, err := net.ResolveIPAddr("ip4", u.Hostname())
+	addr, err := w.checkURL(u)
 	if err != nil {
 		return err
 	}
-	if w.es.isAddressUnsafe(addr) {
-		err := errors.Errorf(errors.EventStreamsWebhookProhibitedAddress, u.Hostname())
-		log.Errorf(err.Error())
-		return err
+	var tlsConfig *tls.Config
+	if w.spec.TLS != nil {
+		if tlsConfig, err = utils.CreateTLSConfiguration(w.spec.TLS); err != nil {
+			return errors.Errorf(errors.EventStreamsWebhookTLSConfig, err)
+		}
 	}
 	// Set the timeout
 	var transport = &http.Transport{
@@ -77,28 +187,51 @@ func (w *webhookAction) attemptBatch(batchNumber, attempt uint64, events []*even
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
 	}
-	transport.TLSClientConfig = &tls.Config{
-		InsecureSkipVerify: w.spec.TLSkipHostVerify,
-	}
+	transport.TLSClientConfig = tlsConfig
 	netClient := &http.Client{
 		Timeout:   time.Duration(w.spec.RequestTimeoutSec) * time.Second,
 		Transport: transport,
 	}
-	log.Infof("%s: POST --> %s [%s] (attempt=%d)", esID, u.String(), addr.String(), attempt)
-	reqBytes, err := json.Marshal(&events)
-	var req *http.Request
-	if err == nil {
-		req, err = http.NewRequest("POST", u.String(), bytes.NewReader(reqBytes))
+	payloads, err := w.payloads(events)
+	for i := 0; err == nil && i < len(payloads); i++ {
+		err = w.post(netClient, u, addr, attempt, payloads[i])
 	}
+	if err != nil {
+		log.Errorf("%s: POST %s failed (attempt=%d): %s", esID, u.String(), attempt, err)
+	}
+	return err
+}
+
+// post performs a single HTTP request of a webhook action
+func (w *webhookAction) post(netClient *http.Client, u *url.URL, addr *net.IPAddr, attempt uint64, payload *webhookPayload) error {
+	esID := w.es.spec.ID
+	log.Infof("%s: POST --> %s [%s] (attempt=%d)", esID, u.String(), addr.String(), attempt)
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(payload.body))
 	if err == nil {
 		var res *http.Response
-		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Type", payload.contentType)
+		req.Header.Set("Idempotency-Key", payload.idempotencyKey)
 		for h, v := range w.spec.Headers {
 			req.Header.Set(h, v)
 		}
-		res, err = netClient.Do(req)
+		if w.spec.Secret != "" {
+			req.Header.Set(WebhookSignatureHeader, signWebhook(w.spec.Secret, time.Now().Unix(), payload.body))
+		}
+		if w.spec.OAuth2 != nil {
+			var token string
+			if token, err = w.accessToken(netClient); err == nil {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+		}
+		if err == nil {
+			res, err = netClient.Do(req)
+		}
 		if err == nil {
 			ok := (res.StatusCode >= 200 && res.StatusCode < 300)
+			if res.StatusCode == http.StatusUnauthorized && w.spec.OAuth2 != nil {
+				// The token might have been revoked before it expired, so get a new one for the next attempt
+				w.clearToken()
+			}
 			log.Infof("%s: POST <-- %s [%d] ok=%t", esID, u.String(), res.StatusCode, ok)
 			if !ok || log.IsLevelEnabled(log.DebugLevel) {
 				bodyBytes, _ := ioutil.ReadAll(res.Body)
@@ -109,8 +242,13 @@ func (w *webhookAction) attemptBatch(batchNumber, attempt uint64, events []*even
 			}
 		}
 	}
-	if err != nil {
-		log.Errorf("%s: POST %s failed (attempt=%d): %s", esID, u.String(), attempt, err)
-	}
 	return err
 }
+
+// signWebhook signs the body together with the timestamp, so a receiver can reject replays of an old delivery
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
@@ -44,6 +44,14 @@ func (w *webSocketAction) attemptBatch(batchNumber, attempt uint64, events []*ev
 		topic = w.spec.Topic
 	}
 
+	// Consumer groups track each batch against the connection it was sent to, so the ack is
+	// correlated by stream and batch number, and the batch is redelivered if that connection closes
+	if w.spec != nil && w.spec.DistributionMode == DistributionModeConsumerGroup {
+		err = w.es.wsChannels.SendToGroup(topic, w.spec.ConsumerGroup, w.es.spec.ID, batchNumber, events, w.es.updateInterrupt)
+		log.Infof("WebSocket event batch %d complete in consumer group '%s' (len=%d). err=%v", batchNumber, w.spec.ConsumerGroup, len(events), err)
+		return err
+	}
+
 	// Get a blocking channel to send and receive on our chosen namespace
 	sender, broadcaster, receiver := w.es.wsChannels.GetChannels(topic)
 
@@ -18,6 +18,8 @@ import (
 	"encoding/json"
 
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/comparer"
+	"github.com/syndtr/goleveldb/leveldb/memdb"
 )
 
 // MockKV simple memory K/V store for testing
@@ -69,12 +71,18 @@ func (m *MockKV) Delete(key string) error {
 
 // NewIterator for a new iterator
 func (m *MockKV) NewIterator() KVIterator {
-	return nil // not implemented in mock
+	return m.NewIteratorWithRange(nil)
 }
 
-// NewIterator for a new iterator
+// NewIteratorWithRange for a new iterator over a snapshot of the keys in the range
 func (m *MockKV) NewIteratorWithRange(rng *Range) KVIterator {
-	return nil // not implemented in mock
+	db := memdb.New(comparer.DefaultComparer, 0)
+	for k, v := range m.KVS {
+		_ = db.Put([]byte(k), v)
+	}
+	return &levelDBKeyIterator{
+		i: db.NewIterator(rng),
+	}
 }
 
 // Close it
@@ -52,8 +52,23 @@ func TestExerciseMockLDB(t *testing.T) {
 	err = m.GetJSON("not found", map[bool]bool{false: true})
 	assert.Equal(ErrorNotFound, err)
 
-	assert.Nil(m.NewIterator())
-	assert.Nil(m.NewIteratorWithRange(&util.Range{}))
+	m.Put("a/1", []byte("v1"))
+	m.Put("a/2", []byte("v2"))
+	m.Put("b/1", []byte("v3"))
+	it := m.NewIterator()
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	it.Release()
+	assert.Equal([]string{"a/1", "a/2", "b/1", "mykey"}, keys)
+	it = m.NewIteratorWithRange(&util.Range{Start: []byte("a/"), Limit: []byte("a0")})
+	keys = nil
+	for it.Next() {
+		keys = append(keys, it.Key()+"="+string(it.Value()))
+	}
+	it.Release()
+	assert.Equal([]string{"a/1=v1", "a/2=v2"}, keys)
 	m.Close()
 
 }
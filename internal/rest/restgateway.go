@@ -270,6 +270,9 @@ func (g *RESTGateway) Init() (receipts.ReceiptStorePersistence, error) {
 
 	router.GET("/status", g.statusHandler)
 	g.receipts = newReceiptStore(receiptStoreConf, receiptStorePersistence, g.smartContractGW)
+	if g.smartContractGW != nil {
+		g.smartContractGW.SetReceiptStore(receiptStorePersistence)
+	}
 	g.receipts.addRoutes(router)
 	if len(g.conf.Kafka.Brokers) > 0 {
 		wk := newWebhooksKafka(&g.conf.Kafka, g.receipts)
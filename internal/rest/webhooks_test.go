@@ -59,6 +59,8 @@ func (m *mockContractGW) SendReply(message interface{}) {
 	}
 }
 
+func (m *mockContractGW) SetReceiptStore(receipts.ReceiptStorePersistence) {}
+
 func (m *mockContractGW) Shutdown() {}
 
 type mockHandler struct{}
@@ -40,9 +40,12 @@ type webSocketConnection struct {
 }
 
 type webSocketCommandMessage struct {
-	Type    string `json:"type,omitempty"`
-	Topic   string `json:"topic,omitempty"`
-	Message string `json:"message,omitempty"`
+	Type        string `json:"type,omitempty"`
+	Topic       string `json:"topic,omitempty"`
+	Group       string `json:"group,omitempty"`       // the consumer group to listen in, or ack a batch for
+	Stream      string `json:"stream,omitempty"`      // the stream of the batch being acked in a consumer group
+	BatchNumber uint64 `json:"batchNumber,omitempty"` // the batch being acked in a consumer group
+	Message     string `json:"message,omitempty"`
 }
 
 func newConnection(server *webSocketServer, conn *ws.Conn) *webSocketConnection {
@@ -144,20 +147,28 @@ func (c *webSocketConnection) listen() {
 		t := c.server.getTopic(msg.Topic)
 		switch strings.ToLower(msg.Type) {
 		case "listen":
-			c.listenTopic(t)
+			if msg.Group != "" {
+				c.server.joinGroup(c, msg.Topic, msg.Group)
+			} else {
+				c.listenTopic(t)
+			}
 		case "listenreplies":
 			c.listenReplies()
 		case "ack":
-			c.handleAckOrError(t, nil)
+			c.handleAckOrError(t, &msg, nil)
 		case "error":
-			c.handleAckOrError(t, errors.Errorf(errors.EventStreamsWebSocketErrorFromClient, msg.Message))
+			c.handleAckOrError(t, &msg, errors.Errorf(errors.EventStreamsWebSocketErrorFromClient, msg.Message))
 		default:
 			log.Errorf("WS/%s: Unexpected message type: %+v", c.id, msg)
 		}
 	}
 }
 
-func (c *webSocketConnection) handleAckOrError(t *webSocketTopic, err error) {
+func (c *webSocketConnection) handleAckOrError(t *webSocketTopic, msg *webSocketCommandMessage, err error) {
+	if msg.Group != "" {
+		c.server.ackGroupBatch(c, msg.Topic, msg.Group, msg.Stream, msg.BatchNumber, err)
+		return
+	}
 	isError := err != nil
 	select {
 	case t.receiverChannel <- err:
@@ -0,0 +1,210 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ws
+
+import (
+	"github.com/hyperledger/firefly-ethconnect/internal/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+type webSocketGroupKey struct {
+	topic string
+	group string
+}
+
+// webSocketGroupBatchKey identifies a batch in flight to a group. Batch numbers are only unique within
+// a stream, and more than one stream can deliver to the same group on a topic.
+type webSocketGroupBatchKey struct {
+	stream      string
+	batchNumber uint64
+}
+
+// webSocketGroup is a named consumer group on a topic. Each batch sent to the group is delivered
+// to exactly one member, and is tracked against that member until it acks the batch by stream and number.
+type webSocketGroup struct {
+	members  []*webSocketConnection
+	inFlight map[webSocketGroupBatchKey]*webSocketGroupBatch
+	joined   chan struct{} // closed, and replaced, each time a member joins
+}
+
+type webSocketGroupBatch struct {
+	key      webSocketGroupBatchKey
+	conn     *webSocketConnection
+	response chan error
+}
+
+// webSocketGroupBatchMessage wraps a batch sent to a member of a group, so the member can
+// correlate its ack or error with the batch
+type webSocketGroupBatchMessage struct {
+	Type        string      `json:"type"`
+	Topic       string      `json:"topic,omitempty"`
+	Group       string      `json:"group"`
+	Stream      string      `json:"stream"`
+	BatchNumber uint64      `json:"batchNumber"`
+	Events      interface{} `json:"events"`
+}
+
+// getGroup must be called holding the server lock
+func (s *webSocketServer) getGroup(topic, group string) *webSocketGroup {
+	key := webSocketGroupKey{topic: topic, group: group}
+	g, exists := s.groups[key]
+	if !exists {
+		g = &webSocketGroup{
+			inFlight: make(map[webSocketGroupBatchKey]*webSocketGroupBatch),
+			joined:   make(chan struct{}),
+		}
+		s.groups[key] = g
+	}
+	return g
+}
+
+func (s *webSocketServer) joinGroup(c *webSocketConnection, topic, group string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	g := s.getGroup(topic, group)
+	for _, m := range g.members {
+		if m == c {
+			return
+		}
+	}
+	g.members = append(g.members, c)
+	close(g.joined)
+	g.joined = make(chan struct{})
+	log.Infof("WS/%s: Joined consumer group '%s' on topic '%s' (members=%d)", c.id, group, topic, len(g.members))
+}
+
+// leaveGroups must be called holding the server lock
+func (s *webSocketServer) leaveGroups(c *webSocketConnection) {
+	for _, g := range s.groups {
+		for i, m := range g.members {
+			if m == c {
+				g.members = append(g.members[:i], g.members[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// assignGroupBatch tracks the batch against the open member with the fewest batches in flight, or
+// returns a nil connection and a channel that is closed when a member next joins, if there are none
+func (s *webSocketServer) assignGroupBatch(topic, group string, b *webSocketGroupBatch) (*webSocketConnection, <-chan struct{}) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	g := s.getGroup(topic, group)
+	var selected *webSocketConnection
+	selectedCount := 0
+	for _, m := range g.members {
+		select {
+		case <-m.closing:
+			continue
+		default:
+		}
+		count := 0
+		for _, ib := range g.inFlight {
+			if ib.conn == m && ib != b {
+				count++
+			}
+		}
+		if selected == nil || count < selectedCount {
+			selected = m
+			selectedCount = count
+		}
+	}
+	if selected == nil {
+		return nil, g.joined
+	}
+	b.conn = selected
+	g.inFlight[b.key] = b
+	return selected, nil
+}
+
+func (s *webSocketServer) completeGroupBatch(topic, group string, b *webSocketGroupBatch) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	g := s.getGroup(topic, group)
+	if g.inFlight[b.key] == b {
+		delete(g.inFlight, b.key)
+	}
+}
+
+// ackGroupBatch passes on an ack or error, only if the batch is in flight to the connection that sent it
+func (s *webSocketServer) ackGroupBatch(c *webSocketConnection, topic, group, stream string, batchNumber uint64, err error) {
+	s.mux.Lock()
+	var b *webSocketGroupBatch
+	if g, exists := s.groups[webSocketGroupKey{topic: topic, group: group}]; exists {
+		b = g.inFlight[webSocketGroupBatchKey{stream: stream, batchNumber: batchNumber}]
+	}
+	assigned := b != nil && b.conn == c
+	s.mux.Unlock()
+
+	isError := err != nil
+	if !assigned {
+		log.Warnf("WS/%s: spurious response (error='%t') for batch %d of stream '%s' in group '%s' on topic '%s'", c.id, isError, batchNumber, stream, group, topic)
+		return
+	}
+	select {
+	case b.response <- err:
+		log.Debugf("WS/%s: response (error='%t') for batch %d in group '%s' on topic '%s' passed on for processing", c.id, isError, batchNumber, group, topic)
+	default:
+		log.Debugf("WS/%s: duplicate response (error='%t') for batch %d in group '%s' on topic '%s'", c.id, isError, batchNumber, group, topic)
+	}
+}
+
+// SendToGroup delivers a batch to one member of a consumer group, and waits for that member to ack the
+// batch by stream and number. If the member disconnects first, the batch is redelivered to another member.
+func (s *webSocketServer) SendToGroup(topic, group, stream string, batchNumber uint64, message interface{}, interrupt <-chan struct{}) error {
+	b := &webSocketGroupBatch{
+		key:      webSocketGroupBatchKey{stream: stream, batchNumber: batchNumber},
+		response: make(chan error, 1),
+	}
+	defer s.completeGroupBatch(topic, group, b)
+	msg := &webSocketGroupBatchMessage{
+		Type:        "batch",
+		Topic:       topic,
+		Group:       group,
+		Stream:      stream,
+		BatchNumber: batchNumber,
+		Events:      message,
+	}
+	for {
+		c, joined := s.assignGroupBatch(topic, group, b)
+		if c == nil {
+			select {
+			case <-joined:
+				continue
+			case <-interrupt:
+				return errors.Errorf(errors.EventStreamsWebSocketInterruptedSend)
+			}
+		}
+
+		select {
+		case c.broadcast <- msg:
+		case <-c.closing:
+			log.Warnf("WS/%s: Closed before batch %d in group '%s' on topic '%s' was sent. Redelivering", c.id, batchNumber, group, topic)
+			continue
+		case <-interrupt:
+			return errors.Errorf(errors.EventStreamsWebSocketInterruptedSend)
+		}
+
+		select {
+		case err := <-b.response:
+			return err
+		case <-c.closing:
+			log.Warnf("WS/%s: Closed while batch %d in group '%s' on topic '%s' was in flight. Redelivering", c.id, batchNumber, group, topic)
+		case <-interrupt:
+			return errors.Errorf(errors.EventStreamsWebSocketInterruptedReceive)
+		}
+	}
+}
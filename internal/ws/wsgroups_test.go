@@ -0,0 +1,201 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ws
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+type testGroupBatch struct {
+	Type        string   `json:"type"`
+	Topic       string   `json:"topic"`
+	Group       string   `json:"group"`
+	Stream      string   `json:"stream"`
+	BatchNumber uint64   `json:"batchNumber"`
+	Events      []string `json:"events"`
+}
+
+func joinTestGroup(t *testing.T, w *webSocketServer, ts *httptest.Server, topic, group string) *ws.Conn {
+	u, _ := url.Parse(ts.URL)
+	u.Scheme = "ws"
+	u.Path = "/ws"
+	c, _, err := ws.DefaultDialer.Dial(u.String(), nil)
+	assert.NoError(t, err)
+
+	w.mux.Lock()
+	members := len(w.getGroup(topic, group).members)
+	w.mux.Unlock()
+	c.WriteJSON(&webSocketCommandMessage{
+		Type:  "listen",
+		Topic: topic,
+		Group: group,
+	})
+
+	// Wait until the client has joined the group before proceeding
+	for {
+		w.mux.Lock()
+		joined := len(w.getGroup(topic, group).members) > members
+		w.mux.Unlock()
+		if joined {
+			return c
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+}
+
+func TestConsumerGroupAckByBatchNumber(t *testing.T) {
+	assert := assert.New(t)
+
+	w, ts := newTestWebSocketServer()
+	defer ts.Close()
+	defer w.Close()
+	c1 := joinTestGroup(t, w, ts, "topic1", "group1")
+	c2 := joinTestGroup(t, w, ts, "topic1", "group1")
+
+	// The batches are spread across the members, as each has one in flight
+	results := make(chan error)
+	go func() { results <- w.SendToGroup("topic1", "group1", "es1", 1, []string{"a"}, nil) }()
+	var b1 testGroupBatch
+	c1.ReadJSON(&b1)
+	assert.Equal(testGroupBatch{Type: "batch", Topic: "topic1", Group: "group1", Stream: "es1", BatchNumber: 1, Events: []string{"a"}}, b1)
+
+	go func() { results <- w.SendToGroup("topic1", "group1", "es1", 2, []string{"b"}, nil) }()
+	var b2 testGroupBatch
+	c2.ReadJSON(&b2)
+	assert.Equal(uint64(2), b2.BatchNumber)
+	assert.Equal([]string{"b"}, b2.Events)
+
+	// An ack from a member that the batch was not sent to is ignored
+	c2.WriteJSON(&webSocketCommandMessage{Type: "ack", Topic: "topic1", Group: "group1", Stream: "es1", BatchNumber: 1})
+	c1.WriteJSON(&webSocketCommandMessage{Type: "error", Topic: "topic1", Group: "group1", Stream: "es1", BatchNumber: 2, Message: "wrong member"})
+	c2.WriteJSON(&webSocketCommandMessage{Type: "error", Topic: "topic1", Group: "group1", Stream: "es1", BatchNumber: 2, Message: "Panic!"})
+	err := <-results
+	assert.Regexp("Error received from WebSocket client: Panic!", err)
+
+	c1.WriteJSON(&webSocketCommandMessage{Type: "ack", Topic: "topic1", Group: "group1", Stream: "es1", BatchNumber: 1})
+	err = <-results
+	assert.NoError(err)
+
+	w.mux.Lock()
+	assert.Empty(w.getGroup("topic1", "group1").inFlight)
+	w.mux.Unlock()
+}
+
+func TestConsumerGroupBatchesOfDifferentStreams(t *testing.T) {
+	assert := assert.New(t)
+
+	w, ts := newTestWebSocketServer()
+	defer ts.Close()
+	defer w.Close()
+	c1 := joinTestGroup(t, w, ts, "", "group1")
+
+	// Two streams delivering to the same group have their own batch numbers
+	results1 := make(chan error)
+	results2 := make(chan error)
+	go func() { results1 <- w.SendToGroup("", "group1", "es1", 1, []string{"a"}, nil) }()
+	var b1 testGroupBatch
+	c1.ReadJSON(&b1)
+	go func() { results2 <- w.SendToGroup("", "group1", "es2", 1, []string{"b"}, nil) }()
+	var b2 testGroupBatch
+	c1.ReadJSON(&b2)
+	assert.Equal(uint64(1), b1.BatchNumber)
+	assert.Equal(uint64(1), b2.BatchNumber)
+	assert.NotEqual(b1.Stream, b2.Stream)
+	w.mux.Lock()
+	assert.Len(w.getGroup("", "group1").inFlight, 2)
+	w.mux.Unlock()
+
+	// Each ack is only passed on for the stream it names
+	c1.WriteJSON(&webSocketCommandMessage{Type: "error", Group: "group1", Stream: "es2", BatchNumber: 1, Message: "pop"})
+	assert.Regexp("pop", <-results2)
+	c1.WriteJSON(&webSocketCommandMessage{Type: "ack", Group: "group1", Stream: "es1", BatchNumber: 1})
+	assert.NoError(<-results1)
+}
+
+func TestConsumerGroupRedeliverOnDisconnect(t *testing.T) {
+	assert := assert.New(t)
+
+	w, ts := newTestWebSocketServer()
+	defer ts.Close()
+	defer w.Close()
+	c1 := joinTestGroup(t, w, ts, "", "group1")
+
+	results := make(chan error)
+	go func() { results <- w.SendToGroup("", "group1", "es1", 5, []string{"a"}, nil) }()
+	var b testGroupBatch
+	c1.ReadJSON(&b)
+	assert.Equal(uint64(5), b.BatchNumber)
+
+	// The batch waits for a new member, when the only member disconnects before acking it
+	c1.Close()
+	for {
+		w.mux.Lock()
+		members := len(w.getGroup("", "group1").members)
+		w.mux.Unlock()
+		if members == 0 {
+			break
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+	c2 := joinTestGroup(t, w, ts, "", "group1")
+	c2.ReadJSON(&b)
+	assert.Equal(uint64(5), b.BatchNumber)
+	assert.Equal([]string{"a"}, b.Events)
+	c2.WriteJSON(&webSocketCommandMessage{Type: "ack", Group: "group1", Stream: "es1", BatchNumber: 5})
+	assert.NoError(<-results)
+}
+
+func TestConsumerGroupInterrupt(t *testing.T) {
+	assert := assert.New(t)
+
+	w, ts := newTestWebSocketServer()
+	defer ts.Close()
+	defer w.Close()
+
+	// No members to send to
+	interrupt := make(chan struct{})
+	close(interrupt)
+	err := w.SendToGroup("topic1", "group1", "es1", 1, []string{"a"}, interrupt)
+	assert.Regexp("Interrupted waiting for WebSocket connection to send event", err)
+
+	// Interrupted waiting for the ack
+	c := joinTestGroup(t, w, ts, "topic1", "group1")
+	interrupt = make(chan struct{})
+	results := make(chan error)
+	go func() { results <- w.SendToGroup("topic1", "group1", "es1", 1, []string{"a"}, interrupt) }()
+	var b testGroupBatch
+	c.ReadJSON(&b)
+	close(interrupt)
+	err = <-results
+	assert.Regexp("Interrupted waiting for WebSocket acknowledgment", err)
+
+	// A late ack is spurious, as is a duplicate join
+	c.WriteJSON(&webSocketCommandMessage{Type: "ack", Topic: "topic1", Group: "group1", Stream: "es1", BatchNumber: 1})
+	c.WriteJSON(&webSocketCommandMessage{Type: "listen", Topic: "topic1", Group: "group1"})
+	c.WriteJSON(&webSocketCommandMessage{Type: "ack", Topic: "topic1", Group: "unknown", Stream: "es1", BatchNumber: 1})
+	c.Close()
+	for len(w.connections) > 0 {
+		time.Sleep(1 * time.Millisecond)
+	}
+	w.mux.Lock()
+	assert.Empty(w.getGroup("topic1", "group1").members)
+	w.mux.Unlock()
+}
@@ -31,6 +31,9 @@ import (
 type WebSocketChannels interface {
 	GetChannels(topic string) (chan<- interface{}, chan<- interface{}, <-chan error)
 	SendReply(message interface{})
+	// SendToGroup is a blocking send of a batch to one member of a named consumer group on a topic,
+	// that returns the ack or error sent by that member for the batch number of the stream
+	SendToGroup(topic, group, stream string, batchNumber uint64, message interface{}, interrupt <-chan struct{}) error
 }
 
 // WebSocketServer is the full server interface with the init call
@@ -45,6 +48,7 @@ type webSocketServer struct {
 	mux               sync.Mutex
 	topics            map[string]*webSocketTopic
 	topicMap          map[string]map[string]*webSocketConnection
+	groups            map[webSocketGroupKey]*webSocketGroup
 	replyMap          map[string]*webSocketConnection
 	newTopic          chan bool
 	replyChannel      chan interface{}
@@ -65,6 +69,7 @@ func NewWebSocketServer() WebSocketServer {
 		connections:       make(map[string]*webSocketConnection),
 		topics:            make(map[string]*webSocketTopic),
 		topicMap:          make(map[string]map[string]*webSocketConnection),
+		groups:            make(map[webSocketGroupKey]*webSocketGroup),
 		replyMap:          make(map[string]*webSocketConnection),
 		newTopic:          make(chan bool),
 		replyChannel:      make(chan interface{}),
@@ -111,6 +116,7 @@ func (s *webSocketServer) connectionClosed(c *webSocketConnection) {
 	for _, topic := range c.topics {
 		delete(s.topicMap[topic.topic], c.id)
 	}
+	s.leaveGroups(c)
 }
 
 func (s *webSocketServer) AddRoutes(r *httprouter.Router) {
@@ -3,9 +3,15 @@
 package contractregistrymocks
 
 import (
+	context "context"
+
 	contractregistry "github.com/hyperledger/firefly-ethconnect/internal/contractregistry"
+	eth "github.com/hyperledger/firefly-ethconnect/internal/eth"
+
 	messages "github.com/hyperledger/firefly-ethconnect/internal/messages"
 
+	pkg "github.com/kaleido-io/ethbinding/pkg"
+
 	mock "github.com/stretchr/testify/mock"
 
 	time "time"
@@ -118,6 +124,29 @@ func (_m *ContractStore) GetABI(location contractregistry.ABILocation, refresh b
 	return r0, r1
 }
 
+// GetEventBySignature provides a mock function with given fields: topic
+func (_m *ContractStore) GetEventBySignature(topic string) (*pkg.ABIElementMarshaling, error) {
+	ret := _m.Called(topic)
+
+	var r0 *pkg.ABIElementMarshaling
+	if rf, ok := ret.Get(0).(func(string) *pkg.ABIElementMarshaling); ok {
+		r0 = rf(topic)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*pkg.ABIElementMarshaling)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(topic)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetContractByAddress provides a mock function with given fields: addrHex
 func (_m *ContractStore) GetContractByAddress(addrHex string) (*contractregistry.ContractInfo, error) {
 	ret := _m.Called(addrHex)
@@ -141,6 +170,29 @@ func (_m *ContractStore) GetContractByAddress(addrHex string) (*contractregistry
 	return r0, r1
 }
 
+// GetImplementationContract provides a mock function with given fields: ctx, rpc, addrHex, blockNumber
+func (_m *ContractStore) GetImplementationContract(ctx context.Context, rpc eth.RPCClient, addrHex string, blockNumber string) (*contractregistry.ContractInfo, error) {
+	ret := _m.Called(ctx, rpc, addrHex, blockNumber)
+
+	var r0 *contractregistry.ContractInfo
+	if rf, ok := ret.Get(0).(func(context.Context, eth.RPCClient, string, string) *contractregistry.ContractInfo); ok {
+		r0 = rf(ctx, rpc, addrHex, blockNumber)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*contractregistry.ContractInfo)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, eth.RPCClient, string, string) error); ok {
+		r1 = rf(ctx, rpc, addrHex, blockNumber)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetLocalABIInfo provides a mock function with given fields: abiID
 func (_m *ContractStore) GetLocalABIInfo(abiID string) (*contractregistry.ABIInfo, error) {
 	ret := _m.Called(abiID)
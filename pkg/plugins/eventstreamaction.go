@@ -0,0 +1,39 @@
+// Copyright 2023 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import "encoding/json"
+
+// EventStreamActionPlugin is a code plug-point that can be implemented using a go plugin module,
+// to deliver the events of a stream to a destination other than the built-in webhook, websocket and sse types.
+// Build your plugin with an "EventStreamActionPlugin" export that implements this interface,
+// and configure the stream type it provides, along with the dynamic load path of your module, in the configuration.
+// Streams of that type carry an opaque JSON "plugin" configuration, which is only interpreted by the plugin.
+type EventStreamActionPlugin interface {
+
+	// ValidateConfig - checks the configuration of a stream when it is created, updated or imported
+	ValidateConfig(config json.RawMessage) error
+	// NewAction - creates the action for a stream. Called again with the new configuration when the stream is updated.
+	// An action that implements io.Closer is closed when it is replaced, or when the stream is stopped or deleted.
+	NewAction(streamID string, config json.RawMessage) (EventStreamAction, error)
+}
+
+// EventStreamAction delivers the batches of events of a single stream
+type EventStreamAction interface {
+
+	// AttemptBatch - delivers a batch of events, each being the JSON object a webhook would receive.
+	// Returning an error retries the batch, then blocks or skips it, according to the error handling of the stream.
+	AttemptBatch(batchNumber, attempt uint64, events []json.RawMessage) error
+}